@@ -1,5 +1,7 @@
 package common
 
+import "github.com/MixinNetwork/mixin/crypto"
+
 const (
 	NodeStatePledging  = "PLEDGING"
 	NodeStateAccepted  = "ACCEPTED"
@@ -9,8 +11,22 @@ const (
 type Node struct {
 	Account Address
 	State   string
+	Weight  uint64
 }
 
 func (n *Node) IsAccepted() bool {
 	return n.State == NodeStateAccepted
 }
+
+// IdForNetwork identifies the node as a peer and as the node of its snapshots in the network
+func (n *Node) IdForNetwork(networkId crypto.Hash) crypto.Hash {
+	return n.Account.Hash().ForNetwork(networkId)
+}
+
+// nodes without a weight have the same weight 1
+func (n *Node) ConsensusWeight() uint64 {
+	if n.Weight == 0 {
+		return 1
+	}
+	return n.Weight
+}
@@ -0,0 +1,22 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeIdForNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	seed := crypto.NewHash([]byte("node"))
+	n := &Node{Account: NewAddressFromSeed(append(seed[:], seed[:]...))}
+	networkId := crypto.NewHash([]byte("network"))
+	id := n.IdForNetwork(networkId)
+	assert.Equal(n.Account.Hash().ForNetwork(networkId), id)
+	h := n.Account.Hash()
+	assert.Equal(crypto.NewHash(append(networkId[:], h[:]...)), id)
+	assert.Equal("c252a48655793667e6dddc1cb8635d92713587c26b93ce3fc2a3c35722581ee9", id.String())
+	assert.NotEqual(id, n.IdForNetwork(crypto.NewHash([]byte("other"))))
+}
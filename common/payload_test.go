@@ -0,0 +1,93 @@
+package common
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+var updatePayload = flag.Bool("update", false, "write the golden snapshot payloads again")
+
+const payloadGoldenFile = "testdata/payload.golden"
+
+// the representative snapshots of fixed keys and values, never change them, or the golden payloads
+// don't pin the encoding of the same snapshots any more
+func testPayloadSnapshots() ([]string, []*Snapshot) {
+	key := func(name string) crypto.Key {
+		seed := crypto.NewHash([]byte(name))
+		return crypto.NewKeyFromSeed(append(seed[:], seed[:]...)).Public()
+	}
+	signature := func(name string) crypto.Signature {
+		var sig crypto.Signature
+		h := crypto.NewHash([]byte(name))
+		copy(sig[:], append(h[:], h[:]...))
+		return sig
+	}
+
+	tx := NewTransaction(XINAssetId)
+	tx.AddInput(crypto.NewHash([]byte("input")), 1)
+	tx.Outputs = append(tx.Outputs, &Output{
+		Type:   OutputTypeScript,
+		Amount: NewInteger(10000),
+		Keys:   []crypto.Key{key("a"), key("b")},
+		Script: Script{OperatorCmp, OperatorSum, 2},
+		Mask:   key("mask"),
+	})
+	tx.Extra = []byte("extra")
+	signed := &SignedTransaction{Transaction: *tx, Signatures: [][]crypto.Signature{{signature("input")}}}
+
+	genesis := NewTransaction(XINAssetId)
+	nodeId := crypto.NewHash([]byte("node"))
+	genesis.Inputs = append(genesis.Inputs, &Input{Genesis: nodeId[:]})
+
+	names, snapshots := make([]string, 0), make([]*Snapshot, 0)
+	add := func(name string, s *Snapshot) {
+		names, snapshots = append(names, name), append(snapshots, s)
+	}
+	add("genesis", &Snapshot{NodeId: nodeId, Transaction: &SignedTransaction{Transaction: *genesis}, Timestamp: 1600000000000000000})
+	add("empty", &Snapshot{Transaction: &SignedTransaction{}})
+	references := [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("external"))}
+	add("references", &Snapshot{NodeId: nodeId, Transaction: signed, References: references, RoundNumber: 7, Timestamp: 1600000003000000001})
+	add("first-round", &Snapshot{NodeId: nodeId, Transaction: signed, References: [2]crypto.Hash{{}, references[1]}, RoundNumber: 1, Timestamp: 1600000003000000001})
+	add("max", &Snapshot{NodeId: nodeId, Transaction: signed, References: references, RoundNumber: ^uint64(0), Timestamp: ^uint64(0)})
+	add("scheme", &Snapshot{NodeId: nodeId, Transaction: signed, References: references, RoundNumber: 7, Timestamp: 1600000003000000001, Scheme: 1})
+	return names, snapshots
+}
+
+func renderPayloads(names []string, snapshots []*Snapshot) string {
+	lines := []string{fmt.Sprintf("version %d", SnapshotPayloadVersion)}
+	for i, s := range snapshots {
+		lines = append(lines, fmt.Sprintf("%s %s %s", names[i], s.PayloadHash(), hex.EncodeToString(s.Payload())))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestSnapshotPayloadGolden(t *testing.T) {
+	assert := assert.New(t)
+
+	names, snapshots := testPayloadSnapshots()
+	if *updatePayload {
+		assert.Nil(ioutil.WriteFile(payloadGoldenFile, []byte(renderPayloads(names, snapshots)), 0644))
+	}
+	golden, err := ioutil.ReadFile(payloadGoldenFile)
+	assert.Nil(err)
+	assert.Equal(string(golden), renderPayloads(names, snapshots), "the payload encoding changed, which forks the chain")
+
+	// the signatures and the local fields are never in the payload
+	for _, s := range snapshots {
+		payload := s.Payload()
+		assert.Equal(SnapshotPayloadVersion, s.PayloadVersion())
+		s.Signatures = []crypto.Signature{{1}, {2}}
+		s.Signers = map[crypto.Signature]crypto.Hash{{1}: crypto.NewHash([]byte("signer"))}
+		s.Source = crypto.NewHash([]byte("source"))
+		assert.Equal(payload, s.Payload())
+		s.Aggregated = &AggregatedSignature{Signature: []byte{1}, Signers: []byte{3}}
+		assert.Equal(payload, s.Payload())
+	}
+}
@@ -1,16 +1,52 @@
 package common
 
 import (
+	"fmt"
+
 	"github.com/MixinNetwork/mixin/crypto"
 )
 
 type Snapshot struct {
-	NodeId      crypto.Hash        `msgpack:"I"json:"node"`
-	Transaction *SignedTransaction `msgpack:"T"json:"transaction"`
-	References  [2]crypto.Hash     `msgpack:"R"json:"references"`
-	RoundNumber uint64             `msgpack:"H"json:"round"`
-	Timestamp   uint64             `msgpack:"C"json:"timestamp"`
-	Signatures  []crypto.Signature `msgpack:"S,omitempty"json:"signatures,omitempty"`
+	NodeId      crypto.Hash            `msgpack:"I"json:"node"`
+	Transaction *SignedTransaction     `msgpack:"T"json:"transaction"`
+	References  [2]crypto.Hash         `msgpack:"R"json:"references"`
+	RoundNumber uint64                 `msgpack:"H"json:"round"`
+	Timestamp   uint64                 `msgpack:"C"json:"timestamp"`
+	Scheme      crypto.SignatureScheme `msgpack:"V,omitempty"json:"scheme,omitempty"`
+	Signatures  []crypto.Signature     `msgpack:"S,omitempty"json:"signatures,omitempty"`
+	Aggregated  *AggregatedSignature   `msgpack:"A,omitempty"json:"aggregated,omitempty"`
+
+	Signers map[crypto.Signature]crypto.Hash `msgpack:"-"json:"-"`
+	Source  crypto.Hash                      `msgpack:"-"json:"-"`
+}
+
+// RejectedSnapshot is a snapshot dropped by the node, with the reason and the peer it came from
+type RejectedSnapshot struct {
+	Snapshot  *Snapshot   `msgpack:"S"json:"snapshot"`
+	Reason    string      `msgpack:"R"json:"reason"`
+	Error     string      `msgpack:"E"json:"error"`
+	Source    crypto.Hash `msgpack:"P"json:"source"`
+	Timestamp uint64      `msgpack:"C"json:"timestamp"`
+}
+
+// signers is a bitmap of the sorted consensus nodes, which signed the snapshot
+type AggregatedSignature struct {
+	Signature []byte `msgpack:"S"json:"signature"`
+	Signers   []byte `msgpack:"M"json:"signers"`
+}
+
+func (a *AggregatedSignature) SetSigner(index int) {
+	for len(a.Signers) <= index/8 {
+		a.Signers = append(a.Signers, 0)
+	}
+	a.Signers[index/8] |= 1 << uint(index%8)
+}
+
+func (a *AggregatedSignature) HasSigner(index int) bool {
+	if index/8 >= len(a.Signers) {
+		return false
+	}
+	return a.Signers[index/8]&(1<<uint(index%8)) != 0
 }
 
 type SnapshotWithTopologicalOrder struct {
@@ -20,6 +56,18 @@ type SnapshotWithTopologicalOrder struct {
 	RoundLinks       map[crypto.Hash]uint64 `msgpack:"-"json:"-"`
 }
 
+// SnapshotPayloadVersion is the version of the Payload encoding, the payload is signed and hashed
+// into the rounds, so any change of the bytes forks the chain, and must come with a new version
+const SnapshotPayloadVersion = 1
+
+// PayloadVersion is the version of the Payload encoding, to gate a future encoding change
+func (s *Snapshot) PayloadVersion() int {
+	return SnapshotPayloadVersion
+}
+
+// Payload is the msgpack encoding of the snapshot without its signatures,
+// the snapshot signatures are signed over exactly these bytes, the scheme
+// is included so a signature can't be verified with another scheme
 func (s *Snapshot) Payload() []byte {
 	p := Snapshot{
 		NodeId:      s.NodeId,
@@ -27,16 +75,25 @@ func (s *Snapshot) Payload() []byte {
 		References:  s.References,
 		RoundNumber: s.RoundNumber,
 		Timestamp:   s.Timestamp,
+		Scheme:      s.Scheme,
 	}
 	return MsgpackMarshalPanic(p)
 }
 
+// PayloadHash identifies the snapshot in the pool, the gossip and the round hash,
+// different nodes and rounds snapshotting the same transaction have different payload hashes
 func (s *Snapshot) PayloadHash() crypto.Hash {
 	return crypto.NewHash(s.Payload())
 }
 
+// TransactionHash identifies the transaction of the snapshot without its input signatures,
+// it's the key of the UTXO locks and the finalized snapshot in the store
+func (s *Snapshot) TransactionHash() crypto.Hash {
+	return s.Transaction.PayloadHash()
+}
+
 func (s *Snapshot) LockInputs(locker UTXOLocker) error {
-	txHash := s.Transaction.PayloadHash()
+	txHash := s.TransactionHash()
 	for _, in := range s.Transaction.Inputs {
 		var err error
 		if in.Deposit != nil {
@@ -62,12 +119,71 @@ func (s *Snapshot) Sign(spendKey crypto.Key) {
 	s.Signatures = append(s.Signatures, sig)
 }
 
+// Verifier is the registered verifier of the snapshot signature scheme
+func (s *Snapshot) Verifier() (crypto.Verifier, bool) {
+	return crypto.GetVerifier(s.Scheme)
+}
+
 func (s *Snapshot) CheckSignature(pub crypto.Key) bool {
+	verifier, found := s.Verifier()
+	if !found {
+		return false
+	}
 	msg := s.Payload()
 	for _, sig := range s.Signatures {
-		if pub.Verify(msg, sig) {
+		if verifier.Verify(pub, msg, sig) {
 			return true
 		}
 	}
 	return false
 }
+
+// ValidateStateless checks a snapshot without any store, it covers
+//   - the transaction format, i.e. version, extra and total size, input signature count and positive outputs
+//   - two different references
+//   - at least one and no more snapshot signatures than the consensus nodes
+//   - every snapshot signature verified by a distinct accepted consensus node
+//
+// it doesn't cover the input existence, input signatures, double spending, output keys reuse,
+// node pledge and accept rules, round and timestamp rules or the finalization threshold,
+// and genesis snapshots are not valid to it because they have no references
+func ValidateStateless(s *Snapshot, consensus []*Node) error {
+	if s.Transaction == nil {
+		return fmt.Errorf("invalid snapshot without transaction")
+	}
+	err := s.Transaction.validateStateless()
+	if err != nil {
+		return err
+	}
+
+	if s.References[0] == s.References[1] {
+		return fmt.Errorf("same references %s", s.References[0].String())
+	}
+
+	if len(s.Signatures) == 0 || len(s.Signatures) > len(consensus) {
+		return fmt.Errorf("invalid snapshot signature number %d %d", len(s.Signatures), len(consensus))
+	}
+	verifier, found := s.Verifier()
+	if !found {
+		return fmt.Errorf("unsupported snapshot signature scheme %d", s.Scheme)
+	}
+	msg := s.Payload()
+	signers := make(map[int]bool)
+	for _, sig := range s.Signatures {
+		signer := -1
+		for i, cn := range consensus {
+			if cn.IsAccepted() && verifier.Verify(cn.Account.PublicSpendKey, msg, sig) {
+				signer = i
+				break
+			}
+		}
+		if signer < 0 {
+			return fmt.Errorf("invalid snapshot signature %s", sig.String())
+		}
+		if signers[signer] {
+			return fmt.Errorf("duplicated snapshot signature %s", sig.String())
+		}
+		signers[signer] = true
+	}
+	return nil
+}
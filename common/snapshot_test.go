@@ -44,3 +44,101 @@ func TestSnapshot(t *testing.T) {
 	assert.False(s.CheckSignature(key))
 	assert.True(s.CheckSignature(key.Public()))
 }
+
+func TestSnapshotHashes(t *testing.T) {
+	assert := assert.New(t)
+
+	accounts := []Address{randomAccount(), randomAccount()}
+	tx := NewTransaction(XINAssetId)
+	tx.AddInput(crypto.NewHash([]byte("input")), 0)
+	tx.AddScriptOutput(accounts, Script{OperatorCmp, OperatorSum, 1}, NewInteger(1))
+	s := &Snapshot{
+		NodeId:      crypto.NewHash([]byte("node")),
+		Transaction: &SignedTransaction{Transaction: *tx},
+		References:  [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("external"))},
+		RoundNumber: 7,
+		Timestamp:   1573000000000000000,
+	}
+
+	payload := MsgpackMarshalPanic(Snapshot{
+		NodeId:      s.NodeId,
+		Transaction: s.Transaction,
+		References:  s.References,
+		RoundNumber: s.RoundNumber,
+		Timestamp:   s.Timestamp,
+	})
+	assert.Equal(payload, s.Payload())
+	assert.Equal(crypto.NewHash(payload), s.PayloadHash())
+	assert.Equal(crypto.NewHash(MsgpackMarshalPanic(tx)), s.TransactionHash())
+	assert.NotEqual(s.PayloadHash(), s.TransactionHash())
+
+	// the snapshot signatures are never in the payload
+	payloadHash := s.PayloadHash()
+	seed := make([]byte, 64)
+	rand.Read(seed)
+	s.Sign(crypto.NewKeyFromSeed(seed))
+	s.Aggregated = &AggregatedSignature{Signature: []byte("signature"), Signers: []byte{1}}
+	assert.Equal(payload, s.Payload())
+	assert.Equal(payloadHash, s.PayloadHash())
+
+	// the input signatures are in the payload but not in the transaction hash
+	txHash := s.TransactionHash()
+	s.Transaction.Signatures = [][]crypto.Signature{{s.Signatures[0]}}
+	assert.Equal(txHash, s.TransactionHash())
+	assert.NotEqual(payloadHash, s.PayloadHash())
+
+	// the same transaction snapshotted by another node or round
+	other := &Snapshot{NodeId: crypto.NewHash([]byte("other")), Transaction: s.Transaction, References: s.References, RoundNumber: 7, Timestamp: s.Timestamp}
+	assert.Equal(s.TransactionHash(), other.TransactionHash())
+	assert.NotEqual(s.PayloadHash(), other.PayloadHash())
+	other.NodeId, other.RoundNumber = s.NodeId, 8
+	assert.Equal(s.TransactionHash(), other.TransactionHash())
+	assert.NotEqual(s.PayloadHash(), other.PayloadHash())
+}
+
+func TestValidateStateless(t *testing.T) {
+	assert := assert.New(t)
+
+	consensus := make([]*Node, 0)
+	for i := 0; i < 4; i++ {
+		consensus = append(consensus, &Node{Account: randomAccount(), State: NodeStateAccepted})
+	}
+	consensus[3].State = NodeStatePledging
+
+	tx := NewTransaction(XINAssetId)
+	tx.AddInput(crypto.NewHash([]byte("input")), 0)
+	tx.AddScriptOutput([]Address{randomAccount()}, Script{OperatorCmp, OperatorSum, 1}, NewInteger(1))
+	s := &Snapshot{
+		Transaction: &SignedTransaction{Transaction: *tx, Signatures: [][]crypto.Signature{{}}},
+		References:  [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("external"))},
+	}
+	assert.NotNil(ValidateStateless(s, consensus))
+
+	s.Sign(consensus[0].Account.PrivateSpendKey)
+	s.Sign(consensus[1].Account.PrivateSpendKey)
+	assert.Nil(ValidateStateless(s, consensus))
+
+	s.Signatures = append(s.Signatures, s.Signatures[0])
+	assert.NotNil(ValidateStateless(s, consensus))
+	s.Signatures = s.Signatures[:2]
+
+	s.Sign(consensus[3].Account.PrivateSpendKey)
+	assert.NotNil(ValidateStateless(s, consensus))
+	s.Signatures = s.Signatures[:2]
+
+	s.Sign(randomAccount().PrivateSpendKey)
+	assert.NotNil(ValidateStateless(s, consensus))
+	s.Signatures = s.Signatures[:2]
+
+	s.References[1] = s.References[0]
+	assert.NotNil(ValidateStateless(s, consensus))
+	s.References[1] = crypto.NewHash([]byte("external"))
+
+	s.Scheme = crypto.SignatureScheme(7)
+	assert.NotNil(ValidateStateless(s, consensus))
+	s.Scheme = crypto.SchemeEd25519
+	assert.Nil(ValidateStateless(s, consensus))
+
+	s.Transaction.Signatures = nil
+	assert.NotNil(ValidateStateless(s, consensus))
+}
@@ -89,29 +89,18 @@ func (tx *Transaction) ViewGhostKey(a *crypto.Key) []*Output {
 }
 
 func (tx *SignedTransaction) Validate(store DataStore) error {
-	if tx.Version != TxVersion {
-		return fmt.Errorf("invalid tx version %d", tx.Version)
-	}
-
-	if len(tx.Inputs) != len(tx.Signatures) {
-		return fmt.Errorf("invalid tx signature number %d %d", len(tx.Inputs), len(tx.Signatures))
-	}
-
-	if len(tx.Extra) > ExtraSizeLimit {
-		return fmt.Errorf("invalid extra size %d", len(tx.Extra))
-	}
-
-	msg := MsgpackMarshalPanic(tx.Transaction)
-	if len(msg) > config.TransactionMaximumSize {
-		return fmt.Errorf("invalid transaction size %d", len(msg))
+	msg, err := tx.validateFormat()
+	if err != nil {
+		return err
 	}
 
 	var inputAmount, outputAmount Integer
 
 	inputsFilter := make(map[string]*UTXO)
 	for i, in := range tx.Inputs {
-		if len(in.Genesis) > 0 {
-			return fmt.Errorf("invalid genesis input detected %s", hex.EncodeToString(in.Genesis))
+		err := in.validateFormat()
+		if err != nil {
+			return err
 		}
 		if in.Deposit != nil {
 			err := tx.validateDepositInput(store, msg)
@@ -152,8 +141,9 @@ func (tx *SignedTransaction) Validate(store DataStore) error {
 
 	outputsFilter := make(map[crypto.Key]bool)
 	for _, o := range tx.Outputs {
-		if o.Amount.Sign() <= 0 {
-			return fmt.Errorf("invalid output amount %s", o.Amount.String())
+		err := o.validateFormat()
+		if err != nil {
+			return err
 		}
 		for _, k := range o.Keys {
 			if outputsFilter[k] {
@@ -209,6 +199,67 @@ func (tx *SignedTransaction) Validate(store DataStore) error {
 	return nil
 }
 
+// the transaction checks before any input, they only need the transaction itself
+func (tx *SignedTransaction) validateFormat() ([]byte, error) {
+	if tx.Version != TxVersion {
+		return nil, fmt.Errorf("invalid tx version %d", tx.Version)
+	}
+
+	if len(tx.Inputs) != len(tx.Signatures) {
+		return nil, fmt.Errorf("invalid tx signature number %d %d", len(tx.Inputs), len(tx.Signatures))
+	}
+
+	if len(tx.Extra) > ExtraSizeLimit {
+		return nil, fmt.Errorf("invalid extra size %d", len(tx.Extra))
+	}
+
+	msg := MsgpackMarshalPanic(tx.Transaction)
+	if len(msg) > config.TransactionMaximumSize {
+		return nil, fmt.Errorf("invalid transaction size %d", len(msg))
+	}
+
+	return msg, nil
+}
+
+// all the input and output checks which need no store, in the same order as Validate,
+// the inputs after a deposit are never checked, and the outputs after all inputs
+func (tx *SignedTransaction) validateStateless() error {
+	_, err := tx.validateFormat()
+	if err != nil {
+		return err
+	}
+	for _, in := range tx.Inputs {
+		err := in.validateFormat()
+		if err != nil {
+			return err
+		}
+		if in.Deposit != nil {
+			break
+		}
+	}
+	for _, o := range tx.Outputs {
+		err := o.validateFormat()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *Input) validateFormat() error {
+	if len(in.Genesis) > 0 {
+		return fmt.Errorf("invalid genesis input detected %s", hex.EncodeToString(in.Genesis))
+	}
+	return nil
+}
+
+func (o *Output) validateFormat() error {
+	if o.Amount.Sign() <= 0 {
+		return fmt.Errorf("invalid output amount %s", o.Amount.String())
+	}
+	return nil
+}
+
 func (tx *SignedTransaction) validateDepositInput(store DataStore, msg []byte) error {
 	if len(tx.Inputs) != 1 {
 		return fmt.Errorf("invalid inputs count %d for deposit", len(tx.Inputs))
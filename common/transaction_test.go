@@ -42,6 +42,19 @@ func TestTransaction(t *testing.T) {
 	assert.Len(outputs, 1)
 	assert.NotEqual(outputs[0].Keys[1].String(), accounts[1].PublicSpendKey.String())
 	assert.NotEqual(outputs[0].Keys[1].String(), accounts[1].PublicViewKey.String())
+
+	// the inputs after a deposit are never checked, neither by the stateless checks
+	deposit := NewTransaction(XINAssetId)
+	deposit.Inputs = append(deposit.Inputs, &Input{Deposit: &DepositData{Amount: NewInteger(1)}})
+	deposit.Inputs = append(deposit.Inputs, &Input{Genesis: genesisHash[:]})
+	deposit.AddScriptOutput(accounts, script, NewInteger(1))
+	signed = &SignedTransaction{Transaction: *deposit, Signatures: make([][]crypto.Signature, 2)}
+	err = signed.Validate(store)
+	assert.Contains(err.Error(), "invalid inputs count 2 for deposit")
+	assert.Nil(signed.validateStateless())
+	signed.Inputs[0], signed.Inputs[1] = signed.Inputs[1], signed.Inputs[0]
+	assert.Contains(signed.Validate(store).Error(), "invalid genesis input")
+	assert.Contains(signed.validateStateless().Error(), "invalid genesis input")
 }
 
 type storeImpl struct {
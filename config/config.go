@@ -3,6 +3,52 @@ package config
 import "time"
 
 const (
-	SnapshotRoundGap       = uint64(3 * time.Second)
-	TransactionMaximumSize = 1024 * 1024
+	SnapshotRoundGap         = uint64(3 * time.Second)
+	SnapshotTimestampMaxWait = uint64(1 * time.Second)
+	TransactionMaximumSize   = 1024 * 1024
+)
+
+var (
+	ConsensusThresholdNumerator   = 2
+	ConsensusThresholdDenominator = 3
+	GossipFanout                  = 3
+	GossipSuppressionWindow       = SnapshotRoundGap
+	GossipSnapshotCacheSize       = 4096
+	CacheRoundSnapshotsLimit      = 1024
+	SnapshotSeenCacheSize         = 8192
+	SignatureVerifyCacheSize      = 65536
+	SignatureAggregation          = false
+	StrictSignatures              = false
+	StrictStartup                 = false
+	SignatureSchemes              = []int{0}
+	SnapshotClockSkewThreshold    = uint64(10 * time.Second)
+	SnapshotTimestampTolerance    = uint64(1 * time.Second)
+	SnapshotTimestampMaxAhead     = uint64(24 * time.Hour)
+	SnapshotSignatureTimeout      = uint64(6 * time.Second)
+	SnapshotLateSignatureWindow   = uint64(0)
+	ConsensusCacheRoundGaps       = 10
+	SnapshotHeartbeatTimeout      = uint64(0)
+	NodeHealthProgressWindow      = uint64(60 * time.Second)
+	NodeHealthFinalLag            = uint64(30 * time.Second)
+	VerifyRoundEnd                = false
+	SnapshotLanes                 = 8
+	SnapshotSignaturesLimit       = 64
+	SnapshotReferenceRetries      = 3
+	SnapshotSelfReferenceDepth    = 8
+	SnapshotReferenceMaxAge       = uint64(0)
+	SnapshotRoundLimit            = 0
+	ConsensusPeerSnapshotRate     = 4096
+	ConsensusPeerSnapshotBurst    = 8192
+	RelayPeerSnapshotRate         = 256
+	RelayPeerSnapshotBurst        = 512
+	StorageBatchWrites            = 256
+	StorageRoundLinksCache        = true
+	StorageReadRetries            = 3
+	StorageReadRetryInterval      = uint64(100 * time.Millisecond)
+	SnapshotSendRetries           = 3
+	SnapshotSendRetryInterval     = uint64(100 * time.Millisecond)
+	SnapshotTraceFile             = ""
+	SnapshotSubscriberBlocking    = false
+	SnapshotsPoolLimit            = 65536
+	SnapshotRejectedLimit         = 1024
 )
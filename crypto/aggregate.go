@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/crypto/edwards25519"
+)
+
+// half aggregation of the signatures for the same message, the aggregated signature
+// is all the R values followed by the sum of the S values weighted by z values,
+// z values are derived from the message, all R values and public keys
+//
+//	s * B = sum(z * R + z * h * A)
+func AggregateSignatures(message []byte, publicKeys []Key, sigs []Signature) ([]byte, error) {
+	if len(sigs) == 0 || len(sigs) != len(publicKeys) {
+		return nil, fmt.Errorf("invalid aggregation signatures count %d %d", len(sigs), len(publicKeys))
+	}
+	for i, sig := range sigs {
+		if !publicKeys[i].Verify(message, sig) {
+			return nil, fmt.Errorf("invalid aggregation signature %d %s", i, sig.String())
+		}
+	}
+
+	rs := make([][32]byte, len(sigs))
+	for i, sig := range sigs {
+		copy(rs[i][:], sig.R())
+	}
+	zs := aggregationWeights(message, publicKeys, rs)
+
+	var s [32]byte
+	for i, sig := range sigs {
+		var si [32]byte
+		copy(si[:], sig.S())
+		edwards25519.ScMulAdd(&s, &zs[i], &si, &s)
+	}
+
+	aggregated := make([]byte, 0, len(sigs)*32+32)
+	for _, r := range rs {
+		aggregated = append(aggregated, r[:]...)
+	}
+	return append(aggregated, s[:]...), nil
+}
+
+func VerifyAggregatedSignature(message []byte, publicKeys []Key, aggregated []byte) bool {
+	if len(publicKeys) == 0 || len(aggregated) != len(publicKeys)*32+32 {
+		return false
+	}
+	var s [32]byte
+	copy(s[:], aggregated[len(publicKeys)*32:])
+	if !edwards25519.ScMinimal(&s) {
+		return false
+	}
+
+	rs := make([][32]byte, len(publicKeys))
+	for i := range rs {
+		copy(rs[i][:], aggregated[i*32:])
+	}
+	zs := aggregationWeights(message, publicKeys, rs)
+
+	var sum edwards25519.ExtendedGroupElement
+	sum.Zero()
+	for i, pub := range publicKeys {
+		var R, A edwards25519.ExtendedGroupElement
+		if !R.FromBytes(&rs[i]) {
+			return false
+		}
+		pubBytes := [32]byte(pub)
+		if !A.FromBytes(&pubBytes) {
+			return false
+		}
+
+		h := sha512.New()
+		h.Write(rs[i][:])
+		h.Write(pub[:])
+		h.Write(message)
+		var digest [64]byte
+		h.Sum(digest[:0])
+		var hReduced, zh, zero [32]byte
+		edwards25519.ScReduce(&hReduced, &digest)
+		edwards25519.ScMulAdd(&zh, &zs[i], &hReduced, &zero)
+
+		if !addScalarMult(&sum, &zs[i], &R) || !addScalarMult(&sum, &zh, &A) {
+			return false
+		}
+	}
+
+	var check edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&check, &s)
+	var expected, actual [32]byte
+	check.ToBytes(&expected)
+	sum.ToBytes(&actual)
+	return bytes.Equal(expected[:], actual[:])
+}
+
+func aggregationWeights(message []byte, publicKeys []Key, rs [][32]byte) [][32]byte {
+	h := sha512.New()
+	h.Write(message)
+	for i := range rs {
+		h.Write(rs[i][:])
+		h.Write(publicKeys[i][:])
+	}
+	transcript := h.Sum(nil)
+
+	zs := make([][32]byte, len(rs))
+	for i := range zs {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		var digest [64]byte
+		h.Reset()
+		h.Write(transcript)
+		h.Write(buf)
+		h.Sum(digest[:0])
+		edwards25519.ScReduce(&zs[i], &digest)
+	}
+	return zs
+}
+
+// sum = sum + a * A
+func addScalarMult(sum *edwards25519.ExtendedGroupElement, a *[32]byte, A *edwards25519.ExtendedGroupElement) bool {
+	var p edwards25519.ProjectiveGroupElement
+	edwards25519.GeScalarMult(&p, a, A)
+	var pBytes [32]byte
+	p.ToBytes(&pBytes)
+	var P edwards25519.ExtendedGroupElement
+	if !P.FromBytes(&pBytes) {
+		return false
+	}
+
+	var cached edwards25519.CachedGroupElement
+	var completed edwards25519.CompletedGroupElement
+	P.ToCached(&cached)
+	edwards25519.GeAdd(&completed, sum, &cached)
+	completed.ToExtended(sum)
+	return true
+}
@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := []byte("aggregation message")
+	keys, pubs, sigs := make([]Key, 0), make([]Key, 0), make([]Signature, 0)
+	for i := 0; i < 5; i++ {
+		seed := NewHash([]byte{byte(i)})
+		key := NewKeyFromSeed(append(seed[:], seed[:]...))
+		keys = append(keys, key)
+		pubs = append(pubs, key.Public())
+		sigs = append(sigs, key.Sign(msg))
+	}
+
+	aggregated, err := AggregateSignatures(msg, pubs, sigs)
+	assert.Nil(err)
+	assert.Len(aggregated, 5*32+32)
+	assert.True(VerifyAggregatedSignature(msg, pubs, aggregated))
+	assert.False(VerifyAggregatedSignature([]byte("other message"), pubs, aggregated))
+	assert.False(VerifyAggregatedSignature(msg, pubs[:4], aggregated))
+	assert.False(VerifyAggregatedSignature(msg, append([]Key{pubs[1], pubs[0]}, pubs[2:]...), aggregated))
+
+	tampered := append([]byte{}, aggregated...)
+	tampered[len(tampered)-32]++
+	assert.False(VerifyAggregatedSignature(msg, pubs, tampered))
+
+	single, err := AggregateSignatures(msg, pubs[:1], sigs[:1])
+	assert.Nil(err)
+	assert.True(VerifyAggregatedSignature(msg, pubs[:1], single))
+
+	_, err = AggregateSignatures(msg, pubs, append([]Signature{sigs[1]}, sigs[1:]...))
+	assert.NotNil(err)
+	_, err = AggregateSignatures(msg, pubs[:4], sigs)
+	assert.NotNil(err)
+}
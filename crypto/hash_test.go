@@ -16,6 +16,8 @@ func TestHash(t *testing.T) {
 
 	h := NewHash(seed)
 	assert.Equal("9323516a9ed2b789339472e38673fd74e8e802efbb94b0b9454f0188ccb70358", h.String())
+	assert.False(h.IsZero())
+	assert.True(Hash{}.IsZero())
 	h, err := HashFromString("9323516a9ed2b789339472e38673fd74e8e802efbb94b0b9454f0188ccb70358")
 	assert.Nil(err)
 	assert.Equal("9323516a9ed2b789339472e38673fd74e8e802efbb94b0b9454f0188ccb70358", h.String())
@@ -0,0 +1,42 @@
+package crypto
+
+import "sync"
+
+// the scheme of a signature is carried by the signed data, the zero scheme
+// is the ed25519 signature of the keys, which is the only one by default
+type SignatureScheme uint8
+
+const SchemeEd25519 SignatureScheme = 0
+
+type Verifier interface {
+	Verify(pub Key, message []byte, sig Signature) bool
+}
+
+type ed25519Verifier struct{}
+
+func (ed25519Verifier) Verify(pub Key, message []byte, sig Signature) bool {
+	return pub.Verify(message, sig)
+}
+
+var verifiers = struct {
+	sync.RWMutex
+	schemes map[SignatureScheme]Verifier
+}{schemes: map[SignatureScheme]Verifier{SchemeEd25519: ed25519Verifier{}}}
+
+// RegisterVerifier sets the verifier of the scheme, a nil verifier removes it
+func RegisterVerifier(scheme SignatureScheme, v Verifier) {
+	verifiers.Lock()
+	defer verifiers.Unlock()
+	if v == nil {
+		delete(verifiers.schemes, scheme)
+		return
+	}
+	verifiers.schemes[scheme] = v
+}
+
+func GetVerifier(scheme SignatureScheme) (Verifier, bool) {
+	verifiers.RLock()
+	defer verifiers.RUnlock()
+	v, found := verifiers.schemes[scheme]
+	return v, found
+}
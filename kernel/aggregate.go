@@ -0,0 +1,188 @@
+package kernel
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+const authenticationCapabilityAggregation = 1
+
+// peers advertised the aggregated signature capability in the authentication message
+type aggregationPeers struct {
+	sync.RWMutex
+	peers map[crypto.Hash]bool
+}
+
+func (p *aggregationPeers) set(id crypto.Hash, capable bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.peers[id] = capable
+}
+
+func (p *aggregationPeers) has(id crypto.Hash) bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.peers[id]
+}
+
+// accepted consensus nodes sorted by id, the aggregated signature signers bitmap indexes into them
+func (node *Node) aggregationSigners() ([]crypto.Hash, []crypto.Key) {
+	return committeeAggregationSigners(node.networkId, node.ConsensusNodes)
+}
+
+func committeeAggregationSigners(networkId crypto.Hash, nodes []common.Node) ([]crypto.Hash, []crypto.Key) {
+	ids := make([]crypto.Hash, 0)
+	keys := make(map[crypto.Hash]crypto.Key)
+	for _, cn := range nodes {
+		if !cn.IsAccepted() {
+			continue
+		}
+		id := cn.IdForNetwork(networkId)
+		ids = append(ids, id)
+		keys[id] = cn.Account.PublicSpendKey
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	pubs := make([]crypto.Key, len(ids))
+	for i, id := range ids {
+		pubs[i] = keys[id]
+	}
+	return ids, pubs
+}
+
+// AggregateSnapshot returns a copy of the snapshot with all the consensus signatures
+// replaced by the aggregated signature
+func (node *Node) AggregateSnapshot(s *common.Snapshot) (*common.Snapshot, error) {
+	node.clearConsensusSignatures(s)
+	if len(s.Signatures) == 0 {
+		return nil, fmt.Errorf("no signatures to aggregate %s", s.PayloadHash().String())
+	}
+	signed := make(map[crypto.Hash]crypto.Signature)
+	for sig, id := range s.Signers {
+		signed[id] = sig
+	}
+
+	ids, pubs := node.aggregationSigners()
+	aggregated := &common.AggregatedSignature{}
+	keys, sigs := make([]crypto.Key, 0), make([]crypto.Signature, 0)
+	for i, id := range ids {
+		sig, found := signed[id]
+		if !found {
+			continue
+		}
+		aggregated.SetSigner(i)
+		keys = append(keys, pubs[i])
+		sigs = append(sigs, sig)
+	}
+	sig, err := crypto.AggregateSignatures(s.Payload(), keys, sigs)
+	if err != nil {
+		return nil, err
+	}
+	aggregated.Signature = sig
+
+	as := *s
+	as.Signatures = nil
+	as.Signers = nil
+	as.Aggregated = aggregated
+	return &as, nil
+}
+
+func (node *Node) verifyAggregatedSignature(s *common.Snapshot) ([]crypto.Hash, bool) {
+	if s.Aggregated == nil {
+		return nil, false
+	}
+	ids, pubs := node.aggregationSigners()
+	return verifyAggregatedSignature(s, ids, pubs)
+}
+
+func verifyAggregatedSignature(s *common.Snapshot, ids []crypto.Hash, pubs []crypto.Key) ([]crypto.Hash, bool) {
+	if s.Aggregated == nil {
+		return nil, false
+	}
+	if len(s.Aggregated.Signers) > (len(ids)+7)/8 {
+		return nil, false
+	}
+	signers, keys := make([]crypto.Hash, 0), make([]crypto.Key, 0)
+	for i, id := range ids {
+		if s.Aggregated.HasSigner(i) {
+			signers = append(signers, id)
+			keys = append(keys, pubs[i])
+		}
+	}
+	if !crypto.VerifyAggregatedSignature(s.Payload(), keys, s.Aggregated.Signature) {
+		return nil, false
+	}
+	return signers, true
+}
+
+// all valid consensus signers of the snapshot, both individual and aggregated, the signatures
+// are cleared in a copy, so the snapshot, e.g. one shared with the cache round, never changes
+func (node *Node) snapshotSigners(s *common.Snapshot) map[crypto.Hash]bool {
+	c := *s
+	node.clearConsensusSignatures(&c)
+	signers := make(map[crypto.Hash]bool)
+	for _, id := range c.Signers {
+		signers[id] = true
+	}
+	if ids, valid := node.verifyAggregatedSignature(s); valid {
+		for _, id := range ids {
+			signers[id] = true
+		}
+	}
+	return signers
+}
+
+func (node *Node) checkSnapshotSigner(s *common.Snapshot, cn *common.Node) bool {
+	if _, enabled := snapshotVerifier(s); !enabled {
+		return false
+	}
+	if s.CheckSignature(cn.Account.PublicSpendKey) {
+		return true
+	}
+	if s.Aggregated == nil {
+		return false
+	}
+	ids, valid := node.verifyAggregatedSignature(s)
+	if !valid {
+		return false
+	}
+	id := cn.IdForNetwork(node.networkId)
+	for _, signer := range ids {
+		if signer == id {
+			return true
+		}
+	}
+	return false
+}
+
+// send the aggregated snapshot to the capable peers, and the original one to the others
+func (node *Node) sendSnapshotBatch(peers []crypto.Hash, s *common.Snapshot) map[crypto.Hash]error {
+	if !config.SignatureAggregation || !node.verifyFinalization(s) {
+		return node.Sender.SendSnapshotMessageBatch(peers, s)
+	}
+	aggregated, err := node.AggregateSnapshot(s)
+	if err != nil {
+		return node.Sender.SendSnapshotMessageBatch(peers, s)
+	}
+
+	capable, others := make([]crypto.Hash, 0), make([]crypto.Hash, 0)
+	for _, id := range peers {
+		if node.aggregation.has(id) {
+			capable = append(capable, id)
+		} else {
+			others = append(others, id)
+		}
+	}
+	errs := node.Sender.SendSnapshotMessageBatch(others, s)
+	for id, err := range node.Sender.SendSnapshotMessageBatch(capable, aggregated) {
+		errs[id] = err
+	}
+	return errs
+}
@@ -0,0 +1,81 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[1:5] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	aggregated, err := node.AggregateSnapshot(s)
+	assert.Nil(err)
+	assert.Len(aggregated.Signatures, 0)
+	assert.NotNil(aggregated.Aggregated)
+	assert.Len(aggregated.Aggregated.Signature, 4*32+32)
+	assert.Equal(s.PayloadHash(), aggregated.PayloadHash())
+	assert.False(node.verifyFinalization(aggregated))
+	assert.True(node.checkSnapshotSigner(aggregated, &node.ConsensusNodes[1]))
+	assert.False(node.checkSnapshotSigner(aggregated, &node.ConsensusNodes[5]))
+
+	s.Sign(accounts[5].PrivateSpendKey)
+	aggregated, err = node.AggregateSnapshot(s)
+	assert.Nil(err)
+	assert.True(node.verifyFinalization(aggregated))
+	assert.Len(node.snapshotSigners(aggregated), 5)
+	assert.Len(s.Signatures, 5)
+
+	bitmap := append([]byte{}, aggregated.Aggregated.Signers...)
+	aggregated.Aggregated.Signers[0] ^= 0xff
+	assert.False(node.verifyFinalization(aggregated))
+	aggregated.Aggregated.Signers = append(bitmap, 0)
+	assert.False(node.verifyFinalization(aggregated))
+	aggregated.Aggregated.Signers = bitmap
+
+	aggregated.Sign(accounts[6].PrivateSpendKey)
+	assert.Len(node.snapshotSigners(aggregated), 6)
+
+	// the signers are counted on a copy, the snapshot keeps the duplicated and unknown signatures
+	seed := crypto.NewHash([]byte("stranger"))
+	stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Signatures = append(s.Signatures, s.Signatures[0])
+	s.Sign(stranger.PrivateSpendKey)
+	signers := len(s.Signers)
+	assert.True(node.verifyFinalization(s))
+	assert.Len(s.Signatures, 7)
+	assert.Len(s.Signers, signers)
+
+	_, err = node.AggregateSnapshot(&common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}})
+	assert.NotNil(err)
+}
+
+func TestAuthenticationAggregationCapability(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(3)
+	msg := node.BuildAuthenticationMessage()
+	id, err := node.Authenticate(msg)
+	assert.Nil(err)
+	assert.Equal(node.IdForNetwork, id)
+	assert.False(node.aggregation.has(id))
+
+	config.SignatureAggregation = true
+	defer func() { config.SignatureAggregation = false }()
+	msg = node.BuildAuthenticationMessage()
+	assert.Len(msg, 105)
+	id, err = node.Authenticate(msg)
+	assert.Nil(err)
+	assert.True(node.aggregation.has(id))
+	id, err = node.Authenticate(msg[:104])
+	assert.Nil(err)
+	assert.False(node.aggregation.has(id))
+}
@@ -0,0 +1,311 @@
+package kernel
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// the signers of finalized snapshots never change until the consensus nodes change, and the
+// committees are the accepted nodes changes since the node started, each since its timestamp
+type signersCache struct {
+	sync.Mutex
+	signers    map[crypto.Hash][]crypto.Hash
+	committees []signersCommittee
+}
+
+type signersCommittee struct {
+	since uint64
+	nodes []common.Node
+}
+
+func (c *signersCache) get(hash crypto.Hash) ([]crypto.Hash, bool) {
+	c.Lock()
+	defer c.Unlock()
+	ids, found := c.signers[hash]
+	return ids, found
+}
+
+func (c *signersCache) set(hash crypto.Hash, ids []crypto.Hash) {
+	c.Lock()
+	defer c.Unlock()
+	if c.signers == nil || len(c.signers) >= config.SnapshotSeenCacheSize {
+		c.signers = make(map[crypto.Hash][]crypto.Hash)
+	}
+	c.signers[hash] = ids
+}
+
+func (c *signersCache) remove(hash crypto.Hash) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.signers, hash)
+}
+
+func (c *signersCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.signers = nil
+}
+
+// the nodes before the first change are known since 0, unless they are the ones loaded at start
+func (c *signersCache) committeeChanged(timestamp uint64, previous, nodes []common.Node) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.committees) == 0 && len(previous) > 0 {
+		c.committees = append(c.committees, signersCommittee{nodes: previous})
+	}
+	c.committees = append(c.committees, signersCommittee{since: timestamp, nodes: nodes})
+}
+
+// the committee at the timestamp, or the first known one and false if the timestamp is before it
+func (c *signersCache) committeeAt(timestamp uint64) ([]common.Node, uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for i := len(c.committees) - 1; i >= 0; i-- {
+		if cm := c.committees[i]; cm.since <= timestamp {
+			return cm.nodes, cm.since, true
+		}
+	}
+	if len(c.committees) == 0 {
+		return nil, 0, false
+	}
+	return c.committees[0].nodes, c.committees[0].since, false
+}
+
+// SnapshotSigners returns the sorted ids of the accepted consensus nodes which signed the
+// finalized snapshot, invalid signatures are excluded. The signatures are checked against the
+// committee at the snapshot timestamp, all committee changes since the node started are kept.
+// The store keeps no committee history, so a snapshot before the nodes loaded at start is
+// checked against them, unless any of them is departing, which may have left after the
+// snapshot, then it fails with CommitteeChangedError instead of a partial list.
+func (node *Node) SnapshotSigners(payloadHash crypto.Hash) ([]crypto.Hash, error) {
+	if ids, found := node.signers.get(payloadHash); found {
+		return ids, nil
+	}
+	s, err := node.store.SnapshotsReadSnapshotByPayloadHash(payloadHash)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, &SnapshotNotFoundError{Hash: payloadHash}
+	}
+
+	nodes, since, known := node.signers.committeeAt(s.Timestamp)
+	if nodes == nil {
+		nodes = node.ConsensusNodes
+	}
+	for _, cn := range nodes {
+		if !known && cn.State == common.NodeStateDeparting {
+			return nil, &CommitteeChangedError{Hash: payloadHash, Timestamp: s.Timestamp, Changed: since}
+		}
+	}
+	ids := make([]crypto.Hash, 0)
+	for id := range node.committeeSigners(&s.Snapshot, nodes) {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	node.signers.set(payloadHash, ids)
+	return ids, nil
+}
+
+// the valid signers of the snapshot in the committee, verified without the caches of the current nodes
+func (node *Node) committeeSigners(s *common.Snapshot, nodes []common.Node) map[crypto.Hash]bool {
+	signers := make(map[crypto.Hash]bool)
+	verifier, enabled := snapshotVerifier(s)
+	if !enabled {
+		return signers
+	}
+	msg := s.Payload()
+	for _, sig := range s.Signatures {
+		for _, cn := range nodes {
+			if cn.IsAccepted() && verifier.Verify(cn.Account.PublicSpendKey, msg, sig) {
+				signers[cn.IdForNetwork(node.networkId)] = true
+				break
+			}
+		}
+	}
+	ids, pubs := committeeAggregationSigners(node.networkId, nodes)
+	if signed, valid := verifyAggregatedSignature(s, ids, pubs); valid {
+		for _, id := range signed {
+			signers[id] = true
+		}
+	}
+	return signers
+}
+
+// VerifyNodeChain verifies the persisted rounds of the node from the genesis to the cache round,
+// each final round hash is recomputed from its snapshots, and must be the self reference of all
+// snapshots in the next round, the first divergence is returned as a RoundChainError.
+func (node *Node) VerifyNodeChain(nodeId crypto.Hash) error {
+	node.stateLock.Lock()
+	cache, final := node.Graph.CacheRound[nodeId], node.Graph.FinalRound[nodeId]
+	if cache == nil || final == nil {
+		node.stateLock.Unlock()
+		return fmt.Errorf("unknown round chain node %s", nodeId.String())
+	}
+	cache, final = cache.Copy(), final.Copy()
+	node.stateLock.Unlock()
+
+	var prev *FinalRound
+	for number := uint64(0); number <= cache.Number; number++ {
+		snapshots, err := node.store.SnapshotsReadSnapshotsForNodeRound(nodeId, number)
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			if s.NodeId != nodeId || s.RoundNumber != number {
+				return &RoundChainError{NodeId: nodeId, Number: number, Reason: fmt.Sprintf("snapshot %s of %s %d", s.PayloadHash(), s.NodeId, s.RoundNumber)}
+			}
+			if prev == nil || s.References[0] == prev.Hash || prev.Number == 0 && s.References[0].IsZero() {
+				continue
+			}
+			return &RoundChainError{NodeId: nodeId, Number: prev.Number, Reason: fmt.Sprintf("hash %s referenced as %s by %s", prev.Hash, s.References[0], s.PayloadHash())}
+		}
+		if number == cache.Number && number > final.Number {
+			break
+		}
+
+		round, err := loadFinalRoundForNode(node.store, nodeId, number)
+		if e, ok := err.(*EmptyFinalRoundError); ok && e.Number == 0 {
+			round, err = &FinalRound{NodeId: nodeId, Hash: roundHash(nodeId, 0, nil)}, nil
+		}
+		switch err.(type) {
+		case nil:
+		case *EmptyFinalRoundError, *RoundInconsistentError:
+			return &RoundChainError{NodeId: nodeId, Number: number, Reason: err.Error()}
+		default:
+			return err
+		}
+		if prev != nil && round.Start < prev.End {
+			return &RoundChainError{NodeId: nodeId, Number: number, Reason: fmt.Sprintf("start %d before %d", round.Start, prev.End)}
+		}
+		prev = round
+	}
+	if prev.Number != final.Number || prev.Hash != final.Hash {
+		return &RoundChainError{NodeId: nodeId, Number: final.Number, Reason: fmt.Sprintf("final %d %s recomputed as %d %s", final.Number, final.Hash, prev.Number, prev.Hash)}
+	}
+	return nil
+}
+
+// VerifyGraphConsistency checks the loaded graph of every node, the final round must be just
+// before the cache round, or both are the genesis round, and the final round hash must match
+// the one recomputed from the persisted snapshots, all inconsistent nodes are reported.
+func (node *Node) VerifyGraphConsistency() []error {
+	node.stateLock.Lock()
+	nodes := append([]crypto.Hash{}, node.Graph.Nodes...)
+	caches, finals := make(map[crypto.Hash]*CacheRound), make(map[crypto.Hash]*FinalRound)
+	for _, id := range nodes {
+		if cache := node.Graph.CacheRound[id]; cache != nil {
+			caches[id] = cache.Copy()
+		}
+		if final := node.Graph.FinalRound[id]; final != nil {
+			finals[id] = final.Copy()
+		}
+	}
+	node.stateLock.Unlock()
+
+	var errs []error
+	for _, id := range nodes {
+		cache, final := caches[id], finals[id]
+		if cache == nil || final == nil {
+			errs = append(errs, &GraphInconsistentError{NodeId: id, Reason: "round missing"})
+			continue
+		}
+		if cache.Number != final.Number+1 && (cache.Number != 0 || final.Number != 0) {
+			errs = append(errs, &GraphInconsistentError{NodeId: id, Reason: fmt.Sprintf("cache %d final %d", cache.Number, final.Number)})
+			continue
+		}
+		round, err := loadFinalRoundForNode(node.store, id, final.Number)
+		if err != nil {
+			errs = append(errs, &GraphInconsistentError{NodeId: id, Reason: err.Error()})
+			continue
+		}
+		if round.Hash != final.Hash {
+			errs = append(errs, &GraphInconsistentError{NodeId: id, Reason: fmt.Sprintf("final %d %s recomputed as %s", final.Number, final.Hash, round.Hash)})
+		}
+	}
+	return errs
+}
+
+// the node refuses to start with an inconsistent graph in strict startup mode,
+// otherwise the inconsistencies are only logged and left for the peers to repair
+func (node *Node) checkGraphConsistency() error {
+	if !config.StrictStartup {
+		return nil
+	}
+	errs := node.VerifyGraphConsistency()
+	for _, err := range errs {
+		node.Logger.Error("GRAPH INCONSISTENT", err)
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// RoundLink is the highest round of the node to referenced by any snapshot of the node from,
+// i.e. the lower bound of the next reference, it's 0 when no snapshot links them yet
+func (node *Node) RoundLink(from, to crypto.Hash) (uint64, error) {
+	return node.store.SnapshotsReadRoundLink(from, to)
+}
+
+// RoundLinksFor reads the links from the node to all nodes in the graph, itself included
+func (node *Node) RoundLinksFor(nodeId crypto.Hash) (map[crypto.Hash]uint64, error) {
+	node.Graph.RLock()
+	nodes := append([]crypto.Hash{}, node.Graph.Nodes...)
+	node.Graph.RUnlock()
+
+	links := make(map[crypto.Hash]uint64)
+	for _, id := range nodes {
+		link, err := node.store.SnapshotsReadRoundLink(nodeId, id)
+		if err != nil {
+			return nil, err
+		}
+		links[id] = link
+	}
+	return links, nil
+}
+
+type RoundChainError struct {
+	NodeId crypto.Hash
+	Number uint64
+	Reason string
+}
+
+func (e *RoundChainError) Error() string {
+	return fmt.Sprintf("round chain divergence %s %d %s", e.NodeId.String(), e.Number, e.Reason)
+}
+
+type GraphInconsistentError struct {
+	NodeId crypto.Hash
+	Reason string
+}
+
+func (e *GraphInconsistentError) Error() string {
+	return fmt.Sprintf("graph inconsistent %s %s", e.NodeId.String(), e.Reason)
+}
+
+type SnapshotNotFoundError struct {
+	Hash crypto.Hash
+}
+
+func (e *SnapshotNotFoundError) Error() string {
+	return fmt.Sprintf("snapshot not found %s", e.Hash.String())
+}
+
+type CommitteeChangedError struct {
+	Hash      crypto.Hash
+	Timestamp uint64
+	Changed   uint64
+}
+
+func (e *CommitteeChangedError) Error() string {
+	return fmt.Sprintf("committee changed after snapshot %s %d %d", e.Hash.String(), e.Timestamp, e.Changed)
+}
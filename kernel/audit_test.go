@@ -0,0 +1,259 @@
+package kernel
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type auditTestStore struct {
+	*storage.MemoryStore
+	reads int
+}
+
+func (s *auditTestStore) SnapshotsReadSnapshotByPayloadHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	s.reads++
+	return s.MemoryStore.SnapshotsReadSnapshotByPayloadHash(hash)
+}
+
+func TestSnapshotSigners(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	store := &auditTestStore{MemoryStore: storage.NewMemoryStore()}
+	node.store = store
+
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.Inputs = append(tx.Inputs, &common.Input{Genesis: node.networkId[:]})
+	s := &common.SnapshotWithTopologicalOrder{
+		Snapshot: common.Snapshot{
+			NodeId:      accounts[1].Hash().ForNetwork(node.networkId),
+			Transaction: &common.SignedTransaction{Transaction: *tx},
+			Timestamp:   1000,
+		},
+	}
+	s.Sign(accounts[1].PrivateSpendKey)
+	s.Sign(accounts[4].PrivateSpendKey)
+	s.Sign(accounts[2].PrivateSpendKey)
+	s.Signatures = append(s.Signatures, crypto.Signature{1, 2, 3})
+	seed := crypto.NewHash([]byte("stray"))
+	stray := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Sign(stray.PrivateSpendKey)
+	assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{s}))
+
+	expected := []crypto.Hash{
+		accounts[1].Hash().ForNetwork(node.networkId),
+		accounts[2].Hash().ForNetwork(node.networkId),
+		accounts[4].Hash().ForNetwork(node.networkId),
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return bytes.Compare(expected[i][:], expected[j][:]) < 0
+	})
+	signers, err := node.SnapshotSigners(s.PayloadHash())
+	assert.Nil(err)
+	assert.Equal(expected, signers)
+	signers, err = node.SnapshotSigners(s.PayloadHash())
+	assert.Nil(err)
+	assert.Equal(expected, signers)
+	assert.Equal(1, store.reads)
+
+	// the removed signers still signed the snapshot before the change
+	node.Clock = &testClock{now: 2000}
+	node.updateConsensusNodes(node.ConsensusNodes[:3])
+	signers, err = node.SnapshotSigners(s.PayloadHash())
+	assert.Nil(err)
+	assert.Equal(expected, signers)
+	assert.Equal(2, store.reads)
+
+	later := &common.SnapshotWithTopologicalOrder{
+		Snapshot: common.Snapshot{
+			NodeId:      accounts[1].Hash().ForNetwork(node.networkId),
+			Transaction: &common.SignedTransaction{Transaction: *tx},
+			Timestamp:   2000,
+		},
+		TopologicalOrder: 1,
+	}
+	later.Transaction.Extra = []byte("later")
+	later.Sign(accounts[1].PrivateSpendKey)
+	later.Sign(accounts[4].PrivateSpendKey)
+	assert.Nil(store.SnapshotsWriteSnapshot(later))
+	signers, err = node.SnapshotSigners(later.PayloadHash())
+	assert.Nil(err)
+	assert.Equal([]crypto.Hash{accounts[1].Hash().ForNetwork(node.networkId)}, signers)
+
+	// a departing node loaded at start may have signed the snapshots before
+	started, _ := testConsensusNode(1)
+	started.store, started.ConsensusNodes = store, nil
+	started.Clock = &testClock{now: 3000}
+	nodes := append([]common.Node{}, node.ConsensusNodes...)
+	nodes = append(nodes, common.Node{Account: accounts[4], State: common.NodeStateDeparting})
+	started.updateConsensusNodes(nodes)
+	_, err = started.SnapshotSigners(later.PayloadHash())
+	assert.IsType(&CommitteeChangedError{}, err)
+	assert.Equal(uint64(3000), err.(*CommitteeChangedError).Changed)
+	signers, err = node.SnapshotSigners(later.PayloadHash())
+	assert.Nil(err)
+	assert.Equal([]crypto.Hash{accounts[1].Hash().ForNetwork(node.networkId)}, signers)
+
+	unknown := crypto.NewHash([]byte("unknown"))
+	_, err = node.SnapshotSigners(unknown)
+	assert.IsType(&SnapshotNotFoundError{}, err)
+}
+
+func TestVerifyNodeChain(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(1)
+	id := crypto.NewHash([]byte("node"))
+	store := &roundTestStore{snapshots: make(map[uint64][]*common.Snapshot)}
+	node.store = store
+
+	hash := roundHash(id, 0, nil)
+	var final *FinalRound
+	for number := uint64(1); number <= 4; number++ {
+		for i := 0; i < 2; i++ {
+			s := &common.Snapshot{NodeId: id, RoundNumber: number, Timestamp: number*100 + uint64(i), Transaction: &common.SignedTransaction{}}
+			s.Transaction.Extra = []byte{byte(number), byte(i)}
+			s.References = [2]crypto.Hash{hash, crypto.NewHash([]byte("peer"))}
+			store.snapshots[number] = append(store.snapshots[number], s)
+		}
+		if number < 4 {
+			final = &FinalRound{NodeId: id, Number: number, Start: number * 100, End: number*100 + 1}
+			final.Hash = roundHash(id, number, store.snapshots[number])
+			hash = final.Hash
+		}
+	}
+	node.Graph = &RoundGraph{
+		Nodes:      []crypto.Hash{id},
+		CacheRound: map[crypto.Hash]*CacheRound{id: {NodeId: id, Number: 4, Start: 400}},
+		FinalRound: map[crypto.Hash]*FinalRound{id: final},
+	}
+	assert.Nil(node.VerifyNodeChain(id))
+	assert.NotNil(node.VerifyNodeChain(crypto.NewHash([]byte("unknown"))))
+
+	corrupted := store.snapshots[2][1]
+	corrupted.Transaction.Extra = []byte("corrupted")
+	err := node.VerifyNodeChain(id)
+	assert.IsType(&RoundChainError{}, err)
+	assert.Equal(uint64(2), err.(*RoundChainError).Number)
+	corrupted.Transaction.Extra = []byte{2, 1}
+	assert.Nil(node.VerifyNodeChain(id))
+
+	store.snapshots[3][0].Transaction.Extra = []byte("corrupted")
+	err = node.VerifyNodeChain(id)
+	assert.IsType(&RoundChainError{}, err)
+	assert.Equal(uint64(3), err.(*RoundChainError).Number)
+	store.snapshots[3][0].Transaction.Extra = []byte{3, 0}
+
+	store.snapshots[2][0].RoundNumber = 3
+	err = node.VerifyNodeChain(id)
+	assert.IsType(&RoundChainError{}, err)
+	assert.Equal(uint64(2), err.(*RoundChainError).Number)
+	store.snapshots[2][0].RoundNumber = 2
+
+	gap := store.snapshots[1]
+	delete(store.snapshots, 1)
+	err = node.VerifyNodeChain(id)
+	assert.IsType(&RoundChainError{}, err)
+	assert.Equal(uint64(1), err.(*RoundChainError).Number)
+	store.snapshots[1] = gap
+	assert.Nil(node.VerifyNodeChain(id))
+}
+
+func TestVerifyGraphConsistency(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(1)
+	id := crypto.NewHash([]byte("node"))
+	store := &roundTestStore{snapshots: make(map[uint64][]*common.Snapshot), meta: [2]uint64{4, 400}}
+	node.store = store
+	for number := uint64(1); number <= 4; number++ {
+		s := &common.Snapshot{NodeId: id, RoundNumber: number, Timestamp: number * 100, Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(number)}
+		store.snapshots[number] = []*common.Snapshot{s}
+	}
+
+	graph, err := LoadRoundGraph(store)
+	assert.Nil(err)
+	node.Graph = graph
+	assert.Len(node.VerifyGraphConsistency(), 0)
+	assert.Nil(node.checkGraphConsistency())
+
+	gap := store.snapshots[3]
+	delete(store.snapshots, 3)
+	_, err = LoadRoundGraph(store)
+	assert.IsType(&EmptyFinalRoundError{}, err)
+	store.snapshots[3] = gap
+
+	// a final round behind the cache round
+	stale, err := loadFinalRoundForNode(store, id, 2)
+	assert.Nil(err)
+	node.Graph.FinalRound[id] = stale
+	errs := node.VerifyGraphConsistency()
+	assert.Len(errs, 1)
+	assert.IsType(&GraphInconsistentError{}, errs[0])
+	assert.Equal(id, errs[0].(*GraphInconsistentError).NodeId)
+	assert.Nil(node.checkGraphConsistency())
+	strict := config.StrictStartup
+	config.StrictStartup = true
+	defer func() { config.StrictStartup = strict }()
+	assert.NotNil(node.checkGraphConsistency())
+
+	graph, err = LoadRoundGraph(store)
+	assert.Nil(err)
+	node.Graph = graph
+	assert.Nil(node.checkGraphConsistency())
+	store.snapshots[3][0].Transaction.Extra = []byte("corrupted")
+	errs = node.VerifyGraphConsistency()
+	assert.Len(errs, 1)
+	assert.Contains(errs[0].Error(), "recomputed")
+	assert.NotNil(node.checkGraphConsistency())
+	store.snapshots[3][0].Transaction.Extra = []byte{3}
+
+	other := crypto.NewHash([]byte("other"))
+	node.Graph.Nodes = append(node.Graph.Nodes, other)
+	node.Graph.CacheRound[other] = &CacheRound{NodeId: other, Number: 5}
+	errs = node.VerifyGraphConsistency()
+	assert.Len(errs, 1)
+	assert.Equal(other, errs[0].(*GraphInconsistentError).NodeId)
+	node.Graph.FinalRound[other] = &FinalRound{NodeId: other, Number: 3}
+	errs = node.VerifyGraphConsistency()
+	assert.Len(errs, 1)
+	assert.Contains(errs[0].Error(), "cache 5 final 3")
+}
+
+func TestRoundLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(3)
+	node.Graph = testRoundGraph(node)
+	store := &pairLinkTestStore{links: make(map[[2]crypto.Hash]uint64)}
+	node.store = store
+
+	self := accounts[0].Hash().ForNetwork(node.networkId)
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	other := accounts[2].Hash().ForNetwork(node.networkId)
+	store.links[[2]crypto.Hash{self, self}] = 5
+	store.links[[2]crypto.Hash{self, peer}] = 3
+	store.links[[2]crypto.Hash{peer, other}] = 7
+
+	link, err := node.RoundLink(self, peer)
+	assert.Nil(err)
+	assert.Equal(uint64(3), link)
+	link, err = node.RoundLink(peer, self)
+	assert.Nil(err)
+	assert.Equal(uint64(0), link)
+
+	links, err := node.RoundLinksFor(self)
+	assert.Nil(err)
+	assert.Equal(map[crypto.Hash]uint64{self: 5, peer: 3, other: 0}, links)
+	links, err = node.RoundLinksFor(crypto.NewHash([]byte("unknown")))
+	assert.Nil(err)
+	assert.Equal(map[crypto.Hash]uint64{self: 0, peer: 0, other: 0}, links)
+}
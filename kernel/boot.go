@@ -7,14 +7,15 @@ import (
 
 var globalNode *Node
 
-func Loop(store storage.Store, addr string, dir string) error {
-	node, err := SetupNode(store, addr, dir)
+func Loop(store storage.Store, addr string, dir string, level int) error {
+	node, err := SetupNode(store, addr, dir, level)
 	if err != nil {
 		return err
 	}
 	globalNode = node
 	panicGo(node.ListenNeighbors)
 	panicGo(node.ConsumeMempool)
+	go node.closeOnSignal()
 	return node.ConsumeQueue()
 }
 
@@ -39,6 +40,18 @@ func TopologicalOrder() uint64 {
 	return globalNode.TopoCounter.seq
 }
 
+func ConsensusInfo() map[string]int {
+	if globalNode == nil {
+		return map[string]int{}
+	}
+	total, accepted, threshold := globalNode.ConsensusInfo()
+	return map[string]int{
+		"total":     total,
+		"accepted":  accepted,
+		"threshold": threshold,
+	}
+}
+
 func ConsensusNodes() []map[string]interface{} {
 	nodes := make([]map[string]interface{}, 0)
 	if globalNode == nil {
@@ -46,7 +59,7 @@ func ConsensusNodes() []map[string]interface{} {
 	}
 	for _, n := range globalNode.ConsensusNodes {
 		nodes = append(nodes, map[string]interface{}{
-			"node":    n.Account.Hash().ForNetwork(globalNode.networkId),
+			"node":    n.IdForNetwork(globalNode.networkId),
 			"account": n.Account.String(),
 			"state":   n.State,
 		})
@@ -0,0 +1,105 @@
+package kernel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+type Clock interface {
+	Now() uint64
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// the node clock as a time, the consensus throttles and timeouts never read the wall clock,
+// so they follow a mocked clock the same as the snapshot timestamps
+func (node *Node) clockTime() time.Time {
+	return time.Unix(0, int64(node.Clock.Now()))
+}
+
+type ClockSkewError struct {
+	Timestamp uint64
+	Observed  uint64
+	Threshold uint64
+}
+
+func (e *ClockSkewError) Error() string {
+	return fmt.Sprintf("clock skew %d %d %d", e.Timestamp, e.Observed, e.Threshold)
+}
+
+// the latest finalized peer snapshot timestamp, and the local clock when it's finalized
+type clockObservation struct {
+	timestamp uint64
+	local     uint64
+}
+
+func (node *Node) observeTimestamp(timestamp uint64) {
+	if timestamp <= node.observed.timestamp {
+		return
+	}
+	node.observed = clockObservation{timestamp: timestamp, local: node.Clock.Now()}
+}
+
+// the observed peer timestamp moves forward with the local clock, so an idle network
+// doesn't stop the signing, and a timestamp ahead of it more than the threshold means
+// the local clock is skewed and peers will reject the snapshots
+func (node *Node) checkClockSkew(timestamp uint64) error {
+	o := node.observed
+	if o.timestamp == 0 || timestamp < o.local {
+		return nil
+	}
+	observed := o.timestamp + timestamp - o.local
+	if timestamp <= observed+config.SnapshotClockSkewThreshold {
+		return nil
+	}
+	return &ClockSkewError{Timestamp: timestamp, Observed: observed, Threshold: config.SnapshotClockSkewThreshold}
+}
+
+// the node clock may be not the wall clock, so the signed timestamp is bounded by the wall
+// clock too. Before any peer timestamp observed, e.g. just restarted, the max timestamp in
+// the graph is the only network time known, which is old when the network has been idle,
+// so only an absurd timestamp ahead of it is refused.
+func (node *Node) checkSignTimestamp(timestamp uint64) error {
+	wall := uint64(time.Now().UnixNano())
+	if timestamp > wall+config.SnapshotTimestampTolerance {
+		return &ClockSkewError{Timestamp: timestamp, Observed: wall, Threshold: config.SnapshotTimestampTolerance}
+	}
+	if node.observed.timestamp != 0 {
+		return node.checkClockSkew(timestamp)
+	}
+	max := node.Graph.MaxTimestamp(node.IdForNetwork)
+	if max > 0 && timestamp > max+config.SnapshotTimestampMaxAhead {
+		return &ClockSkewError{Timestamp: timestamp, Observed: max, Threshold: config.SnapshotTimestampMaxAhead}
+	}
+	return nil
+}
+
+// ObservedTimestamp is the latest finalized peer snapshot timestamp and the local clock when it's
+// finalized, the clock skew guard moves the timestamp forward with the local clock since then.
+// Both are 0 before any peer snapshot finalized, then the guard compares against the max cache
+// round end of all other nodes in the graph.
+func (node *Node) ObservedTimestamp() (uint64, uint64) {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+	return node.observed.timestamp, node.observed.local
+}
+
+func (g *RoundGraph) MaxTimestamp(exclude crypto.Hash) uint64 {
+	g.RLock()
+	defer g.RUnlock()
+
+	var max uint64
+	for id, c := range g.CacheRound {
+		if id != exclude && c.End > max {
+			max = c.End
+		}
+	}
+	return max
+}
@@ -0,0 +1,74 @@
+package kernel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+)
+
+const closeTimeout = 10 * time.Second
+
+var errNodeClosed = errors.New("node closed")
+
+// Close stops accepting new snapshots, waits the mempool lanes to finish the snapshots in
+// handling, then flushes the snapshots pool. The finalized snapshots are always written before
+// the graph updated, so the persisted state is consistent once the consumer stops. The snapshots
+// left in the mempool are dropped, and will be sent again by peers or the queue.
+func (node *Node) Close(ctx context.Context) error {
+	node.closeOnce.Do(func() {
+		close(node.closing)
+	})
+	select {
+	case <-node.closed:
+		return node.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (node *Node) isClosing() bool {
+	select {
+	case <-node.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// never blocks after closing, because the mempool consumer may have stopped
+func (node *Node) queueSnapshot(s *common.Snapshot) {
+	select {
+	case node.mempoolChan <- s:
+	case <-node.closing:
+	}
+}
+
+// called by the mempool consumer when closing, after all lanes stopped, the pool is still
+// changed by the nodes updates and the timers, so it's flushed with the state lock held
+func (node *Node) shutdown() {
+	node.stateLock.Lock()
+	node.closeErr = node.FlushSnapshotsPool()
+	node.stateLock.Unlock()
+	if node.closeErr != nil {
+		node.Logger.Error("CLOSE FLUSH SNAPSHOTS POOL ERROR", node.closeErr)
+	}
+	close(node.closed)
+}
+
+func (node *Node) closeOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err := node.Close(ctx)
+	if err != nil {
+		node.Logger.Error("CLOSE NODE ERROR", err)
+	}
+}
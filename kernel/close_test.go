@@ -0,0 +1,90 @@
+package kernel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/network"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func testClosableNode(store storage.Store) *Node {
+	node, _ := testConsensusNode(4)
+	node.store = store
+	node.Graph = testRoundGraph(node)
+	node.TopoCounter = getTopologyCounter(store)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.persistedPool = make(map[crypto.Hash]int)
+	node.mempoolChan = make(chan *common.Snapshot, 16)
+	node.closing = make(chan struct{})
+	node.closed = make(chan struct{})
+	return node
+}
+
+func TestNodeClose(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStore()
+	node := testClosableNode(store)
+	var snapshots []*common.SnapshotWithTopologicalOrder
+	for i := 0; i < 3; i++ {
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: node.networkId[:]})
+		tx.Extra = []byte{byte(i)}
+		snapshots = append(snapshots, &common.SnapshotWithTopologicalOrder{
+			Snapshot: common.Snapshot{
+				NodeId:      node.IdForNetwork,
+				Transaction: &common.SignedTransaction{Transaction: *tx},
+				Timestamp:   uint64(1000 + i),
+			},
+			TopologicalOrder: node.TopoCounter.Next(),
+		})
+	}
+	assert.Nil(store.SnapshotsLoadGenesis(snapshots))
+	pending := crypto.NewHash([]byte("pending"))
+	node.SnapshotsPool[pending] = []crypto.Signature{{1}, {2}}
+
+	done := make(chan error)
+	go func() {
+		done <- node.ConsumeMempool()
+	}()
+	peer := network.NewPeer(node, node.IdForNetwork, "")
+	for i := 0; i < 8; i++ {
+		s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+		assert.Nil(node.FeedMempool(peer, s))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(node.Close(ctx))
+	assert.Nil(<-done)
+	assert.Equal(errNodeClosed, node.FeedMempool(peer, &common.Snapshot{}))
+	assert.Nil(node.Close(ctx))
+
+	reopened := testClosableNode(store)
+	assert.Nil(reopened.LoadSnapshotsPool())
+	assert.Equal([]crypto.Signature{{1}, {2}}, reopened.SnapshotsPool[pending])
+	seen := make(map[uint64]bool)
+	all, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+	assert.Nil(err)
+	for _, s := range all {
+		seen[s.TopologicalOrder] = true
+	}
+	next := reopened.TopoCounter.Next()
+	assert.False(seen[next])
+	assert.Equal(uint64(len(all)), next)
+}
+
+func TestNodeCloseTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	node := testClosableNode(storage.NewMemoryStore())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, node.Close(ctx))
+	assert.True(node.isClosing())
+}
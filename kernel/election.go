@@ -1,5 +1,12 @@
 package kernel
 
+import (
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
 func (node *Node) handlePledgeTransactionConfirmation() error {
 	return node.manageConsensusNodesList()
 }
@@ -8,7 +15,136 @@ func (node *Node) handleRelcaimTransactionConfirmation() error {
 	return node.manageConsensusNodesList()
 }
 
+// ConsensusChange is a change of the accepted consensus nodes, the threshold is of the new nodes,
+// i.e. a snapshot is finalized by more than threshold signers when all nodes have the same weight
+type ConsensusChange struct {
+	Added     []common.Node
+	Removed   []common.Node
+	Accepted  int
+	Threshold int
+}
+
 // consensus nodes may be updated, not same as peers
 func (node *Node) manageConsensusNodesList() error {
+	node.updateConsensusNodes(node.store.SnapshotsReadConsensusNodes())
+	return nil
+}
+
+// the change is sent after the nodes list replaced, so the callback sees the same nodes and threshold
+func (node *Node) updateConsensusNodes(nodes []common.Node) *ConsensusChange {
+	previous := make(map[crypto.Hash]bool)
+	for _, cn := range node.ConsensusNodes {
+		if cn.IsAccepted() {
+			previous[cn.IdForNetwork(node.networkId)] = true
+		}
+	}
+
+	change := &ConsensusChange{}
+	accepted := make(map[crypto.Hash]bool)
+	for _, cn := range nodes {
+		if !cn.IsAccepted() {
+			continue
+		}
+		id := cn.IdForNetwork(node.networkId)
+		accepted[id] = true
+		change.Accepted++
+		if !previous[id] {
+			change.Added = append(change.Added, cn)
+		}
+	}
+	for _, cn := range node.ConsensusNodes {
+		id := cn.IdForNetwork(node.networkId)
+		if previous[id] && !accepted[id] {
+			change.Removed = append(change.Removed, cn)
+		}
+	}
+
+	if len(previous) == 0 || len(change.Added)+len(change.Removed) > 0 {
+		node.signers.committeeChanged(node.Clock.Now(), node.ConsensusNodes, nodes)
+	}
+	node.ConsensusNodes = nodes
+	node.signers.reset()
+	node.verified.reset()
+	change.Threshold = node.consensusThreshold()
+	if len(change.Added)+len(change.Removed) == 0 || node.OnConsensusChange == nil {
+		return change
+	}
+	node.OnConsensusChange(change)
+	return change
+}
+
+// UpdateConsensusNodes replaces the consensus nodes of a running node, e.g. applying a governance
+// change without restart. No snapshot is handled with a partial nodes list, the throttles of the
+// removed peers are cleared, and the pending snapshots keep only the signatures of the new nodes,
+// the other pooled signatures are checked again when their snapshots come.
+func (node *Node) UpdateConsensusNodes(nodes []common.Node) error {
+	err := node.checkConsensusNodes(nodes)
+	if err != nil {
+		return err
+	}
+
+	node.nodesLock.Lock()
+	defer node.nodesLock.Unlock()
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	change := node.updateConsensusNodes(nodes)
+	for _, cn := range change.Removed {
+		peerId := cn.IdForNetwork(node.networkId)
+		for hash := range node.SnapshotsPool {
+			delete(node.ConsensusCache, consensusCacheKey(hash, peerId))
+		}
+		for hash := range node.pending {
+			delete(node.ConsensusCache, consensusCacheKey(hash, peerId))
+		}
+	}
+	if len(change.Removed) == 0 {
+		return nil
+	}
+	for hash, p := range node.pending {
+		sigs := node.SnapshotsPool[hash]
+		if len(sigs) == 0 {
+			continue
+		}
+		s := p.snapshot
+		s.Signatures, s.Signers = append([]crypto.Signature{}, sigs...), nil
+		node.clearConsensusSignatures(s)
+		if len(s.Signatures) == 0 {
+			delete(node.SnapshotsPool, hash)
+			continue
+		}
+		node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	}
+	return nil
+}
+
+func (node *Node) checkConsensusNodes(nodes []common.Node) error {
+	filter := make(map[crypto.Hash]bool)
+	var accepted int
+	for _, cn := range nodes {
+		id := cn.IdForNetwork(node.networkId)
+		if filter[id] {
+			return fmt.Errorf("duplicated consensus node %s", id.String())
+		}
+		filter[id] = true
+		if cn.IsAccepted() {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return fmt.Errorf("no accepted consensus nodes %d", len(nodes))
+	}
+	return nil
+}
+
+// finalization requires more than numerator/denominator signatures,
+// anything below a simple majority could finalize conflict snapshots
+func checkConsensusThreshold(numerator, denominator int) error {
+	if numerator <= 0 || denominator <= 0 || numerator >= denominator {
+		return fmt.Errorf("invalid consensus threshold %d/%d", numerator, denominator)
+	}
+	if numerator*2 < denominator {
+		return fmt.Errorf("unsafe consensus threshold %d/%d below majority", numerator, denominator)
+	}
 	return nil
 }
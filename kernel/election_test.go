@@ -0,0 +1,184 @@
+package kernel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsensusChange(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	var changes []*ConsensusChange
+	node.OnConsensusChange = func(c *ConsensusChange) {
+		assert.Equal(c.Threshold, node.consensusThreshold())
+		changes = append(changes, c)
+	}
+
+	nodes := append([]common.Node{}, node.ConsensusNodes...)
+	node.updateConsensusNodes(nodes)
+	assert.Len(changes, 0)
+
+	nodes = append([]common.Node{}, node.ConsensusNodes[:6]...)
+	nodes[2].State = common.NodeStatePledging
+	seed := accounts[0].Hash()
+	joined := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	nodes = append(nodes, common.Node{Account: joined, State: common.NodeStateAccepted})
+	node.updateConsensusNodes(nodes)
+	assert.Len(changes, 1)
+	c := changes[0]
+	assert.Len(c.Added, 1)
+	assert.Equal(joined.String(), c.Added[0].Account.String())
+	assert.Len(c.Removed, 2)
+	assert.Equal(accounts[2].String(), c.Removed[0].Account.String())
+	assert.Equal(accounts[6].String(), c.Removed[1].Account.String())
+	assert.Equal(6, c.Accepted)
+	assert.Equal(7*2/3, c.Threshold)
+
+	node.updateConsensusNodes(nodes[:3])
+	assert.Len(changes, 2)
+	c = changes[1]
+	assert.Len(c.Added, 0)
+	assert.Len(c.Removed, 4)
+	assert.Equal(joined.String(), c.Removed[3].Account.String())
+	assert.Equal(2, c.Accepted)
+	assert.Equal(3*2/3, c.Threshold)
+
+	node.OnConsensusChange = nil
+	node.updateConsensusNodes(node.ConsensusNodes[:1])
+	assert.Len(node.ConsensusNodes, 1)
+}
+
+func TestUpdateConsensusNodes(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.ConsensusCache = make(map[crypto.Hash]time.Time)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: 100}
+	for _, i := range []int{0, 1, 2, 6} {
+		s.Sign(accounts[i].PrivateSpendKey)
+	}
+	node.clearConsensusSignatures(s)
+	assert.False(node.verifyFinalization(s))
+	hash := s.PayloadHash()
+	node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	node.trackPendingSnapshot(s, time.Now())
+	removed := accounts[6].Hash().ForNetwork(node.networkId)
+	kept := accounts[5].Hash().ForNetwork(node.networkId)
+	node.ConsensusCache[consensusCacheKey(hash, removed)] = time.Now()
+	node.ConsensusCache[consensusCacheKey(hash, kept)] = time.Now()
+
+	assert.NotNil(node.UpdateConsensusNodes(append(node.ConsensusNodes, node.ConsensusNodes[0])))
+	assert.NotNil(node.UpdateConsensusNodes(nil))
+	assert.Len(node.ConsensusNodes, 7)
+
+	assert.Nil(node.UpdateConsensusNodes(node.ConsensusNodes[:6]))
+	assert.Equal(6*2/3, node.consensusThreshold())
+	assert.Len(node.SnapshotsPool[hash], 3)
+	_, found := node.ConsensusCache[consensusCacheKey(hash, removed)]
+	assert.False(found)
+	_, found = node.ConsensusCache[consensusCacheKey(hash, kept)]
+	assert.True(found)
+
+	// the signature of the removed node never counts, even it comes again
+	incoming := &common.Snapshot{NodeId: s.NodeId, Transaction: s.Transaction, Timestamp: s.Timestamp}
+	incoming.Sign(accounts[3].PrivateSpendKey)
+	incoming.Sign(accounts[6].PrivateSpendKey)
+	incoming.Signatures = append(incoming.Signatures, node.SnapshotsPool[hash]...)
+	assert.False(node.verifyFinalization(incoming))
+	node.clearConsensusSignatures(incoming)
+	assert.Len(incoming.Signatures, 4)
+
+	incoming.Sign(accounts[4].PrivateSpendKey)
+	assert.True(node.verifyFinalization(incoming))
+	assert.Len(incoming.Signatures, 5)
+}
+
+func TestUpdateConsensusNodesMidRound(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts, store := testReplayNode(assert)
+	peer, other := accounts[1].Hash().ForNetwork(node.networkId), accounts[2].Hash().ForNetwork(node.networkId)
+	finalize := func(output int, number, timestamp uint64, reference crypto.Hash, signers int) *common.Snapshot {
+		signed := testNetworkTransaction(assert, store, node, accounts, output)
+		s := &common.Snapshot{NodeId: peer, Transaction: signed, RoundNumber: number, Timestamp: timestamp}
+		s.References = [2]crypto.Hash{reference, node.Graph.FinalRound[other].Hash}
+		for i := 1; i <= signers; i++ {
+			s.Sign(accounts[i].PrivateSpendKey)
+			fed := *s
+			fed.Signatures = append([]crypto.Signature{}, s.Signatures...)
+			assert.Nil(node.handleSnapshotInput(&fed))
+		}
+		ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+		assert.Nil(err)
+		assert.NotNil(ss)
+		return s
+	}
+
+	timestamp := replayGenesis + node.roundGap + uint64(time.Millisecond)
+	cache, final, err := node.Graph.CacheRound[peer].TryAdvance(timestamp, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+	assert.Nil(err)
+	if final == nil {
+		final = node.Graph.FinalRound[peer]
+	}
+	s := finalize(0, cache.Number, timestamp, final.Hash, 2)
+	round := node.Graph.CacheRound[peer].Copy()
+	assert.Len(round.Snapshots, 1)
+
+	// the joined node raises the threshold, the written snapshot has too few signatures now
+	seed := accounts[0].Hash()
+	joined := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	assert.Nil(node.UpdateConsensusNodes(append(node.ConsensusNodes, common.Node{Account: joined, State: common.NodeStateAccepted})))
+	assert.False(node.verifyFinalization(s))
+	assert.True(node.verifyCacheFinalization(s))
+
+	// the next round snapshot still advances the round with the snapshot written before
+	finalize(1, round.Number+1, round.Start+node.roundGap, round.FinalHash(), 3)
+	assert.Equal(round.Number, node.Graph.FinalRound[peer].Number)
+	assert.Equal(round.FinalHash(), node.Graph.FinalRound[peer].Hash)
+	assert.Equal(round.Number+1, node.Graph.CacheRound[peer].Number)
+	assert.Len(node.Graph.CacheRound[peer].Snapshots, 1)
+}
+
+func TestUpdateConsensusNodesFeedRace(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.ConsensusCache = make(map[crypto.Hash]time.Time)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	node.GossipPeers = make(map[crypto.Hash]bool)
+	node.gossipFilter = newGossipFilter()
+	node.limiter = newPeerLimiter()
+	node.mempoolChan = make(chan *common.Snapshot, MempoolSize)
+	node.closing = make(chan struct{})
+	peer := network.NewPeer(nil, accounts[1].Hash().ForNetwork(node.networkId), "")
+	nodes := append([]common.Node{}, node.ConsensusNodes...)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			assert.Nil(node.UpdateConsensusNodes(nodes[:6+i%2]))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s := &common.Snapshot{NodeId: peer.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: uint64(i)}
+		s.Sign(accounts[1].PrivateSpendKey)
+		assert.Nil(node.FeedMempool(peer, s))
+		_, err := node.Authenticate(node.BuildAuthenticationMessage())
+		assert.Nil(err)
+	}
+	wg.Wait()
+	assert.Len(node.mempoolChan, 100)
+}
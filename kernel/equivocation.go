@@ -0,0 +1,64 @@
+package kernel
+
+import (
+	"encoding/binary"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// a node signing two different payloads with the same round and timestamp
+// is equivocating, both snapshots are kept as the proof for slashing. The
+// snapshot is checked against both the finalized snapshots of the cache round
+// and the pool snapshots not finalized yet.
+func (node *Node) detectEquivocation(s *common.Snapshot) (bool, error) {
+	if !snapshotSignedBy(s, s.NodeId) {
+		return false, nil
+	}
+	cache := node.Graph.CacheRound[s.NodeId]
+	if cache == nil {
+		return false, nil
+	}
+	hash := s.PayloadHash()
+	conflict := node.poolOrder.conflict(s, hash, node.SnapshotsPool)
+	for _, ps := range cache.Snapshots {
+		if conflict != nil {
+			break
+		}
+		if ps.RoundNumber != s.RoundNumber || ps.Timestamp != s.Timestamp {
+			continue
+		}
+		if ps.PayloadHash() != hash {
+			conflict = ps
+		}
+	}
+	if conflict == nil {
+		return false, nil
+	}
+	node.Logger.Warn("EQUIVOCATION DETECTED", s.NodeId, s.RoundNumber, s.Timestamp)
+	err := node.store.SnapshotsWriteEquivocation(conflict, s)
+	if err != nil {
+		return true, err
+	}
+	if node.OnEquivocation != nil {
+		node.OnEquivocation(conflict, s)
+	}
+	return true, nil
+}
+
+// the node, round and timestamp of a snapshot, a node never signs two payloads for it
+func equivocationSlot(s *common.Snapshot) crypto.Hash {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], s.RoundNumber)
+	binary.BigEndian.PutUint64(buf[8:], s.Timestamp)
+	return crypto.NewHash(append(s.NodeId[:], buf...))
+}
+
+func snapshotSignedBy(s *common.Snapshot, id crypto.Hash) bool {
+	for _, signer := range s.Signers {
+		if signer == id {
+			return true
+		}
+	}
+	return false
+}
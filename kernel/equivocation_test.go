@@ -0,0 +1,117 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type equivocationTestStore struct {
+	storage.Store
+	proofs [][2]*common.Snapshot
+}
+
+func (s *equivocationTestStore) SnapshotsWriteEquivocation(a, b *common.Snapshot) error {
+	s.proofs = append(s.proofs, [2]*common.Snapshot{a, b})
+	return nil
+}
+
+func TestDetectEquivocation(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	store := &equivocationTestStore{}
+	node.store = store
+	var reported int
+	node.OnEquivocation = func(a, b *common.Snapshot) {
+		reported++
+	}
+
+	id := accounts[1].Hash().ForNetwork(node.networkId)
+	ps := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: 100, Transaction: &common.SignedTransaction{}}
+	ps.Transaction.Extra = []byte("a")
+	node.Graph.CacheRound[id].Snapshots = []*common.Snapshot{ps}
+
+	s := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: 100, Transaction: &common.SignedTransaction{}}
+	s.Transaction.Extra = []byte("a")
+	s.Sign(accounts[1].PrivateSpendKey)
+	node.clearConsensusSignatures(s)
+	equivocated, err := node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.False(equivocated)
+
+	s.Transaction.Extra = []byte("b")
+	s.Signatures = nil
+	s.Signers = nil
+	s.Sign(accounts[2].PrivateSpendKey)
+	node.clearConsensusSignatures(s)
+	equivocated, err = node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.False(equivocated)
+
+	s.Sign(accounts[1].PrivateSpendKey)
+	node.clearConsensusSignatures(s)
+	equivocated, err = node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.True(equivocated)
+	assert.Equal(1, reported)
+	assert.Len(store.proofs, 1)
+	assert.Equal(ps, store.proofs[0][0])
+	assert.Equal(s, store.proofs[0][1])
+
+	s.Timestamp = 101
+	equivocated, err = node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.False(equivocated)
+}
+
+func TestDetectPoolEquivocation(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	store := &equivocationTestStore{}
+	node.store = store
+
+	id := accounts[1].Hash().ForNetwork(node.networkId)
+	ps := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: 100, Transaction: &common.SignedTransaction{}}
+	ps.Transaction.Extra = []byte("a")
+	ps.Sign(accounts[1].PrivateSpendKey)
+	node.clearConsensusSignatures(ps)
+	node.sign(ps)
+	assert.Len(node.SnapshotsPool[ps.PayloadHash()], 2)
+
+	// the conflict snapshot is never finalized, only the first one in the pool
+	s := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: 100, Transaction: &common.SignedTransaction{}}
+	s.Transaction.Extra = []byte("b")
+	s.Sign(accounts[1].PrivateSpendKey)
+	node.clearConsensusSignatures(s)
+	equivocated, err := node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.True(equivocated)
+	assert.Len(store.proofs, 1)
+	assert.Equal(ps.PayloadHash(), store.proofs[0][0].PayloadHash())
+	assert.Len(store.proofs[0][0].Signatures, 2)
+	assert.Equal(s, store.proofs[0][1])
+
+	equivocated, err = node.detectEquivocation(ps)
+	assert.Nil(err)
+	assert.False(equivocated)
+	s.Timestamp = 101
+	equivocated, err = node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.False(equivocated)
+
+	// the slot is stale once the snapshot leaves the pool, e.g. evicted
+	s.Timestamp = 100
+	delete(node.SnapshotsPool, ps.PayloadHash())
+	equivocated, err = node.detectEquivocation(s)
+	assert.Nil(err)
+	assert.False(equivocated)
+	assert.Len(store.proofs, 1)
+}
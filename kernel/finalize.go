@@ -0,0 +1,32 @@
+package kernel
+
+import (
+	"github.com/MixinNetwork/mixin/common"
+)
+
+// the OnFinalized hook is called synchronously by the snapshots consuming loop right after
+// the snapshot is written, so the snapshots arrive in their topological order, and the loop
+// is blocked until the hook returns. A panicking hook is recovered and logged, the snapshot
+// stays finalized. The hook must not wait on the node itself, and slow consumers should use
+// the FinalizedChannel adapter or SubscribeSnapshots instead.
+func (node *Node) notifyFinalized(s *common.SnapshotWithTopologicalOrder) {
+	node.subscribers.send(node, s)
+	if node.OnFinalized == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			node.Logger.Error("FINALIZED HOOK PANIC", s.TransactionHash(), r)
+		}
+	}()
+	node.OnFinalized(s)
+}
+
+// FinalizedChannel returns a hook and the channel it delivers to in order, the hook only blocks
+// the consuming loop when the channel buffer is full, i.e. the receiver is size snapshots behind
+func FinalizedChannel(size int) (func(*common.SnapshotWithTopologicalOrder), <-chan *common.SnapshotWithTopologicalOrder) {
+	ch := make(chan *common.SnapshotWithTopologicalOrder, size)
+	return func(s *common.SnapshotWithTopologicalOrder) {
+		ch <- s
+	}, ch
+}
@@ -0,0 +1,45 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyFinalized(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	node.notifyFinalized(testFinalizedSnapshot(0))
+
+	hook, ch := FinalizedChannel(8)
+	node.OnFinalized = hook
+	for i := uint64(0); i < 5; i++ {
+		node.notifyFinalized(testFinalizedSnapshot(i))
+	}
+	assert.Len(ch, 5)
+	for i := uint64(0); i < 5; i++ {
+		s := <-ch
+		assert.Equal(i, s.TopologicalOrder)
+	}
+
+	var orders []uint64
+	node.OnFinalized = func(s *common.SnapshotWithTopologicalOrder) {
+		if s.TopologicalOrder == 1 {
+			panic("hook")
+		}
+		orders = append(orders, s.TopologicalOrder)
+	}
+	for i := uint64(0); i < 3; i++ {
+		assert.NotPanics(func() { node.notifyFinalized(testFinalizedSnapshot(i)) })
+	}
+	assert.Equal([]uint64{0, 2}, orders)
+}
+
+func testFinalizedSnapshot(topo uint64) *common.SnapshotWithTopologicalOrder {
+	return &common.SnapshotWithTopologicalOrder{
+		Snapshot:         common.Snapshot{Transaction: &common.SignedTransaction{}},
+		TopologicalOrder: topo,
+	}
+}
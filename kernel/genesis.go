@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/crypto"
 )
 
@@ -15,9 +16,13 @@ const (
 	PledgeAmount     = 10000
 )
 
+// the round gap and limit are hashed into the network id with the whole genesis, so all
+// nodes of a network agree on them, and a node with another gap is in another network
 type Genesis struct {
-	Epoch int64 `json:"epoch"`
-	Nodes []struct {
+	Epoch      int64  `json:"epoch"`
+	RoundGap   uint64 `json:"round_gap,omitempty"`
+	RoundLimit int    `json:"round_limit,omitempty"`
+	Nodes      []struct {
 		Address common.Address `json:"address"`
 		Balance common.Integer `json:"balance"`
 	} `json:"nodes"`
@@ -41,6 +46,10 @@ func (node *Node) LoadGenesis(configDir string) error {
 	}
 	node.networkId = crypto.NewHash(data)
 	node.IdForNetwork = node.Account.Hash().ForNetwork(node.networkId)
+	node.roundGap = gns.roundGap()
+	node.store.SnapshotsSetRoundGap(node.roundGap)
+	node.roundLimit = gns.roundLimit()
+	node.store.SnapshotsSetRoundLimit(node.roundLimit)
 
 	var state struct {
 		Id crypto.Hash
@@ -149,7 +158,7 @@ func (node *Node) LoadGenesis(configDir string) error {
 		snapshots = append(snapshots, topo)
 	}
 
-	err = node.store.SnapshotsLoadGenesis(snapshots)
+	err = node.InitGenesis(snapshots)
 	if err != nil {
 		return err
 	}
@@ -158,6 +167,68 @@ func (node *Node) LoadGenesis(configDir string) error {
 	return node.store.StateSet(stateKeyNetwork, state)
 }
 
+// InitGenesis writes the genesis snapshots of a fresh network, and starts the round graph from
+// them, each genesis node has its snapshots as the final round 0 and an empty cache round 1. The
+// rounds only depend on the snapshots, so all nodes bootstrap the same graph and final hashes, and
+// the graph loaded again from the store after a restart is the same one.
+func (node *Node) InitGenesis(snapshots []*common.SnapshotWithTopologicalOrder) error {
+	if node.Graph != nil && len(node.Graph.Nodes) > 0 {
+		return fmt.Errorf("round graph initialized already %d", len(node.Graph.Nodes))
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("no genesis snapshots")
+	}
+	for _, s := range snapshots {
+		if s.RoundNumber != 0 || s.Timestamp == 0 {
+			return fmt.Errorf("invalid genesis snapshot %s %d %d", s.NodeId, s.RoundNumber, s.Timestamp)
+		}
+	}
+
+	err := node.store.SnapshotsLoadGenesis(snapshots)
+	if err != nil {
+		return err
+	}
+	graph, err := LoadRoundGraph(node.store)
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if graph.FinalRound[s.NodeId] == nil {
+			return fmt.Errorf("genesis node not loaded %s", s.NodeId)
+		}
+	}
+	node.Graph = graph
+	node.trackProgress()
+	return nil
+}
+
+// the genesis snapshots in round 0 are final already, the cache round 1 starts with them, so
+// its snapshots are accepted by the store only after the round gap
+func genesisCacheRound(final *FinalRound) *CacheRound {
+	return &CacheRound{
+		NodeId: final.NodeId,
+		Number: 1,
+		Start:  final.Start,
+		End:    final.Start,
+	}
+}
+
+func (gns *Genesis) roundGap() uint64 {
+	if gns.RoundGap > 0 {
+		return gns.RoundGap
+	}
+	return config.SnapshotRoundGap
+}
+
+// a round has at most the limit snapshots, the next round starts before the gap once
+// the round is full, 0 for no limit
+func (gns *Genesis) roundLimit() int {
+	if gns.RoundLimit > 0 {
+		return gns.RoundLimit
+	}
+	return config.SnapshotRoundLimit
+}
+
 func readGenesis(path string) (*Genesis, error) {
 	f, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -191,6 +262,10 @@ func readGenesis(path string) (*Genesis, error) {
 		}
 	}
 
+	if gns.RoundGap > 0 && gns.RoundGap <= config.SnapshotTimestampMaxWait {
+		return nil, fmt.Errorf("invalid genesis round gap %d", gns.RoundGap)
+	}
+
 	if len(gns.Domains) != 1 {
 		return nil, fmt.Errorf("invalid genesis domain inputs count %d", len(gns.Domains))
 	}
@@ -0,0 +1,105 @@
+package kernel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGenesisEpoch = int64(1600000000)
+
+// the genesis of 7 nodes, with the view keys derived from the spend keys as required
+func testGenesisAccounts() []common.Address {
+	accounts := make([]common.Address, 0)
+	for i := 0; i < MinimumNodeCount; i++ {
+		seed := crypto.NewHash([]byte(fmt.Sprintf("genesis%d", i)))
+		a := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+		a.PrivateViewKey = a.PublicSpendKey.DeterministicHashDerive()
+		a.PublicViewKey = a.PrivateViewKey.Public()
+		accounts = append(accounts, a)
+	}
+	return accounts
+}
+
+// a node of the account with a fresh memory store, the genesis loaded from a config dir
+func testGenesisNode(assert *assert.Assertions, accounts []common.Address, account int) *Node {
+	inputs := make([]map[string]string, 0)
+	for _, a := range accounts {
+		inputs = append(inputs, map[string]string{"address": a.String(), "balance": "10000"})
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"epoch":   testGenesisEpoch,
+		"nodes":   inputs,
+		"domains": []map[string]string{{"address": accounts[0].String(), "balance": "50000"}},
+	})
+	assert.Nil(err)
+	dir, err := ioutil.TempDir("", "mixin-genesis-test")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	assert.Nil(ioutil.WriteFile(dir+"/genesis.json", data, 0644))
+
+	store := storage.NewMemoryStore()
+	node := &Node{
+		Account:     accounts[account],
+		Clock:       wallClock{},
+		Metrics:     noopMetrics{},
+		store:       store,
+		TopoCounter: getTopologyCounter(store),
+	}
+	assert.Nil(node.LoadGenesis(dir))
+	return node
+}
+
+func TestInitGenesis(t *testing.T) {
+	assert := assert.New(t)
+
+	accounts := testGenesisAccounts()
+	a := testGenesisNode(assert, accounts, 0)
+	b := testGenesisNode(assert, accounts, 1)
+	assert.Equal(a.networkId, b.networkId)
+	assert.Len(a.Graph.Nodes, MinimumNodeCount)
+	assert.Equal(a.Graph.Print(), b.Graph.Print())
+	assert.ElementsMatch(a.Graph.FinalCache(), b.Graph.FinalCache())
+
+	epoch := uint64(time.Unix(testGenesisEpoch, 0).UnixNano())
+	for _, id := range a.Graph.Nodes {
+		snapshots, err := a.store.SnapshotsReadSnapshotsForNodeRound(id, 0)
+		assert.Nil(err)
+		assert.NotEmpty(snapshots)
+		final := a.Graph.FinalRound[id]
+		assert.Equal(uint64(0), final.Number)
+		assert.Equal(roundHash(id, 0, snapshots), final.Hash)
+		assert.NotEqual(roundHash(id, 0, nil), final.Hash)
+		assert.Equal(final, b.Graph.FinalRound[id])
+		cache := a.Graph.CacheRound[id]
+		assert.Equal(uint64(1), cache.Number)
+		assert.Equal(epoch, cache.Start)
+		assert.Len(cache.Snapshots, 0)
+	}
+	// the domain accept snapshot is in the round 0 of the first node
+	first := accounts[0].Hash().ForNetwork(a.networkId)
+	snapshots, err := a.store.SnapshotsReadSnapshotsForNodeRound(first, 0)
+	assert.Nil(err)
+	assert.Len(snapshots, 2)
+	assert.Equal(epoch+1, a.Graph.FinalRound[first].End)
+
+	// the graph loaded from the store after a restart is the same one
+	graph, err := LoadRoundGraph(a.store)
+	assert.Nil(err)
+	assert.Equal(a.Graph.Print(), graph.Print())
+	assert.ElementsMatch(a.Graph.FinalCache(), graph.FinalCache())
+
+	assert.NotNil(a.InitGenesis([]*common.SnapshotWithTopologicalOrder{}))
+	c := &Node{store: storage.NewMemoryStore()}
+	assert.NotNil(c.InitGenesis(nil))
+	assert.NotNil(c.InitGenesis([]*common.SnapshotWithTopologicalOrder{{Snapshot: common.Snapshot{NodeId: first, RoundNumber: 1, Timestamp: epoch}}}))
+	assert.Nil(c.Graph)
+}
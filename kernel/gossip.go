@@ -0,0 +1,107 @@
+package kernel
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// remembers which peers already have a snapshot, either sent to or received from, so a snapshot
+// is never forwarded back and forth in a dense mesh, the entries expire after the suppression window
+type gossipFilter struct {
+	sync.Mutex
+	seen map[crypto.Hash]time.Time
+}
+
+func newGossipFilter() *gossipFilter {
+	return &gossipFilter{seen: make(map[crypto.Hash]time.Time)}
+}
+
+func (f *gossipFilter) mark(peerId, snapshotHash crypto.Hash, now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.seen[snapshotHash.ForNetwork(peerId)] = now
+}
+
+func (f *gossipFilter) has(peerId, snapshotHash crypto.Hash, now time.Time) bool {
+	f.Lock()
+	defer f.Unlock()
+	ts, found := f.seen[snapshotHash.ForNetwork(peerId)]
+	return found && now.Before(ts.Add(time.Duration(config.GossipSuppressionWindow)))
+}
+
+func (f *gossipFilter) prune(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	for k, ts := range f.seen {
+		if !now.Before(ts.Add(time.Duration(config.GossipSuppressionWindow))) {
+			delete(f.seen, k)
+		}
+	}
+}
+
+func (node *Node) AddGossipPeer(idForNetwork crypto.Hash) {
+	if idForNetwork == node.IdForNetwork {
+		return
+	}
+	node.gossipLock.Lock()
+	defer node.gossipLock.Unlock()
+	node.GossipPeers[idForNetwork] = true
+}
+
+func (node *Node) isGossipPeer(idForNetwork crypto.Hash) bool {
+	node.gossipLock.RLock()
+	defer node.gossipLock.RUnlock()
+	return node.GossipPeers[idForNetwork]
+}
+
+// pick at most fanout random gossip peers which have not seen the snapshot yet,
+// the snapshot node is excluded because it always gets the snapshot directly
+func (node *Node) selectGossipPeers(s *common.Snapshot, fanout int) []crypto.Hash {
+	now, hash := time.Now(), s.PayloadHash()
+	node.gossipLock.RLock()
+	peers := make([]crypto.Hash, 0, len(node.GossipPeers))
+	for id := range node.GossipPeers {
+		peers = append(peers, id)
+	}
+	node.gossipLock.RUnlock()
+
+	candidates := make([]crypto.Hash, 0)
+	for _, id := range peers {
+		if id == s.NodeId || id == node.IdForNetwork {
+			continue
+		}
+		if node.gossipFilter.has(id, hash, now) {
+			node.Metrics.Inc(MetricGossipSuppressed, s.NodeId == node.IdForNetwork)
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > fanout {
+		candidates = candidates[:fanout]
+	}
+	for _, id := range candidates {
+		node.gossipFilter.mark(id, hash, now)
+	}
+	return candidates
+}
+
+func (node *Node) gossipSnapshot(s *common.Snapshot) {
+	peers := node.selectGossipPeers(s, config.GossipFanout)
+	if len(peers) == 0 {
+		return
+	}
+	errs := node.sendSnapshotBatch(peers, s)
+	for _, id := range peers {
+		if err := errs[id]; err != nil {
+			node.Logger.Warn("GOSSIP SNAPSHOT ERROR", id, err)
+		}
+	}
+}
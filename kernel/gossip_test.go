@@ -0,0 +1,135 @@
+package kernel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectGossipPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.GossipPeers = make(map[crypto.Hash]bool)
+	node.gossipFilter = newGossipFilter()
+	for _, a := range accounts {
+		node.AddGossipPeer(a.Hash().ForNetwork(node.networkId))
+	}
+	assert.Len(node.GossipPeers, 6)
+
+	origin := accounts[1].Hash().ForNetwork(node.networkId)
+	relay := accounts[2].Hash().ForNetwork(node.networkId)
+	s := &common.Snapshot{NodeId: origin, Transaction: &common.SignedTransaction{}}
+	node.gossipFilter.mark(relay, s.PayloadHash(), time.Now())
+
+	selected := make(map[crypto.Hash]bool)
+	for i := 0; i < 3; i++ {
+		peers := node.selectGossipPeers(s, 2)
+		for _, id := range peers {
+			assert.False(selected[id])
+			assert.NotEqual(origin, id)
+			assert.NotEqual(relay, id)
+			assert.NotEqual(node.IdForNetwork, id)
+			selected[id] = true
+		}
+		if i < 2 {
+			assert.Len(peers, 2)
+		} else {
+			assert.Len(peers, 0)
+		}
+	}
+	assert.Len(selected, 4)
+
+	node.gossipFilter.prune(time.Now().Add(time.Duration(config.GossipSuppressionWindow)))
+	assert.Len(node.gossipFilter.seen, 0)
+	assert.Len(node.selectGossipPeers(s, 10), 5)
+}
+
+func TestGossipMeshSuppression(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := NewPrometheusMetrics()
+	mesh := make(map[crypto.Hash]*Node)
+	var origin crypto.Hash
+	var first *Node
+	for i := 0; i < 3; i++ {
+		node, accounts := testConsensusNode(7)
+		node.Account = accounts[i]
+		node.IdForNetwork = accounts[i].Hash().ForNetwork(node.networkId)
+		node.Metrics = metrics
+		node.GossipPeers = make(map[crypto.Hash]bool)
+		node.gossipFilter = newGossipFilter()
+		mesh[node.IdForNetwork] = node
+		origin = accounts[3].Hash().ForNetwork(node.networkId)
+		if first == nil {
+			first = node
+		}
+	}
+	for _, node := range mesh {
+		for id := range mesh {
+			node.AddGossipPeer(id)
+		}
+	}
+
+	// every received copy is forwarded again, the worst case of a dense mesh
+	type delivery struct{ from, to crypto.Hash }
+	s := &common.Snapshot{NodeId: origin, Transaction: &common.SignedTransaction{}}
+	forwards := make(map[delivery]int)
+	queue := []delivery{{from: origin, to: first.IdForNetwork}}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		node := mesh[d.to]
+		node.gossipFilter.mark(d.from, s.PayloadHash(), time.Now())
+		for _, id := range node.selectGossipPeers(s, config.GossipFanout) {
+			next := delivery{from: d.to, to: id}
+			forwards[next]++
+			queue = append(queue, next)
+		}
+	}
+
+	for d, count := range forwards {
+		assert.Equal(1, count)
+		assert.NotEqual(d.from, d.to)
+		assert.NotEqual(origin, d.to)
+	}
+	assert.True(len(forwards) <= 6)
+	assert.True(metrics.Value(MetricGossipSuppressed, false) > 0)
+	for id, node := range mesh {
+		for peer := range mesh {
+			if peer != id {
+				assert.True(node.gossipFilter.has(peer, s.PayloadHash(), time.Now()))
+			}
+		}
+	}
+}
+
+func TestGossipPeersConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.GossipPeers = make(map[crypto.Hash]bool)
+	node.gossipFilter = newGossipFilter()
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			node.AddGossipPeer(crypto.NewHash([]byte(fmt.Sprintf("relay%d", i))))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		node.selectGossipPeers(s, 2)
+		node.isGossipPeer(accounts[1].Hash().ForNetwork(node.networkId))
+	}
+	wg.Wait()
+	assert.Len(node.GossipPeers, 100)
+}
@@ -1,180 +1,728 @@
 package kernel
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/crypto"
-	"github.com/MixinNetwork/mixin/logger"
 )
 
 func (node *Node) handleSnapshotInput(s *common.Snapshot) error {
-	o, err := node.store.SnapshotsReadSnapshotByTransactionHash(s.Transaction.PayloadHash())
+	b, err := node.processSnapshotInput(s)
+	if err != nil || b == nil {
+		return err
+	}
+	node.broadcastSnapshot(b)
+	return nil
+}
+
+// the snapshot is verified, signed or finalized with the nodes and state locks held,
+// and returns the signed snapshot to broadcast after both locks released
+func (node *Node) processSnapshotInput(s *common.Snapshot) (*snapshotBroadcast, error) {
+	node.nodesLock.RLock()
+	defer node.nodesLock.RUnlock()
+
+	self := s.NodeId == node.IdForNetwork
+	err := node.checkSnapshotLimits(s)
 	if err != nil {
-		logger.Println("READ SNAPSHOT BY TRANSACTION ERROR", err)
-		return nil
+		node.Logger.Warn("SNAPSHOT LIMITS ERROR", err)
+		node.Metrics.Inc(MetricValidationFailure, self)
+		node.rejectSnapshot(s, RejectLimits, err)
+		return nil, nil
+	}
+	// the seen cache hits are the usual gossip duplicates, never recorded as rejected,
+	// but they may bring late signatures to merge in the window after finalization
+	txHash := s.TransactionHash()
+	seen := node.seenCache.Contains(txHash)
+	if seen && !node.inLateSignatureWindow(s, txHash) {
+		node.Metrics.Inc(MetricSnapshotSeen, self)
+		return nil, nil
+	}
+	o, err := node.store.SnapshotsReadSnapshotByTransactionHash(txHash)
+	if err != nil {
+		return nil, node.retryStoreRead(s, txHash, err)
 	}
+	node.readRetries.reset(txHash)
 	if o != nil {
-		return nil
+		node.seenCache.Add(txHash)
+		merged, err := node.mergeLateSignatures(o, s, txHash)
+		if err != nil || merged {
+			return nil, err
+		}
+		node.Metrics.Inc(MetricSnapshotSeen, self)
+		if !seen {
+			node.rejectSnapshot(s, RejectSeen, nil)
+		}
+		return nil, nil
 	}
 	err = s.Transaction.Validate(node.store)
 	if err != nil {
-		logger.Println("VALIDATE TRANSACTION ERROR", err)
-		return nil
+		node.Logger.Warn("VALIDATE TRANSACTION ERROR", err)
+		node.Metrics.Inc(MetricValidationFailure, self)
+		node.rejectSnapshot(s, RejectTransaction, err)
+		return nil, nil
 	}
 
+	err = node.clearConsensusSignatures(s)
+	if err != nil {
+		node.Logger.Warn("SNAPSHOT SIGNATURES ERROR", s.NodeId, err)
+		node.Metrics.Inc(MetricValidationFailure, self)
+		node.rejectSnapshot(s, RejectSignatures, err)
+		return nil, nil
+	}
+
+	return node.handleSnapshotState(s, txHash)
+}
+
+// a signed snapshot to send after the state lock released, the sends may block on
+// the network, and must never stall the other lanes waiting for the state lock
+type snapshotBroadcast struct {
+	snapshot *common.Snapshot
+	peers    []crypto.Hash
+	marked   time.Time
+}
+
+func (node *Node) handleSnapshotState(s *common.Snapshot, txHash crypto.Hash) (*snapshotBroadcast, error) {
+	self := s.NodeId == node.IdForNetwork
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
 	defer node.Graph.UpdateFinalCache()
-	node.clearConsensusSignatures(s)
+	defer node.trackProgress()
+	if node.Graph.CacheRound[s.NodeId] == nil || node.Graph.FinalRound[s.NodeId] == nil {
+		node.Logger.Warn("SNAPSHOT NODE WITHOUT ROUND", s.NodeId)
+		node.Metrics.Inc(MetricValidationFailure, self)
+		node.rejectSnapshot(s, RejectRound, nil)
+		return nil, nil
+	}
+	if equivocated, err := node.detectEquivocation(s); err != nil || equivocated {
+		return nil, err
+	}
 
-	cache, final, err := node.signSnapshot(s)
-	if err != nil {
-		return err
+	cache := node.Graph.CacheRound[s.NodeId].Copy()
+	final := node.Graph.FinalRound[s.NodeId].Copy()
+	if node.shouldSign(s) {
+		var err error
+		cache, final, err = node.signSnapshot(context.Background(), s)
+		switch err.(type) {
+		case *RoundCandidateMissingError, *RoundCandidateStaleError, *RoundPendingError:
+			node.Logger.Warn("SIGN SNAPSHOT DEFERRED", err)
+			time.AfterFunc(time.Duration(node.roundGap), func() {
+				node.queueSnapshot(s)
+			})
+			return nil, nil
+		}
+		if err != nil {
+			node.Logger.Warn("SIGN SNAPSHOT ERROR", err)
+			node.rejectSnapshot(s, RejectSign, err)
+			return nil, nil
+		}
 	}
 
 	var links map[crypto.Hash]uint64
-	if s.NodeId != node.IdForNetwork || len(s.Signatures) > 1 {
-		links, cache, final, err = node.verifySnapshot(s)
-		if err != nil {
-			return err
+	verified := s.NodeId != node.IdForNetwork || len(s.Signatures) > 1 || s.Aggregated != nil
+	if verified {
+		r, err := node.verifySnapshot(s)
+		if unknown, ok := err.(*UnknownReferencedNodeError); ok {
+			node.Logger.Warn("VERIFY SNAPSHOT DEFERRED", err)
+			node.deferUnknownReference(unknown.NodeId, s)
+			return nil, nil
+		}
+		switch err.(type) {
+		case *StaleRoundError, *NextRoundAvailableError:
+			node.Logger.Warn("VERIFY SNAPSHOT STALE", err)
+			node.rejectSnapshot(s, RejectStale, err)
+			return nil, nil
+		case *ReferenceCountError, *ZeroReferenceError, *DuplicateReferenceError, *ReferenceStaleError, *ReferenceSelfError, *ReferenceCycleError:
+			node.Logger.Warn("VERIFY SNAPSHOT DROPPED", err)
+			node.Metrics.Inc(MetricValidationFailure, self)
+			node.rejectSnapshot(s, RejectReferences, err)
+			return nil, nil
+		case *ReferenceMissingError:
+			node.retryMissingReference(s, err)
+			return nil, nil
 		}
+		if err != nil || r.Known {
+			return nil, err
+		}
+		links, cache, final = r.Links, r.Cache, r.Final
 	}
 
 	if node.verifyFinalization(s) {
+		// the pool signatures merged by the verification may repeat a signer, only the
+		// distinct ones are written, the error was checked before the merge already
+		node.clearConsensusSignatures(s)
+		// a self snapshot with a single signature skips the verification, e.g. when the node
+		// weight alone crosses the threshold, never finalize it with unchecked references
+		if !verified {
+			r, err := node.verifyReferences(*final, s)
+			if err != nil && !r.Handled {
+				return nil, err
+			}
+			if err != nil {
+				node.Logger.Warn("FINALIZE SNAPSHOT REFERENCES ERROR", err)
+				node.Metrics.Inc(MetricValidationFailure, self)
+				node.rejectSnapshot(s, RejectReferences, err)
+				return nil, nil
+			}
+			links = r.Links
+		}
 		cache.Snapshots = append(cache.Snapshots, s)
 		cache.End = s.Timestamp
+		cache.flushSnapshots(config.CacheRoundSnapshotsLimit)
 		topo := &common.SnapshotWithTopologicalOrder{
-			Snapshot:         *s,
-			TopologicalOrder: node.TopoCounter.Next(),
-			RoundLinks:       links,
+			Snapshot:   *s,
+			RoundLinks: links,
 		}
-		err := node.store.SnapshotsWriteSnapshot(topo)
+		err := node.TopoCounter.assign([]*common.SnapshotWithTopologicalOrder{topo}, func() error {
+			return node.store.SnapshotsWriteSnapshot(topo)
+		})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		node.Graph.CacheRound[s.NodeId] = cache
-		node.Graph.FinalRound[s.NodeId] = final
-		return nil
+		node.seenCache.Add(txHash)
+		delete(node.SnapshotsPool, s.PayloadHash())
+		delete(node.pending, s.PayloadHash())
+		delete(node.refRetries, s.PayloadHash())
+		node.Graph.UpdateRound(cache, final)
+		node.recordFinalization(txHash)
+		node.resumeUnknownReferences()
+		node.Metrics.Inc(MetricFinalization, self)
+		if !self {
+			node.observeTimestamp(s.Timestamp)
+		}
+		node.notifyFinalized(topo)
+		return nil, nil
 	}
 
-	err = s.LockInputs(node.store)
+	err := s.LockInputs(node.store)
 	if err != nil {
-		logger.Println("LOCK INPUTS ERROR", err)
-		return nil
+		node.Logger.Warn("LOCK INPUTS ERROR", err)
+		node.Metrics.Inc(MetricLockInputsFailure, self)
+		node.rejectSnapshot(s, RejectLockInputs, err)
+		return nil, nil
 	}
 	node.sign(s)
+	// the signed snapshot may be sent already even when the broadcast fails,
+	// so the graph is updated before that to never assign its round again
+	node.Graph.UpdateRound(cache, final)
+	if self {
+		node.assigned = roundAssignment{number: s.RoundNumber, timestamp: s.Timestamp}
+	}
 
-	if node.IdForNetwork == s.NodeId {
-		for _, cn := range node.ConsensusNodes {
-			if !cn.IsAccepted() {
-				continue
-			}
-			peerId := cn.Account.Hash().ForNetwork(node.networkId)
-			cacheId := s.PayloadHash().ForNetwork(peerId)
-			if time.Now().Before(node.ConsensusCache[cacheId].Add(time.Duration(config.SnapshotRoundGap))) {
-				continue
-			}
-			err = node.Peer.SendSnapshotMessage(peerId, s)
-			if err != nil {
-				return err
-			}
-			node.ConsensusCache[cacheId] = time.Now()
+	// the handler keeps changing the snapshot signatures after the lock released
+	c := *s
+	c.Signatures = append([]crypto.Signature{}, s.Signatures...)
+	c.Signers = nil
+	if !self {
+		return &snapshotBroadcast{snapshot: &c}, nil
+	}
+	// the peers are marked as sent before the send, so a concurrent handling never sends
+	// the snapshot again, and the mark of a failed send is cleared by the broadcast
+	now := node.clockTime()
+	peers := make([]crypto.Hash, 0)
+	for _, cn := range node.ConsensusNodes {
+		if !cn.IsAccepted() {
+			continue
 		}
-	} else {
-		// FIXME gossip peers are different from consensus nodes
-		err := node.Peer.SendSnapshotMessage(s.NodeId, s)
+		peerId := cn.IdForNetwork(node.networkId)
+		cacheId := consensusCacheKey(s.PayloadHash(), peerId)
+		if now.Before(node.ConsensusCache[cacheId].Add(time.Duration(node.roundGap))) {
+			continue
+		}
+		node.ConsensusCache[cacheId] = now
+		peers = append(peers, peerId)
+	}
+	node.trackPendingSnapshot(s, now)
+	return &snapshotBroadcast{snapshot: &c, peers: peers, marked: now}, nil
+}
+
+// a self snapshot is sent to the consensus peers for signatures, and the others are
+// sent back to their nodes with the signature and gossiped, without any lock held
+func (node *Node) broadcastSnapshot(b *snapshotBroadcast) {
+	s := b.snapshot
+	if s.NodeId != node.IdForNetwork {
+		err := node.Sender.SendSnapshotMessage(s.NodeId, s)
 		if err != nil {
-			return err
+			node.retrySend(s.NodeId, s, err)
+		} else {
+			node.Metrics.Inc(MetricSignatureBroadcast, false)
 		}
+		node.gossipSnapshot(s)
+		return
 	}
 
-	node.Graph.CacheRound[s.NodeId] = cache
-	node.Graph.FinalRound[s.NodeId] = final
-	return nil
+	errs := node.Sender.SendSnapshotMessageBatch(b.peers, s)
+	failed := make([]crypto.Hash, 0)
+	for _, peerId := range b.peers {
+		if err := errs[peerId]; err != nil {
+			node.retrySend(peerId, s, err)
+			failed = append(failed, peerId)
+			continue
+		}
+		node.Metrics.Inc(MetricSignatureBroadcast, true)
+	}
+	node.unmarkConsensusCache(s.PayloadHash(), failed, b.marked)
 }
 
-func (node *Node) clearConsensusSignatures(s *common.Snapshot) {
+// each unique signature is verified at most once, the signers of a snapshot
+// are remembered for the same payload to skip verification in later calls,
+// and only the first signature of a signer is kept, a node may sign the same
+// payload with different nonces, which must not count twice. A signature of no
+// accepted consensus node is dropped, and fails the snapshot with strict signatures,
+// all signatures are dropped and fail the snapshot if its scheme is not enabled
+func (node *Node) clearConsensusSignatures(s *common.Snapshot) error {
+	verifier, enabled := snapshotVerifier(s)
+	if !enabled {
+		s.Signatures, s.Signers = nil, nil
+		return fmt.Errorf("unsupported snapshot signature scheme %s %d", s.PayloadHash(), s.Scheme)
+	}
 	msg := s.Payload()
 	sigs := make([]crypto.Signature, 0)
+	signers := make(map[crypto.Signature]crypto.Hash)
 	filter := make(map[crypto.Signature]bool)
+	signed := make(map[crypto.Hash]bool)
+	var err error
+	observer, observing := node.Metrics.(Observer)
+	var start time.Time
+	if observing {
+		start = time.Now()
+	}
+	var verified int
+	var hash crypto.Hash
 	for _, sig := range s.Signatures {
 		if filter[sig] {
 			continue
 		}
-		for _, cn := range node.ConsensusNodes {
-			if !cn.IsAccepted() {
-				continue
+		filter[sig] = true
+		id, found := s.Signers[sig]
+		if !found {
+			if !hash.HasValue() {
+				hash = crypto.NewHash(msg)
 			}
-			if cn.Account.PublicSpendKey.Verify(msg, sig) {
-				sigs = append(sigs, sig)
+			if r, cached := node.verified.get(sig, hash); cached {
+				id, found = r.id, r.found
+			} else {
+				id, found = node.signatureSigner(verifier, msg, sig)
+				node.verified.set(sig, hash, verifyResult{id: id, found: found})
+				verified++
 			}
 		}
-		filter[sig] = true
+		if !found && config.StrictSignatures && err == nil {
+			err = fmt.Errorf("unattributable snapshot signature %s %s", s.PayloadHash(), sig)
+		}
+		if !found || signed[id] {
+			continue
+		}
+		signed[id] = true
+		signers[sig] = id
+		sigs = append(sigs, sig)
 	}
 	s.Signatures = sigs
+	s.Signers = signers
+	if observing && verified > 0 {
+		observer.Observe(MetricSignatureVerify, verified, time.Since(start))
+	}
+	return err
 }
 
-func (node *Node) verifyReferences(self FinalRound, s *common.Snapshot) (map[crypto.Hash]uint64, bool, error) {
+func (node *Node) signatureSigner(verifier crypto.Verifier, msg []byte, sig crypto.Signature) (crypto.Hash, bool) {
+	for _, cn := range node.ConsensusNodes {
+		if !cn.IsAccepted() {
+			continue
+		}
+		if verifier.Verify(cn.Account.PublicSpendKey, msg, sig) {
+			return cn.IdForNetwork(node.networkId), true
+		}
+	}
+	return crypto.Hash{}, false
+}
+
+// only the enabled schemes are accepted, even if more verifiers are registered
+func snapshotVerifier(s *common.Snapshot) (crypto.Verifier, bool) {
+	for _, scheme := range config.SignatureSchemes {
+		if crypto.SignatureScheme(scheme) == s.Scheme {
+			return s.Verifier()
+		}
+	}
+	return nil, false
+}
+
+type verifyKey struct {
+	sig  crypto.Signature
+	hash crypto.Hash
+}
+
+type verifyResult struct {
+	id    crypto.Hash
+	found bool
+}
+
+// the signer of a signature on the same message never changes until the consensus
+// nodes change, both attributed and unattributable signatures are remembered, so the
+// same finalized snapshot coming from many peers is verified only once
+type verifyCache struct {
+	sync.Mutex
+	results map[verifyKey]verifyResult
+}
+
+func (c *verifyCache) get(sig crypto.Signature, hash crypto.Hash) (verifyResult, bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, found := c.results[verifyKey{sig: sig, hash: hash}]
+	return r, found
+}
+
+func (c *verifyCache) set(sig crypto.Signature, hash crypto.Hash, r verifyResult) {
+	c.Lock()
+	defer c.Unlock()
+	if c.results == nil || len(c.results) >= config.SignatureVerifyCacheSize {
+		c.results = make(map[verifyKey]verifyResult)
+	}
+	c.results[verifyKey{sig: sig, hash: hash}] = r
+}
+
+func (c *verifyCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.results = nil
+}
+
+// the snapshot brings no new signatures to the pool, it has been verified
+// and signed when the pooled signatures came, so nothing to do again
+func signaturesSubset(sigs, pool []crypto.Signature) bool {
+	if len(sigs) > len(pool) {
+		return false
+	}
+	filter := make(map[crypto.Signature]bool)
+	for _, sig := range pool {
+		filter[sig] = true
+	}
+	for _, sig := range sigs {
+		if !filter[sig] {
+			return false
+		}
+	}
+	return true
+}
+
+type VerifyResult struct {
+	Links   map[crypto.Hash]uint64
+	Cache   *CacheRound
+	Final   *FinalRound
+	Handled bool
+	Known   bool
+}
+
+// a round link from => to is the highest round number of the node to, referenced by any
+// snapshot of the node from, so both links are read from the snapshot node s.NodeId. A node
+// never references a round earlier than one it has linked, neither its own nor a peer round.
+func (node *Node) verifyReferences(self FinalRound, s *common.Snapshot) (*VerifyResult, error) {
 	links := make(map[crypto.Hash]uint64)
+	r := &VerifyResult{Links: links, Handled: true}
 	if len(s.References) != 2 {
-		return links, true, fmt.Errorf("invalid reference count %d", len(s.References))
+		return r, &ReferenceCountError{Hash: s.PayloadHash(), Count: len(s.References)}
 	}
 	ref0, ref1 := s.References[0], s.References[1]
+	if ref1.IsZero() {
+		return r, &ZeroReferenceError{Hash: s.PayloadHash()}
+	}
 	if ref0 == ref1 {
-		return links, true, fmt.Errorf("same references %s", s.Transaction.PayloadHash().String())
+		return r, &DuplicateReferenceError{Hash: s.PayloadHash(), Reference: ref1}
+	}
+	if self.Hash.IsZero() && self.Number > 0 {
+		return r, fmt.Errorf("empty self final round %s %d", self.NodeId, self.Number)
 	}
-
 	if ref0 != self.Hash {
-		return links, true, fmt.Errorf("invalid self reference %s %s %s", s.Transaction.PayloadHash(), ref0, self.Hash)
+		return r, fmt.Errorf("invalid self reference %s %s %s", s.TransactionHash(), ref0, self.Hash)
 	}
 	if s.NodeId != self.NodeId {
 		panic(*s)
 	}
 
 	for _, final := range node.Graph.FinalRound {
-		if final.NodeId == s.NodeId || final.Hash != ref1 {
+		if final.Hash != ref1 {
 			continue
 		}
+		if final.NodeId == s.NodeId {
+			return r, &ReferenceSelfError{Hash: s.PayloadHash(), NodeId: s.NodeId, Number: final.Number}
+		}
+		if final.End >= s.Timestamp {
+			return r, fmt.Errorf("future final reference %s %d %d", s.TransactionHash(), final.End, s.Timestamp)
+		}
 		links[self.NodeId] = self.Number
 		links[final.NodeId] = final.Number
 		selfLink, err := node.store.SnapshotsReadRoundLink(s.NodeId, self.NodeId)
 		if err != nil {
-			return links, false, err
+			r.Handled = false
+			return r, err
 		}
 		if links[self.NodeId] < selfLink {
-			return links, true, fmt.Errorf("invalid self reference %d=>%d", selfLink, links[self.NodeId])
+			return r, &ReferenceStaleError{Kind: "self", Link: selfLink, Number: links[self.NodeId]}
 		}
 		finalLink, err := node.store.SnapshotsReadRoundLink(s.NodeId, final.NodeId)
 		if err != nil {
-			return links, false, err
+			r.Handled = false
+			return r, err
 		}
 		if links[final.NodeId] < finalLink {
-			return links, true, fmt.Errorf("invalid final reference %d=>%d", finalLink, links[final.NodeId])
+			return r, &ReferenceStaleError{Kind: "final", Link: finalLink, Number: links[final.NodeId]}
+		}
+		if links[final.NodeId] > finalLink {
+			err = node.verifyReferenceCycle(self, final)
+			if _, ok := err.(*ReferenceCycleError); !ok && err != nil {
+				r.Handled = false
+			}
+			return r, err
+		}
+		return r, nil
+	}
+	number, found, err := node.selfRoundReference(self, ref1)
+	if err != nil {
+		r.Handled = false
+		return r, err
+	}
+	if found {
+		return r, &ReferenceSelfError{Hash: s.PayloadHash(), NodeId: s.NodeId, Number: number}
+	}
+	id, found, err := node.unknownReferencedNode(ref1)
+	if err != nil {
+		r.Handled = false
+		return r, err
+	}
+	if found {
+		return r, &UnknownReferencedNodeError{NodeId: id, Reference: ref1}
+	}
+	return r, &ReferenceMissingError{Hash: s.PayloadHash(), Reference: ref1}
+}
+
+// the graph has only the latest final round of a node, so an older round of the snapshot node is
+// read from the store, but only the recent ones. A reference to an even older round is never found
+// and the snapshot is dropped as a missing reference after the retries. The cached hashes are
+// checked before any store read, so a junk or retried reference reads each round at most once.
+func (node *Node) selfRoundReference(self FinalRound, ref crypto.Hash) (uint64, bool, error) {
+	depth := uint64(config.SnapshotSelfReferenceDepth)
+	if depth > self.Number {
+		depth = self.Number
+	}
+	missing := make([]uint64, 0)
+	for i := uint64(1); i <= depth; i++ {
+		number := self.Number - i
+		hash, found := node.roundHashes.get(self.NodeId, number)
+		if !found {
+			missing = append(missing, number)
+		} else if hash == ref {
+			return number, true, nil
+		}
+	}
+	for _, number := range missing {
+		snapshots, err := node.store.SnapshotsReadSnapshotsForNodeRound(self.NodeId, number)
+		if err != nil {
+			return 0, false, err
+		}
+		hash := roundHash(self.NodeId, number, snapshots)
+		node.roundHashes.set(self.NodeId, number, hash, self.Number-depth)
+		if hash == ref {
+			return number, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// the hash of a final round never changes, so the recent final rounds of each node are
+// cached by number, and the rounds below the lowest referable one are evicted
+type roundHashCache struct {
+	sync.Mutex
+	hashes map[crypto.Hash]map[uint64]crypto.Hash
+}
+
+func (c *roundHashCache) get(nodeId crypto.Hash, number uint64) (crypto.Hash, bool) {
+	c.Lock()
+	defer c.Unlock()
+	hash, found := c.hashes[nodeId][number]
+	return hash, found
+}
+
+func (c *roundHashCache) set(nodeId crypto.Hash, number uint64, hash crypto.Hash, lowest uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.hashes == nil {
+		c.hashes = make(map[crypto.Hash]map[uint64]crypto.Hash)
+	}
+	rounds := c.hashes[nodeId]
+	if rounds == nil {
+		rounds = make(map[uint64]crypto.Hash)
+		c.hashes[nodeId] = rounds
+	}
+	for n := range rounds {
+		if n < lowest {
+			delete(rounds, n)
+		}
+	}
+	rounds[number] = hash
+}
+
+// the snapshot joins the round self.Number+1 of its node, and a node only links the final rounds
+// it has seen, so any node reachable by links from the referenced final round must never link
+// the snapshot node beyond self.Number, otherwise the new link closes a cycle. The links are the
+// highest rounds ever referenced, so the walk is only done when a new link is made.
+func (node *Node) verifyReferenceCycle(self FinalRound, final *FinalRound) error {
+	visited := map[crypto.Hash]bool{final.NodeId: true}
+	queue := []crypto.Hash{final.NodeId}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, to := range node.Graph.Nodes {
+			if to == from || visited[to] {
+				continue
+			}
+			link, err := node.store.SnapshotsReadRoundLink(from, to)
+			if err != nil {
+				return err
+			}
+			if to == self.NodeId {
+				if link > self.Number {
+					return &ReferenceCycleError{NodeId: self.NodeId, Number: self.Number + 1, Reference: final.NodeId, Via: from, Link: link}
+				}
+				continue
+			}
+			if link > 0 {
+				visited[to] = true
+				queue = append(queue, to)
+			}
 		}
-		return links, true, nil
 	}
-	return links, true, fmt.Errorf("invalid references %s", s.Transaction.PayloadHash().String())
+	return nil
+}
+
+// an accepted consensus node without any final round in the graph, i.e. its rounds not synced yet,
+// which has a recent stored round of the reference hash, a reference to no round of such a node is
+// never deferred for it, otherwise any forged reference would wait until all nodes are synced
+func (node *Node) unknownReferencedNode(ref crypto.Hash) (crypto.Hash, bool, error) {
+	for _, cn := range node.ConsensusNodes {
+		if !cn.IsAccepted() {
+			continue
+		}
+		id := cn.IdForNetwork(node.networkId)
+		if node.Graph.FinalRound[id] != nil {
+			continue
+		}
+		meta, err := node.store.SnapshotsReadRoundMeta(id)
+		if err != nil {
+			return crypto.Hash{}, false, err
+		}
+		for i := uint64(0); i <= uint64(config.SnapshotSelfReferenceDepth) && i <= meta[0]; i++ {
+			number := meta[0] - i
+			snapshots, err := node.store.SnapshotsReadSnapshotsForNodeRound(id, number)
+			if err != nil {
+				return crypto.Hash{}, false, err
+			}
+			if len(snapshots) > 0 && roundHash(id, number, snapshots) == ref {
+				return id, true, nil
+			}
+		}
+	}
+	return crypto.Hash{}, false, nil
+}
+
+// ConsensusInfo returns the number of all consensus nodes, the accepted ones, and the threshold,
+// a snapshot is only finalized when signed by more than the threshold nodes
+func (node *Node) ConsensusInfo() (total int, accepted int, threshold int) {
+	node.nodesLock.RLock()
+	defer node.nodesLock.RUnlock()
+	return node.consensusInfo()
 }
 
+func (node *Node) consensusInfo() (int, int, int) {
+	var accepted int
+	for _, cn := range node.ConsensusNodes {
+		if cn.IsAccepted() {
+			accepted++
+		}
+	}
+	total := len(node.ConsensusNodes)
+	return total, accepted, int(finalizationThreshold(uint64(total)))
+}
+
+func (node *Node) consensusThreshold() int {
+	_, _, threshold := node.consensusInfo()
+	return threshold
+}
+
+// the signatures or weights must be more than the threshold, e.g. 0 of 1, 1 of 2 and 2 of 3 nodes
+func finalizationThreshold(total uint64) uint64 {
+	return total * uint64(config.ConsensusThresholdNumerator) / uint64(config.ConsensusThresholdDenominator)
+}
+
+// accepted consensus node weights, and the total weight of all consensus nodes, the pledging ones
+// included the same as the threshold, weighted is false when all nodes have the same weight
+func (node *Node) consensusWeights() (map[crypto.Hash]uint64, uint64, bool) {
+	weights := make(map[crypto.Hash]uint64)
+	var total uint64
+	var weighted bool
+	for _, cn := range node.ConsensusNodes {
+		w := cn.ConsensusWeight()
+		weighted = weighted || w != 1
+		total += w
+		if cn.IsAccepted() {
+			weights[cn.IdForNetwork(node.networkId)] = w
+		}
+	}
+	return weights, total, weighted
+}
+
+// the individual and aggregated signatures are counted against the same total, so a
+// snapshot is final or not regardless of the format it's received in
 func (node *Node) verifyFinalization(s *common.Snapshot) bool {
-	consensusThreshold := len(node.ConsensusNodes) * 2 / 3
-	return len(s.Signatures) > consensusThreshold
+	weights, total, _ := node.consensusWeights()
+	var signed uint64
+	for id := range node.snapshotSigners(s) {
+		signed += weights[id]
+	}
+	return signed > finalizationThreshold(total)
 }
 
-func (node *Node) verifySnapshot(s *common.Snapshot) (map[crypto.Hash]uint64, *CacheRound, *FinalRound, error) {
-	logger.Println("VERIFY SNAPSHOT", *s)
+// the cache snapshots were finalized with the consensus nodes of their write, a later nodes
+// change may raise the threshold, so only a snapshot not written yet is verified again
+func (node *Node) verifyCacheFinalization(s *common.Snapshot) bool {
+	ss, err := node.store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+	if err == nil && ss != nil && ss.NodeId == s.NodeId && ss.RoundNumber == s.RoundNumber {
+		return true
+	}
+	return node.verifyFinalization(s)
+}
+
+func (node *Node) verifySnapshot(s *common.Snapshot) (*VerifyResult, error) {
 	cache := node.Graph.CacheRound[s.NodeId].Copy()
 	final := node.Graph.FinalRound[s.NodeId].Copy()
 
-	if osigs := node.SnapshotsPool[s.PayloadHash()]; len(osigs) > 0 || node.verifyFinalization(s) {
-		links, handled, err := node.verifyReferences(*final, s)
+	osigs := node.SnapshotsPool[s.PayloadHash()]
+	if s.Aggregated == nil && len(s.Signatures) > 0 && signaturesSubset(s.Signatures, osigs) {
+		return &VerifyResult{Cache: cache, Final: final, Handled: true, Known: true}, nil
+	}
+	// never accept a snapshot of a round earlier than the finalized one, e.g. an old round replayed
+	if s.RoundNumber < final.Number {
+		return &VerifyResult{Cache: cache, Final: final, Handled: true}, &StaleRoundError{NodeId: s.NodeId, Number: s.RoundNumber, Final: final.Number}
+	}
+	// the rule 1 of the rounds, the cache round has only finalized snapshots, so a round is never
+	// updated once its next round has any, e.g. an earlier conflict snapshot in the final round
+	if s.RoundNumber < cache.Number && len(cache.Snapshots)+cache.Flushed > 0 {
+		return &VerifyResult{Cache: cache, Final: final, Handled: true}, &NextRoundAvailableError{NodeId: s.NodeId, Number: s.RoundNumber, Next: cache.Number}
+	}
+	node.Logger.Debug("VERIFY SNAPSHOT", *s)
+	if len(osigs) > 0 || node.verifyFinalization(s) {
+		r, err := node.verifyReferences(*final, s)
+		r.Cache, r.Final = cache, final
 		if err != nil {
-			logger.Println(err)
-			if !handled {
-				return links, cache, final, err
+			node.Logger.Warn(err)
+			if isReferenceError(err) || !r.Handled {
+				return r, err
 			}
-			return links, cache, final, nil
+			return r, nil
 		}
 		filter := make(map[crypto.Signature]bool)
 		for _, sig := range s.Signatures {
@@ -187,98 +735,334 @@ func (node *Node) verifySnapshot(s *common.Snapshot) (map[crypto.Hash]uint64, *C
 			s.Signatures = append(s.Signatures, sig)
 			filter[sig] = true
 		}
-		node.SnapshotsPool[s.PayloadHash()] = append([]crypto.Signature{}, s.Signatures...)
-		return links, cache, final, nil
+		node.poolSnapshot(s.PayloadHash(), append([]crypto.Signature{}, s.Signatures...))
+		node.poolOrder.addSnapshot(s, node.SnapshotsPool)
+		return r, nil
 	}
 
-	if s.Timestamp >= config.SnapshotRoundGap+cache.Start {
-		if len(cache.Snapshots) == 0 {
-			cache.Start = s.Timestamp
-		} else {
-			for _, ps := range cache.Snapshots {
-				if !node.verifyFinalization(ps) {
-					panic("cache is the new final, round snapshots should have been finalized")
-				}
-			}
-
-			final = cache.asFinal()
-			cache = &CacheRound{
-				NodeId: s.NodeId,
-				Number: cache.Number + 1,
-				Start:  s.Timestamp,
-				End:    s.Timestamp,
-			}
-		}
+	cache, advanced, err := cache.TryAdvance(s.Timestamp, node.roundGap, node.roundLimit, node.verifyCacheFinalization, node.store)
+	if err != nil {
+		return &VerifyResult{Cache: cache, Final: final}, err
+	}
+	if advanced != nil {
+		final = advanced
 	}
 
 	if s.RoundNumber != cache.Number || s.Timestamp < cache.End {
-		return nil, cache, final, nil
+		return &VerifyResult{Cache: cache, Final: final, Handled: true}, nil
 	}
 
-	links, handled, err := node.verifyReferences(*final, s)
+	r, err := node.verifyReferences(*final, s)
+	r.Cache, r.Final = cache, final
 	if err != nil {
-		logger.Println(err)
-		if !handled {
-			return links, cache, final, err
+		node.Logger.Warn(err)
+		if isReferenceError(err) || !r.Handled {
+			return r, err
 		}
-		return links, cache, final, nil
 	}
-	return links, cache, final, nil
+	return r, nil
 }
 
-func (node *Node) signSnapshot(s *common.Snapshot) (*CacheRound, *FinalRound, error) {
+// only a fresh self snapshot is signed, i.e. without any signature or timestamp, all
+// other snapshots have their round and references assigned already, and are verified
+func (node *Node) shouldSign(s *common.Snapshot) bool {
+	return s.NodeId == node.IdForNetwork && len(s.Signatures) == 0 && s.Timestamp == 0
+}
+
+// signSnapshot assigns the timestamp, round and references of a fresh self snapshot,
+// any other snapshot is a routing bug of the caller and fails with UnsignableSnapshotError
+func (node *Node) signSnapshot(ctx context.Context, s *common.Snapshot) (*CacheRound, *FinalRound, error) {
 	cache := node.Graph.CacheRound[s.NodeId].Copy()
 	final := node.Graph.FinalRound[s.NodeId].Copy()
 
-	if s.NodeId != node.IdForNetwork || len(s.Signatures) != 0 || s.Timestamp != 0 {
-		return cache, final, nil
+	if !node.shouldSign(s) {
+		err := &UnsignableSnapshotError{NodeId: s.NodeId, Signatures: len(s.Signatures), Timestamp: s.Timestamp}
+		node.Logger.Error("SIGN SNAPSHOT UNEXPECTED", err)
+		return cache, final, err
 	}
-	logger.Println("SIGN SNAPSHOT", *s)
+	node.Logger.Debug("SIGN SNAPSHOT", *s)
 
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.SnapshotTimestampMaxWait))
+	defer cancel()
+	after := cache.End
+	if node.assigned.timestamp > after {
+		after = node.assigned.timestamp
+	}
 	for {
-		s.Timestamp = uint64(time.Now().UnixNano())
-		if s.Timestamp > cache.End {
+		s.Timestamp = node.Clock.Now()
+		if s.Timestamp > after {
 			break
 		}
-		time.Sleep(1 * time.Millisecond)
-	}
-	if s.Timestamp >= config.SnapshotRoundGap+cache.Start {
-		if len(cache.Snapshots) == 0 {
-			cache.Start = s.Timestamp
-		} else {
-			for _, ps := range cache.Snapshots {
-				if !node.verifyFinalization(ps) {
-					panic("cache is the new final, round snapshots should have been finalized")
-				}
-			}
-
-			final = cache.asFinal()
-			cache = &CacheRound{
-				NodeId: s.NodeId,
-				Number: cache.Number + 1,
-				Start:  s.Timestamp,
-			}
+		select {
+		case <-ctx.Done():
+			s.Timestamp = 0
+			return cache, final, fmt.Errorf("sign snapshot timestamp %d %s", after, ctx.Err())
+		case <-time.After(1 * time.Millisecond):
 		}
 	}
+	err := node.checkSignTimestamp(s.Timestamp)
+	if err != nil {
+		s.Timestamp = 0
+		return cache, final, err
+	}
+	// the self snapshots signed in an empty cache round are not finalized yet, and
+	// pin its start, the round can't move past them or advance before finalized
+	if len(cache.Snapshots)+cache.Flushed == 0 && s.Timestamp >= cache.Start+node.roundGap && node.pendingInRound(cache.Number) {
+		err := &RoundPendingError{NodeId: s.NodeId, Number: cache.Number, Start: cache.Start, Timestamp: s.Timestamp}
+		s.Timestamp = 0
+		return cache, final, err
+	}
+	cache, advanced, err := cache.TryAdvance(s.Timestamp, node.roundGap, node.roundLimit, node.verifyCacheFinalization, node.store)
+	if err != nil {
+		s.Timestamp = 0
+		return cache, final, err
+	}
+	if advanced != nil {
+		final = advanced
+	}
+	if cache.Number < node.assigned.number {
+		err := &RoundAssignmentError{NodeId: s.NodeId, Number: cache.Number, Assigned: node.assigned.number}
+		s.Timestamp = 0
+		return cache, final, err
+	}
 	cache.End = s.Timestamp
 
-	best := &FinalRound{NodeId: final.NodeId}
-	for _, r := range node.Graph.FinalRound {
-		if r.NodeId != s.NodeId && r.Start >= best.Start && r.End < uint64(time.Now().UnixNano()) {
-			best = r
-		}
+	best := bestReferenceRound(node.Graph.FinalCache(), s.NodeId, s.Timestamp)
+	if best == nil {
+		err := &RoundCandidateMissingError{NodeId: s.NodeId, Timestamp: s.Timestamp}
+		s.Timestamp = 0
+		return cache, final, err
 	}
-	if best.NodeId == final.NodeId {
-		panic(node.IdForNetwork)
+	if age := config.SnapshotReferenceMaxAge; age > 0 && best.End+age < s.Timestamp {
+		err := &RoundCandidateStaleError{NodeId: s.NodeId, Candidate: best.NodeId, End: best.End, Timestamp: s.Timestamp}
+		s.Timestamp = 0
+		return cache, final, err
 	}
 
+	references := [2]crypto.Hash{final.Hash, best.Hash}
+	err = checkSignReferences(final, references)
+	if err != nil {
+		s.Timestamp = 0
+		return cache, final, err
+	}
 	s.RoundNumber = cache.Number
-	s.References = [2]crypto.Hash{final.Hash, best.Hash}
+	s.References = references
 	return cache, final, nil
 }
 
+// the final round of another node with the latest start, and the lowest node id among the same
+// start ones, so the same graph always gives the same reference regardless of the cache order
+func bestReferenceRound(rounds []FinalRound, self crypto.Hash, timestamp uint64) *FinalRound {
+	var best *FinalRound
+	for i := range rounds {
+		r := &rounds[i]
+		if r.NodeId == self || r.Hash.IsZero() || r.End >= timestamp {
+			continue
+		}
+		if best == nil || r.Start > best.Start || (r.Start == best.Start && bytes.Compare(r.NodeId[:], best.NodeId[:]) < 0) {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	r := *best
+	return &r
+}
+
+// no other node has a final round to be referenced yet, e.g. a single node network,
+// the snapshot should be signed again later
+type RoundCandidateMissingError struct {
+	NodeId    crypto.Hash
+	Timestamp uint64
+}
+
+func (e *RoundCandidateMissingError) Error() string {
+	return fmt.Sprintf("round candidate missing %s %d", e.NodeId.String(), e.Timestamp)
+}
+
+// the best round of other nodes ended too long before the snapshot, e.g. all other nodes
+// are partitioned, the snapshot is signed again later instead of an ancient reference
+type RoundCandidateStaleError struct {
+	NodeId    crypto.Hash
+	Candidate crypto.Hash
+	End       uint64
+	Timestamp uint64
+}
+
+func (e *RoundCandidateStaleError) Error() string {
+	return fmt.Sprintf("round candidate stale %s %s %d %d", e.NodeId.String(), e.Candidate.String(), e.End, e.Timestamp)
+}
+
+type UnsignableSnapshotError struct {
+	NodeId     crypto.Hash
+	Signatures int
+	Timestamp  uint64
+}
+
+func (e *UnsignableSnapshotError) Error() string {
+	return fmt.Sprintf("unsignable snapshot %s %d %d", e.NodeId.String(), e.Signatures, e.Timestamp)
+}
+
+// the round and timestamp of the latest signed self snapshot, both never decrease,
+// they are assigned by signSnapshot and updated with the graph under the state lock
+type roundAssignment struct {
+	number    uint64
+	timestamp uint64
+}
+
+type RoundAssignmentError struct {
+	NodeId   crypto.Hash
+	Number   uint64
+	Assigned uint64
+}
+
+func (e *RoundAssignmentError) Error() string {
+	return fmt.Sprintf("round assignment %s %d %d", e.NodeId.String(), e.Number, e.Assigned)
+}
+
+// the snapshot should be signed again after the pending ones of the round finalized
+type RoundPendingError struct {
+	NodeId    crypto.Hash
+	Number    uint64
+	Start     uint64
+	Timestamp uint64
+}
+
+func (e *RoundPendingError) Error() string {
+	return fmt.Sprintf("round pending %s %d %d %d", e.NodeId.String(), e.Number, e.Start, e.Timestamp)
+}
+
+type UnknownReferencedNodeError struct {
+	NodeId    crypto.Hash
+	Reference crypto.Hash
+}
+
+func (e *UnknownReferencedNodeError) Error() string {
+	return fmt.Sprintf("unknown referenced node %s %s", e.NodeId.String(), e.Reference.String())
+}
+
+// the snapshot is malformed and never valid, it must have exactly two references
+type ReferenceCountError struct {
+	Hash  crypto.Hash
+	Count int
+}
+
+func (e *ReferenceCountError) Error() string {
+	return fmt.Sprintf("invalid reference count %s %d", e.Hash.String(), e.Count)
+}
+
+// the snapshot is malformed and never valid, the final round reference is empty
+type ZeroReferenceError struct {
+	Hash crypto.Hash
+}
+
+func (e *ZeroReferenceError) Error() string {
+	return fmt.Sprintf("zero reference %s", e.Hash.String())
+}
+
+// the snapshot is malformed and never valid, both references are the same round
+type DuplicateReferenceError struct {
+	Hash      crypto.Hash
+	Reference crypto.Hash
+}
+
+func (e *DuplicateReferenceError) Error() string {
+	return fmt.Sprintf("duplicate reference %s %s", e.Hash.String(), e.Reference.String())
+}
+
+// the snapshot references a round earlier than one linked already by its node
+type ReferenceStaleError struct {
+	Kind   string
+	Link   uint64
+	Number uint64
+}
+
+func (e *ReferenceStaleError) Error() string {
+	return fmt.Sprintf("invalid %s reference %d=>%d", e.Kind, e.Link, e.Number)
+}
+
+// the snapshot references a round of its own node as the final round of another node
+type ReferenceSelfError struct {
+	Hash   crypto.Hash
+	NodeId crypto.Hash
+	Number uint64
+}
+
+func (e *ReferenceSelfError) Error() string {
+	return fmt.Sprintf("self final reference %s %s %d", e.Hash.String(), e.NodeId.String(), e.Number)
+}
+
+// the referenced round is not any final round in the graph, it may be not synced yet
+type ReferenceMissingError struct {
+	Hash      crypto.Hash
+	Reference crypto.Hash
+}
+
+func (e *ReferenceMissingError) Error() string {
+	return fmt.Sprintf("missing reference %s %s", e.Hash.String(), e.Reference.String())
+}
+
+func isReferenceError(err error) bool {
+	switch err.(type) {
+	case *UnknownReferencedNodeError, *ReferenceCycleError:
+		return true
+	case *ReferenceCountError, *ReferenceStaleError, *ReferenceMissingError, *ReferenceSelfError:
+		return true
+	case *ZeroReferenceError, *DuplicateReferenceError:
+		return true
+	}
+	return false
+}
+
+// the node Via has linked the round Link of the node, while the round Number of the node
+// references the final round of the node Reference, which reaches Via
+type ReferenceCycleError struct {
+	NodeId    crypto.Hash
+	Number    uint64
+	Reference crypto.Hash
+	Via       crypto.Hash
+	Link      uint64
+}
+
+func (e *ReferenceCycleError) Error() string {
+	return fmt.Sprintf("reference cycle %s %d %s %s %d", e.NodeId.String(), e.Number, e.Reference.String(), e.Via.String(), e.Link)
+}
+
+type StaleRoundError struct {
+	NodeId crypto.Hash
+	Number uint64
+	Final  uint64
+}
+
+func (e *StaleRoundError) Error() string {
+	return fmt.Sprintf("stale round %s %d %d", e.NodeId.String(), e.Number, e.Final)
+}
+
+type NextRoundAvailableError struct {
+	NodeId crypto.Hash
+	Number uint64
+	Next   uint64
+}
+
+func (e *NextRoundAvailableError) Error() string {
+	return fmt.Sprintf("next round available %s %d %d", e.NodeId.String(), e.Number, e.Next)
+}
+
+// the genesis final round of a node is the only one allowed to have an empty hash
+func checkSignReferences(final *FinalRound, references [2]crypto.Hash) error {
+	if references[0] == references[1] {
+		return fmt.Errorf("same sign references %s", references[0].String())
+	}
+	if references[0].IsZero() && final.Number > 0 {
+		return fmt.Errorf("empty sign self reference %s %d", final.NodeId.String(), final.Number)
+	}
+	return nil
+}
+
 func (node *Node) sign(s *common.Snapshot) {
 	s.Sign(node.Account.PrivateSpendKey)
 	node.clearConsensusSignatures(s)
-	node.SnapshotsPool[s.PayloadHash()] = append([]crypto.Signature{}, s.Signatures...)
+	node.poolSnapshot(s.PayloadHash(), append([]crypto.Signature{}, s.Signatures...))
+	node.poolOrder.addSnapshot(s, node.SnapshotsPool)
 }
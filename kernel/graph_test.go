@@ -0,0 +1,1531 @@
+package kernel
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/crypto/edwards25519"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsensusThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(checkConsensusThreshold(2, 3))
+	assert.Nil(checkConsensusThreshold(1, 2))
+	assert.Nil(checkConsensusThreshold(3, 4))
+	assert.NotNil(checkConsensusThreshold(1, 3))
+	assert.NotNil(checkConsensusThreshold(3, 3))
+	assert.NotNil(checkConsensusThreshold(0, 3))
+	assert.NotNil(checkConsensusThreshold(2, 0))
+
+	node, accounts := testConsensusNode(7)
+	assert.Equal(4, node.consensusThreshold())
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:4] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	assert.False(node.verifyFinalization(s))
+	s.Signatures = append(s.Signatures, crypto.Signature{})
+	assert.False(node.verifyFinalization(s))
+	s.Sign(accounts[4].PrivateSpendKey)
+	assert.True(node.verifyFinalization(s))
+}
+
+func TestConsensusInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	// the pledging nodes count in the threshold, but never sign
+	for _, c := range []struct{ nodes, pledging, threshold int }{
+		{1, 0, 0}, {2, 0, 1}, {3, 0, 2}, {4, 0, 2}, {5, 0, 3}, {6, 0, 4}, {7, 0, 4}, {10, 0, 6}, {3, 1, 2}, {4, 1, 2},
+	} {
+		node, accounts := testConsensusNode(c.nodes)
+		for i := 0; i < c.pledging; i++ {
+			node.ConsensusNodes[c.nodes-1-i].State = common.NodeStatePledging
+		}
+		total, accepted, threshold := node.ConsensusInfo()
+		assert.Equal(c.nodes, total)
+		assert.Equal(c.nodes-c.pledging, accepted)
+		assert.Equal(c.threshold, threshold, fmt.Sprint(c))
+		assert.Equal(threshold, node.consensusThreshold())
+
+		// the finalization needs exactly one more signature than the threshold
+		s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+		for i := 0; i < threshold; i++ {
+			s.Sign(accounts[i].PrivateSpendKey)
+		}
+		assert.False(node.verifyFinalization(s), fmt.Sprint(c))
+		if threshold < accepted {
+			s.Sign(accounts[threshold].PrivateSpendKey)
+			assert.True(node.verifyFinalization(s), fmt.Sprint(c))
+		}
+	}
+}
+
+func TestVerifyFinalizationDistinctSigners(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:4] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	assert.False(node.verifyFinalization(s))
+
+	sig := testSignWithNonce(accounts[0].PrivateSpendKey, s.Payload(), []byte("nonce"))
+	assert.NotEqual(s.Signatures[0], sig)
+	assert.True(accounts[0].PublicSpendKey.Verify(s.Payload(), sig))
+	s.Signatures = append(s.Signatures, sig)
+	s.Signers = nil
+	assert.False(node.verifyFinalization(s))
+	assert.Len(s.Signatures, 5)
+	node.clearConsensusSignatures(s)
+	assert.Len(s.Signatures, 4)
+	assert.Len(s.Signers, 4)
+
+	s.Sign(accounts[4].PrivateSpendKey)
+	assert.True(node.verifyFinalization(s))
+}
+
+// a valid signature different from the deterministic one, with the nonce mixed into the message digest
+func testSignWithNonce(privateKey crypto.Key, message, nonce []byte) crypto.Signature {
+	var digest1, messageDigest, hramDigest [64]byte
+	var expandedSecretKey [32]byte
+	copy(expandedSecretKey[:], privateKey[:])
+
+	h := sha512.New()
+	h.Write(privateKey[:32])
+	h.Sum(digest1[:0])
+	h.Reset()
+	h.Write(digest1[32:])
+	h.Write(nonce)
+	h.Write(message)
+	h.Sum(messageDigest[:0])
+
+	var messageDigestReduced [32]byte
+	edwards25519.ScReduce(&messageDigestReduced, &messageDigest)
+	var R edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&R, &messageDigestReduced)
+	var encodedR [32]byte
+	R.ToBytes(&encodedR)
+
+	pub := privateKey.Public()
+	h.Reset()
+	h.Write(encodedR[:])
+	h.Write(pub[:])
+	h.Write(message)
+	h.Sum(hramDigest[:0])
+	var hramDigestReduced [32]byte
+	edwards25519.ScReduce(&hramDigestReduced, &hramDigest)
+
+	var sum [32]byte
+	edwards25519.ScMulAdd(&sum, &hramDigestReduced, &expandedSecretKey, &messageDigestReduced)
+
+	var sig crypto.Signature
+	copy(sig[:], encodedR[:])
+	copy(sig[32:], sum[:])
+	return sig
+}
+
+func TestClearConsensusSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:5] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	seed := crypto.NewHash([]byte("stranger"))
+	stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Sign(stranger.PrivateSpendKey)
+	s.Signatures = append(s.Signatures, s.Signatures[0])
+	assert.Len(s.Signatures, 7)
+
+	assert.Nil(node.clearConsensusSignatures(s))
+	assert.Len(s.Signatures, 5)
+	assert.Len(s.Signers, 5)
+	for i, sig := range s.Signatures {
+		assert.Equal(accounts[i].Hash().ForNetwork(node.networkId), s.Signers[sig])
+	}
+
+	node.clearConsensusSignatures(s)
+	assert.Len(s.Signatures, 5)
+	assert.Len(s.Signers, 5)
+}
+
+func TestVerifyCache(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:5] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	seed := crypto.NewHash([]byte("stranger"))
+	stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Sign(stranger.PrivateSpendKey)
+	sigs := s.Signatures
+
+	assert.Nil(node.clearConsensusSignatures(s))
+	assert.Equal(uint64(6), metrics.histograms[MetricSignatureVerify].count)
+	msg, hash := s.Payload(), s.PayloadHash()
+	verifier, _ := s.Verifier()
+	for _, sig := range sigs {
+		r, found := node.verified.get(sig, hash)
+		assert.True(found)
+		id, valid := node.signatureSigner(verifier, msg, sig)
+		assert.Equal(valid, r.found)
+		assert.Equal(id, r.id)
+	}
+
+	s.Signatures, s.Signers = sigs, nil
+	assert.Nil(node.clearConsensusSignatures(s))
+	assert.Equal(uint64(6), metrics.histograms[MetricSignatureVerify].count)
+	assert.Len(s.Signers, 5)
+
+	other := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: 1}
+	other.Signatures = sigs[:1]
+	assert.Nil(node.clearConsensusSignatures(other))
+	assert.Len(other.Signatures, 0)
+	assert.Equal(uint64(7), metrics.histograms[MetricSignatureVerify].count)
+
+	node.updateConsensusNodes(node.ConsensusNodes[1:])
+	_, found := node.verified.get(sigs[0], hash)
+	assert.False(found)
+	s.Signatures, s.Signers = sigs, nil
+	assert.Nil(node.clearConsensusSignatures(s))
+	assert.Len(s.Signers, 4)
+	assert.Equal(uint64(13), metrics.histograms[MetricSignatureVerify].count)
+}
+
+func TestStrictSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	seed := crypto.NewHash([]byte("mask"))
+	store := newLaneTestStore(seed, accounts)
+	node.store = store
+
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(crypto.NewHash([]byte("genesis")), 0)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+	signed := &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+	assert.Nil(signed.Validate(store))
+	s := &common.Snapshot{NodeId: accounts[1].Hash().ForNetwork(node.networkId), Transaction: signed, Timestamp: 100}
+	s.References = [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("final"))}
+	s.Sign(accounts[1].PrivateSpendKey)
+	seed = crypto.NewHash([]byte("stranger"))
+	stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Sign(stranger.PrivateSpendKey)
+
+	c := *s
+	assert.Nil(node.clearConsensusSignatures(&c))
+	assert.Len(c.Signatures, 1)
+
+	strict := config.StrictSignatures
+	config.StrictSignatures = true
+	defer func() { config.StrictSignatures = strict }()
+	c = *s
+	assert.NotNil(node.clearConsensusSignatures(&c))
+	assert.Len(c.Signatures, 1)
+	assert.Len(c.Signers, 1)
+	c = *s
+	c.Signatures = c.Signatures[:1]
+	assert.Nil(node.clearConsensusSignatures(&c))
+
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, false))
+	assert.Len(store.written, 0)
+}
+
+// a stub scheme signing the hash of the public key and message, which anyone could forge
+type stubVerifier struct {
+	calls int
+}
+
+func (v *stubVerifier) Verify(pub crypto.Key, message []byte, sig crypto.Signature) bool {
+	v.calls++
+	return sig == stubSignature(pub, message)
+}
+
+func stubSignature(pub crypto.Key, message []byte) crypto.Signature {
+	var sig crypto.Signature
+	h := crypto.NewHash(append(pub[:], message...))
+	copy(sig[:32], h[:])
+	h = crypto.NewHash(h[:])
+	copy(sig[32:], h[:])
+	return sig
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	assert := assert.New(t)
+
+	const scheme = crypto.SignatureScheme(7)
+	node, accounts := testConsensusNode(7)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	payload := s.Payload()
+	s.Scheme = scheme
+	assert.NotEqual(payload, s.Payload())
+	for _, a := range accounts[:5] {
+		s.Signatures = append(s.Signatures, stubSignature(a.PublicSpendKey, s.Payload()))
+	}
+	s.Sign(accounts[5].PrivateSpendKey)
+	sigs := s.Signatures
+
+	assert.NotNil(node.clearConsensusSignatures(s))
+	assert.Len(s.Signatures, 0)
+	assert.False(node.verifyFinalization(s))
+
+	verifier := &stubVerifier{}
+	crypto.RegisterVerifier(scheme, verifier)
+	defer crypto.RegisterVerifier(scheme, nil)
+	s.Signatures = sigs
+	assert.NotNil(node.clearConsensusSignatures(s))
+	assert.Equal(0, verifier.calls)
+
+	schemes := config.SignatureSchemes
+	config.SignatureSchemes = []int{int(crypto.SchemeEd25519), int(scheme)}
+	defer func() { config.SignatureSchemes = schemes }()
+	s.Signatures = sigs
+	assert.Nil(node.clearConsensusSignatures(s))
+	assert.Len(s.Signatures, 5)
+	for i, sig := range s.Signatures {
+		assert.Equal(accounts[i].Hash().ForNetwork(node.networkId), s.Signers[sig])
+	}
+	assert.True(verifier.calls > 0)
+	s.Signatures, s.Signers = sigs, nil
+	assert.True(node.verifyFinalization(s))
+	assert.True(node.checkSnapshotSigner(s, &node.ConsensusNodes[0]))
+	assert.False(node.checkSnapshotSigner(s, &node.ConsensusNodes[5]))
+
+	d := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:5] {
+		d.Sign(a.PrivateSpendKey)
+	}
+	d.Signatures = append(d.Signatures, stubSignature(accounts[5].PublicSpendKey, d.Payload()))
+	calls := verifier.calls
+	assert.Nil(node.clearConsensusSignatures(d))
+	assert.Len(d.Signatures, 5)
+	assert.True(node.verifyFinalization(d))
+	assert.Equal(calls, verifier.calls)
+}
+
+func TestSignSnapshotTimestampWait(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	cache.End = uint64(time.Now().Add(time.Hour).UnixNano())
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := node.signSnapshot(ctx, s)
+	assert.NotNil(err)
+	assert.Equal(uint64(0), s.Timestamp)
+	assert.True(time.Since(start) < time.Second)
+
+	cache.End = 0
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.True(s.Timestamp > 0)
+}
+
+func TestSignReferences(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	final := node.Graph.FinalRound[node.IdForNetwork]
+	final.Hash = crypto.Hash{}
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.False(s.References[0].HasValue())
+	assert.True(s.References[1].HasValue())
+
+	final.Number = 1
+	s = &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.NotNil(err)
+	assert.Equal(uint64(0), s.Timestamp)
+
+	hash := crypto.NewHash([]byte("final"))
+	assert.NotNil(checkSignReferences(final, [2]crypto.Hash{hash, hash}))
+	assert.Nil(checkSignReferences(final, [2]crypto.Hash{hash, crypto.Hash{}}))
+}
+
+func TestBestReferenceRound(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	ids := make([]crypto.Hash, 0)
+	for _, a := range accounts[1:] {
+		ids = append(ids, a.Hash().ForNetwork(node.networkId))
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	for _, r := range node.Graph.FinalRound {
+		r.Start, r.End = 100, 100
+	}
+	node.Graph.FinalRound[ids[0]].Start = 50
+	node.Graph.FinalRound[ids[1]].Hash = crypto.Hash{}
+	node.Graph.FinalRound[ids[2]].End = 300
+	node.Graph.FinalRound[node.IdForNetwork].Start = 200
+	node.Graph.UpdateFinalCache()
+
+	for i := 0; i < 100; i++ {
+		best := bestReferenceRound(node.Graph.FinalCache(), node.IdForNetwork, 200)
+		assert.Equal(ids[3], best.NodeId)
+	}
+	assert.Nil(bestReferenceRound(node.Graph.FinalCache(), node.IdForNetwork, 100))
+
+	node.Graph.FinalRound[ids[4]].Start = 150
+	node.Graph.UpdateFinalCache()
+	for i := 0; i < 10; i++ {
+		s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(i)}
+		_, _, err := node.signSnapshot(context.Background(), s)
+		assert.Nil(err)
+		assert.Equal(node.Graph.FinalRound[ids[4]].Hash, s.References[1])
+	}
+}
+
+// the references of a 50 nodes network, with the round links of all nodes written
+func BenchmarkVerifyReferences(b *testing.B) {
+	root, err := ioutil.TempDir("", "mixin-kernel-test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, err := storage.NewBadgerStore(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	node, _ := testConsensusNode(50)
+	node.store = store
+	node.Graph = testRoundGraph(node)
+	genesis := make([]*common.SnapshotWithTopologicalOrder, 0)
+	for i, id := range node.Graph.Nodes {
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: id[:]})
+		s := &common.SnapshotWithTopologicalOrder{
+			Snapshot:         common.Snapshot{NodeId: id, Transaction: &common.SignedTransaction{Transaction: *tx}, Timestamp: 1000},
+			TopologicalOrder: uint64(i),
+			RoundLinks:       make(map[crypto.Hash]uint64),
+		}
+		for _, to := range node.Graph.Nodes {
+			s.RoundLinks[to] = 0
+		}
+		genesis = append(genesis, s)
+	}
+	err = store.SnapshotsLoadGenesis(genesis)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	nodes := node.Graph.Nodes
+	snapshots := make([]*common.Snapshot, len(nodes))
+	for i, id := range nodes {
+		other := node.Graph.FinalRound[nodes[(i+1)%len(nodes)]]
+		snapshots[i] = &common.Snapshot{NodeId: id, Timestamp: 2000, Transaction: &common.SignedTransaction{}}
+		snapshots[i].References = [2]crypto.Hash{node.Graph.FinalRound[id].Hash, other.Hash}
+	}
+	verify := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s := snapshots[i%len(snapshots)]
+			_, err := node.verifyReferences(*node.Graph.FinalRound[s.NodeId], s)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	cache := config.StorageRoundLinksCache
+	defer func() { config.StorageRoundLinksCache = cache }()
+	config.StorageRoundLinksCache = false
+	b.Run("store", verify)
+	config.StorageRoundLinksCache = true
+	b.Run("cache", verify)
+}
+
+func BenchmarkClearConsensusSignatures(b *testing.B) {
+	node, accounts := testConsensusNode(31)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts {
+		s.Sign(a.PrivateSpendKey)
+	}
+	sigs := s.Signatures
+
+	b.Run("verify", func(b *testing.B) {
+		metrics := NewPrometheusMetrics()
+		node.Metrics = metrics
+		for i := 0; i < b.N; i++ {
+			s.Signatures, s.Signers = sigs, nil
+			node.verified.reset()
+			node.clearConsensusSignatures(s)
+		}
+		b.ReportMetric(float64(metrics.histograms[MetricSignatureVerify].count)/float64(b.N), "verifies/op")
+	})
+	b.Run("cached", func(b *testing.B) {
+		metrics := NewPrometheusMetrics()
+		node.Metrics = metrics
+		for i := 0; i < b.N; i++ {
+			s.Signatures, s.Signers = sigs, nil
+			node.clearConsensusSignatures(s)
+		}
+		var count uint64
+		if h := metrics.histograms[MetricSignatureVerify]; h != nil {
+			count = h.count
+		}
+		b.ReportMetric(float64(count)/float64(b.N), "verifies/op")
+	})
+	b.Run("signers", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.Signatures = sigs
+			node.clearConsensusSignatures(s)
+		}
+	})
+
+	for name, metrics := range map[string]Metrics{"noop": noopMetrics{}, "prometheus": NewPrometheusMetrics()} {
+		node.Metrics = metrics
+		for _, n := range []int{1, 4, 16, 31} {
+			b.Run(fmt.Sprintf("%s/%d", name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s.Signatures, s.Signers = sigs[:n], nil
+					node.verified.reset()
+					node.clearConsensusSignatures(s)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifySnapshotKnown(t *testing.T) {
+	assert := assert.New(t)
+
+	node, s := testKnownSnapshot()
+	sigs := s.Signatures
+	node.SnapshotsPool[s.PayloadHash()] = sigs
+	s.Signatures = sigs[:3]
+	r, err := node.verifySnapshot(s)
+	assert.Nil(err)
+	assert.True(r.Known)
+	assert.Len(s.Signatures, 3)
+
+	node.SnapshotsPool[s.PayloadHash()] = sigs[:2]
+	r, err = node.verifySnapshot(s)
+	assert.Nil(err)
+	assert.False(r.Known)
+	assert.Len(s.Signatures, 3)
+	assert.Len(node.SnapshotsPool[s.PayloadHash()], 3)
+}
+
+func TestVerifySnapshotStaleRound(t *testing.T) {
+	assert := assert.New(t)
+
+	node, s := testKnownSnapshot()
+	final, cache := node.Graph.FinalRound[s.NodeId], node.Graph.CacheRound[s.NodeId]
+	final.Number, cache.Number = 5, 6
+
+	s.RoundNumber = 3
+	r, err := node.verifySnapshot(s)
+	assert.True(r.Handled)
+	stale, ok := err.(*StaleRoundError)
+	assert.True(ok)
+	assert.Equal(uint64(3), stale.Number)
+	assert.Equal(uint64(5), stale.Final)
+
+	node.SnapshotsPool[s.PayloadHash()] = s.Signatures[:2]
+	_, err = node.verifySnapshot(s)
+	_, ok = err.(*StaleRoundError)
+	assert.True(ok)
+
+	s.RoundNumber = 5
+	_, err = node.verifySnapshot(s)
+	_, ok = err.(*StaleRoundError)
+	assert.False(ok)
+}
+
+func BenchmarkVerifySnapshotKnown(b *testing.B) {
+	node, s := testKnownSnapshot()
+	sigs := s.Signatures
+
+	b.Run("known", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			node.SnapshotsPool[s.PayloadHash()] = sigs
+			s.Signatures = sigs
+			node.verifySnapshot(s)
+		}
+	})
+	b.Run("merge", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			node.SnapshotsPool[s.PayloadHash()] = sigs[1:]
+			s.Signatures = sigs
+			node.verifySnapshot(s)
+		}
+	})
+}
+
+func testKnownSnapshot() (*Node, *common.Snapshot) {
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	node.store = &linkTestStore{links: make(map[crypto.Hash]uint64)}
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	self, other := node.Graph.FinalRound[peer], node.Graph.FinalRound[node.IdForNetwork]
+	s := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, RoundNumber: 1, Timestamp: 100}
+	s.References = [2]crypto.Hash{self.Hash, other.Hash}
+	for _, a := range accounts[:5] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	return node, s
+}
+
+type testClock struct {
+	now uint64
+}
+
+func (c *testClock) Now() uint64 {
+	return c.now
+}
+
+func TestSignSnapshotRoundRollover(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	clock := &testClock{}
+	node.Clock = clock
+	// the test clock runs ahead of start, which must be still behind the wall clock
+	start := uint64(time.Now().Add(-time.Minute).UnixNano())
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	cache.Start, cache.End = start, start
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	clock.now = start + config.SnapshotRoundGap - 1
+	c, _, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(clock.now, s.Timestamp)
+	assert.Equal(uint64(1), s.RoundNumber)
+	assert.Equal(start, c.Start)
+
+	s.Timestamp = 0
+	clock.now = start + config.SnapshotRoundGap
+	c, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(uint64(1), s.RoundNumber)
+	assert.Equal(clock.now, c.Start)
+
+	ps := &common.Snapshot{NodeId: node.IdForNetwork, Timestamp: start, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:5] {
+		ps.Sign(a.PrivateSpendKey)
+	}
+	cache.Snapshots = []*common.Snapshot{ps}
+	s.Timestamp = 0
+	c, f, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(uint64(2), s.RoundNumber)
+	assert.Equal(uint64(2), c.Number)
+	assert.Equal(clock.now, c.Start)
+	assert.Equal(uint64(1), f.Number)
+	assert.Equal(f.Hash, s.References[0])
+}
+
+type stepClock struct {
+	now  uint64
+	step uint64
+}
+
+func (c *stepClock) Now() uint64 {
+	return atomic.AddUint64(&c.now, c.step)
+}
+
+func TestSignSnapshotConcurrentRounds(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts, store := testReplayNode(assert)
+	node.ConsensusNodes[0].Weight = 20
+	node.Clock = &stepClock{now: replayGenesis + node.roundGap, step: node.roundGap / 4}
+
+	const count = 32
+	var wg sync.WaitGroup
+	signed := make([]*common.Snapshot, count)
+	for i := 0; i < count; i++ {
+		genesis, err := store.SnapshotsReadSnapshotsForNodeRound(accounts[i/replayOutputs].Hash().ForNetwork(node.networkId), 0)
+		assert.Nil(err)
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.AddInput(genesis[0].Transaction.PayloadHash(), i%replayOutputs)
+		tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+		st := &common.SignedTransaction{Transaction: *tx}
+		assert.Nil(st.SignInput(store, 0, accounts[:1]))
+
+		wg.Add(1)
+		go func(i int, s *common.Snapshot) {
+			defer wg.Done()
+			// deferred until the pending snapshots of the round finalized
+			for s.Timestamp == 0 {
+				assert.Nil(node.handleSnapshotInput(s))
+			}
+			signed[i] = &common.Snapshot{RoundNumber: s.RoundNumber, Timestamp: s.Timestamp}
+			assert.Nil(node.handleSnapshotInput(s))
+		}(i, &common.Snapshot{NodeId: node.IdForNetwork, Transaction: st})
+	}
+	wg.Wait()
+
+	sort.Slice(signed, func(i, j int) bool { return signed[i].Timestamp < signed[j].Timestamp })
+	for i := 1; i < count; i++ {
+		assert.True(signed[i].Timestamp > signed[i-1].Timestamp)
+		assert.True(signed[i].RoundNumber >= signed[i-1].RoundNumber)
+	}
+	assert.True(signed[count-1].RoundNumber > signed[0].RoundNumber)
+	assert.Equal(signed[count-1].RoundNumber, node.assigned.number)
+	assert.Equal(signed[count-1].Timestamp, node.assigned.timestamp)
+	assert.Equal(node.assigned.number, node.Graph.CacheRound[node.IdForNetwork].Number)
+}
+
+func TestSignSnapshotRoundAssignment(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	start := uint64(time.Now().Add(-time.Minute).UnixNano())
+	node.Clock = &testClock{now: start}
+	node.assigned = roundAssignment{number: 2, timestamp: start - 1}
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.Equal(&RoundAssignmentError{NodeId: node.IdForNetwork, Number: 1, Assigned: 2}, err)
+	assert.Equal(uint64(0), s.Timestamp)
+
+	node.assigned.number = 1
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(start, s.Timestamp)
+	assert.Equal(uint64(1), s.RoundNumber)
+
+	// the round can't move its start past a pending self snapshot
+	pending := &common.Snapshot{NodeId: node.IdForNetwork, RoundNumber: 1, Timestamp: start}
+	node.pending = map[crypto.Hash]*pendingSnapshot{pending.PayloadHash(): {snapshot: pending}}
+	s = &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.IsType(&RoundPendingError{}, err)
+	assert.Equal(uint64(0), s.Timestamp)
+	delete(node.pending, pending.PayloadHash())
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+}
+
+func TestShouldSign(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	start := uint64(time.Now().Add(-time.Minute).UnixNano())
+	node.Clock = &testClock{now: start}
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	assert.True(node.shouldSign(s))
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	foreign := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}}
+	assert.False(node.shouldSign(foreign))
+	signed := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	signed.Sign(accounts[0].PrivateSpendKey)
+	assert.False(node.shouldSign(signed))
+	stamped := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: start}
+	assert.False(node.shouldSign(stamped))
+
+	for _, c := range []*common.Snapshot{foreign, signed, stamped} {
+		ref := *c
+		cache, final, err := node.signSnapshot(context.Background(), c)
+		assert.Equal(&UnsignableSnapshotError{NodeId: c.NodeId, Signatures: len(c.Signatures), Timestamp: c.Timestamp}, err)
+		assert.Equal(node.Graph.CacheRound[c.NodeId].Number, cache.Number)
+		assert.Equal(node.Graph.FinalRound[c.NodeId].Hash, final.Hash)
+		assert.Equal(ref.Timestamp, c.Timestamp)
+		assert.Equal(ref.References, c.References)
+	}
+
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(start, s.Timestamp)
+	assert.False(node.shouldSign(s))
+}
+
+func TestSignSnapshotClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	clock := &testClock{}
+	node.Clock = clock
+	start := uint64(time.Now().Add(-time.Minute).UnixNano())
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	node.Graph.CacheRound[peer].End = start
+	timestamp, local := node.ObservedTimestamp()
+	assert.Equal(uint64(0), timestamp)
+	assert.Equal(uint64(0), local)
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	clock.now = start + config.SnapshotClockSkewThreshold*2
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+
+	clock.now = start + config.SnapshotClockSkewThreshold
+	node.observeTimestamp(start)
+	clock.now = start + config.SnapshotClockSkewThreshold*3
+	s.Timestamp = 0
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+
+	clock.now = start + config.SnapshotClockSkewThreshold + 1
+	node.observed = clockObservation{}
+	node.observeTimestamp(start)
+	timestamp, local = node.ObservedTimestamp()
+	assert.Equal(start, timestamp)
+	assert.Equal(start+config.SnapshotClockSkewThreshold+1, local)
+	clock.now = start + config.SnapshotClockSkewThreshold*3
+	s.Timestamp = 0
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.IsType(&ClockSkewError{}, err)
+	assert.Equal(uint64(0), s.Timestamp)
+	cse := err.(*ClockSkewError)
+	assert.Equal(clock.now, cse.Timestamp)
+	assert.Equal(timestamp+clock.now-local, cse.Observed)
+	assert.Equal(start+config.SnapshotClockSkewThreshold*2-1, cse.Observed)
+}
+
+func TestSignSnapshotTimestampWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	clock := &testClock{}
+	node.Clock = clock
+	now := uint64(time.Now().UnixNano())
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	cache.Start, cache.End = now-uint64(time.Hour), now-uint64(time.Hour)
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	node.Graph.CacheRound[peer].End = now
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	clock.now = now + uint64(time.Minute)
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.IsType(&ClockSkewError{}, err)
+	assert.Equal(uint64(0), s.Timestamp)
+	cse := err.(*ClockSkewError)
+	assert.Equal(clock.now, cse.Timestamp)
+	assert.True(cse.Observed >= now)
+	assert.Equal(config.SnapshotTimestampTolerance, cse.Threshold)
+
+	clock.now = now + config.SnapshotTimestampTolerance/2
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(clock.now, s.Timestamp)
+
+	// the graph is far behind and no peer timestamp observed yet
+	node.Graph.CacheRound[peer].End = now - config.SnapshotTimestampMaxAhead - uint64(time.Hour)
+	s.Timestamp = 0
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.IsType(&ClockSkewError{}, err)
+	assert.Equal(node.Graph.CacheRound[peer].End, err.(*ClockSkewError).Observed)
+
+	node.observed = clockObservation{timestamp: now, local: now}
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+}
+
+func TestSignSnapshotNetworkRoundGap(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(config.SnapshotRoundGap, (&Genesis{}).roundGap())
+	assert.Equal(uint64(time.Second*2), (&Genesis{RoundGap: uint64(time.Second * 2)}).roundGap())
+
+	start := uint64(time.Now().Add(-time.Minute).UnixNano())
+	short, long := testRoundGapNode(start, 2*time.Second), testRoundGapNode(start, 5*time.Second)
+	for _, node := range []*Node{short, long} {
+		node.Clock.(*testClock).now = start + uint64(3*time.Second)
+	}
+
+	s := &common.Snapshot{NodeId: short.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	c, f, err := short.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(uint64(2), s.RoundNumber)
+	assert.Equal(uint64(2), c.Number)
+	assert.Equal(uint64(1), f.Number)
+
+	s = &common.Snapshot{NodeId: long.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	c, f, err = long.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(uint64(1), s.RoundNumber)
+	assert.Equal(uint64(1), c.Number)
+	assert.Equal(start, c.Start)
+	assert.Equal(uint64(0), f.Number)
+}
+
+func testRoundGapNode(start uint64, gap time.Duration) *Node {
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	node.Clock = &testClock{}
+	node.roundGap = uint64(gap)
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	cache.Start, cache.End = start, start
+	ps := &common.Snapshot{NodeId: node.IdForNetwork, Timestamp: start, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:5] {
+		ps.Sign(a.PrivateSpendKey)
+	}
+	cache.Snapshots = []*common.Snapshot{ps}
+	return node
+}
+
+func testConsensusNode(n int) (*Node, []common.Address) {
+	node := &Node{
+		networkId:      crypto.NewHash([]byte("network")),
+		ConsensusNodes: make([]common.Node, 0),
+		Clock:          wallClock{},
+		Metrics:        noopMetrics{},
+		store:          storage.NewMemoryStore(),
+		roundGap:       config.SnapshotRoundGap,
+		seenCache:      newHashLRU(16),
+		aggregation:    &aggregationPeers{peers: make(map[crypto.Hash]bool)},
+	}
+	accounts := make([]common.Address, 0)
+	for i := 0; i < n; i++ {
+		seed := crypto.NewHash([]byte(fmt.Sprintf("node%d", i)))
+		a := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+		accounts = append(accounts, a)
+		node.ConsensusNodes = append(node.ConsensusNodes, common.Node{Account: a, State: common.NodeStateAccepted})
+	}
+	node.Account = accounts[0]
+	node.IdForNetwork = accounts[0].Hash().ForNetwork(node.networkId)
+	return node, accounts
+}
+
+func testRoundGraph(node *Node) *RoundGraph {
+	graph := &RoundGraph{
+		CacheRound: make(map[crypto.Hash]*CacheRound),
+		FinalRound: make(map[crypto.Hash]*FinalRound),
+	}
+	for _, cn := range node.ConsensusNodes {
+		id := cn.IdForNetwork(node.networkId)
+		graph.Nodes = append(graph.Nodes, id)
+		graph.CacheRound[id] = &CacheRound{NodeId: id, Number: 1}
+		graph.FinalRound[id] = &FinalRound{NodeId: id, Hash: crypto.NewHash(id[:])}
+	}
+	graph.UpdateFinalCache()
+	return graph
+}
+
+type linkTestStore struct {
+	storage.Store
+	links map[crypto.Hash]uint64
+	err   error
+}
+
+func (s *linkTestStore) SnapshotsReadRoundLink(from, to crypto.Hash) (uint64, error) {
+	return s.links[to], s.err
+}
+
+func TestVerifyReferences(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	store := &linkTestStore{links: make(map[crypto.Hash]uint64)}
+	node.store = store
+
+	self := *node.Graph.FinalRound[node.IdForNetwork]
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	other := node.Graph.FinalRound[peer]
+	other.Number = 3
+	other.End = 100
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: 200}
+
+	s.References = [2]crypto.Hash{self.Hash, self.Hash}
+	r, err := node.verifyReferences(self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+
+	s.References = [2]crypto.Hash{other.Hash, self.Hash}
+	r, err = node.verifyReferences(self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+
+	s.References = [2]crypto.Hash{self.Hash, other.Hash}
+	r, err = node.verifyReferences(self, s)
+	assert.Nil(err)
+	assert.True(r.Handled)
+	assert.Equal(uint64(3), r.Links[peer])
+	assert.Equal(self.Number, r.Links[node.IdForNetwork])
+
+	s.Timestamp = 100
+	r, err = node.verifyReferences(self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+	s.Timestamp = 200
+
+	store.links[peer] = 4
+	r, err = node.verifyReferences(self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+
+	store.err = fmt.Errorf("store failure")
+	r, err = node.verifyReferences(self, s)
+	assert.NotNil(err)
+	assert.False(r.Handled)
+}
+
+type pairLinkTestStore struct {
+	storage.Store
+	links map[[2]crypto.Hash]uint64
+}
+
+func (s *pairLinkTestStore) SnapshotsReadRoundLink(from, to crypto.Hash) (uint64, error) {
+	return s.links[[2]crypto.Hash{from, to}], nil
+}
+
+func TestVerifyReferencesPeerLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	store := &pairLinkTestStore{links: make(map[[2]crypto.Hash]uint64)}
+	node.store = store
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	other := accounts[2].Hash().ForNetwork(node.networkId)
+	self := node.Graph.FinalRound[peer]
+	self.Number = 5
+	final := node.Graph.FinalRound[other]
+	final.Number = 3
+	final.End = 100
+	s := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, Timestamp: 200}
+	s.References = [2]crypto.Hash{self.Hash, final.Hash}
+
+	// links of other nodes never restrict the peer references
+	store.links[[2]crypto.Hash{other, peer}] = 9
+	store.links[[2]crypto.Hash{other, other}] = 9
+	store.links[[2]crypto.Hash{node.IdForNetwork, other}] = 9
+	store.links[[2]crypto.Hash{peer, peer}] = 5
+	store.links[[2]crypto.Hash{peer, other}] = 3
+	r, err := node.verifyReferences(*self, s)
+	assert.Nil(err)
+	assert.Equal(uint64(5), r.Links[peer])
+	assert.Equal(uint64(3), r.Links[other])
+
+	store.links[[2]crypto.Hash{peer, other}] = 4
+	r, err = node.verifyReferences(*self, s)
+	assert.EqualError(err, "invalid final reference 4=>3")
+	assert.True(r.Handled)
+
+	store.links[[2]crypto.Hash{peer, other}] = 3
+	store.links[[2]crypto.Hash{peer, peer}] = 6
+	r, err = node.verifyReferences(*self, s)
+	assert.EqualError(err, "invalid self reference 6=>5")
+	assert.True(r.Handled)
+}
+
+func TestVerifyReferenceCycle(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	store := &pairLinkTestStore{links: make(map[[2]crypto.Hash]uint64)}
+	node.store = store
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	other := accounts[2].Hash().ForNetwork(node.networkId)
+	third := accounts[3].Hash().ForNetwork(node.networkId)
+	self := node.Graph.FinalRound[peer]
+	self.Number = 5
+	final := node.Graph.FinalRound[other]
+	final.Number = 3
+	final.End = 100
+	s := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, Timestamp: 200, RoundNumber: 6}
+	s.References = [2]crypto.Hash{self.Hash, final.Hash}
+
+	store.links[[2]crypto.Hash{peer, peer}] = 5
+	store.links[[2]crypto.Hash{peer, other}] = 2
+	store.links[[2]crypto.Hash{other, third}] = 4
+	store.links[[2]crypto.Hash{other, peer}] = 5
+	store.links[[2]crypto.Hash{third, peer}] = 5
+	r, err := node.verifyReferences(*self, s)
+	assert.Nil(err)
+	assert.Equal(uint64(3), r.Links[other])
+
+	// other => third => peer round 6, which references other round 3
+	store.links[[2]crypto.Hash{third, peer}] = 6
+	r, err = node.verifyReferences(*self, s)
+	assert.IsType(&ReferenceCycleError{}, err)
+	assert.True(r.Handled)
+	cycle := err.(*ReferenceCycleError)
+	assert.Equal(peer, cycle.NodeId)
+	assert.Equal(uint64(6), cycle.Number)
+	assert.Equal(third, cycle.Via)
+
+	// the cycle is never checked again for an existing link
+	store.links[[2]crypto.Hash{peer, other}] = 3
+	r, err = node.verifyReferences(*self, s)
+	assert.Nil(err)
+
+	store.links[[2]crypto.Hash{peer, other}] = 2
+	node.Graph.CacheRound[peer].Number = 6
+	node.Graph.CacheRound[peer].Start = 200
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	r, err = node.verifySnapshot(s)
+	assert.IsType(&ReferenceCycleError{}, err)
+	assert.True(r.Handled)
+}
+
+func TestReferenceErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	store := &pairLinkTestStore{links: make(map[[2]crypto.Hash]uint64)}
+	node.store = store
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	other := accounts[2].Hash().ForNetwork(node.networkId)
+	self := node.Graph.FinalRound[peer]
+	final := node.Graph.FinalRound[other]
+	final.Number = 3
+	s := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, Timestamp: 200}
+
+	s.References = [2]crypto.Hash{self.Hash, self.Hash}
+	_, err := node.verifyReferences(*self, s)
+	var duplicate *DuplicateReferenceError
+	assert.True(errors.As(err, &duplicate))
+	assert.Equal(self.Hash, duplicate.Reference)
+	var count *ReferenceCountError
+	assert.False(errors.As(err, &count))
+	s.References = [2]crypto.Hash{self.Hash, crypto.Hash{}}
+	_, err = node.verifyReferences(*self, s)
+	var zero *ZeroReferenceError
+	assert.True(errors.As(err, &zero))
+	assert.Equal(s.PayloadHash(), zero.Hash)
+	assert.False(errors.As(err, &count))
+
+	s.References = [2]crypto.Hash{self.Hash, crypto.NewHash([]byte("missing"))}
+	r, err := node.verifyReferences(*self, s)
+	assert.IsType(&ReferenceMissingError{}, err)
+	assert.True(r.Handled)
+	assert.Equal(s.References[1], err.(*ReferenceMissingError).Reference)
+
+	s.References = [2]crypto.Hash{self.Hash, final.Hash}
+	store.links[[2]crypto.Hash{peer, other}] = 4
+	_, err = node.verifyReferences(*self, s)
+	assert.IsType(&ReferenceStaleError{}, err)
+	assert.Equal("final", err.(*ReferenceStaleError).Kind)
+	store.links[[2]crypto.Hash{peer, other}] = 3
+	store.links[[2]crypto.Hash{peer, peer}] = 1
+	_, err = node.verifyReferences(*self, s)
+	assert.IsType(&ReferenceStaleError{}, err)
+	assert.Equal("self", err.(*ReferenceStaleError).Kind)
+	store.links[[2]crypto.Hash{peer, peer}] = 0
+	_, err = node.verifyReferences(*self, s)
+	assert.Nil(err)
+
+	for _, e := range []error{&ReferenceCountError{}, &ZeroReferenceError{}, &DuplicateReferenceError{}, &ReferenceStaleError{}, &ReferenceMissingError{}, &ReferenceSelfError{}, &ReferenceCycleError{}, &UnknownReferencedNodeError{}} {
+		assert.True(isReferenceError(e))
+	}
+	assert.False(isReferenceError(&StaleRoundError{}))
+}
+
+func TestReferenceErrorsHandling(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	seed := crypto.NewHash([]byte("mask"))
+	store := newLaneTestStore(seed, accounts)
+	node.store = store
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.mempoolChan = make(chan *common.Snapshot, 16)
+	node.closing = make(chan struct{})
+	node.roundGap = uint64(10 * time.Millisecond)
+
+	snapshot := func(i int, reference crypto.Hash) *common.Snapshot {
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.AddInput(crypto.NewHash([]byte("genesis")), i)
+		tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+		signed := &common.SignedTransaction{Transaction: *tx}
+		assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+		peer := accounts[1].Hash().ForNetwork(node.networkId)
+		s := &common.Snapshot{NodeId: peer, Transaction: signed, RoundNumber: 1, Timestamp: 100}
+		s.References = [2]crypto.Hash{node.Graph.FinalRound[peer].Hash, reference}
+		s.Sign(accounts[1].PrivateSpendKey)
+		return s
+	}
+
+	// malformed, dropped without signing
+	malformed := snapshot(0, node.Graph.FinalRound[accounts[1].Hash().ForNetwork(node.networkId)].Hash)
+	assert.Nil(node.handleSnapshotInput(malformed))
+	assert.Len(malformed.Signatures, 1)
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, false))
+	assert.Len(node.mempoolChan, 0)
+
+	// missing, handled again later until the retries limit
+	missing := snapshot(1, crypto.NewHash([]byte("missing")))
+	for i := 1; i <= config.SnapshotReferenceRetries; i++ {
+		assert.Nil(node.handleSnapshotInput(missing))
+		assert.Len(missing.Signatures, 1)
+		assert.Equal(i, node.refRetries[missing.PayloadHash()])
+		select {
+		case s := <-node.mempoolChan:
+			assert.Equal(missing, s)
+		case <-time.After(time.Second):
+			assert.Fail("missing reference not retried")
+		}
+	}
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, false))
+	assert.Nil(node.handleSnapshotInput(missing))
+	assert.Equal(uint64(2), metrics.Value(MetricValidationFailure, false))
+	assert.Len(node.refRetries, 0)
+	time.Sleep(30 * time.Millisecond)
+	assert.Len(node.mempoolChan, 0)
+}
+
+func TestSelfSnapshotFinalizationReferences(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.ConsensusNodes[0].Weight = 20
+	node.Graph = testRoundGraph(node)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	seed := crypto.NewHash([]byte("mask"))
+	store := newLaneTestStore(seed, accounts)
+	node.store = store
+	node.TopoCounter = &TopologicalSequence{}
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	node.unknownRefs = make(map[crypto.Hash][]*common.Snapshot)
+
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(crypto.NewHash([]byte("genesis")), 0)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+	signed := &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: signed, RoundNumber: 1, Timestamp: 100}
+	s.References = [2]crypto.Hash{crypto.NewHash([]byte("self")), node.Graph.FinalRound[peer].Hash}
+	s.Sign(accounts[0].PrivateSpendKey)
+	assert.True(node.verifyFinalization(s))
+
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(0, store.count())
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, true))
+	assert.Equal(uint64(0), metrics.Value(MetricFinalization, true))
+
+	s.References[0] = node.Graph.FinalRound[node.IdForNetwork].Hash
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(1, store.count())
+	assert.Equal(uint64(1), metrics.Value(MetricFinalization, true))
+	topo := store.written[node.IdForNetwork][0]
+	assert.Equal(map[crypto.Hash]uint64{node.IdForNetwork: 0, peer: 0}, topo.RoundLinks)
+}
+
+type roundReadTestStore struct {
+	storage.Store
+	reads int
+}
+
+func (s *roundReadTestStore) SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error) {
+	s.reads++
+	return []*common.Snapshot{{NodeId: nodeIdWithNetwork, RoundNumber: round, Transaction: &common.SignedTransaction{}}}, nil
+}
+
+func TestSelfRoundReferenceCache(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(1)
+	store := &roundReadTestStore{}
+	node.store = store
+	self := FinalRound{NodeId: node.IdForNetwork, Number: 5}
+	junk := crypto.NewHash([]byte("junk"))
+
+	_, found, err := node.selfRoundReference(self, junk)
+	assert.Nil(err)
+	assert.False(found)
+	assert.Equal(5, store.reads)
+	_, found, err = node.selfRoundReference(self, junk)
+	assert.Nil(err)
+	assert.False(found)
+	assert.Equal(5, store.reads)
+
+	older, _ := store.SnapshotsReadSnapshotsForNodeRound(node.IdForNetwork, 2)
+	number, found, err := node.selfRoundReference(self, roundHash(node.IdForNetwork, 2, older))
+	assert.Nil(err)
+	assert.True(found)
+	assert.Equal(uint64(2), number)
+	assert.Equal(6, store.reads)
+
+	self.Number = 20
+	_, found, err = node.selfRoundReference(self, junk)
+	assert.Nil(err)
+	assert.False(found)
+	assert.Equal(6+config.SnapshotSelfReferenceDepth, store.reads)
+	_, found = node.roundHashes.get(node.IdForNetwork, 4)
+	assert.False(found)
+}
+
+func TestVerifyReferencesSelf(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts, store := testReplayNode(assert)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	trace, err := ioutil.ReadFile(replayTraceFile)
+	assert.Nil(err)
+	snapshots, err := ReadSnapshotTrace(bytes.NewReader(trace))
+	assert.Nil(err)
+	assert.Nil(ReplaySnapshots(node, snapshots))
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	self := node.Graph.FinalRound[peer]
+	assert.Equal(uint64(2), self.Number)
+	older, err := loadFinalRoundForNode(store, peer, 1)
+	assert.Nil(err)
+	s := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, RoundNumber: 3}
+	s.Timestamp = node.Graph.CacheRound[peer].End + 1
+	s.References = [2]crypto.Hash{self.Hash, older.Hash}
+	_, err = node.verifyReferences(*self, s)
+	assert.Equal(&ReferenceSelfError{Hash: s.PayloadHash(), NodeId: peer, Number: 1}, err)
+
+	depth := config.SnapshotSelfReferenceDepth
+	config.SnapshotSelfReferenceDepth = 0
+	_, err = node.verifyReferences(*self, s)
+	assert.IsType(&ReferenceMissingError{}, err)
+	config.SnapshotSelfReferenceDepth = depth
+
+	// the advanced final round of the snapshot node, while the graph has the previous one
+	_, advanced, err := node.Graph.CacheRound[peer].TryAdvance(s.Timestamp+node.roundGap, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+	assert.Nil(err)
+	assert.Equal(uint64(3), advanced.Number)
+	s.RoundNumber = 4
+	s.References = [2]crypto.Hash{advanced.Hash, self.Hash}
+	_, err = node.verifyReferences(*advanced, s)
+	assert.Equal(&ReferenceSelfError{Hash: s.PayloadHash(), NodeId: peer, Number: 2}, err)
+
+	// dropped without any retries
+	s.RoundNumber = 3
+	s.References = [2]crypto.Hash{self.Hash, older.Hash}
+	genesis, err := store.SnapshotsReadSnapshotsForNodeRound(accounts[3].Hash().ForNetwork(node.networkId), 0)
+	assert.Nil(err)
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(genesis[0].Transaction.PayloadHash(), 0)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+	s.Transaction = &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(s.Transaction.SignInput(store, 0, accounts[:1]))
+	for _, a := range accounts[1:] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, false))
+	assert.Len(node.refRetries, 0)
+	assert.Equal(uint64(2), node.Graph.FinalRound[peer].Number)
+}
+
+func TestVerifyReferencesFirstRound(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	node.Clock = &testClock{now: 200}
+	node.store = &linkTestStore{links: make(map[crypto.Hash]uint64)}
+	self := node.Graph.FinalRound[node.IdForNetwork]
+	self.Hash = crypto.Hash{}
+	for _, a := range accounts[2:] {
+		node.Graph.FinalRound[a.Hash().ForNetwork(node.networkId)].Hash = crypto.Hash{}
+	}
+	peer := node.Graph.FinalRound[accounts[1].Hash().ForNetwork(node.networkId)]
+	node.Graph.UpdateFinalCache()
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.True(s.References[0].IsZero())
+	assert.Equal(peer.Hash, s.References[1])
+	r, err := node.verifyReferences(*self, s)
+	assert.Nil(err)
+	assert.True(r.Handled)
+
+	s.References = [2]crypto.Hash{peer.Hash, crypto.Hash{}}
+	r, err = node.verifyReferences(*self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+
+	s.References = [2]crypto.Hash{crypto.Hash{}, peer.Hash}
+	self.Number = 1
+	r, err = node.verifyReferences(*self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+
+	peer.Hash = crypto.Hash{}
+	self.Number = 0
+	s.Timestamp = 0
+	node.Graph.UpdateFinalCache()
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.IsType(&RoundCandidateMissingError{}, err)
+}
+
+func TestSignSnapshotRoundCandidateMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(1)
+	node.Graph = testRoundGraph(node)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.IsType(&RoundCandidateMissingError{}, err)
+	assert.Equal(uint64(0), s.Timestamp)
+
+	node, _ = testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	future := uint64(time.Now().Add(time.Hour).UnixNano())
+	for id, r := range node.Graph.FinalRound {
+		if id != node.IdForNetwork {
+			r.End = future
+		}
+	}
+	node.Graph.UpdateFinalCache()
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.IsType(&RoundCandidateMissingError{}, err)
+	assert.Equal(uint64(0), s.Timestamp)
+
+	for _, r := range node.Graph.FinalRound {
+		r.End = 0
+	}
+	node.Graph.UpdateFinalCache()
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.True(s.Timestamp > 0)
+}
+
+func TestSignSnapshotRoundCandidateStale(t *testing.T) {
+	assert := assert.New(t)
+
+	maxAge := config.SnapshotReferenceMaxAge
+	defer func() { config.SnapshotReferenceMaxAge = maxAge }()
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	now := uint64(time.Now().Add(-time.Minute).UnixNano())
+	node.Clock = &testClock{now: now}
+	stale := now - uint64(2*time.Hour)
+	for id, r := range node.Graph.FinalRound {
+		if id != node.IdForNetwork {
+			r.Start, r.End = stale, stale
+		}
+	}
+	node.Graph.UpdateFinalCache()
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(now, s.Timestamp)
+
+	config.SnapshotReferenceMaxAge = uint64(time.Hour)
+	s = &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.IsType(&RoundCandidateStaleError{}, err)
+	assert.Equal(stale, err.(*RoundCandidateStaleError).End)
+	assert.Equal(uint64(0), s.Timestamp)
+
+	recent := node.Graph.FinalRound[accounts[3].Hash().ForNetwork(node.networkId)]
+	recent.Start, recent.End = now-uint64(time.Hour), now-uint64(time.Minute)
+	node.Graph.UpdateFinalCache()
+	_, _, err = node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(now, s.Timestamp)
+	assert.Equal(recent.Hash, s.References[1])
+}
+
+func TestWeightedFinalization(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(4)
+	node.ConsensusNodes[3].Weight = 3
+	_, total, weighted := node.consensusWeights()
+	assert.True(weighted)
+	assert.Equal(uint64(6), total)
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	s.Sign(accounts[3].PrivateSpendKey)
+	s.Sign(accounts[0].PrivateSpendKey)
+	assert.False(node.verifyFinalization(s))
+	s.Sign(accounts[1].PrivateSpendKey)
+	assert.True(node.verifyFinalization(s))
+
+	s = &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:3] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	assert.False(node.verifyFinalization(s))
+	s.Signatures = append(s.Signatures, s.Signatures[0], crypto.Signature{})
+	assert.False(node.verifyFinalization(s))
+	assert.Len(s.Signatures, 5)
+	node.clearConsensusSignatures(s)
+	assert.Len(s.Signatures, 3)
+
+	node.ConsensusNodes[3].Weight = 1
+	_, total, weighted = node.consensusWeights()
+	assert.False(weighted)
+	assert.Equal(uint64(4), total)
+	assert.True(node.verifyFinalization(s))
+}
+
+func TestPledgingFinalization(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(6)
+	node.ConsensusNodes[5].State = common.NodeStatePledging
+	_, total, _ := node.consensusWeights()
+	assert.Equal(uint64(6), total)
+	assert.Equal(4, node.consensusThreshold())
+
+	// 4 of the 5 accepted nodes, but not more than the threshold of all 6 nodes
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:4] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	aggregated, err := node.AggregateSnapshot(&common.Snapshot{NodeId: s.NodeId, Transaction: s.Transaction, Signatures: s.Signatures})
+	assert.Nil(err)
+	assert.False(node.verifyFinalization(s))
+	assert.False(node.verifyFinalization(aggregated))
+
+	s.Sign(accounts[4].PrivateSpendKey)
+	aggregated, err = node.AggregateSnapshot(&common.Snapshot{NodeId: s.NodeId, Transaction: s.Transaction, Signatures: s.Signatures})
+	assert.Nil(err)
+	assert.True(node.verifyFinalization(s))
+	assert.True(node.verifyFinalization(aggregated))
+}
@@ -0,0 +1,65 @@
+package kernel
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/config"
+)
+
+// the own cache round last seen, and the local clock when it changed
+type nodeProgress struct {
+	sync.Mutex
+	number uint64
+	end    uint64
+	local  uint64
+}
+
+func (node *Node) trackProgress() {
+	node.Graph.RLock()
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	node.Graph.RUnlock()
+	if cache == nil {
+		return
+	}
+
+	p := &node.progress
+	p.Lock()
+	defer p.Unlock()
+	if p.local > 0 && p.number == cache.Number && p.end == cache.End {
+		return
+	}
+	p.number, p.end, p.local = cache.Number, cache.End, node.Clock.Now()
+}
+
+// Healthy is a readiness check, the node is not ready when its own cache round doesn't
+// advance in the progress window, or its final round starts too long before the max
+// cache round end of other nodes in the graph, i.e. it's left behind by the network
+func (node *Node) Healthy() (bool, string) {
+	now := node.Clock.Now()
+	p := &node.progress
+	p.Lock()
+	number, local := p.number, p.local
+	p.Unlock()
+	if local == 0 {
+		return false, "round progress not tracked"
+	}
+	if now > local+config.NodeHealthProgressWindow {
+		return false, fmt.Sprintf("cache round %d stalled for %d", number, now-local)
+	}
+
+	start, found := uint64(0), false
+	for _, f := range node.Graph.FinalCache() {
+		if f.NodeId == node.IdForNetwork {
+			start, found = f.Start, true
+		}
+	}
+	if !found {
+		return false, "final round missing"
+	}
+	max := node.Graph.MaxTimestamp(node.IdForNetwork)
+	if max > start+config.NodeHealthFinalLag {
+		return false, fmt.Sprintf("final round lags %d %d", start, max)
+	}
+	return true, ""
+}
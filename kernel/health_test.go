@@ -0,0 +1,44 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthy(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(4)
+	node.Graph = testRoundGraph(node)
+	node.Graph.UpdateFinalCache()
+	clock := &testClock{now: 1000}
+	node.Clock = clock
+
+	healthy, reason := node.Healthy()
+	assert.False(healthy)
+	assert.NotEmpty(reason)
+
+	node.trackProgress()
+	healthy, reason = node.Healthy()
+	assert.True(healthy)
+	assert.Empty(reason)
+
+	clock.now += config.NodeHealthProgressWindow + 1
+	node.trackProgress()
+	healthy, reason = node.Healthy()
+	assert.False(healthy)
+	assert.Contains(reason, "stalled")
+
+	node.Graph.CacheRound[node.IdForNetwork].End = clock.now
+	node.trackProgress()
+	healthy, _ = node.Healthy()
+	assert.True(healthy)
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	node.Graph.CacheRound[peer].End = config.NodeHealthFinalLag + 1
+	healthy, reason = node.Healthy()
+	assert.False(healthy)
+	assert.Contains(reason, "lags")
+}
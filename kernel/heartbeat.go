@@ -0,0 +1,41 @@
+package kernel
+
+import (
+	"encoding/binary"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+)
+
+// a heartbeat is an empty transaction of the node, without any input or output, signed and
+// finalized the same as any other snapshot, so an idle node still seals its own rounds and
+// peers keep referencing fresh rounds. At most one is emitted in the timeout, no matter the
+// previous one finalized or not, and the heartbeat is disabled with a zero timeout.
+func (node *Node) heartbeat(now uint64) *common.Snapshot {
+	timeout := config.SnapshotHeartbeatTimeout
+	if timeout == 0 {
+		return nil
+	}
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	if cache == nil {
+		return nil
+	}
+	last := cache.End
+	if node.heartbeatAt > last {
+		last = node.heartbeatAt
+	}
+	if now < last+timeout {
+		return nil
+	}
+	node.heartbeatAt = now
+
+	extra := make([]byte, len(node.IdForNetwork)+8)
+	copy(extra, node.IdForNetwork[:])
+	binary.BigEndian.PutUint64(extra[len(node.IdForNetwork):], now)
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.Extra = extra
+	return &common.Snapshot{
+		NodeId:      node.IdForNetwork,
+		Transaction: &common.SignedTransaction{Transaction: *tx},
+	}
+}
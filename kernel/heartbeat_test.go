@@ -0,0 +1,63 @@
+package kernel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+
+	timeout := config.SnapshotHeartbeatTimeout
+	defer func() { config.SnapshotHeartbeatTimeout = timeout }()
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	clock := &testClock{}
+	node.Clock = clock
+	now := uint64(time.Now().UnixNano())
+	start := now - config.SnapshotRoundGap*4
+	cache := node.Graph.CacheRound[node.IdForNetwork]
+	cache.Start, cache.End = start, start
+	ps := &common.Snapshot{NodeId: node.IdForNetwork, Timestamp: start, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:5] {
+		ps.Sign(a.PrivateSpendKey)
+	}
+	cache.Snapshots = []*common.Snapshot{ps}
+
+	config.SnapshotHeartbeatTimeout = 0
+	assert.Nil(node.heartbeat(now))
+
+	config.SnapshotHeartbeatTimeout = config.SnapshotRoundGap * 2
+	assert.Nil(node.heartbeat(start + config.SnapshotRoundGap))
+	s := node.heartbeat(now)
+	assert.NotNil(s)
+	assert.Equal(node.IdForNetwork, s.NodeId)
+	assert.Len(s.Transaction.Inputs, 0)
+	assert.Len(s.Transaction.Outputs, 0)
+	assert.Nil(s.Transaction.Validate(nil))
+	assert.Nil(node.heartbeat(now + config.SnapshotRoundGap))
+	next := node.heartbeat(now + config.SnapshotHeartbeatTimeout)
+	assert.NotNil(next)
+	assert.NotEqual(s.PayloadHash(), next.PayloadHash())
+
+	// signed as any other own snapshot, and the idle round is sealed
+	clock.now = now
+	c, f, err := node.signSnapshot(context.Background(), s)
+	assert.Nil(err)
+	assert.Equal(now, s.Timestamp)
+	assert.Equal(uint64(2), s.RoundNumber)
+	assert.Equal(uint64(2), c.Number)
+	assert.Equal(uint64(1), f.Number)
+	assert.Equal(f.Hash, s.References[0])
+	assert.Nil(s.LockInputs(nil))
+
+	node.Graph.CacheRound[node.IdForNetwork] = c
+	assert.Nil(node.heartbeat(now + config.SnapshotHeartbeatTimeout*2 - 1))
+	assert.NotNil(node.heartbeat(now + config.SnapshotHeartbeatTimeout*2))
+}
@@ -0,0 +1,216 @@
+package kernel
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// the snapshots near finalization are handled first to finalize them sooner, then the self
+// ones, which are only finalized by this node collecting signatures, and the others at last
+const (
+	priorityFinalizing = iota
+	prioritySelf
+	priorityNormal
+)
+
+// the consensus state of a node is only changed by the snapshots of the node itself, so the
+// snapshots are handled in lanes by the node id, in order of arrival for the same node id, and
+// in parallel across lanes. The priority only orders the snapshots of different node ids in the
+// same lane, a later round snapshot never overtakes an earlier one of the same node, which would
+// be dropped as stale then. The lanes validate transactions and verify signatures without any
+// lock, while the graph, the pool and the caches shared by all nodes are changed with the node
+// state lock held. The consensus nodes are only replaced when no snapshot is in handling of any lane.
+//
+// The consensus threshold of the priorities is kept by the lanes, and only refreshed by the
+// mempool consumer at each round gap, so the dispatch never takes the nodes lock.
+type snapshotLanes struct {
+	lanes     []*laneQueue
+	handle    func(*common.Snapshot) error
+	threshold int
+	wg        sync.WaitGroup
+	stop      chan struct{}
+	failed    chan struct{}
+	once      sync.Once
+	err       error
+}
+
+// the snapshots waiting in a lane, in order of arrival for each node id, the next snapshot
+// of the highest priority among all node ids is popped, the earliest one for the same priority
+type laneQueue struct {
+	sync.Mutex
+	nodes    map[crypto.Hash][]laneEntry
+	sequence uint64
+	size     int
+	limit    int
+	ready    chan struct{}
+	space    chan struct{}
+}
+
+type laneEntry struct {
+	snapshot *common.Snapshot
+	priority int
+	sequence uint64
+}
+
+func newLaneQueue(limit int) *laneQueue {
+	return &laneQueue{
+		nodes: make(map[crypto.Hash][]laneEntry),
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+}
+
+func (q *laneQueue) push(s *common.Snapshot, priority int) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.size >= q.limit {
+		return false
+	}
+	q.sequence++
+	q.nodes[s.NodeId] = append(q.nodes[s.NodeId], laneEntry{snapshot: s, priority: priority, sequence: q.sequence})
+	q.size++
+	notify(q.ready)
+	return true
+}
+
+func (q *laneQueue) pop() *common.Snapshot {
+	q.Lock()
+	defer q.Unlock()
+	var next *laneEntry
+	var nodeId crypto.Hash
+	for id, queue := range q.nodes {
+		e := &queue[0]
+		if next == nil || e.priority < next.priority || e.priority == next.priority && e.sequence < next.sequence {
+			next, nodeId = e, id
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	s := next.snapshot
+	queue := q.nodes[nodeId]
+	queue[0] = laneEntry{}
+	if len(queue) == 1 {
+		delete(q.nodes, nodeId)
+	} else {
+		q.nodes[nodeId] = queue[1:]
+	}
+	q.size--
+	notify(q.space)
+	return s
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (node *Node) startLanes(n int, handle func(*common.Snapshot) error) *snapshotLanes {
+	if n < 1 {
+		n = 1
+	}
+	_, _, threshold := node.ConsensusInfo()
+	l := &snapshotLanes{
+		lanes:     make([]*laneQueue, n),
+		handle:    handle,
+		threshold: threshold,
+		stop:      make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+	for i := range l.lanes {
+		l.lanes[i] = newLaneQueue(MempoolSize/n + 1)
+		l.wg.Add(1)
+		go l.consume(l.lanes[i])
+	}
+	return l
+}
+
+func (l *snapshotLanes) consume(lane *laneQueue) {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		s := lane.pop()
+		if s == nil {
+			select {
+			case <-lane.ready:
+			case <-l.stop:
+				return
+			}
+			continue
+		}
+		err := l.handle(s)
+		if err != nil {
+			l.fail(err)
+			return
+		}
+	}
+}
+
+// the priority of a snapshot in its lane, a snapshot with signatures of the threshold nodes
+// is finalized by one more signature. Only the signers verified already, e.g. by an earlier
+// copy of the snapshot, are counted by the cached results, so junk signatures never take the
+// priority, and an aggregated snapshot takes it by the flag until verified in its handling
+func (node *Node) snapshotPriority(s *common.Snapshot, threshold int) int {
+	if s.Aggregated != nil || node.cachedSigners(s, threshold) >= threshold {
+		return priorityFinalizing
+	}
+	if s.NodeId == node.IdForNetwork {
+		return prioritySelf
+	}
+	return priorityNormal
+}
+
+// the distinct signers of the snapshot signatures in the verify cache, at most the limit
+func (node *Node) cachedSigners(s *common.Snapshot, limit int) int {
+	if len(s.Signatures) < limit {
+		return 0
+	}
+	hash := crypto.NewHash(s.Payload())
+	signers := make(map[crypto.Hash]bool)
+	for _, sig := range s.Signatures {
+		if r, cached := node.verified.get(sig, hash); cached && r.found {
+			signers[r.id] = true
+		}
+		if len(signers) >= limit {
+			break
+		}
+	}
+	return len(signers)
+}
+
+// never blocks after the node closing or any lane failed
+func (l *snapshotLanes) dispatch(s *common.Snapshot, priority int, closing <-chan struct{}) {
+	lane := l.lanes[binary.BigEndian.Uint64(s.NodeId[:8])%uint64(len(l.lanes))]
+	for !lane.push(s, priority) {
+		select {
+		case <-lane.space:
+		case <-closing:
+			return
+		case <-l.failed:
+			return
+		}
+	}
+}
+
+func (l *snapshotLanes) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.failed)
+	})
+}
+
+// the snapshots in handling are finished, and the ones left in lanes are dropped
+func (l *snapshotLanes) close() {
+	close(l.stop)
+	l.wg.Wait()
+}
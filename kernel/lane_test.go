@@ -0,0 +1,268 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+type laneTestStore struct {
+	validateTestStore
+	sync.Mutex
+	written map[crypto.Hash][]*common.SnapshotWithTopologicalOrder
+}
+
+func newLaneTestStore(seed crypto.Hash, accounts []common.Address) *laneTestStore {
+	return &laneTestStore{
+		validateTestStore: *newValidateTestStore(seed, accounts),
+		written:           make(map[crypto.Hash][]*common.SnapshotWithTopologicalOrder),
+	}
+}
+
+func (s *laneTestStore) SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	return nil, nil
+}
+
+func (s *laneTestStore) SnapshotsReadRoundLink(from, to crypto.Hash) (uint64, error) {
+	return 0, nil
+}
+
+func (s *laneTestStore) SnapshotsWriteSnapshot(snapshot *common.SnapshotWithTopologicalOrder) error {
+	s.Lock()
+	defer s.Unlock()
+	s.written[snapshot.NodeId] = append(s.written[snapshot.NodeId], snapshot)
+	return nil
+}
+
+func (s *laneTestStore) count() int {
+	s.Lock()
+	defer s.Unlock()
+	var n int
+	for _, snapshots := range s.written {
+		n += len(snapshots)
+	}
+	return n
+}
+
+func TestSnapshotLanes(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	seed := crypto.NewHash([]byte("mask"))
+	store := newLaneTestStore(seed, accounts)
+	node.store = store
+	node.TopoCounter = &TopologicalSequence{}
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	node.unknownRefs = make(map[crypto.Hash][]*common.Snapshot)
+	node.persistedPool = make(map[crypto.Hash]int)
+	node.gossipFilter = newGossipFilter()
+	node.mempoolChan = make(chan *common.Snapshot, MempoolSize)
+	node.closing = make(chan struct{})
+	node.closed = make(chan struct{})
+
+	const count = 8
+	peers := accounts[1:]
+	snapshots := make([][]*common.Snapshot, len(peers))
+	for i, a := range peers {
+		id := a.Hash().ForNetwork(node.networkId)
+		self := node.Graph.FinalRound[id]
+		other := node.Graph.FinalRound[peers[(i+1)%len(peers)].Hash().ForNetwork(node.networkId)]
+		for j := 0; j < count; j++ {
+			tx := common.NewTransaction(common.XINAssetId)
+			tx.AddInput(crypto.NewHash([]byte(fmt.Sprintf("genesis%d", i))), j)
+			tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+			signed := &common.SignedTransaction{Transaction: *tx}
+			assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+			s := &common.Snapshot{NodeId: id, Transaction: signed, RoundNumber: 1, Timestamp: uint64(100 + j)}
+			s.References = [2]crypto.Hash{self.Hash, other.Hash}
+			for _, k := range accounts[:5] {
+				s.Sign(k.PrivateSpendKey)
+			}
+			snapshots[i] = append(snapshots[i], s)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- node.ConsumeMempool()
+	}()
+	var wg sync.WaitGroup
+	for _, ss := range snapshots {
+		wg.Add(1)
+		go func(ss []*common.Snapshot) {
+			defer wg.Done()
+			for _, s := range ss {
+				node.queueSnapshot(s)
+			}
+		}(ss)
+	}
+	wg.Wait()
+
+	for i := 0; i < 500 && store.count() < len(peers)*count; i++ {
+		node.Healthy()
+		node.BuildGraph()
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(node.Close(ctx))
+	assert.Nil(<-done)
+
+	assert.Equal(len(peers)*count, store.count())
+	topos := make(map[uint64]bool)
+	for _, a := range peers {
+		id := a.Hash().ForNetwork(node.networkId)
+		written := store.written[id]
+		assert.Len(written, count)
+		for j, s := range written {
+			assert.Equal(uint64(100+j), s.Timestamp)
+			topos[s.TopologicalOrder] = true
+		}
+		assert.Len(node.Graph.CacheRound[id].Snapshots, count)
+		assert.Equal(uint64(100+count-1), node.Graph.CacheRound[id].End)
+	}
+	assert.Len(topos, len(peers)*count)
+}
+
+func TestSnapshotLanesPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	_, _, threshold := node.ConsensusInfo()
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	snapshot := func(nodeId crypto.Hash, i, signatures int) *common.Snapshot {
+		s := &common.Snapshot{NodeId: nodeId, Transaction: &common.SignedTransaction{}, Timestamp: uint64(i)}
+		for _, a := range accounts[:signatures] {
+			s.Sign(a.PrivateSpendKey)
+		}
+		// verified by an earlier copy, e.g. the same snapshot from another peer
+		verified := *s
+		assert.Nil(node.clearConsensusSignatures(&verified))
+		return s
+	}
+	assert.Equal(priorityNormal, node.snapshotPriority(snapshot(peer, 0, 1), threshold))
+	assert.Equal(prioritySelf, node.snapshotPriority(snapshot(node.IdForNetwork, 0, 1), threshold))
+	assert.Equal(priorityFinalizing, node.snapshotPriority(snapshot(peer, 0, threshold), threshold))
+	assert.Equal(priorityFinalizing, node.snapshotPriority(snapshot(node.IdForNetwork, 0, threshold+1), threshold))
+	assert.Equal(priorityNormal, node.snapshotPriority(snapshot(peer, 0, threshold-1), threshold))
+
+	// the signatures not verified yet, or verified as junk, never take the priority
+	unverified := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, Timestamp: 1}
+	for _, a := range accounts[:threshold] {
+		unverified.Sign(a.PrivateSpendKey)
+	}
+	assert.Equal(priorityNormal, node.snapshotPriority(unverified, threshold))
+	junk := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}, Timestamp: 2}
+	junk.Sign(accounts[0].PrivateSpendKey)
+	for _, a := range accounts[1:threshold] {
+		junk.Signatures = append(junk.Signatures, a.PrivateSpendKey.Sign([]byte("junk")))
+	}
+	verified := *junk
+	assert.Nil(node.clearConsensusSignatures(&verified))
+	assert.Len(verified.Signatures, 1)
+	assert.Len(junk.Signatures, threshold)
+	assert.Equal(priorityNormal, node.snapshotPriority(junk, threshold))
+	assert.Equal(priorityFinalizing, node.snapshotPriority(&common.Snapshot{NodeId: peer, Aggregated: &common.AggregatedSignature{}}, threshold))
+
+	// the lane is busy with the first snapshot while all others queued
+	var order []*common.Snapshot
+	started, busy, handled := make(chan struct{}), make(chan struct{}), make(chan struct{}, 64)
+	lanes := node.startLanes(1, func(s *common.Snapshot) error {
+		if len(order) == 0 {
+			close(started)
+			<-busy
+		}
+		order = append(order, s)
+		handled <- struct{}{}
+		return nil
+	})
+	closing := make(chan struct{})
+	fresh := make([]*common.Snapshot, 0)
+	for i := 0; i < 16; i++ {
+		s := snapshot(peer, i, 1)
+		fresh = append(fresh, s)
+		lanes.dispatch(s, node.snapshotPriority(s, lanes.threshold), closing)
+		if i == 0 {
+			<-started
+		}
+	}
+	self := snapshot(node.IdForNetwork, 16, 1)
+	lanes.dispatch(self, node.snapshotPriority(self, lanes.threshold), closing)
+	near := snapshot(accounts[2].Hash().ForNetwork(node.networkId), 17, threshold)
+	lanes.dispatch(near, node.snapshotPriority(near, lanes.threshold), closing)
+	// never before the earlier snapshots of the same node, even near finalization
+	behind := snapshot(peer, 18, threshold)
+	lanes.dispatch(behind, node.snapshotPriority(behind, lanes.threshold), closing)
+	close(busy)
+	for i := 0; i < 19; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			assert.Fail("lane snapshot not handled")
+		}
+	}
+	lanes.close()
+
+	assert.Len(order, 19)
+	assert.True(order[0] == fresh[0])
+	assert.True(order[1] == near)
+	assert.True(order[2] == self)
+	for i, s := range order[3:18] {
+		assert.True(s == fresh[i+1])
+	}
+	assert.True(order[18] == behind)
+}
+
+func TestSnapshotLanesLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newLaneQueue(2)
+	other := crypto.NewHash([]byte("other"))
+	a, b, c := &common.Snapshot{Timestamp: 1}, &common.Snapshot{Timestamp: 2}, &common.Snapshot{NodeId: other, Timestamp: 3}
+	assert.True(q.push(a, priorityNormal))
+	assert.True(q.push(b, priorityNormal))
+	assert.False(q.push(c, priorityFinalizing))
+	assert.True(q.pop() == a)
+	assert.True(q.push(c, priorityFinalizing))
+	assert.True(q.pop() == c)
+	assert.True(q.pop() == b)
+	assert.Nil(q.pop())
+
+	// the snapshots of the same node are never reordered by priority
+	assert.True(q.push(a, priorityNormal))
+	assert.True(q.push(b, priorityFinalizing))
+	assert.True(q.pop() == a)
+	assert.True(q.pop() == b)
+	assert.Nil(q.pop())
+
+	// a full lane blocks the dispatch until the snapshots handled, or the node closing
+	lanes := &snapshotLanes{lanes: []*laneQueue{newLaneQueue(1)}, failed: make(chan struct{})}
+	closing := make(chan struct{})
+	lanes.dispatch(a, priorityNormal, closing)
+	done := make(chan struct{})
+	go func() {
+		lanes.dispatch(b, priorityNormal, closing)
+		close(done)
+	}()
+	select {
+	case <-done:
+		assert.Fail("full lane dispatched")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.True(lanes.lanes[0].pop() == a)
+	<-done
+	assert.True(lanes.lanes[0].pop() == b)
+
+	lanes.dispatch(a, priorityNormal, closing)
+	close(closing)
+	lanes.dispatch(b, priorityNormal, closing)
+	assert.Equal(1, lanes.lanes[0].size)
+}
@@ -0,0 +1,132 @@
+package kernel
+
+import (
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// the finalization times of the snapshots by transaction hash, only kept in memory for the late
+// signature window, so a snapshot finalized before a restart never merges late signatures
+type finalizedTimes struct {
+	sync.Mutex
+	times map[crypto.Hash]uint64
+}
+
+func (c *finalizedTimes) get(hash crypto.Hash) (uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	ts, found := c.times[hash]
+	return ts, found
+}
+
+func (c *finalizedTimes) set(hash crypto.Hash, now, window uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.times == nil {
+		c.times = make(map[crypto.Hash]uint64)
+	}
+	if len(c.times) >= config.SnapshotSeenCacheSize {
+		for h, ts := range c.times {
+			if ts+window < now {
+				delete(c.times, h)
+			}
+		}
+	}
+	if len(c.times) >= config.SnapshotSeenCacheSize {
+		c.times = make(map[crypto.Hash]uint64)
+	}
+	c.times[hash] = now
+}
+
+func (node *Node) recordFinalization(txHash crypto.Hash) {
+	if window := config.SnapshotLateSignatureWindow; window > 0 {
+		node.finalized.set(txHash, node.Clock.Now(), window)
+	}
+}
+
+// the signatures of the slow peers may arrive after the snapshot finalized, they are merged
+// into the stored snapshot for a stronger finality proof, but only in the window after the
+// finalization by this node, and ignored as seen after that. It's checked for each gossip
+// duplicate, so the finalization times are looked up by the transaction hash known already,
+// and never without the window enabled.
+func (node *Node) inLateSignatureWindow(s *common.Snapshot, txHash crypto.Hash) bool {
+	window := config.SnapshotLateSignatureWindow
+	if window == 0 || s.Aggregated != nil {
+		return false
+	}
+	ts, found := node.finalized.get(txHash)
+	return found && node.Clock.Now() <= ts+window
+}
+
+// returns true when any new valid signature merged, the stored snapshot signers are verified
+// again, most of them from the verify cache, so a signer is never counted twice. The snapshot
+// in the cache round is replaced with the merged signatures as well, while the final rounds
+// and the final cache have no signatures, and a finalized snapshot is never in the pool.
+func (node *Node) mergeLateSignatures(stored *common.SnapshotWithTopologicalOrder, s *common.Snapshot, txHash crypto.Hash) (bool, error) {
+	if !node.inLateSignatureWindow(&stored.Snapshot, txHash) || stored.PayloadHash() != s.PayloadHash() {
+		return false, nil
+	}
+	if node.clearConsensusSignatures(s) != nil || len(s.Signatures) == 0 {
+		return false, nil
+	}
+	merged := stored.Snapshot
+	merged.Signatures = append([]crypto.Signature{}, stored.Signatures...)
+	// without the stored signers, a stored signer would be appended again
+	if err := node.clearConsensusSignatures(&merged); err != nil {
+		node.Logger.Warn("LATE SIGNATURES STORED ERROR", stored.PayloadHash(), err)
+		return false, nil
+	}
+	signed := make(map[crypto.Hash]bool)
+	for _, id := range merged.Signers {
+		signed[id] = true
+	}
+
+	sigs := append([]crypto.Signature{}, stored.Signatures...)
+	for _, sig := range s.Signatures {
+		id := s.Signers[sig]
+		if signed[id] {
+			continue
+		}
+		signed[id] = true
+		sigs = append(sigs, sig)
+	}
+	if len(sigs) == len(stored.Signatures) {
+		return false, nil
+	}
+	err := node.store.SnapshotsUpdateSignatures(txHash, sigs)
+	if err != nil {
+		return false, err
+	}
+	node.updateCacheSignatures(stored.NodeId, stored.PayloadHash(), sigs)
+	node.signers.remove(stored.PayloadHash())
+	node.Logger.Info("LATE SIGNATURES MERGED", stored.PayloadHash(), len(stored.Signatures), len(sigs))
+	node.Metrics.Inc(MetricLateSignature, stored.NodeId == node.IdForNetwork)
+	return true, nil
+}
+
+// the cache round snapshots may be shared by the round copies, so the snapshot is replaced
+// in a new copy of the cache round, never changed in place
+func (node *Node) updateCacheSignatures(nodeId, hash crypto.Hash, sigs []crypto.Signature) {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	cache, final := node.Graph.CacheRound[nodeId], node.Graph.FinalRound[nodeId]
+	if cache == nil || final == nil {
+		return
+	}
+	for i, cs := range cache.Snapshots {
+		if cs.PayloadHash() != hash {
+			continue
+		}
+		s := *cs
+		s.Signatures = append([]crypto.Signature{}, sigs...)
+		s.Signers = nil
+		cache = cache.Copy()
+		cache.Snapshots[i] = &s
+		node.Graph.UpdateRound(cache, final)
+		return
+	}
+}
@@ -0,0 +1,117 @@
+package kernel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLateSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	window := config.SnapshotLateSignatureWindow
+	defer func() { config.SnapshotLateSignatureWindow = window }()
+	config.SnapshotLateSignatureWindow = uint64(time.Second)
+
+	node, accounts, store := testReplayNode(assert)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	clock := node.Clock.(*testClock)
+	peer, other := accounts[1].Hash().ForNetwork(node.networkId), accounts[2].Hash().ForNetwork(node.networkId)
+	timestamp := replayGenesis + node.roundGap + uint64(time.Millisecond)
+	cache, final, err := node.Graph.CacheRound[peer].TryAdvance(timestamp, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+	assert.Nil(err)
+	if final == nil {
+		final = node.Graph.FinalRound[peer]
+	}
+	signed := testNetworkTransaction(assert, store, node, accounts, 0)
+	s := &common.Snapshot{NodeId: peer, Transaction: signed, RoundNumber: cache.Number, Timestamp: timestamp}
+	s.References = [2]crypto.Hash{final.Hash, node.Graph.FinalRound[other].Hash}
+	s.Sign(accounts[1].PrivateSpendKey)
+	feed := func(sigs ...crypto.Signature) {
+		fed := *s
+		fed.Signatures = append([]crypto.Signature{}, sigs...)
+		assert.Nil(node.handleSnapshotInput(&fed))
+	}
+	stored := func() int {
+		ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+		assert.Nil(err)
+		assert.NotNil(ss)
+		return len(ss.Signatures)
+	}
+
+	// finalized with the signatures of 3 nodes later than the timestamp, the last node is slow
+	finalized := timestamp + uint64(500*time.Millisecond)
+	clock.now = finalized
+	feed(s.Signatures...)
+	s.Sign(accounts[2].PrivateSpendKey)
+	feed(s.Signatures...)
+	assert.Equal(3, stored())
+	signers, err := node.SnapshotSigners(s.PayloadHash())
+	assert.Nil(err)
+	assert.Len(signers, 3)
+	s.Sign(accounts[3].PrivateSpendKey)
+	late := s.Signatures[len(s.Signatures)-1]
+
+	// just outside the window, the late signature is ignored as seen
+	clock.now = finalized + config.SnapshotLateSignatureWindow + 1
+	feed(late)
+	assert.Equal(3, stored())
+	assert.Equal(uint64(0), metrics.Value(MetricLateSignature, false))
+	assert.Equal(uint64(1), metrics.Value(MetricSnapshotSeen, false))
+
+	// just inside the window, the late signature is merged, and never counted twice
+	clock.now = finalized + config.SnapshotLateSignatureWindow
+	feed(late)
+	assert.Equal(4, stored())
+	assert.Equal(uint64(1), metrics.Value(MetricLateSignature, false))
+	signers, err = node.SnapshotSigners(s.PayloadHash())
+	assert.Nil(err)
+	assert.Len(signers, 4)
+	assert.Contains(signers, accounts[3].Hash().ForNetwork(node.networkId))
+	var cached *common.Snapshot
+	for _, cs := range node.Graph.CacheRound[peer].Snapshots {
+		if cs.PayloadHash() == s.PayloadHash() {
+			cached = cs
+		}
+	}
+	assert.NotNil(cached)
+	assert.Len(cached.Signatures, 4)
+	assert.Equal(late, cached.Signatures[3])
+	assert.Nil(node.SnapshotsPool[s.PayloadHash()])
+	feed(s.Signatures...)
+	assert.Equal(4, stored())
+	assert.Equal(uint64(1), metrics.Value(MetricLateSignature, false))
+	assert.Equal(uint64(2), metrics.Value(MetricSnapshotSeen, false))
+
+	// an invalid signature is never merged
+	seed := crypto.NewHash([]byte("stranger"))
+	stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Sign(stranger.PrivateSpendKey)
+	feed(s.Signatures[len(s.Signatures)-1])
+	assert.Equal(4, stored())
+
+	// the stored signatures failed to clear, a stored signer is never appended again
+	strict := config.StrictSignatures
+	defer func() { config.StrictSignatures = strict }()
+	config.StrictSignatures = true
+	ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+	assert.Nil(err)
+	assert.Nil(store.SnapshotsUpdateSignatures(ss.TransactionHash(), append(ss.Signatures, crypto.Signature{1})))
+	ss, err = store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+	assert.Nil(err)
+	again := *s
+	again.Signatures = []crypto.Signature{ss.Signatures[0]}
+	merged, err := node.mergeLateSignatures(ss, &again, ss.TransactionHash())
+	assert.Nil(err)
+	assert.False(merged)
+	assert.Equal(5, stored())
+	config.StrictSignatures = strict
+
+	config.SnapshotLateSignatureWindow = 0
+	assert.False(node.inLateSignatureWindow(s, s.TransactionHash()))
+}
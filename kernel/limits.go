@@ -0,0 +1,32 @@
+package kernel
+
+import (
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+)
+
+// the cheap checks before any signature verification or store access, a malformed snapshot
+// is rejected without burning CPU. The references are a fixed size array, so the count is
+// enforced when decoded, and only the snapshots not to be signed by this node have them.
+func (node *Node) checkSnapshotLimits(s *common.Snapshot) error {
+	if s.Transaction == nil {
+		return fmt.Errorf("invalid snapshot without transaction")
+	}
+	if node.snapshotNode(s.NodeId) == nil {
+		return fmt.Errorf("invalid snapshot node %s", s.NodeId)
+	}
+	if n := len(s.Signatures); n > config.SnapshotSignaturesLimit || n > len(node.ConsensusNodes) {
+		return fmt.Errorf("invalid snapshot signature number %d %d", n, len(node.ConsensusNodes))
+	}
+	if !node.shouldSign(s) {
+		if s.References[0] == s.References[1] || s.References[1].IsZero() {
+			return fmt.Errorf("invalid snapshot references %s %s", s.References[0], s.References[1])
+		}
+	}
+	if n := len(s.Transaction.Marshal()); n > config.TransactionMaximumSize {
+		return fmt.Errorf("invalid transaction size %d", n)
+	}
+	return nil
+}
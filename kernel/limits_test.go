@@ -0,0 +1,98 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	store := &seenTestStore{seen: make(map[crypto.Hash]bool)}
+	node.store = store
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	s := &common.Snapshot{NodeId: peer, Transaction: &common.SignedTransaction{}}
+	s.References = [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("final"))}
+	s.Sign(accounts[1].PrivateSpendKey)
+	assert.Nil(node.checkSnapshotLimits(s))
+
+	signatures := s.Signatures
+	for i := 0; i < 1000; i++ {
+		s.Signatures = append(s.Signatures, crypto.Signature{byte(i), byte(i >> 8)})
+	}
+	assert.NotNil(node.checkSnapshotLimits(s))
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(0, store.reads)
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, false))
+
+	s.Signatures = signatures
+	for len(s.Signatures) < len(node.ConsensusNodes)+1 {
+		s.Signatures = append(s.Signatures, signatures[0])
+	}
+	assert.NotNil(node.checkSnapshotLimits(s))
+	limit := config.SnapshotSignaturesLimit
+	config.SnapshotSignaturesLimit = 0
+	s.Signatures = signatures
+	assert.NotNil(node.checkSnapshotLimits(s))
+	config.SnapshotSignaturesLimit = limit
+
+	s.References[1] = s.References[0]
+	assert.NotNil(node.checkSnapshotLimits(s))
+	s.References[1] = crypto.Hash{}
+	assert.NotNil(node.checkSnapshotLimits(s))
+	own := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	assert.Nil(node.checkSnapshotLimits(own))
+
+	own.Transaction.Extra = make([]byte, config.TransactionMaximumSize)
+	assert.NotNil(node.checkSnapshotLimits(own))
+	own.Transaction = nil
+	assert.NotNil(node.checkSnapshotLimits(own))
+	assert.Nil(node.handleSnapshotInput(own))
+	assert.Equal(0, store.reads)
+}
+
+func TestSnapshotUnknownNode(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts, store := testReplayNode(assert)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+
+	genesis, err := store.SnapshotsReadSnapshotsForNodeRound(node.IdForNetwork, 0)
+	assert.Nil(err)
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(genesis[0].TransactionHash(), 0)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+	st := &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(st.SignInput(store, 0, accounts[:1]))
+
+	for i, state := range []string{common.NodeStateDeparting, common.NodeStatePledging} {
+		seed := crypto.NewHash([]byte(state))
+		stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+		id := stranger.Hash().ForNetwork(node.networkId)
+		s := &common.Snapshot{NodeId: id, Transaction: st, Timestamp: replayGenesis + node.roundGap}
+		s.References = [2]crypto.Hash{crypto.NewHash([]byte("self")), node.Graph.FinalRound[node.IdForNetwork].Hash}
+		s.Sign(stranger.PrivateSpendKey)
+		node.ConsensusNodes = append(node.ConsensusNodes, common.Node{Account: stranger, State: state})
+		if state == common.NodeStateDeparting {
+			assert.NotNil(node.checkSnapshotLimits(s))
+		} else {
+			assert.Nil(node.checkSnapshotLimits(s))
+		}
+
+		assert.Nil(node.handleSnapshotInput(s))
+		assert.Equal(uint64(i+1), metrics.Value(MetricValidationFailure, false))
+		assert.Nil(node.Graph.CacheRound[id])
+		assert.Nil(node.Graph.FinalRound[id])
+		assert.Len(node.SnapshotsPool, 0)
+		node.ConsensusNodes = node.ConsensusNodes[:4]
+	}
+}
@@ -0,0 +1,51 @@
+package kernel
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// a fixed size set of hashes, the least recently used one is evicted when full
+type hashLRU struct {
+	sync.Mutex
+	size  int
+	order *list.List
+	items map[crypto.Hash]*list.Element
+}
+
+func newHashLRU(size int) *hashLRU {
+	return &hashLRU{
+		size:  size,
+		order: list.New(),
+		items: make(map[crypto.Hash]*list.Element),
+	}
+}
+
+func (c *hashLRU) Add(hash crypto.Hash) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, found := c.items[hash]; found {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[hash] = c.order.PushFront(hash)
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(crypto.Hash))
+	}
+}
+
+func (c *hashLRU) Contains(hash crypto.Hash) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	e, found := c.items[hash]
+	if found {
+		c.order.MoveToFront(e)
+	}
+	return found
+}
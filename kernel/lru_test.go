@@ -0,0 +1,77 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type seenTestStore struct {
+	storage.Store
+	reads int
+	seen  map[crypto.Hash]bool
+}
+
+func (s *seenTestStore) SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	s.reads++
+	if s.seen[hash] {
+		return &common.SnapshotWithTopologicalOrder{}, nil
+	}
+	return nil, nil
+}
+
+func (s *seenTestStore) SnapshotsWriteRejected(r *common.RejectedSnapshot) error {
+	return nil
+}
+
+func TestHashLRU(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b, c := crypto.NewHash([]byte("a")), crypto.NewHash([]byte("b")), crypto.NewHash([]byte("c"))
+	lru := newHashLRU(2)
+	lru.Add(a)
+	lru.Add(b)
+	assert.True(lru.Contains(a))
+	lru.Add(c)
+	assert.True(lru.Contains(a))
+	assert.False(lru.Contains(b))
+	assert.True(lru.Contains(c))
+	lru.Add(c)
+	assert.Equal(2, lru.order.Len())
+}
+
+func TestSnapshotSeenCache(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	node.seenCache = newHashLRU(2)
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	s.Transaction.Extra = []byte("seen")
+	store := &seenTestStore{seen: map[crypto.Hash]bool{s.Transaction.PayloadHash(): true}}
+	node.store = store
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(node.handleSnapshotInput(s))
+	}
+	assert.Equal(1, store.reads)
+	assert.Equal(uint64(5), metrics.Value(MetricSnapshotSeen, true))
+
+	node.seenCache.Add(crypto.NewHash([]byte("a")))
+	node.seenCache.Add(crypto.NewHash([]byte("b")))
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(2, store.reads)
+	assert.Equal(uint64(6), metrics.Value(MetricSnapshotSeen, true))
+
+	n := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	n.Transaction.Extra = []byte("new")
+	assert.Nil(node.handleSnapshotInput(n))
+	assert.Equal(3, store.reads)
+	assert.Equal(uint64(6), metrics.Value(MetricSnapshotSeen, true))
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, true))
+}
@@ -0,0 +1,169 @@
+package kernel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the latency buckets in seconds, a signature verification takes about 100 microseconds
+var metricsLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+
+const (
+	MetricSnapshotSeen       = "snapshot_seen_drops"
+	MetricValidationFailure  = "snapshot_validation_failures"
+	MetricFinalization       = "snapshot_finalizations"
+	MetricLockInputsFailure  = "snapshot_lock_inputs_failures"
+	MetricSignatureBroadcast = "snapshot_signatures_broadcast"
+	MetricGossipSuppressed   = "snapshot_gossip_suppressed"
+	MetricPeerThrottled      = "snapshot_peer_throttled"
+	MetricSignatureVerify    = "snapshot_signature_verify"
+	MetricPoolEviction       = "snapshot_pool_evictions"
+	MetricSubscriberDrop     = "snapshot_subscriber_drops"
+	MetricLateSignature      = "snapshot_late_signatures"
+	metricsPrometheusPrefix  = "mixin_kernel_"
+)
+
+// Metrics counts the snapshot decisions made in the consensus pipeline,
+// self is true when the snapshot is originated by this node
+type Metrics interface {
+	Inc(name string, self bool)
+}
+
+// Observer is optionally implemented by Metrics to record the duration of a batch of count
+// operations, the time is never measured when the metrics doesn't implement it
+type Observer interface {
+	Observe(name string, count int, d time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Inc(name string, self bool) {}
+
+// PrometheusMetrics renders the counters and latency histograms in the prometheus text format
+type PrometheusMetrics struct {
+	sync.Mutex
+	counters   map[string]map[bool]uint64
+	histograms map[string]*latencyHistogram
+}
+
+type latencyHistogram struct {
+	buckets []uint64
+	sum     float64
+	batches uint64
+	count   uint64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		counters:   make(map[string]map[bool]uint64),
+		histograms: make(map[string]*latencyHistogram),
+	}
+}
+
+func (m *PrometheusMetrics) Inc(name string, self bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[bool]uint64)
+	}
+	m.counters[name][self]++
+}
+
+func (m *PrometheusMetrics) Observe(name string, count int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	h := m.histograms[name]
+	if h == nil {
+		h = &latencyHistogram{buckets: make([]uint64, len(metricsLatencyBuckets))}
+		m.histograms[name] = h
+	}
+	seconds := d.Seconds()
+	for i, le := range metricsLatencyBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.batches++
+	h.count += uint64(count)
+}
+
+func (m *PrometheusMetrics) Value(name string, self bool) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[name][self]
+}
+
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	names := make([]string, 0)
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var total int64
+	for _, name := range names {
+		metric := metricsPrometheusPrefix + name + "_total"
+		n, err := fmt.Fprintf(w, "# TYPE %s counter\n", metric)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		for _, self := range []bool{false, true} {
+			n, err := fmt.Fprintf(w, "%s{self=\"%t\"} %d\n", metric, self, m.counters[name][self])
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	names = names[:0]
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, err := m.histograms[name].writeTo(w, metricsPrometheusPrefix+name)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// the batch durations histogram, and the total operations count of all batches
+func (h *latencyHistogram) writeTo(w io.Writer, metric string) (int64, error) {
+	lines := []string{fmt.Sprintf("# TYPE %s_seconds histogram", metric)}
+	for i, le := range metricsLatencyBuckets {
+		lines = append(lines, fmt.Sprintf("%s_seconds_bucket{le=\"%g\"} %d", metric, le, h.buckets[i]))
+	}
+	lines = append(lines, fmt.Sprintf("%s_seconds_bucket{le=\"+Inf\"} %d", metric, h.batches))
+	lines = append(lines, fmt.Sprintf("%s_seconds_sum %g", metric, h.sum))
+	lines = append(lines, fmt.Sprintf("%s_seconds_count %d", metric, h.batches))
+	lines = append(lines, fmt.Sprintf("# TYPE %s_operations_total counter", metric))
+	lines = append(lines, fmt.Sprintf("%s_operations_total %d", metric, h.count))
+
+	var total int64
+	for _, l := range lines {
+		n, err := fmt.Fprintln(w, l)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
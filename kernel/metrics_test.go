@@ -0,0 +1,99 @@
+package kernel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type metricsTestStore struct {
+	storage.Store
+	seen *common.SnapshotWithTopologicalOrder
+}
+
+func (s *metricsTestStore) SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	return s.seen, nil
+}
+
+func (s *metricsTestStore) SnapshotsWriteRejected(r *common.RejectedSnapshot) error {
+	return nil
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := NewPrometheusMetrics()
+	node, accounts := testConsensusNode(7)
+	node.Metrics = metrics
+	store := &metricsTestStore{}
+	node.store = store
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(uint64(1), metrics.Value(MetricValidationFailure, true))
+	assert.Equal(uint64(0), metrics.Value(MetricValidationFailure, false))
+
+	store.seen = &common.SnapshotWithTopologicalOrder{}
+	s.NodeId = accounts[1].Hash().ForNetwork(node.networkId)
+	s.References = [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("final"))}
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(uint64(2), metrics.Value(MetricSnapshotSeen, false))
+	assert.Equal(uint64(0), metrics.Value(MetricSnapshotSeen, true))
+
+	var buf bytes.Buffer
+	_, err := metrics.WriteTo(&buf)
+	assert.Nil(err)
+	assert.Equal(`# TYPE mixin_kernel_snapshot_seen_drops_total counter
+mixin_kernel_snapshot_seen_drops_total{self="false"} 2
+mixin_kernel_snapshot_seen_drops_total{self="true"} 0
+# TYPE mixin_kernel_snapshot_validation_failures_total counter
+mixin_kernel_snapshot_validation_failures_total{self="false"} 0
+mixin_kernel_snapshot_validation_failures_total{self="true"} 1
+`, buf.String())
+}
+
+func TestPrometheusMetricsObserve(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := NewPrometheusMetrics()
+	metrics.Observe(MetricSignatureVerify, 3, 300*time.Microsecond)
+	metrics.Observe(MetricSignatureVerify, 2, 200*time.Millisecond)
+
+	var buf bytes.Buffer
+	_, err := metrics.WriteTo(&buf)
+	assert.Nil(err)
+	assert.Equal(`# TYPE mixin_kernel_snapshot_signature_verify_seconds histogram
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.0001"} 0
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.00025"} 0
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.0005"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.001"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.0025"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.005"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.01"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.025"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.05"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="0.1"} 1
+mixin_kernel_snapshot_signature_verify_seconds_bucket{le="+Inf"} 2
+mixin_kernel_snapshot_signature_verify_seconds_sum 0.2003
+mixin_kernel_snapshot_signature_verify_seconds_count 2
+# TYPE mixin_kernel_snapshot_signature_verify_operations_total counter
+mixin_kernel_snapshot_signature_verify_operations_total 5
+`, buf.String())
+
+	node, accounts := testConsensusNode(7)
+	node.Metrics = metrics
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:4] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	node.clearConsensusSignatures(s)
+	assert.Equal(uint64(9), metrics.histograms[MetricSignatureVerify].count)
+	node.clearConsensusSignatures(s)
+	assert.Equal(uint64(3), metrics.histograms[MetricSignatureVerify].batches)
+}
@@ -6,10 +6,14 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/crypto"
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/mixin/network"
@@ -20,34 +24,98 @@ const (
 	MempoolSize = 8192
 )
 
+// the snapshot messages are sent to the consensus peers through the sender,
+// which is the network peer, unless replaced e.g. by a simulated network
+type SnapshotSender interface {
+	SendSnapshotMessage(idForNetwork crypto.Hash, s *common.Snapshot) error
+	SendSnapshotMessageBatch(peerIds []crypto.Hash, s *common.Snapshot) map[crypto.Hash]error
+}
+
 type Node struct {
-	IdForNetwork   crypto.Hash
-	Account        common.Address
-	ConsensusNodes []common.Node
-	Graph          *RoundGraph
-	TopoCounter    *TopologicalSequence
-	SnapshotsPool  map[crypto.Hash][]crypto.Signature
-	ConsensusCache map[crypto.Hash]time.Time
-	Peer           *network.Peer
-
-	networkId   crypto.Hash
-	store       storage.Store
-	mempoolChan chan *common.Snapshot
-	configDir   string
-}
-
-func SetupNode(store storage.Store, addr string, dir string) (*Node, error) {
+	IdForNetwork      crypto.Hash
+	Account           common.Address
+	ConsensusNodes    []common.Node
+	Graph             *RoundGraph
+	TopoCounter       *TopologicalSequence
+	SnapshotsPool     map[crypto.Hash][]crypto.Signature
+	ConsensusCache    map[crypto.Hash]time.Time
+	GossipPeers       map[crypto.Hash]bool
+	Peer              *network.Peer
+	Sender            SnapshotSender
+	Clock             Clock
+	Metrics           Metrics
+	Logger            *logger.Logger
+	OnEquivocation    func(a, b *common.Snapshot)
+	OnFinalized       func(*common.SnapshotWithTopologicalOrder)
+	OnConsensusChange func(*ConsensusChange)
+	Recorder          *SnapshotRecorder
+
+	networkId     crypto.Hash
+	roundGap      uint64
+	roundLimit    int
+	observed      clockObservation
+	progress      nodeProgress
+	pending       map[crypto.Hash]*pendingSnapshot
+	unknownRefs   map[crypto.Hash][]*common.Snapshot
+	refRetries    map[crypto.Hash]int
+	readRetries   readRetries
+	subscribers   snapshotSubscribers
+	store         storage.Store
+	mempoolChan   chan *common.Snapshot
+	configDir     string
+	persistedPool map[crypto.Hash]int
+	poolOrder     poolOrder
+	gossipFilter  *gossipFilter
+	limiter       *peerLimiter
+	heartbeatAt   uint64
+	assigned      roundAssignment
+	seenCache     *hashLRU
+	signers       signersCache
+	verified      verifyCache
+	roundHashes   roundHashCache
+	finalized     finalizedTimes
+	aggregation   *aggregationPeers
+	nodesLock     sync.RWMutex
+	gossipLock    sync.RWMutex
+	stateLock     sync.Mutex
+	closing       chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closeErr      error
+}
+
+func SetupNode(store storage.Store, addr string, dir string, level int) (*Node, error) {
+	err := checkConsensusThreshold(config.ConsensusThresholdNumerator, config.ConsensusThresholdDenominator)
+	if err != nil {
+		return nil, err
+	}
+
 	var node = &Node{
 		ConsensusNodes: make([]common.Node, 0),
 		SnapshotsPool:  make(map[crypto.Hash][]crypto.Signature),
 		ConsensusCache: make(map[crypto.Hash]time.Time),
+		GossipPeers:    make(map[crypto.Hash]bool),
+		Clock:          wallClock{},
+		roundGap:       config.SnapshotRoundGap,
+		roundLimit:     config.SnapshotRoundLimit,
+		Metrics:        noopMetrics{},
+		Logger:         logger.New(level),
 		store:          store,
 		mempoolChan:    make(chan *common.Snapshot, MempoolSize),
 		configDir:      dir,
 		TopoCounter:    getTopologyCounter(store),
+		persistedPool:  make(map[crypto.Hash]int),
+		pending:        make(map[crypto.Hash]*pendingSnapshot),
+		unknownRefs:    make(map[crypto.Hash][]*common.Snapshot),
+		gossipFilter:   newGossipFilter(),
+		limiter:        newPeerLimiter(),
+		seenCache:      newHashLRU(config.SnapshotSeenCacheSize),
+		aggregation:    &aggregationPeers{peers: make(map[crypto.Hash]bool)},
+		closing:        make(chan struct{}),
+		closed:         make(chan struct{}),
 	}
 
-	err := node.LoadNodeState()
+	err = node.LoadNodeState()
 	if err != nil {
 		return nil, err
 	}
@@ -57,30 +125,58 @@ func SetupNode(store storage.Store, addr string, dir string) (*Node, error) {
 		return nil, err
 	}
 
+	err = node.resumeTopologyReindex()
+	if err != nil {
+		return nil, err
+	}
+
 	err = node.LoadConsensusNodes()
 	if err != nil {
 		return nil, err
 	}
 
-	graph, err := LoadRoundGraph(node.store)
+	// the graph is initialized by the genesis already for a fresh network
+	if node.Graph == nil {
+		graph, err := LoadRoundGraph(node.store)
+		if err != nil {
+			return nil, err
+		}
+		node.Graph = graph
+		node.trackProgress()
+	}
+
+	err = node.checkGraphConsistency()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SnapshotTraceFile != "" {
+		f, err := os.OpenFile(config.SnapshotTraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		node.Recorder = NewSnapshotRecorder(f)
+	}
+
+	err = node.LoadSnapshotsPool()
 	if err != nil {
 		return nil, err
 	}
-	node.Graph = graph
 
 	node.Peer = network.NewPeer(node, node.IdForNetwork, addr)
+	node.Sender = node.Peer
 	err = node.AddNeighborsFromConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Printf("Listen:\t%s\n", addr)
-	logger.Printf("Account:\t%s\n", node.Account.String())
-	logger.Printf("View Key:\t%s\n", node.Account.PrivateViewKey.String())
-	logger.Printf("Spend Key:\t%s\n", node.Account.PrivateSpendKey.String())
-	logger.Printf("Network:\t%s\n", node.networkId.String())
-	logger.Printf("Node Id:\t%s\n", node.IdForNetwork.String())
-	logger.Printf("Topology:\t%d\n", node.TopoCounter.seq)
+	node.Logger.Infof("Listen:\t%s\n", addr)
+	node.Logger.Infof("Account:\t%s\n", node.Account.String())
+	node.Logger.Infof("View Key:\t%s\n", node.Account.PrivateViewKey.String())
+	node.Logger.Infof("Spend Key:\t%s\n", node.Account.PrivateSpendKey.String())
+	node.Logger.Infof("Network:\t%s\n", node.networkId.String())
+	node.Logger.Infof("Node Id:\t%s\n", node.IdForNetwork.String())
+	node.Logger.Infof("Topology:\t%d\n", node.TopoCounter.seq)
 	return node, nil
 }
 
@@ -107,9 +203,9 @@ func (node *Node) LoadNodeState() error {
 }
 
 func (node *Node) LoadConsensusNodes() error {
-	node.ConsensusNodes = node.store.SnapshotsReadConsensusNodes()
+	node.updateConsensusNodes(node.store.SnapshotsReadConsensusNodes())
 	for _, cn := range node.ConsensusNodes {
-		logger.Println(cn.Account.String(), cn.State)
+		node.Logger.Info(cn.Account.String(), cn.State)
 	}
 	return nil
 }
@@ -135,7 +231,9 @@ func (node *Node) AddNeighborsFromConfig() error {
 		if err != nil {
 			return err
 		}
-		node.Peer.AddNeighbor(acc.Hash().ForNetwork(node.networkId), in.Host)
+		id := acc.Hash().ForNetwork(node.networkId)
+		node.Peer.AddNeighbor(id, in.Host)
+		node.AddGossipPeer(id)
 	}
 
 	return nil
@@ -151,7 +249,7 @@ func (node *Node) NetworkId() crypto.Hash {
 
 func (node *Node) BuildGraph() []network.SyncPoint {
 	points := make([]network.SyncPoint, 0)
-	for _, c := range node.Graph.FinalCache {
+	for _, c := range node.Graph.FinalCache() {
 		points = append(points, network.SyncPoint{
 			NodeId: c.NodeId,
 			Number: c.Number,
@@ -167,7 +265,11 @@ func (node *Node) BuildAuthenticationMessage() []byte {
 	hash := node.Account.Hash()
 	data = append(data, hash[:]...)
 	sig := node.Account.PrivateSpendKey.Sign(data)
-	return append(data, sig[:]...)
+	data = append(data, sig[:]...)
+	if config.SignatureAggregation {
+		data = append(data, authenticationCapabilityAggregation)
+	}
+	return data
 }
 
 func (node *Node) Authenticate(msg []byte) (crypto.Hash, error) {
@@ -176,6 +278,8 @@ func (node *Node) Authenticate(msg []byte) (crypto.Hash, error) {
 		return crypto.Hash{}, errors.New("peer authentication message timeout")
 	}
 
+	node.nodesLock.RLock()
+	defer node.nodesLock.RUnlock()
 	for _, cn := range node.ConsensusNodes {
 		if !cn.IsAccepted() {
 			continue
@@ -187,6 +291,8 @@ func (node *Node) Authenticate(msg []byte) (crypto.Hash, error) {
 		var sig crypto.Signature
 		copy(sig[:], msg[40:])
 		if cn.Account.PublicSpendKey.Verify(msg[:40], sig) {
+			capable := len(msg) > 104 && msg[104]&authenticationCapabilityAggregation != 0
+			node.aggregation.set(peerId.ForNetwork(node.networkId), capable)
 			return peerId.ForNetwork(node.networkId), nil
 		}
 		break
@@ -196,23 +302,85 @@ func (node *Node) Authenticate(msg []byte) (crypto.Hash, error) {
 }
 
 func (node *Node) FeedMempool(peer *network.Peer, s *common.Snapshot) error {
+	if node.isClosing() {
+		return errNodeClosed
+	}
+	s.Source = peer.IdForNetwork
 	if peer.IdForNetwork == node.IdForNetwork {
-		node.mempoolChan <- s
+		node.recordSnapshot(s)
+		node.queueSnapshot(s)
 		return nil
 	}
 
-	for _, cn := range node.ConsensusNodes {
+	// the consensus peers send all their snapshots and signatures, relay peers only gossip
+	rate, burst := config.RelayPeerSnapshotRate, config.RelayPeerSnapshotBurst
+	node.nodesLock.RLock()
+	consensus := node.consensusNode(peer.IdForNetwork) != nil
+	node.nodesLock.RUnlock()
+	if consensus {
+		rate, burst = config.ConsensusPeerSnapshotRate, config.ConsensusPeerSnapshotBurst
+	}
+	if allowed, first := node.limiter.allow(peer.IdForNetwork, rate, burst, time.Now()); !allowed {
+		if first {
+			node.Logger.Warn("SNAPSHOT PEER THROTTLED", peer.IdForNetwork, rate, burst)
+		}
+		node.Metrics.Inc(MetricPeerThrottled, false)
+		return nil
+	}
+
+	node.gossipFilter.mark(peer.IdForNetwork, s.PayloadHash(), time.Now())
+
+	if node.checkFeedSigner(peer.IdForNetwork, s) {
+		node.recordSnapshot(s)
+		node.queueSnapshot(s)
+	} else {
+		node.rejectSnapshot(s, RejectSigner, nil)
+	}
+	return nil
+}
+
+// gossip peers may relay snapshots without signing, the snapshot node signature is required then.
+// The consensus nodes may be replaced meanwhile, but the lock is never held to queue the snapshot,
+// which may wait for the consumer, and the consumer waits for the lock when a replacement waits.
+func (node *Node) checkFeedSigner(peerId crypto.Hash, s *common.Snapshot) bool {
+	node.nodesLock.RLock()
+	defer node.nodesLock.RUnlock()
+
+	signer := peerId
+	if node.isGossipPeer(signer) && node.consensusNode(signer) == nil {
+		signer = s.NodeId
+	}
+	cn := node.consensusNode(signer)
+	return cn != nil && node.checkSnapshotSigner(s, cn)
+}
+
+func (node *Node) recordSnapshot(s *common.Snapshot) {
+	if node.Recorder != nil {
+		node.Recorder.Record(s)
+	}
+}
+
+func (node *Node) consensusNode(idForNetwork crypto.Hash) *common.Node {
+	for i, cn := range node.ConsensusNodes {
 		if !cn.IsAccepted() {
 			continue
 		}
-		idForNetwork := cn.Account.Hash().ForNetwork(node.networkId)
-		if idForNetwork != peer.IdForNetwork {
+		if cn.IdForNetwork(node.networkId) == idForNetwork {
+			return &node.ConsensusNodes[i]
+		}
+	}
+	return nil
+}
+
+// a snapshot is only from an accepted node, or a pledging one to be accepted
+func (node *Node) snapshotNode(idForNetwork crypto.Hash) *common.Node {
+	for i, cn := range node.ConsensusNodes {
+		if !cn.IsAccepted() && cn.State != common.NodeStatePledging {
 			continue
 		}
-		if s.CheckSignature(cn.Account.PublicSpendKey) {
-			node.mempoolChan <- s
+		if cn.IdForNetwork(node.networkId) == idForNetwork {
+			return &node.ConsensusNodes[i]
 		}
-		break
 	}
 	return nil
 }
@@ -221,6 +389,14 @@ func (node *Node) ReadSnapshotsSinceTopology(offset, count uint64) ([]*common.Sn
 	return node.store.SnapshotsReadSnapshotsSinceTopology(offset, count)
 }
 
+// ReadSnapshotsSince pages through the ledger, it returns at most limit finalized snapshots with
+// the topological order strictly larger than topo in ascending order, the order of the last one
+// is the cursor of the next page. The first genesis snapshot has the order 0, which is read by
+// ReadSnapshotsSinceTopology instead.
+func (node *Node) ReadSnapshotsSince(topo uint64, limit int) ([]*common.SnapshotWithTopologicalOrder, error) {
+	return node.store.SnapshotsReadSnapshotsAfterTopology(topo, limit)
+}
+
 func (node *Node) ReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error) {
 	return node.store.SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork, round)
 }
@@ -229,13 +405,74 @@ func (node *Node) ReadSnapshotByTransactionHash(hash crypto.Hash) (*common.Snaps
 	return node.store.SnapshotsReadSnapshotByTransactionHash(hash)
 }
 
+// TransactionTopology returns the topological order of a finalized transaction, only finalized
+// snapshots are written to the store. A transaction with a snapshot in the pool, i.e. signed but
+// not finalized yet, returns false, and an unknown one returns TransactionNotFoundError. The
+// store and the pool are read with the state lock held, a snapshot is written to the store and
+// deleted from the pool in the same finalization, so it's never missed by both.
+func (node *Node) TransactionTopology(txHash crypto.Hash) (uint64, bool, error) {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	s, err := node.store.SnapshotsReadSnapshotByTransactionHash(txHash)
+	if err != nil {
+		return 0, false, err
+	}
+	if s != nil {
+		return s.TopologicalOrder, true, nil
+	}
+	if node.poolOrder.pooled(txHash, node.SnapshotsPool) {
+		return 0, false, nil
+	}
+	return 0, false, &TransactionNotFoundError{Hash: txHash}
+}
+
+type TransactionNotFoundError struct {
+	Hash crypto.Hash
+}
+
+func (e *TransactionNotFoundError) Error() string {
+	return fmt.Sprintf("transaction not found %s", e.Hash.String())
+}
+
+func (node *Node) ReadSnapshotByPayloadHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	return node.store.SnapshotsReadSnapshotByPayloadHash(hash)
+}
+
+func (node *Node) ListNodeRounds() []NodeRoundInfo {
+	return node.Graph.NodeRoundInfos()
+}
+
 func (node *Node) ConsumeMempool() error {
+	ticker := time.NewTicker(time.Duration(node.roundGap))
+	defer ticker.Stop()
+
+	lanes := node.startLanes(config.SnapshotLanes, node.handleSnapshotInput)
 	for {
 		select {
 		case s := <-node.mempoolChan:
-			err := node.handleSnapshotInput(s)
-			if err != nil {
-				return err
+			lanes.dispatch(s, node.snapshotPriority(s, lanes.threshold), node.closing)
+		case <-lanes.failed:
+			lanes.close()
+			return lanes.err
+		case <-node.closing:
+			lanes.close()
+			node.shutdown()
+			return nil
+		case <-ticker.C:
+			now := node.clockTime()
+			node.stateLock.Lock()
+			node.flushSnapshotsPool()
+			requests := node.reconcileSignatures(now)
+			node.evictConsensusCache(now)
+			heartbeat := node.heartbeat(uint64(now.UnixNano()))
+			node.stateLock.Unlock()
+			node.sendSignatureRequests(requests, node.clockTime())
+			node.gossipFilter.prune(time.Now())
+			_, _, lanes.threshold = node.ConsensusInfo()
+			if heartbeat != nil {
+				node.Logger.Info("SNAPSHOT HEARTBEAT", heartbeat.PayloadHash())
+				lanes.dispatch(heartbeat, node.snapshotPriority(heartbeat, lanes.threshold), node.closing)
 			}
 		}
 	}
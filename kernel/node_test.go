@@ -0,0 +1,132 @@
+package kernel
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(4)
+	store := storage.NewMemoryStore()
+	node.store = store
+
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.Inputs = append(tx.Inputs, &common.Input{Genesis: node.networkId[:]})
+	s := &common.SnapshotWithTopologicalOrder{
+		Snapshot: common.Snapshot{
+			NodeId:      node.IdForNetwork,
+			Transaction: &common.SignedTransaction{Transaction: *tx},
+			Timestamp:   1000,
+		},
+		TopologicalOrder: 5,
+	}
+	assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{s}))
+
+	topo, finalized, err := node.TransactionTopology(tx.PayloadHash())
+	assert.Nil(err)
+	assert.True(finalized)
+	assert.Equal(uint64(5), topo)
+
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	pool := func(extra string) *common.Snapshot {
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: node.networkId[:]})
+		tx.Extra = []byte(extra)
+		s := &common.Snapshot{
+			NodeId:      node.IdForNetwork,
+			Transaction: &common.SignedTransaction{Transaction: *tx},
+			Timestamp:   2000,
+			Signatures:  []crypto.Signature{{1}},
+		}
+		node.poolSnapshot(s.PayloadHash(), s.Signatures)
+		node.poolOrder.addSnapshot(s, node.SnapshotsPool)
+		return s
+	}
+	signed := pool("signed")
+	// far more snapshots signed after it than any bounded cache of the signed ones
+	for i := 0; i < 64; i++ {
+		pool(fmt.Sprintf("other%d", i))
+	}
+	node.poolOrder.compact(node.SnapshotsPool)
+	topo, finalized, err = node.TransactionTopology(signed.TransactionHash())
+	assert.Nil(err)
+	assert.False(finalized)
+	assert.Equal(uint64(0), topo)
+
+	delete(node.SnapshotsPool, signed.PayloadHash())
+	_, finalized, err = node.TransactionTopology(signed.TransactionHash())
+	assert.False(finalized)
+	assert.IsType(&TransactionNotFoundError{}, err)
+	node.poolOrder.compact(node.SnapshotsPool)
+	assert.Len(node.poolOrder.transactions, 64)
+
+	unknown := crypto.NewHash([]byte("unknown"))
+	_, finalized, err = node.TransactionTopology(unknown)
+	assert.False(finalized)
+	nf, ok := err.(*TransactionNotFoundError)
+	assert.True(ok)
+	assert.Equal(unknown, nf.Hash)
+}
+
+func TestReadSnapshotsSince(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(3)
+	store := storage.NewMemoryStore()
+	node.store = store
+
+	snapshot := func(i int, topo uint64) *common.SnapshotWithTopologicalOrder {
+		id := accounts[i].Hash().ForNetwork(node.networkId)
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: node.networkId[:]})
+		tx.Extra = []byte{byte(topo)}
+		return &common.SnapshotWithTopologicalOrder{
+			Snapshot: common.Snapshot{
+				NodeId:      id,
+				Transaction: &common.SignedTransaction{Transaction: *tx},
+				Timestamp:   1000 + topo,
+			},
+			TopologicalOrder: topo,
+		}
+	}
+	assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+		snapshot(0, 0), snapshot(1, 1), snapshot(2, 2),
+	}))
+	for topo := uint64(3); topo < 9; topo++ {
+		assert.Nil(store.SnapshotsWriteSnapshot(snapshot(int(topo*2%3), topo)))
+	}
+
+	var cursor uint64
+	var orders []uint64
+	nodes := make(map[crypto.Hash]int)
+	for {
+		snapshots, err := node.ReadSnapshotsSince(cursor, 2)
+		assert.Nil(err)
+		if len(snapshots) == 0 {
+			break
+		}
+		assert.True(len(snapshots) <= 2)
+		for _, s := range snapshots {
+			orders = append(orders, s.TopologicalOrder)
+			nodes[s.NodeId]++
+			cursor = s.TopologicalOrder
+		}
+	}
+	assert.Equal([]uint64{1, 2, 3, 4, 5, 6, 7, 8}, orders)
+	assert.Len(nodes, 3)
+
+	snapshots, err := node.ReadSnapshotsSince(5, 10)
+	assert.Nil(err)
+	assert.Len(snapshots, 3)
+	assert.Equal(uint64(6), snapshots[0].TopologicalOrder)
+	snapshots, err = node.ReadSnapshotsSince(5, 0)
+	assert.Nil(err)
+	assert.Len(snapshots, 0)
+}
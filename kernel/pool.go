@@ -0,0 +1,288 @@
+package kernel
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// the first seen order of the pool snapshots, an entry is stale once the snapshot
+// is deleted from the pool, or seen again after that with a new sequence
+//
+// The pool snapshots signed by their own nodes are kept by their round and timestamp as well,
+// so a node signing another payload of the same round and timestamp is detected before any of
+// them finalized. A slot is stale once its snapshot is deleted from the pool.
+//
+// The pool snapshots are kept by their transaction hash too, to tell a transaction signed but
+// not finalized yet, and stale the same way as the slots.
+type poolOrder struct {
+	sequence     uint64
+	seen         map[crypto.Hash]uint64
+	since        map[crypto.Hash]uint64
+	entries      []poolEntry
+	slots        map[crypto.Hash]poolSlot
+	transactions map[crypto.Hash]crypto.Hash
+}
+
+type poolSlot struct {
+	hash     crypto.Hash
+	snapshot *common.Snapshot
+}
+
+type poolEntry struct {
+	hash     crypto.Hash
+	sequence uint64
+}
+
+func (o *poolOrder) add(hash crypto.Hash, now uint64) {
+	if o.seen == nil {
+		o.seen = make(map[crypto.Hash]uint64)
+		o.since = make(map[crypto.Hash]uint64)
+	}
+	o.sequence++
+	o.seen[hash] = o.sequence
+	o.since[hash] = now
+	o.entries = append(o.entries, poolEntry{hash: hash, sequence: o.sequence})
+}
+
+// drop the stale entries, pool is the live snapshots
+func (o *poolOrder) compact(pool map[crypto.Hash][]crypto.Signature) {
+	entries := make([]poolEntry, 0, len(pool))
+	for _, e := range o.entries {
+		if pool[e.hash] != nil && o.seen[e.hash] == e.sequence {
+			entries = append(entries, e)
+		}
+	}
+	for hash := range o.seen {
+		if pool[hash] == nil {
+			delete(o.seen, hash)
+			delete(o.since, hash)
+		}
+	}
+	for key, slot := range o.slots {
+		if pool[slot.hash] == nil {
+			delete(o.slots, key)
+		}
+	}
+	for txHash, hash := range o.transactions {
+		if pool[hash] == nil {
+			delete(o.transactions, txHash)
+		}
+	}
+	o.entries = entries
+}
+
+// the first live snapshot of the transaction and the slot is kept, a conflict one is detected before pooled
+func (o *poolOrder) addSnapshot(s *common.Snapshot, pool map[crypto.Hash][]crypto.Signature) {
+	hash := s.PayloadHash()
+	if o.transactions == nil {
+		o.transactions = make(map[crypto.Hash]crypto.Hash)
+	}
+	txHash := s.TransactionHash()
+	if live, found := o.transactions[txHash]; !found || pool[live] == nil {
+		o.transactions[txHash] = hash
+	}
+
+	if !snapshotSignedBy(s, s.NodeId) {
+		return
+	}
+	if o.slots == nil {
+		o.slots = make(map[crypto.Hash]poolSlot)
+	}
+	key := equivocationSlot(s)
+	if slot, found := o.slots[key]; found && pool[slot.hash] != nil {
+		return
+	}
+	c := *s
+	c.Signatures = append([]crypto.Signature{}, s.Signatures...)
+	c.Signers = nil
+	o.slots[key] = poolSlot{hash: hash, snapshot: &c}
+}
+
+// whether a snapshot of the transaction is in the pool, i.e. signed but not finalized yet
+func (o *poolOrder) pooled(txHash crypto.Hash, pool map[crypto.Hash][]crypto.Signature) bool {
+	hash, found := o.transactions[txHash]
+	return found && pool[hash] != nil
+}
+
+// the live pool snapshot of the same slot, but a different payload
+func (o *poolOrder) conflict(s *common.Snapshot, hash crypto.Hash, pool map[crypto.Hash][]crypto.Signature) *common.Snapshot {
+	slot, found := o.slots[equivocationSlot(s)]
+	if !found || slot.hash == hash || pool[slot.hash] == nil {
+		return nil
+	}
+	return slot.snapshot
+}
+
+// poolSnapshot puts the signatures of a snapshot to the pool, and the oldest snapshots never
+// finalized are evicted when the pool grows over the limit, e.g. in a long network partition.
+// An evicted snapshot persisted already is kept in the store, and loaded again when restarted.
+func (node *Node) poolSnapshot(hash crypto.Hash, sigs []crypto.Signature) {
+	if node.SnapshotsPool[hash] == nil {
+		node.poolOrder.add(hash, node.Clock.Now())
+	}
+	node.SnapshotsPool[hash] = sigs
+	if len(node.poolOrder.entries) > 2*config.SnapshotsPoolLimit {
+		node.poolOrder.compact(node.SnapshotsPool)
+	}
+
+	for len(node.SnapshotsPool) > config.SnapshotsPoolLimit && len(node.poolOrder.entries) > 0 {
+		e := node.poolOrder.entries[0]
+		node.poolOrder.entries = node.poolOrder.entries[1:]
+		if node.SnapshotsPool[e.hash] == nil || node.poolOrder.seen[e.hash] != e.sequence {
+			continue
+		}
+		self := node.pending[e.hash] != nil
+		node.Logger.Warn("SNAPSHOTS POOL EVICTED", e.hash, len(node.SnapshotsPool[e.hash]))
+		node.Metrics.Inc(MetricPoolEviction, self)
+		delete(node.SnapshotsPool, e.hash)
+		delete(node.poolOrder.seen, e.hash)
+		delete(node.poolOrder.since, e.hash)
+		delete(node.persistedPool, e.hash)
+		delete(node.pending, e.hash)
+		delete(node.refRetries, e.hash)
+	}
+}
+
+func (node *Node) LoadSnapshotsPool() error {
+	pool, err := node.store.SnapshotsPoolRead()
+	if err != nil {
+		return err
+	}
+
+	// any finalized snapshot is in the store, even the ones of the sealed rounds
+	// or flushed from the cache round, never only in the cache round snapshots
+	for hash, sigs := range pool {
+		s, err := node.store.SnapshotsReadSnapshotByPayloadHash(hash)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			err := node.store.SnapshotsPoolDelete(hash)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		node.persistedPool[hash] = len(sigs)
+		node.poolSnapshot(hash, sigs)
+	}
+	return nil
+}
+
+func (node *Node) FlushSnapshotsPool() error {
+	for hash, sigs := range node.SnapshotsPool {
+		if node.persistedPool[hash] == len(sigs) {
+			continue
+		}
+		err := node.store.SnapshotsPoolWrite(hash, sigs)
+		if err != nil {
+			return err
+		}
+		node.persistedPool[hash] = len(sigs)
+	}
+	for hash := range node.persistedPool {
+		if node.SnapshotsPool[hash] != nil {
+			continue
+		}
+		err := node.store.SnapshotsPoolDelete(hash)
+		if err != nil {
+			return err
+		}
+		delete(node.persistedPool, hash)
+	}
+	return nil
+}
+
+func (node *Node) flushSnapshotsPool() {
+	err := node.FlushSnapshotsPool()
+	if err != nil {
+		node.Logger.Error("FLUSH SNAPSHOTS POOL ERROR", err)
+	}
+}
+
+// a pool snapshot signed by some consensus nodes, but not finalized for a while
+type StuckInfo struct {
+	PayloadHash crypto.Hash   `json:"hash"`
+	Since       uint64        `json:"since"`
+	Signatures  int           `json:"signatures"`
+	Threshold   int           `json:"threshold"`
+	Signers     []crypto.Hash `json:"signers"`
+	Missing     []crypto.Hash `json:"missing"`
+	Unknown     int           `json:"unknown"`
+}
+
+// StuckSnapshots returns the pool snapshots first seen longer than the duration ago, the oldest
+// first, a snapshot is finalized only with more signatures than the threshold. The signers are
+// attributed by the verified signatures, a signature not verified since the node started, e.g.
+// loaded from the persisted pool, is unknown unless the snapshot is a pending self one.
+func (node *Node) StuckSnapshots(olderThan time.Duration) []StuckInfo {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	now := node.Clock.Now()
+	_, _, threshold := node.consensusInfo()
+	stuck := make([]StuckInfo, 0)
+	for hash, sigs := range node.SnapshotsPool {
+		since, found := node.poolOrder.since[hash]
+		if !found || since+uint64(olderThan) > now {
+			continue
+		}
+		info := StuckInfo{
+			PayloadHash: hash,
+			Since:       since,
+			Signatures:  len(sigs),
+			Threshold:   threshold,
+			Signers:     make([]crypto.Hash, 0),
+			Missing:     make([]crypto.Hash, 0),
+		}
+		signed := make(map[crypto.Hash]bool)
+		for _, sig := range sigs {
+			id, found := node.poolSigner(hash, sig)
+			if !found {
+				info.Unknown++
+				continue
+			}
+			if !signed[id] {
+				signed[id] = true
+				info.Signers = append(info.Signers, id)
+			}
+		}
+		for _, cn := range node.ConsensusNodes {
+			id := cn.IdForNetwork(node.networkId)
+			if cn.IsAccepted() && !signed[id] {
+				info.Missing = append(info.Missing, id)
+			}
+		}
+		sort.Slice(info.Signers, func(i, j int) bool {
+			return bytes.Compare(info.Signers[i][:], info.Signers[j][:]) < 0
+		})
+		stuck = append(stuck, info)
+	}
+	sort.Slice(stuck, func(i, j int) bool {
+		if stuck[i].Since == stuck[j].Since {
+			return bytes.Compare(stuck[i].PayloadHash[:], stuck[j].PayloadHash[:]) < 0
+		}
+		return stuck[i].Since < stuck[j].Since
+	})
+	return stuck
+}
+
+func (node *Node) poolSigner(hash crypto.Hash, sig crypto.Signature) (crypto.Hash, bool) {
+	if r, cached := node.verified.get(sig, hash); cached {
+		return r.id, r.found
+	}
+	p := node.pending[hash]
+	if p == nil {
+		return crypto.Hash{}, false
+	}
+	verifier, enabled := snapshotVerifier(p.snapshot)
+	if !enabled {
+		return crypto.Hash{}, false
+	}
+	return node.signatureSigner(verifier, p.snapshot.Payload(), sig)
+}
@@ -0,0 +1,198 @@
+package kernel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPoolNode(store storage.Store) *Node {
+	node, _ := testConsensusNode(4)
+	node.Graph = testRoundGraph(node)
+	node.store = store
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.persistedPool = make(map[crypto.Hash]int)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	node.refRetries = make(map[crypto.Hash]int)
+	return node
+}
+
+func TestSnapshotsPoolEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	limit := config.SnapshotsPoolLimit
+	defer func() { config.SnapshotsPoolLimit = limit }()
+	config.SnapshotsPoolLimit = 8
+
+	store := storage.NewMemoryStore()
+	node := testPoolNode(store)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+
+	hashes := make([]crypto.Hash, 12)
+	for i := range hashes {
+		hashes[i] = crypto.NewHash([]byte(fmt.Sprintf("snapshot%d", i)))
+	}
+	sigs := []crypto.Signature{{1}}
+	for i := 0; i < 4; i++ {
+		node.poolSnapshot(hashes[i], sigs)
+	}
+	node.pending[hashes[0]] = &pendingSnapshot{}
+	assert.Nil(node.FlushSnapshotsPool())
+
+	// the signatures of an old snapshot don't change its first seen order
+	for i := 4; i < 8; i++ {
+		node.poolSnapshot(hashes[i], sigs)
+		node.poolSnapshot(hashes[0], append(sigs, crypto.Signature{byte(i)}))
+	}
+	for i := 8; i < 12; i++ {
+		node.poolSnapshot(hashes[i], sigs)
+	}
+	assert.Len(node.SnapshotsPool, 8)
+	for i, hash := range hashes {
+		assert.Equal(i >= 4, node.SnapshotsPool[hash] != nil, hash.String())
+	}
+	assert.Nil(node.pending[hashes[0]])
+	assert.Equal(uint64(1), metrics.Value(MetricPoolEviction, true))
+	assert.Equal(uint64(3), metrics.Value(MetricPoolEviction, false))
+
+	// the evicted snapshots persisted are kept in the store as they were flushed
+	assert.Nil(node.FlushSnapshotsPool())
+	pool, err := store.SnapshotsPoolRead()
+	assert.Nil(err)
+	assert.Len(pool, 12)
+	assert.Equal(sigs, pool[hashes[0]])
+
+	node.poolSnapshot(hashes[0], sigs)
+	assert.Equal(sigs, node.SnapshotsPool[hashes[0]])
+	assert.Nil(node.SnapshotsPool[hashes[4]])
+	node.poolSnapshot(hashes[1], sigs)
+	assert.Nil(node.SnapshotsPool[hashes[5]])
+	assert.NotNil(node.SnapshotsPool[hashes[0]])
+	assert.Equal(uint64(5), metrics.Value(MetricPoolEviction, false))
+
+	restarted := testPoolNode(store)
+	assert.Nil(restarted.LoadSnapshotsPool())
+	assert.Len(restarted.SnapshotsPool, 8)
+	pool, err = store.SnapshotsPoolRead()
+	assert.Nil(err)
+	assert.Len(pool, 12)
+}
+
+func TestLoadSnapshotsPoolFinalized(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStore()
+	node := testPoolNode(store)
+	finalized := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: 1000}
+	assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{{Snapshot: *finalized}}))
+	pending := crypto.NewHash([]byte("pending"))
+	assert.Nil(store.SnapshotsPoolWrite(finalized.PayloadHash(), []crypto.Signature{{1}}))
+	assert.Nil(store.SnapshotsPoolWrite(pending, []crypto.Signature{{2}}))
+
+	// the snapshot of an older round isn't in the cache round, but pruned as well
+	assert.Equal(uint64(1), node.Graph.CacheRound[node.IdForNetwork].Number)
+	assert.Nil(node.LoadSnapshotsPool())
+	assert.Len(node.SnapshotsPool, 1)
+	assert.Equal([]crypto.Signature{{2}}, node.SnapshotsPool[pending])
+	pool, err := store.SnapshotsPoolRead()
+	assert.Nil(err)
+	assert.Len(pool, 1)
+	assert.NotNil(pool[pending])
+}
+
+func TestSnapshotsPoolOrderCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	limit := config.SnapshotsPoolLimit
+	defer func() { config.SnapshotsPoolLimit = limit }()
+	config.SnapshotsPoolLimit = 8
+
+	node := testPoolNode(storage.NewMemoryStore())
+	for i := 0; i < 100; i++ {
+		hash := crypto.NewHash([]byte(fmt.Sprintf("snapshot%d", i)))
+		node.poolSnapshot(hash, []crypto.Signature{{1}})
+		if i%2 == 0 {
+			delete(node.SnapshotsPool, hash)
+		}
+		assert.True(len(node.poolOrder.entries) <= 2*config.SnapshotsPoolLimit+1)
+		assert.True(len(node.poolOrder.seen) <= 2*config.SnapshotsPoolLimit+1)
+	}
+	assert.Len(node.SnapshotsPool, 8)
+	for i := 85; i < 100; i += 2 {
+		assert.NotNil(node.SnapshotsPool[crypto.NewHash([]byte(fmt.Sprintf("snapshot%d", i)))])
+	}
+}
+
+func TestStuckSnapshots(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	clock := &testClock{now: uint64(time.Hour)}
+	node.Clock = clock
+	ids := make([]crypto.Hash, len(accounts))
+	for i, a := range accounts {
+		ids[i] = a.Hash().ForNetwork(node.networkId)
+	}
+	snapshot := func(extra string) *common.Snapshot {
+		s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte(extra)
+		return s
+	}
+
+	// a pending self snapshot, the signers are verified with the snapshot
+	self := snapshot("self")
+	for _, a := range accounts[:4] {
+		self.Sign(a.PrivateSpendKey)
+	}
+	node.trackPendingSnapshot(self, time.Now())
+	node.poolSnapshot(self.PayloadHash(), append([]crypto.Signature{}, self.Signatures...))
+
+	// a peer snapshot, the signers are attributed by the verified signatures only
+	clock.now += uint64(time.Second)
+	peer := snapshot("peer")
+	peer.NodeId = ids[1]
+	peer.Sign(accounts[1].PrivateSpendKey)
+	peer.Sign(accounts[2].PrivateSpendKey)
+	assert.Nil(node.clearConsensusSignatures(peer))
+	peer.Sign(accounts[5].PrivateSpendKey)
+	node.poolSnapshot(peer.PayloadHash(), append([]crypto.Signature{}, peer.Signatures...))
+
+	clock.now += uint64(time.Minute)
+	recent := snapshot("recent")
+	recent.Sign(accounts[0].PrivateSpendKey)
+	node.poolSnapshot(recent.PayloadHash(), append([]crypto.Signature{}, recent.Signatures...))
+
+	stuck := node.StuckSnapshots(time.Minute)
+	assert.Len(stuck, 2)
+	assert.Equal(self.PayloadHash(), stuck[0].PayloadHash)
+	assert.Equal(uint64(time.Hour), stuck[0].Since)
+	assert.Equal(4, stuck[0].Signatures)
+	assert.Equal(4, stuck[0].Threshold)
+	assert.ElementsMatch(ids[:4], stuck[0].Signers)
+	assert.Equal(ids[4:], stuck[0].Missing)
+	assert.Equal(0, stuck[0].Unknown)
+
+	assert.Equal(peer.PayloadHash(), stuck[1].PayloadHash)
+	assert.Equal(3, stuck[1].Signatures)
+	assert.ElementsMatch(ids[1:3], stuck[1].Signers)
+	assert.Equal([]crypto.Hash{ids[0], ids[3], ids[4], ids[5], ids[6]}, stuck[1].Missing)
+	assert.Equal(1, stuck[1].Unknown)
+
+	assert.Len(node.StuckSnapshots(time.Hour), 0)
+	assert.Len(node.StuckSnapshots(0), 3)
+
+	// a snapshot is never reported again once finalized
+	delete(node.SnapshotsPool, self.PayloadHash())
+	stuck = node.StuckSnapshots(time.Minute)
+	assert.Len(stuck, 1)
+	assert.Equal(peer.PayloadHash(), stuck[0].PayloadHash)
+}
@@ -17,9 +17,10 @@ func QueueTransaction(store storage.Store, tx *common.SignedTransaction) (string
 	return tx.PayloadHash().String(), store.QueueAdd(tx)
 }
 
+// it stops when the node closing, and returns after the node closed
 func (node *Node) ConsumeQueue() error {
 	var offset = uint64(0)
-	for {
+	for !node.isClosing() {
 		err := node.store.QueuePoll(offset, func(k uint64, v []byte) error {
 			var tx common.SignedTransaction
 			err := msgpack.Unmarshal(v, &tx)
@@ -37,10 +38,14 @@ func (node *Node) ConsumeQueue() error {
 			offset = k
 			return nil
 		})
+		if err == errNodeClosed {
+			break
+		}
 		if err != nil {
 			panic(err)
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
+	<-node.closed
 	return nil
 }
@@ -0,0 +1,79 @@
+package kernel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// token buckets of the inbound snapshots by the sending peer, each bucket is refilled by rate
+// snapshots a second up to burst, and a non positive rate never limits the peer
+type peerLimiter struct {
+	sync.Mutex
+	buckets   map[crypto.Hash]*tokenBucket
+	throttled map[crypto.Hash]uint64
+}
+
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+func newPeerLimiter() *peerLimiter {
+	return &peerLimiter{
+		buckets:   make(map[crypto.Hash]*tokenBucket),
+		throttled: make(map[crypto.Hash]uint64),
+	}
+}
+
+// first is true for the first throttled snapshot since the peer was allowed the last time,
+// so a flooding peer is logged once a burst
+func (l *peerLimiter) allow(peerId crypto.Hash, rate, burst int, now time.Time) (allowed, first bool) {
+	if rate <= 0 {
+		return true, false
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.buckets[peerId]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[peerId] = b
+	}
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		b.last = now
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		b.throttled = false
+		return true, false
+	}
+	first = !b.throttled
+	b.throttled = true
+	l.throttled[peerId]++
+	return false, first
+}
+
+func (l *peerLimiter) counts() map[crypto.Hash]uint64 {
+	l.Lock()
+	defer l.Unlock()
+	counts := make(map[crypto.Hash]uint64)
+	for id, n := range l.throttled {
+		counts[id] = n
+	}
+	return counts
+}
+
+// ThrottledSnapshots returns the inbound snapshots dropped by the rate limit of each peer
+func (node *Node) ThrottledSnapshots() map[crypto.Hash]uint64 {
+	return node.limiter.counts()
+}
@@ -0,0 +1,96 @@
+package kernel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newPeerLimiter()
+	peer := crypto.NewHash([]byte("peer"))
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		allowed, _ := l.allow(peer, 2, 4, now)
+		assert.True(allowed)
+	}
+	allowed, first := l.allow(peer, 2, 4, now)
+	assert.False(allowed)
+	assert.True(first)
+	allowed, first = l.allow(peer, 2, 4, now)
+	assert.False(allowed)
+	assert.False(first)
+
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = l.allow(peer, 2, 4, now)
+	assert.True(allowed)
+	allowed, first = l.allow(peer, 2, 4, now)
+	assert.False(allowed)
+	assert.True(first)
+
+	// never refilled above the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		allowed, _ = l.allow(peer, 2, 4, now)
+		assert.True(allowed)
+	}
+	allowed, _ = l.allow(peer, 2, 4, now)
+	assert.False(allowed)
+	assert.Equal(map[crypto.Hash]uint64{peer: 4}, l.counts())
+
+	for i := 0; i < 16; i++ {
+		allowed, _ = l.allow(peer, 0, 0, now)
+		assert.True(allowed)
+	}
+}
+
+func TestFeedMempoolThrottled(t *testing.T) {
+	assert := assert.New(t)
+
+	rate, burst := config.RelayPeerSnapshotRate, config.RelayPeerSnapshotBurst
+	crate, cburst := config.ConsensusPeerSnapshotRate, config.ConsensusPeerSnapshotBurst
+	defer func() {
+		config.RelayPeerSnapshotRate, config.RelayPeerSnapshotBurst = rate, burst
+		config.ConsensusPeerSnapshotRate, config.ConsensusPeerSnapshotBurst = crate, cburst
+	}()
+	config.RelayPeerSnapshotRate, config.RelayPeerSnapshotBurst = 1, 4
+	config.ConsensusPeerSnapshotRate, config.ConsensusPeerSnapshotBurst = 1, 16
+
+	node, accounts := testConsensusNode(7)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	node.GossipPeers = make(map[crypto.Hash]bool)
+	node.gossipFilter = newGossipFilter()
+	node.limiter = newPeerLimiter()
+	node.mempoolChan = make(chan *common.Snapshot, MempoolSize)
+	node.closing = make(chan struct{})
+
+	relayId := crypto.NewHash([]byte("relay"))
+	node.AddGossipPeer(relayId)
+	relay := network.NewPeer(nil, relayId, "")
+	consensusId := accounts[1].Hash().ForNetwork(node.networkId)
+	consensus := network.NewPeer(nil, consensusId, "")
+
+	for i := 0; i < 12; i++ {
+		s := &common.Snapshot{NodeId: consensusId, Transaction: &common.SignedTransaction{}, Timestamp: uint64(i)}
+		s.Sign(accounts[1].PrivateSpendKey)
+		assert.Nil(node.FeedMempool(relay, s))
+		assert.Nil(node.FeedMempool(consensus, s))
+	}
+	assert.Len(node.mempoolChan, 4+12)
+	assert.Equal(uint64(8), metrics.Value(MetricPeerThrottled, false))
+	assert.Equal(map[crypto.Hash]uint64{relayId: 8}, node.ThrottledSnapshots())
+
+	self := network.NewPeer(nil, node.IdForNetwork, "")
+	for i := 0; i < 32; i++ {
+		assert.Nil(node.FeedMempool(self, &common.Snapshot{NodeId: node.IdForNetwork}))
+	}
+	assert.Len(node.mempoolChan, 4+12+32)
+}
@@ -0,0 +1,155 @@
+package kernel
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// a self snapshot broadcasted for signatures, but not finalized yet
+type pendingSnapshot struct {
+	snapshot *common.Snapshot
+	since    time.Time
+}
+
+func (node *Node) trackPendingSnapshot(s *common.Snapshot, now time.Time) {
+	hash := s.PayloadHash()
+	if node.pending[hash] != nil {
+		return
+	}
+	node.pending[hash] = &pendingSnapshot{snapshot: s, since: now}
+}
+
+// any self snapshot of the round signed but not finalized yet
+func (node *Node) pendingInRound(number uint64) bool {
+	for _, p := range node.pending {
+		if p.snapshot.RoundNumber == number {
+			return true
+		}
+	}
+	return false
+}
+
+// the consensus nodes to ask again for each pending snapshot not finalized in the timeout,
+// a node is only asked when its signature is still missing from the pool, and at most once
+// in a round gap, the same throttle as the signatures broadcast
+func (node *Node) signatureRequests(now time.Time) map[crypto.Hash][]crypto.Hash {
+	requests := make(map[crypto.Hash][]crypto.Hash)
+	for hash, p := range node.pending {
+		sigs := node.SnapshotsPool[hash]
+		if len(sigs) == 0 {
+			delete(node.pending, hash)
+			continue
+		}
+		if now.Before(p.since.Add(time.Duration(config.SnapshotSignatureTimeout))) {
+			continue
+		}
+
+		s := p.snapshot
+		s.Signatures = append([]crypto.Signature{}, sigs...)
+		node.clearConsensusSignatures(s)
+		signed := make(map[crypto.Hash]bool)
+		for _, id := range s.Signers {
+			signed[id] = true
+		}
+
+		peers := make([]crypto.Hash, 0)
+		for _, cn := range node.ConsensusNodes {
+			if !cn.IsAccepted() {
+				continue
+			}
+			peerId := cn.IdForNetwork(node.networkId)
+			if signed[peerId] || peerId == node.IdForNetwork {
+				continue
+			}
+			cacheId := consensusCacheKey(hash, peerId)
+			if now.Before(node.ConsensusCache[cacheId].Add(time.Duration(node.roundGap))) {
+				continue
+			}
+			peers = append(peers, peerId)
+		}
+		if len(peers) > 0 {
+			requests[hash] = peers
+		}
+	}
+	return requests
+}
+
+// the signature requests are built with the state lock held, on copies of the pending snapshots,
+// and sent by sendSignatureRequests after the lock released, a slow peer never stalls the lanes
+func (node *Node) reconcileSignatures(now time.Time) []*snapshotBroadcast {
+	requests := make([]*snapshotBroadcast, 0)
+	for hash, peers := range node.signatureRequests(now) {
+		s := node.pending[hash].snapshot
+		c := *s
+		c.Signatures = append([]crypto.Signature{}, s.Signatures...)
+		c.Signers = nil
+		requests = append(requests, &snapshotBroadcast{snapshot: &c, peers: peers})
+	}
+	return requests
+}
+
+// only the peers sent successfully are throttled, the others are asked again at the next tick
+func (node *Node) sendSignatureRequests(requests []*snapshotBroadcast, now time.Time) {
+	sent := make([]crypto.Hash, 0)
+	for _, r := range requests {
+		for _, peerId := range r.peers {
+			err := node.Sender.SendSnapshotMessage(peerId, r.snapshot)
+			if err != nil {
+				node.Logger.Warn("SIGNATURE REQUEST ERROR", peerId, err)
+				continue
+			}
+			sent = append(sent, consensusCacheKey(r.snapshot.PayloadHash(), peerId))
+		}
+	}
+	if len(sent) == 0 {
+		return
+	}
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+	for _, id := range sent {
+		node.ConsensusCache[id] = now
+	}
+}
+
+// the peers failed to receive the snapshot are asked again at the next tick, unless
+// they are marked again after the failed send, which is then another send to wait for
+func (node *Node) unmarkConsensusCache(payloadHash crypto.Hash, peers []crypto.Hash, marked time.Time) {
+	if len(peers) == 0 {
+		return
+	}
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+	for _, peerId := range peers {
+		id := consensusCacheKey(payloadHash, peerId)
+		if at, found := node.ConsensusCache[id]; found && at.Equal(marked) {
+			delete(node.ConsensusCache, id)
+		}
+	}
+}
+
+// the consensus cache key of the last time a snapshot sent to the peer
+func consensusCacheKey(payloadHash, peerId crypto.Hash) crypto.Hash {
+	return payloadHash.ForNetwork(peerId)
+}
+
+// the consensus cache only throttles the sends within a round gap, so the entries
+// older than a few round gaps are useless, and evicted to not grow with every snapshot
+func (node *Node) evictConsensusCache(now time.Time) int {
+	gaps := config.ConsensusCacheRoundGaps
+	if gaps < 1 {
+		gaps = 1
+	}
+	ttl := time.Duration(node.roundGap) * time.Duration(gaps)
+	var evicted int
+	for id, at := range node.ConsensusCache {
+		if now.Before(at.Add(ttl)) {
+			continue
+		}
+		delete(node.ConsensusCache, id)
+		evicted++
+	}
+	return evicted
+}
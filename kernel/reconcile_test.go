@@ -0,0 +1,172 @@
+package kernel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.ConsensusCache = make(map[crypto.Hash]time.Time)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:4] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	hash := s.PayloadHash()
+	node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	start := time.Now()
+	node.trackPendingSnapshot(s, start)
+	node.trackPendingSnapshot(s, start.Add(time.Hour))
+	assert.Equal(start, node.pending[hash].since)
+
+	assert.Len(node.signatureRequests(start), 0)
+	now := start.Add(time.Duration(config.SnapshotSignatureTimeout))
+	requests := node.signatureRequests(now)
+	assert.Len(requests[hash], 3)
+	for i, a := range accounts[4:] {
+		assert.Equal(a.Hash().ForNetwork(node.networkId), requests[hash][i])
+	}
+
+	unresponsive := accounts[4].Hash().ForNetwork(node.networkId)
+	for _, id := range requests[hash] {
+		node.ConsensusCache[consensusCacheKey(hash, id)] = now
+	}
+	assert.Len(node.signatureRequests(now), 0)
+
+	s.Sign(accounts[5].PrivateSpendKey)
+	s.Sign(accounts[6].PrivateSpendKey)
+	node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	now = now.Add(time.Duration(node.roundGap))
+	requests = node.signatureRequests(now)
+	assert.Equal([]crypto.Hash{unresponsive}, requests[hash])
+
+	s.Sign(accounts[4].PrivateSpendKey)
+	node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	assert.Len(node.signatureRequests(now), 0)
+
+	delete(node.SnapshotsPool, hash)
+	assert.Len(node.signatureRequests(now), 0)
+	assert.Len(node.pending, 0)
+}
+
+type acceptTestSender struct {
+	SnapshotSender
+}
+
+func (s *acceptTestSender) SendSnapshotMessage(idForNetwork crypto.Hash, ss *common.Snapshot) error {
+	return nil
+}
+
+func TestSendSignatureRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.ConsensusCache = make(map[crypto.Hash]time.Time)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	failing := accounts[4].Hash().ForNetwork(node.networkId)
+	sender := &faultTestSender{
+		SnapshotSender: &acceptTestSender{},
+		failing:        map[crypto.Hash]bool{failing: true},
+		sends:          make(map[crypto.Hash]int),
+	}
+	node.Sender = sender
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	for _, a := range accounts[:4] {
+		s.Sign(a.PrivateSpendKey)
+	}
+	hash := s.PayloadHash()
+	node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	start := time.Now()
+	node.trackPendingSnapshot(s, start)
+
+	// the requests are copies, the pending snapshot may change after the lock released
+	now := start.Add(time.Duration(config.SnapshotSignatureTimeout))
+	node.stateLock.Lock()
+	requests := node.reconcileSignatures(now)
+	node.stateLock.Unlock()
+	assert.Len(requests, 1)
+	assert.Len(requests[0].peers, 3)
+	assert.False(s == requests[0].snapshot)
+	assert.Equal(hash, requests[0].snapshot.PayloadHash())
+
+	node.sendSignatureRequests(requests, now)
+	for _, a := range accounts[4:] {
+		assert.Equal(1, sender.count(a.Hash().ForNetwork(node.networkId)))
+	}
+	assert.Len(node.ConsensusCache, 2)
+	assert.Equal([]crypto.Hash{failing}, node.signatureRequests(now)[hash])
+}
+
+func TestEvictConsensusCache(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.ConsensusCache = make(map[crypto.Hash]time.Time)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	s.Sign(accounts[0].PrivateSpendKey)
+	hash := s.PayloadHash()
+	node.SnapshotsPool[hash] = append([]crypto.Signature{}, s.Signatures...)
+	start := time.Now()
+	node.trackPendingSnapshot(s, start)
+
+	ttl := time.Duration(node.roundGap) * time.Duration(config.ConsensusCacheRoundGaps)
+	now := start.Add(ttl)
+	stale, active := accounts[1].Hash().ForNetwork(node.networkId), accounts[2].Hash().ForNetwork(node.networkId)
+	for _, a := range accounts[1:] {
+		node.ConsensusCache[consensusCacheKey(hash, a.Hash().ForNetwork(node.networkId))] = now
+	}
+	node.ConsensusCache[consensusCacheKey(hash, stale)] = start
+	node.ConsensusCache[consensusCacheKey(hash, active)] = now.Add(-time.Duration(node.roundGap) / 2)
+	for i := 0; i < 8; i++ {
+		node.ConsensusCache[crypto.NewHash([]byte{byte(i)})] = start.Add(-time.Hour)
+	}
+	assert.Equal([]crypto.Hash{stale}, node.signatureRequests(now)[hash])
+
+	assert.Equal(9, node.evictConsensusCache(now))
+	assert.Len(node.ConsensusCache, 5)
+	_, found := node.ConsensusCache[consensusCacheKey(hash, stale)]
+	assert.False(found)
+	_, found = node.ConsensusCache[consensusCacheKey(hash, active)]
+	assert.True(found)
+	assert.Equal([]crypto.Hash{stale}, node.signatureRequests(now)[hash])
+
+	node.ConsensusCache[consensusCacheKey(hash, stale)] = now
+	assert.Len(node.signatureRequests(now), 0)
+	assert.Equal(0, node.evictConsensusCache(now))
+
+	gaps := config.ConsensusCacheRoundGaps
+	config.ConsensusCacheRoundGaps = 0
+	defer func() { config.ConsensusCacheRoundGaps = gaps }()
+	assert.Equal(6, node.evictConsensusCache(now.Add(time.Duration(node.roundGap))))
+	assert.Len(node.ConsensusCache, 0)
+}
+
+func TestConsensusCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	payloadHash, peerId := crypto.NewHash([]byte("payload")), crypto.NewHash([]byte("peer"))
+	key := consensusCacheKey(payloadHash, peerId)
+	assert.Equal(crypto.NewHash(append(peerId[:], payloadHash[:]...)), key)
+	assert.Equal("f91cca654a696f4da0a059dd84b7499a603433a25ff84e7f44ea291da15366cd", key.String())
+	assert.NotEqual(key, consensusCacheKey(peerId, payloadHash))
+
+	node, _ := testConsensusNode(4)
+	for _, cn := range node.ConsensusNodes {
+		assert.Equal(cn.Account.Hash().ForNetwork(node.networkId), cn.IdForNetwork(node.networkId))
+	}
+}
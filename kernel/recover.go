@@ -0,0 +1,55 @@
+package kernel
+
+import (
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// ForceFinalizeRound seals the cache round of the node as final without waiting for the round gap,
+// an admin operation to recover a stuck round. All cache snapshots must be finalized, the same
+// invariant of TryAdvance, otherwise the round hash would differ from the other nodes. The next
+// round still starts after the round gap, the store never accepts its snapshots before that. The
+// next round is started in the store as well, so the sealed round is never loaded as the cache
+// round again after a restart.
+func (node *Node) ForceFinalizeRound(nodeId crypto.Hash) (*FinalRound, error) {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	cache, final := node.Graph.CacheRound[nodeId], node.Graph.FinalRound[nodeId]
+	if cache == nil || final == nil {
+		return nil, fmt.Errorf("unknown round node %s", nodeId.String())
+	}
+	cache = cache.Copy()
+	if len(cache.Snapshots)+cache.Flushed == 0 {
+		return nil, fmt.Errorf("force finalize empty round %s %d", nodeId.String(), cache.Number)
+	}
+	for _, s := range cache.Snapshots {
+		if !node.verifyCacheFinalization(s) {
+			return nil, fmt.Errorf("round snapshot not finalized %s %d %s", nodeId.String(), cache.Number, s.PayloadHash().String())
+		}
+	}
+	sealed, err := cache.asFinal(node.store)
+	if err != nil {
+		return nil, err
+	}
+
+	start := cache.Start + node.roundGap
+	if cache.End > start {
+		start = cache.End
+	}
+	next := &CacheRound{
+		NodeId: nodeId,
+		Number: cache.Number + 1,
+		Start:  start,
+		End:    start,
+	}
+	err = node.store.SnapshotsStartRound(nodeId, next.Number, next.Start)
+	if err != nil {
+		return nil, err
+	}
+	node.Graph.UpdateRound(next, sealed)
+	node.Graph.UpdateFinalCache()
+	node.Logger.Error("FORCE FINALIZE ROUND", nodeId, sealed.Number, sealed.Hash, len(cache.Snapshots)+cache.Flushed)
+	return sealed.Copy(), nil
+}
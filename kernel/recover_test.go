@@ -0,0 +1,123 @@
+package kernel
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForceFinalizeRound(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-kernel-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+	var store storage.Store
+	store, err = storage.NewBadgerStore(root)
+	assert.Nil(err)
+	defer func() { store.Close() }()
+	node, accounts, _ := testReplayNodeWithStore(assert, store)
+	peer, other := accounts[1].Hash().ForNetwork(node.networkId), accounts[2].Hash().ForNetwork(node.networkId)
+	propose := func(output int, number, timestamp uint64, reference crypto.Hash, signers int) *common.Snapshot {
+		signed := testNetworkTransaction(assert, store, node, accounts, output)
+		s := &common.Snapshot{NodeId: peer, Transaction: signed, RoundNumber: number, Timestamp: timestamp}
+		s.References = [2]crypto.Hash{reference, node.Graph.FinalRound[other].Hash}
+		for i := 1; i <= signers; i++ {
+			s.Sign(accounts[i].PrivateSpendKey)
+		}
+		return s
+	}
+	// the inputs are locked with the first signature, and finalized with the node signature
+	finalize := func(s *common.Snapshot) bool {
+		for i := 1; i <= len(s.Signatures); i++ {
+			fed := *s
+			fed.Signatures = append([]crypto.Signature{}, s.Signatures[:i]...)
+			assert.Nil(node.handleSnapshotInput(&fed))
+		}
+		ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+		assert.Nil(err)
+		return ss != nil
+	}
+
+	_, err = node.ForceFinalizeRound(crypto.NewHash([]byte("stranger")))
+	assert.NotNil(err)
+
+	timestamp := replayGenesis + node.roundGap + uint64(time.Millisecond)
+	cache, final, err := node.Graph.CacheRound[peer].TryAdvance(timestamp, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+	assert.Nil(err)
+	if final == nil {
+		final = node.Graph.FinalRound[peer]
+	}
+	s := propose(0, cache.Number, timestamp, final.Hash, 2)
+	assert.True(finalize(s))
+	stuck := node.Graph.CacheRound[peer].Copy()
+	assert.Equal(uint64(1), stuck.Number)
+	assert.Len(stuck.Snapshots, 1)
+
+	// a snapshot without enough signatures in the cache, the round is never sealed
+	pending := propose(1, stuck.Number, timestamp+1, final.Hash, 1)
+	injected := stuck.Copy()
+	injected.Snapshots = append(injected.Snapshots, pending)
+	node.Graph.UpdateRound(injected, node.Graph.FinalRound[peer])
+	_, err = node.ForceFinalizeRound(peer)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), pending.PayloadHash().String())
+	assert.Equal(final.Number, node.Graph.FinalRound[peer].Number)
+	node.Graph.UpdateRound(stuck, node.Graph.FinalRound[peer])
+
+	// sealed before the round gap, with the same hash of the usual advance
+	sealed, err := node.ForceFinalizeRound(peer)
+	assert.Nil(err)
+	assert.Equal(stuck.Number, sealed.Number)
+	assert.Equal(stuck.FinalHash(), sealed.Hash)
+	assert.Equal(timestamp, sealed.Start)
+	assert.Equal(timestamp, sealed.End)
+	assert.Equal(sealed.Hash, node.Graph.FinalRound[peer].Hash)
+	assert.Contains(node.Graph.FinalCache(), *sealed)
+	next := node.Graph.CacheRound[peer]
+	assert.Equal(stuck.Number+1, next.Number)
+	assert.Equal(timestamp+node.roundGap, next.Start)
+	assert.Len(next.Snapshots, 0)
+
+	// the next round is empty, nothing to seal again
+	_, err = node.ForceFinalizeRound(peer)
+	assert.NotNil(err)
+	assert.Equal(sealed.Number, node.Graph.FinalRound[peer].Number)
+
+	// the same rounds are loaded after a restart with the store reopened
+	restart := func() *RoundGraph {
+		assert.Nil(store.Close())
+		store, err = storage.NewBadgerStore(root)
+		assert.Nil(err)
+		graph, err := LoadRoundGraph(store)
+		assert.Nil(err)
+		node.store, node.Graph = store, graph
+		node.TopoCounter = getTopologyCounter(store)
+		return graph
+	}
+	graph := restart()
+	assert.Equal(*sealed, *graph.FinalRound[peer])
+	assert.Equal(next.Number, graph.CacheRound[peer].Number)
+	assert.Equal(next.Start, graph.CacheRound[peer].Start)
+	assert.Len(graph.CacheRound[peer].Snapshots, 0)
+	_, err = node.ForceFinalizeRound(peer)
+	assert.NotNil(err)
+
+	// the next round snapshots reference the sealed round, the empty round starts with the first one
+	n := propose(2, next.Number, next.Start+node.roundGap, sealed.Hash, 2)
+	assert.True(finalize(n))
+	assert.Len(node.Graph.CacheRound[peer].Snapshots, 1)
+	assert.Equal(n.Timestamp, node.Graph.CacheRound[peer].Start)
+	assert.Nil(node.VerifyNodeChain(peer))
+	graph = restart()
+	assert.Equal(sealed.Hash, graph.FinalRound[peer].Hash)
+	assert.Equal(next.Number, graph.CacheRound[peer].Number)
+	assert.Equal(n.Timestamp, graph.CacheRound[peer].Start)
+	assert.Len(graph.CacheRound[peer].Snapshots, 1)
+}
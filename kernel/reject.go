@@ -0,0 +1,43 @@
+package kernel
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+)
+
+// the reason codes of the rejected snapshots records
+const (
+	RejectLimits      = "LIMITS"
+	RejectSeen        = "SEEN"
+	RejectTransaction = "TRANSACTION"
+	RejectSignatures  = "SIGNATURES"
+	RejectSigner      = "SIGNER"
+	RejectRound       = "ROUND"
+	RejectSign        = "SIGN"
+	RejectStale       = "STALE"
+	RejectReferences  = "REFERENCES"
+	RejectLockInputs  = "LOCK INPUTS"
+)
+
+// the dropped snapshots are recorded to the store for forensics, e.g. why the node falls
+// behind, a failed record is only logged and never changes how the snapshot is handled
+func (node *Node) rejectSnapshot(s *common.Snapshot, reason string, err error) {
+	r := &common.RejectedSnapshot{
+		Snapshot:  s,
+		Reason:    reason,
+		Source:    s.Source,
+		Timestamp: uint64(time.Now().UnixNano()),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if err := node.store.SnapshotsWriteRejected(r); err != nil {
+		node.Logger.Warn("SNAPSHOT REJECTED RECORD ERROR", s.PayloadHash(), err)
+	}
+}
+
+// RejectedSnapshots reads the recently rejected snapshots, the newest first
+func (node *Node) RejectedSnapshots(limit int) ([]*common.RejectedSnapshot, error) {
+	return node.store.SnapshotsReadRejected(limit)
+}
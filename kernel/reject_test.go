@@ -0,0 +1,90 @@
+package kernel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectedSnapshots(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts, store := testReplayNode(assert)
+	peer, other := accounts[1].Hash().ForNetwork(node.networkId), accounts[2].Hash().ForNetwork(node.networkId)
+	source := crypto.NewHash([]byte("source"))
+	timestamp := replayGenesis + node.roundGap + uint64(time.Millisecond)
+	cache, final, err := node.Graph.CacheRound[peer].TryAdvance(timestamp, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+	assert.Nil(err)
+	if final == nil {
+		final = node.Graph.FinalRound[peer]
+	}
+	snapshot := func(output int) *common.Snapshot {
+		signed := testNetworkTransaction(assert, store, node, accounts, output)
+		s := &common.Snapshot{NodeId: peer, Transaction: signed, RoundNumber: cache.Number, Timestamp: timestamp + uint64(output)}
+		s.References = [2]crypto.Hash{final.Hash, node.Graph.FinalRound[other].Hash}
+		s.Sign(accounts[1].PrivateSpendKey)
+		s.Source = source
+		return s
+	}
+	latest := func() *common.RejectedSnapshot {
+		records, err := node.RejectedSnapshots(1)
+		assert.Nil(err)
+		assert.Len(records, 1)
+		return records[0]
+	}
+
+	s := snapshot(0)
+	s.References[1] = s.References[0]
+	assert.Nil(node.handleSnapshotInput(s))
+	r := latest()
+	assert.Equal(RejectLimits, r.Reason)
+	assert.Equal(source, r.Source)
+	assert.Equal(s.PayloadHash(), r.Snapshot.PayloadHash())
+	assert.Contains(r.Error, "invalid snapshot references")
+
+	s = snapshot(0)
+	s.Transaction.Inputs[0].Hash = crypto.NewHash([]byte("missing"))
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(RejectTransaction, latest().Reason)
+
+	strict := config.StrictSignatures
+	config.StrictSignatures = true
+	s = snapshot(0)
+	seed := crypto.NewHash([]byte("stranger"))
+	stranger := common.NewAddressFromSeed(append(seed[:], seed[:]...))
+	s.Sign(stranger.PrivateSpendKey)
+	assert.Nil(node.handleSnapshotInput(s))
+	config.StrictSignatures = strict
+	assert.Equal(RejectSignatures, latest().Reason)
+
+	s = snapshot(0)
+	assert.Nil(node.handleSnapshotInput(s))
+	s.Sign(accounts[2].PrivateSpendKey)
+	s.Sign(accounts[3].PrivateSpendKey)
+	assert.Nil(node.handleSnapshotInput(s))
+	ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+	assert.Nil(err)
+	assert.NotNil(ss)
+	assert.Equal(RejectSignatures, latest().Reason)
+
+	// the seen cache hits are the usual gossip duplicates, only the store hits are recorded
+	assert.Nil(node.handleSnapshotInput(s))
+	assert.Equal(RejectSignatures, latest().Reason)
+	node.seenCache = newHashLRU(16)
+	assert.Nil(node.handleSnapshotInput(s))
+	r = latest()
+	assert.Equal(RejectSeen, r.Reason)
+	assert.Equal("", r.Error)
+
+	records, err := node.RejectedSnapshots(10)
+	assert.Nil(err)
+	assert.Len(records, 4)
+	for i, reason := range []string{RejectSeen, RejectSignatures, RejectTransaction, RejectLimits} {
+		assert.Equal(reason, records[i].Reason)
+		assert.Equal(source, records[i].Source)
+	}
+}
@@ -0,0 +1,67 @@
+package kernel
+
+import (
+	"io"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/vmihailenco/msgpack"
+)
+
+// SnapshotRecorder writes the inbound snapshots as a msgpack stream in the order they are fed
+// to the mempool, and with the signatures they have when fed. The trace replays the graph only
+// against a copy of the store taken when the recording started.
+type SnapshotRecorder struct {
+	sync.Mutex
+	enc *msgpack.Encoder
+	err error
+}
+
+func NewSnapshotRecorder(w io.Writer) *SnapshotRecorder {
+	return &SnapshotRecorder{enc: msgpack.NewEncoder(w)}
+}
+
+// the recording stops at the first write error, which is kept for Err
+func (r *SnapshotRecorder) Record(s *common.Snapshot) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(s)
+}
+
+func (r *SnapshotRecorder) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+func ReadSnapshotTrace(r io.Reader) ([]*common.Snapshot, error) {
+	dec := msgpack.NewDecoder(r)
+	snapshots := make([]*common.Snapshot, 0)
+	for {
+		var s common.Snapshot
+		err := dec.Decode(&s)
+		if err == io.EOF {
+			return snapshots, nil
+		}
+		if err != nil {
+			return snapshots, err
+		}
+		snapshots = append(snapshots, &s)
+	}
+}
+
+// ReplaySnapshots handles the snapshots one by one in the calling goroutine, so the same trace
+// on the same store and clock always results in the same graph. The snapshots deferred to later
+// by a timer, e.g. with a missing reference, are never replayed.
+func ReplaySnapshots(node *Node, snapshots []*common.Snapshot) error {
+	for _, s := range snapshots {
+		err := node.handleSnapshotInput(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
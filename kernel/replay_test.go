@@ -0,0 +1,205 @@
+package kernel
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/network"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateReplay = flag.Bool("update", false, "record the replay trace and golden graph again")
+
+const (
+	replayTraceFile  = "testdata/replay.trace"
+	replayGoldenFile = "testdata/replay.golden"
+	replayGenesis    = uint64(1600000000 * time.Second)
+	replayOutputs    = 16
+)
+
+// a fresh node of 4 consensus nodes, each genesis snapshot has some outputs to the first node
+func testReplayNode(assert *assert.Assertions) (*Node, []common.Address, storage.Store) {
+	return testReplayNodeWithStore(assert, storage.NewMemoryStore())
+}
+
+func testReplayNodeWithStore(assert *assert.Assertions, store storage.Store) (*Node, []common.Address, storage.Store) {
+	node, accounts := testConsensusNode(4)
+	genesis := make([]*common.SnapshotWithTopologicalOrder, 0)
+	for i, a := range accounts {
+		seed := crypto.NewHash([]byte(a.String()))
+		mask := crypto.NewKeyFromSeed(append(seed[:], seed[:]...))
+		id := a.Hash().ForNetwork(node.networkId)
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: id[:]})
+		for j := 0; j < replayOutputs; j++ {
+			key := crypto.DeriveGhostPublicKey(&mask, &accounts[0].PublicViewKey, &accounts[0].PublicSpendKey, uint64(j))
+			tx.Outputs = append(tx.Outputs, &common.Output{
+				Type:   common.OutputTypeScript,
+				Amount: common.NewInteger(10000),
+				Script: common.Script{common.OperatorCmp, common.OperatorSum, 1},
+				Mask:   mask.Public(),
+				Keys:   []crypto.Key{*key},
+			})
+		}
+		genesis = append(genesis, &common.SnapshotWithTopologicalOrder{
+			Snapshot: common.Snapshot{
+				NodeId:      id,
+				Transaction: &common.SignedTransaction{Transaction: *tx},
+				Timestamp:   replayGenesis + uint64(i),
+			},
+			TopologicalOrder: uint64(i),
+		})
+	}
+	assert.Nil(store.SnapshotsLoadGenesis(genesis))
+
+	graph, err := LoadRoundGraph(store)
+	assert.Nil(err)
+	node.Graph = graph
+	node.store = store
+	node.Clock = &testClock{now: replayGenesis}
+	node.TopoCounter = getTopologyCounter(store)
+	node.SnapshotsPool = make(map[crypto.Hash][]crypto.Signature)
+	node.ConsensusCache = make(map[crypto.Hash]time.Time)
+	node.GossipPeers = make(map[crypto.Hash]bool)
+	node.pending = make(map[crypto.Hash]*pendingSnapshot)
+	node.unknownRefs = make(map[crypto.Hash][]*common.Snapshot)
+	node.gossipFilter = newGossipFilter()
+	node.limiter = newPeerLimiter()
+	node.mempoolChan = make(chan *common.Snapshot, MempoolSize)
+	node.closing = make(chan struct{})
+	node.Peer = network.NewPeer(node, node.IdForNetwork, "")
+	node.Sender = node.Peer
+	return node, accounts, store
+}
+
+// the peers make some rounds of snapshots, each one is fed first with only the peer signature,
+// and then with the signatures of all peers to finalize it
+func testRecordReplayTrace(assert *assert.Assertions) []byte {
+	node, accounts, store := testReplayNode(assert)
+	var buf bytes.Buffer
+	recorder := NewSnapshotRecorder(&buf)
+	feed := func(s *common.Snapshot) {
+		fed := *s
+		fed.Signatures = append([]crypto.Signature{}, s.Signatures...)
+		recorder.Record(&fed)
+		assert.Nil(node.handleSnapshotInput(&fed))
+	}
+
+	const rounds, count = 3, 4
+	peers := accounts[1:]
+	var output int
+	for r := 1; r <= rounds; r++ {
+		for j := 0; j < count; j++ {
+			for i, a := range peers {
+				id := a.Hash().ForNetwork(node.networkId)
+				other := peers[(i+1)%len(peers)].Hash().ForNetwork(node.networkId)
+				timestamp := replayGenesis + uint64(r)*node.roundGap + uint64(j+1)*uint64(time.Millisecond)
+				cache, final, err := node.Graph.CacheRound[id].TryAdvance(timestamp, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+				assert.Nil(err)
+				if final == nil {
+					final = node.Graph.FinalRound[id]
+				}
+
+				genesis := accounts[output/replayOutputs].Hash().ForNetwork(node.networkId)
+				in, err := store.SnapshotsReadSnapshotsForNodeRound(genesis, 0)
+				assert.Nil(err)
+				tx := common.NewTransaction(common.XINAssetId)
+				tx.AddInput(in[0].Transaction.PayloadHash(), output%replayOutputs)
+				tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+				signed := &common.SignedTransaction{Transaction: *tx}
+				assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+				output++
+
+				s := &common.Snapshot{NodeId: id, Transaction: signed, RoundNumber: cache.Number, Timestamp: timestamp}
+				s.References = [2]crypto.Hash{final.Hash, node.Graph.FinalRound[other].Hash}
+				s.Sign(a.PrivateSpendKey)
+				feed(s)
+				s.Sign(peers[(i+1)%len(peers)].PrivateSpendKey)
+				s.Sign(peers[(i+2)%len(peers)].PrivateSpendKey)
+				feed(s)
+			}
+		}
+	}
+	assert.Nil(recorder.Err())
+	return buf.Bytes()
+}
+
+func TestReplaySnapshots(t *testing.T) {
+	assert := assert.New(t)
+
+	if *updateReplay {
+		trace := testRecordReplayTrace(assert)
+		assert.Nil(ioutil.WriteFile(replayTraceFile, trace, 0644))
+		node, _, _ := testReplayNode(assert)
+		snapshots, err := ReadSnapshotTrace(bytes.NewReader(trace))
+		assert.Nil(err)
+		assert.Nil(ReplaySnapshots(node, snapshots))
+		assert.Nil(ioutil.WriteFile(replayGoldenFile, []byte(node.Graph.Print()+"\n"), 0644))
+	}
+
+	trace, err := ioutil.ReadFile(replayTraceFile)
+	assert.Nil(err)
+	golden, err := ioutil.ReadFile(replayGoldenFile)
+	assert.Nil(err)
+	for i := 0; i < 2; i++ {
+		node, accounts, store := testReplayNode(assert)
+		snapshots, err := ReadSnapshotTrace(bytes.NewReader(trace))
+		assert.Nil(err)
+		assert.Len(snapshots, 2*3*4*3)
+		assert.Nil(ReplaySnapshots(node, snapshots))
+		assert.Equal(string(golden), node.Graph.Print()+"\n")
+		assert.Equal(uint64(len(accounts)+len(snapshots)/2), store.SnapshotsTopologySequence())
+		for _, a := range accounts[1:] {
+			final := node.Graph.FinalRound[a.Hash().ForNetwork(node.networkId)]
+			assert.Equal(uint64(2), final.Number)
+		}
+	}
+}
+
+func TestSnapshotRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(4)
+	node.mempoolChan = make(chan *common.Snapshot, 16)
+	node.closing = make(chan struct{})
+	node.gossipFilter = newGossipFilter()
+	node.limiter = newPeerLimiter()
+	node.Metrics = noopMetrics{}
+	node.store = storage.NewMemoryStore()
+	var buf bytes.Buffer
+	node.Recorder = NewSnapshotRecorder(&buf)
+
+	self := network.NewPeer(nil, node.IdForNetwork, "")
+	own := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	assert.Nil(node.FeedMempool(self, own))
+	peerId := accounts[1].Hash().ForNetwork(node.networkId)
+	peer := network.NewPeer(nil, peerId, "")
+	s := &common.Snapshot{NodeId: peerId, Transaction: &common.SignedTransaction{}, Timestamp: 100}
+	assert.Nil(node.FeedMempool(peer, s))
+	rejected, err := node.RejectedSnapshots(8)
+	assert.Nil(err)
+	assert.Len(rejected, 1)
+	assert.Equal(RejectSigner, rejected[0].Reason)
+	assert.Equal(peerId, rejected[0].Source)
+	s.Sign(accounts[1].PrivateSpendKey)
+	assert.Nil(node.FeedMempool(peer, s))
+	s.Sign(accounts[2].PrivateSpendKey)
+	assert.Len(node.mempoolChan, 2)
+	assert.Nil(node.Recorder.Err())
+
+	snapshots, err := ReadSnapshotTrace(&buf)
+	assert.Nil(err)
+	assert.Len(snapshots, 2)
+	assert.Equal(own.PayloadHash(), snapshots[0].PayloadHash())
+	assert.Equal(s.PayloadHash(), snapshots[1].PayloadHash())
+	assert.Len(snapshots[1].Signatures, 1)
+
+	_, err = ReadSnapshotTrace(bytes.NewReader([]byte{0xc1}))
+	assert.NotNil(err)
+}
@@ -0,0 +1,98 @@
+package kernel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// the store read retries of each transaction, it's counted before the state lock is held,
+// so it has its own lock for the concurrent lanes
+type readRetries struct {
+	sync.Mutex
+	counts map[crypto.Hash]int
+}
+
+func (r *readRetries) next(hash crypto.Hash) int {
+	r.Lock()
+	defer r.Unlock()
+	if r.counts == nil {
+		r.counts = make(map[crypto.Hash]int)
+	}
+	r.counts[hash]++
+	return r.counts[hash]
+}
+
+func (r *readRetries) reset(hash crypto.Hash) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.counts, hash)
+}
+
+// a store read failed again after all retries, it's never taken as not found, otherwise
+// a finalized snapshot could be handled again, the consumer stops with this error
+type StoreReadError struct {
+	Hash    crypto.Hash
+	Retries int
+	Err     error
+}
+
+func (e *StoreReadError) Error() string {
+	return fmt.Sprintf("store read error %s %d %s", e.Hash.String(), e.Retries, e.Err)
+}
+
+// a failed store read may be transient, e.g. a busy disk, the snapshot is handled again
+// later, at most the retries limit times before the error is returned to stop the node
+func (node *Node) retryStoreRead(s *common.Snapshot, hash crypto.Hash, err error) error {
+	retries := node.readRetries.next(hash)
+	if retries > config.StorageReadRetries {
+		node.readRetries.reset(hash)
+		node.Logger.Error("READ SNAPSHOT BY TRANSACTION ERROR", retries, err)
+		return &StoreReadError{Hash: hash, Retries: retries - 1, Err: err}
+	}
+	node.Logger.Warn("READ SNAPSHOT BY TRANSACTION DEFERRED", retries, err)
+	time.AfterFunc(time.Duration(config.StorageReadRetryInterval), func() {
+		node.queueSnapshot(s)
+	})
+	return nil
+}
+
+// a failed send to a peer may be transient, and never stops the handler for the other peers,
+// the snapshot is sent again to the peer in the background, with the interval doubled after
+// each failure, at most the retries limit times
+func (node *Node) retrySend(peerId crypto.Hash, s *common.Snapshot, err error) {
+	if config.SnapshotSendRetries < 1 {
+		node.Logger.Error("SEND SNAPSHOT ERROR", peerId, s.PayloadHash(), 0, err)
+		return
+	}
+	node.Logger.Warn("SEND SNAPSHOT DEFERRED", peerId, s.PayloadHash(), err)
+	// the handler keeps changing the snapshot signatures after it returns
+	c := *s
+	c.Signatures = append([]crypto.Signature{}, s.Signatures...)
+	c.Signers = nil
+	node.resendSnapshot(peerId, &c, 1)
+}
+
+func (node *Node) resendSnapshot(peerId crypto.Hash, s *common.Snapshot, retries int) {
+	interval := time.Duration(config.SnapshotSendRetryInterval) << uint(retries-1)
+	time.AfterFunc(interval, func() {
+		if node.isClosing() {
+			return
+		}
+		err := node.Sender.SendSnapshotMessage(peerId, s)
+		if err == nil {
+			node.Metrics.Inc(MetricSignatureBroadcast, s.NodeId == node.IdForNetwork)
+			return
+		}
+		if retries >= config.SnapshotSendRetries {
+			node.Logger.Error("SEND SNAPSHOT ERROR", peerId, s.PayloadHash(), retries, err)
+			return
+		}
+		node.Logger.Warn("SEND SNAPSHOT DEFERRED", peerId, s.PayloadHash(), retries, err)
+		node.resendSnapshot(peerId, s, retries+1)
+	})
+}
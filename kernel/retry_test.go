@@ -0,0 +1,276 @@
+package kernel
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type faultTestStore struct {
+	storage.Store
+	failures int
+	reads    int
+}
+
+func (s *faultTestStore) SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	s.reads++
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("injected read error")
+	}
+	return s.Store.SnapshotsReadSnapshotByTransactionHash(hash)
+}
+
+type faultTestSender struct {
+	SnapshotSender
+	sync.Mutex
+	failing map[crypto.Hash]bool
+	sends   map[crypto.Hash]int
+}
+
+func (s *faultTestSender) SendSnapshotMessage(idForNetwork crypto.Hash, ss *common.Snapshot) error {
+	s.Lock()
+	s.sends[idForNetwork]++
+	failing := s.failing[idForNetwork]
+	s.Unlock()
+	if failing {
+		return errors.New("injected send error")
+	}
+	return s.SnapshotSender.SendSnapshotMessage(idForNetwork, ss)
+}
+
+func (s *faultTestSender) SendSnapshotMessageBatch(peerIds []crypto.Hash, ss *common.Snapshot) map[crypto.Hash]error {
+	errs := make(map[crypto.Hash]error)
+	for _, id := range peerIds {
+		errs[id] = s.SendSnapshotMessage(id, ss)
+	}
+	return errs
+}
+
+func (s *faultTestSender) count(id crypto.Hash) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.sends[id]
+}
+
+func TestStoreReadRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := config.StorageReadRetryInterval
+	defer func() { config.StorageReadRetryInterval = interval }()
+	config.StorageReadRetryInterval = uint64(time.Millisecond)
+
+	node, accounts, store := testReplayNode(assert)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+	node.Clock = &testClock{now: replayGenesis + node.roundGap}
+	fault := &faultTestStore{Store: store}
+	node.store = fault
+	retry := func(s *common.Snapshot) error {
+		for {
+			err := node.handleSnapshotInput(s)
+			if err != nil {
+				return err
+			}
+			select {
+			case q := <-node.mempoolChan:
+				assert.True(q == s)
+			case <-time.After(100 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+
+	// a finalized snapshot is never handled again after a failed read
+	genesis, err := store.SnapshotsReadSnapshotsForNodeRound(node.IdForNetwork, 0)
+	assert.Nil(err)
+	finalized := *genesis[0]
+	finalized.References = [2]crypto.Hash{crypto.NewHash([]byte("self")), crypto.NewHash([]byte("external"))}
+	fault.failures = 1
+	assert.Nil(retry(&finalized))
+	assert.Equal(2, fault.reads)
+	assert.Equal(uint64(1), metrics.Value(MetricSnapshotSeen, true))
+	assert.True(node.seenCache.Contains(genesis[0].TransactionHash()))
+	assert.Len(node.SnapshotsPool, 0)
+
+	// a new snapshot is handled once the read succeeds
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(genesis[0].TransactionHash(), 0)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+	st := &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(st.SignInput(store, 0, accounts[:1]))
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: st}
+	fault.failures, fault.reads = config.StorageReadRetries, 0
+	assert.Nil(retry(s))
+	assert.Equal(config.StorageReadRetries+1, fault.reads)
+	assert.Len(node.SnapshotsPool, 1)
+	assert.Len(node.SnapshotsPool[s.PayloadHash()], 1)
+	assert.Equal(uint64(0), metrics.Value(MetricValidationFailure, true))
+
+	// the node stops when the store keeps failing
+	tx.Extra = []byte("failing")
+	st = &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(st.SignInput(store, 0, accounts[:1]))
+	s = &common.Snapshot{NodeId: node.IdForNetwork, Transaction: st}
+	fault.failures, fault.reads = config.StorageReadRetries+1, 0
+	err = retry(s)
+	assert.IsType(&StoreReadError{}, err)
+	assert.Equal(config.StorageReadRetries, err.(*StoreReadError).Retries)
+	assert.Equal(config.StorageReadRetries+1, fault.reads)
+	assert.Equal(uint64(0), s.Timestamp)
+	assert.Len(node.SnapshotsPool, 1)
+	assert.Len(node.readRetries.counts, 0)
+}
+
+func TestSendRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := config.SnapshotSendRetryInterval
+	defer func() { config.SnapshotSendRetryInterval = interval }()
+	config.SnapshotSendRetryInterval = uint64(time.Millisecond)
+
+	network := newTestNetwork(1)
+	clock := &stepClock{now: replayGenesis + config.SnapshotRoundGap, step: uint64(time.Millisecond)}
+	nodes, accounts, stores := testNetworkNodes(assert, network, clock)
+	ids := make([]crypto.Hash, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.IdForNetwork
+	}
+	sender := &faultTestSender{
+		SnapshotSender: nodes[0].Sender,
+		failing:        map[crypto.Hash]bool{ids[3]: true},
+		sends:          make(map[crypto.Hash]int),
+	}
+	nodes[0].Sender = sender
+	attempts := func(id crypto.Hash, expected int) int {
+		for i := 0; i < 100 && sender.count(id) < expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return sender.count(id)
+	}
+
+	// the failing peer doesn't stop the broadcast to the others, and the graph is still updated
+	s := &common.Snapshot{NodeId: ids[0], Transaction: testNetworkTransaction(assert, stores[0], nodes[0], accounts, 0)}
+	assert.Nil(nodes[0].handleSnapshotInput(s))
+	assert.Len(s.Signatures, 1)
+	assert.Len(network.queue, 2)
+	assert.NotNil(nodes[0].pending[s.PayloadHash()])
+	assert.Equal(s.RoundNumber, nodes[0].assigned.number)
+	assert.Equal(s.Timestamp, nodes[0].Graph.CacheRound[ids[0]].End)
+	assert.Equal(1, sender.count(ids[1]))
+	assert.Equal(1, sender.count(ids[2]))
+	// only the failed peer is asked again by the reconciliation
+	nodes[0].stateLock.Lock()
+	at, marked := nodes[0].ConsensusCache[consensusCacheKey(s.PayloadHash(), ids[1])]
+	assert.True(marked)
+	// marked by the node clock, not the wall clock
+	assert.True(uint64(at.UnixNano()) > replayGenesis)
+	assert.True(uint64(at.UnixNano()) < atomic.LoadUint64(&clock.now))
+	_, marked = nodes[0].ConsensusCache[consensusCacheKey(s.PayloadHash(), ids[3])]
+	assert.False(marked)
+	nodes[0].stateLock.Unlock()
+
+	// the failed send is retried in the background until the retries limit
+	assert.Equal(1+config.SnapshotSendRetries, attempts(ids[3], 1+config.SnapshotSendRetries))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(1+config.SnapshotSendRetries, sender.count(ids[3]))
+
+	_, err := network.deliver(network.now + uint64(time.Second))
+	assert.Nil(err)
+	// the failing peer still has it finalized by the gossip of the others
+	for _, store := range stores {
+		ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+		assert.Nil(err)
+		assert.NotNil(ss)
+	}
+
+	// a recovered peer receives the retried snapshot
+	sender.Lock()
+	sender.failing[ids[2]] = true
+	sender.Unlock()
+	sent := sender.count(ids[2])
+	s = &common.Snapshot{NodeId: ids[0], Transaction: testNetworkTransaction(assert, stores[0], nodes[0], accounts, 1)}
+	assert.Nil(nodes[0].handleSnapshotInput(s))
+	sender.Lock()
+	sender.failing[ids[2]] = false
+	sender.Unlock()
+	queued := func() int {
+		network.Lock()
+		defer network.Unlock()
+		var count int
+		for _, m := range network.queue {
+			if m.to == ids[2] && m.snapshot.PayloadHash() == s.PayloadHash() {
+				count++
+			}
+		}
+		return count
+	}
+	for i := 0; i < 100 && queued() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(1, queued())
+	assert.Equal(sent+2, sender.count(ids[2]))
+}
+
+type blockingTestSender struct {
+	SnapshotSender
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingTestSender) SendSnapshotMessageBatch(peerIds []crypto.Hash, ss *common.Snapshot) map[crypto.Hash]error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.SnapshotSender.SendSnapshotMessageBatch(peerIds, ss)
+}
+
+func TestSendWithoutStateLock(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(1)
+	clock := &stepClock{now: replayGenesis + config.SnapshotRoundGap, step: uint64(time.Millisecond)}
+	nodes, accounts, stores := testNetworkNodes(assert, network, clock)
+	sender := &blockingTestSender{
+		SnapshotSender: nodes[0].Sender,
+		entered:        make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+	nodes[0].Sender = sender
+
+	s := &common.Snapshot{NodeId: nodes[0].IdForNetwork, Transaction: testNetworkTransaction(assert, stores[0], nodes[0], accounts, 0)}
+	done := make(chan error)
+	go func() {
+		done <- nodes[0].handleSnapshotInput(s)
+	}()
+	<-sender.entered
+
+	// the other lanes are never stalled by a slow send
+	locked := make(chan struct{})
+	go func() {
+		nodes[0].nodesLock.Lock()
+		nodes[0].stateLock.Lock()
+		nodes[0].stateLock.Unlock()
+		nodes[0].nodesLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		assert.Fail("locks held by the send")
+	}
+	assert.NotNil(nodes[0].pending[s.PayloadHash()])
+	assert.Equal(s.Timestamp, nodes[0].Graph.CacheRound[nodes[0].IdForNetwork].End)
+	assert.Len(nodes[0].ConsensusCache, 4)
+
+	close(sender.release)
+	assert.Nil(<-done)
+	assert.Len(network.queue, 3)
+}
@@ -1,11 +1,17 @@
 package kernel
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/crypto"
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/mixin/storage"
@@ -27,6 +33,7 @@ type CacheRound struct {
 	Start     uint64             `msgpack:"T"`
 	End       uint64             `msgpack:"-"`
 	Snapshots []*common.Snapshot `msgpack:"-"`
+	Flushed   int                `msgpack:"-"`
 }
 
 type FinalRound struct {
@@ -37,38 +44,177 @@ type FinalRound struct {
 	Hash   crypto.Hash `msgpack:"-"`
 }
 
+type RoundInconsistentError struct {
+	NodeId    crypto.Hash
+	Number    uint64
+	Timestamp uint64
+}
+
+func (e *RoundInconsistentError) Error() string {
+	return fmt.Sprintf("round inconsistent %s %d %d", e.NodeId.String(), e.Number, e.Timestamp)
+}
+
+type EmptyFinalRoundError struct {
+	NodeId crypto.Hash
+	Number uint64
+}
+
+func (e *EmptyFinalRoundError) Error() string {
+	return fmt.Sprintf("empty final round %s %d", e.NodeId.String(), e.Number)
+}
+
 type RoundGraph struct {
+	sync.RWMutex
 	Nodes      []crypto.Hash
 	CacheRound map[crypto.Hash]*CacheRound
 	FinalRound map[crypto.Hash]*FinalRound
-	FinalCache []FinalRound
+
+	finalCache atomic.Value
+}
+
+type RoundState struct {
+	NodeId    crypto.Hash `json:"node"`
+	Number    uint64      `json:"round"`
+	Start     uint64      `json:"start"`
+	End       uint64      `json:"end"`
+	Hash      crypto.Hash `json:"hash"`
+	Snapshots int         `json:"snapshots"`
+}
+
+// a node without a final round yet has the final number 0 and an empty final hash
+type NodeRoundInfo struct {
+	NodeId      crypto.Hash `json:"node"`
+	FinalNumber uint64      `json:"final"`
+	CacheNumber uint64      `json:"cache"`
+	FinalHash   crypto.Hash `json:"hash"`
+}
+
+type GraphState struct {
+	Nodes      []crypto.Hash         `json:"nodes"`
+	CacheRound map[string]RoundState `json:"cache"`
+	FinalRound map[string]RoundState `json:"final"`
 }
 
+// UpdateFinalCache builds a new final cache from the final rounds, and swaps it in as a whole,
+// the cache returned before is never modified, so the readers never see a partial update
 func (g *RoundGraph) UpdateFinalCache() {
-	finals := make([]FinalRound, 0)
+	g.Lock()
+	defer g.Unlock()
+
+	finals := make([]FinalRound, 0, len(g.FinalRound))
 	for _, f := range g.FinalRound {
-		finals = append(finals, FinalRound{
+		finals = append(finals, *f)
+	}
+	g.finalCache.Store(finals)
+}
+
+// FinalCache is the final rounds of all nodes when the cache updated last time,
+// it must be read only, and is safe to read without any lock
+func (g *RoundGraph) FinalCache() []FinalRound {
+	finals, _ := g.finalCache.Load().([]FinalRound)
+	return finals
+}
+
+func (g *RoundGraph) UpdateRound(cache *CacheRound, final *FinalRound) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.CacheRound[cache.NodeId] = cache
+	g.FinalRound[final.NodeId] = final
+}
+
+func (g *RoundGraph) Snapshot() GraphState {
+	g.RLock()
+	defer g.RUnlock()
+
+	state := GraphState{
+		Nodes:      append([]crypto.Hash{}, g.Nodes...),
+		CacheRound: make(map[string]RoundState),
+		FinalRound: make(map[string]RoundState),
+	}
+	for id, c := range g.CacheRound {
+		state.CacheRound[id.String()] = RoundState{
+			NodeId:    c.NodeId,
+			Number:    c.Number,
+			Start:     c.Start,
+			End:       c.End,
+			Snapshots: len(c.Snapshots) + c.Flushed,
+		}
+	}
+	for id, f := range g.FinalRound {
+		state.FinalRound[id.String()] = RoundState{
 			NodeId: f.NodeId,
 			Number: f.Number,
 			Start:  f.Start,
-		})
+			End:    f.End,
+			Hash:   f.Hash,
+		}
 	}
-	g.FinalCache = finals
+	return state
 }
 
 func (g *RoundGraph) Print() string {
 	desc := "ROUND GRAPH BEGIN\n"
 	for _, id := range g.Nodes {
-		desc = desc + fmt.Sprintf("NODE# %s\n", id)
-		final := g.FinalRound[id]
-		desc = desc + fmt.Sprintf("FINAL %d %d %s\n", final.Number, final.Start, final.Hash)
-		cache := g.CacheRound[id]
-		desc = desc + fmt.Sprintf("CACHE %d %d\n", cache.Number, cache.Start)
+		desc = desc + g.printNode(id)
 	}
 	desc = desc + "ROUND GRAPH END"
 	return desc
 }
 
+func (g *RoundGraph) PrintNode(id crypto.Hash) string {
+	g.RLock()
+	defer g.RUnlock()
+
+	if g.CacheRound[id] == nil || g.FinalRound[id] == nil {
+		return fmt.Sprintf("NODE# %s NOT FOUND", id)
+	}
+	return strings.TrimSuffix(g.printNode(id), "\n")
+}
+
+func (g *RoundGraph) printNode(id crypto.Hash) string {
+	desc := fmt.Sprintf("NODE# %s\n", id)
+	final := g.FinalRound[id]
+	desc = desc + fmt.Sprintf("FINAL %d %d %s\n", final.Number, final.Start, final.Hash)
+	cache := g.CacheRound[id]
+	desc = desc + fmt.Sprintf("CACHE %d %d\n", cache.Number, cache.Start)
+	return desc
+}
+
+func (g *RoundGraph) NodeRounds(id crypto.Hash) (*CacheRound, *FinalRound, bool) {
+	g.RLock()
+	defer g.RUnlock()
+
+	cache, final := g.CacheRound[id], g.FinalRound[id]
+	if cache == nil || final == nil {
+		return nil, nil, false
+	}
+	return cache.Copy(), final.Copy(), true
+}
+
+func (g *RoundGraph) NodeRoundInfos() []NodeRoundInfo {
+	g.RLock()
+	defer g.RUnlock()
+
+	infos := make([]NodeRoundInfo, 0)
+	for _, id := range g.Nodes {
+		info := NodeRoundInfo{NodeId: id}
+		if cache := g.CacheRound[id]; cache != nil {
+			info.CacheNumber = cache.Number
+		}
+		if final := g.FinalRound[id]; final != nil {
+			info.FinalNumber = final.Number
+			info.FinalHash = final.Hash
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// LoadRoundGraph loads the cache round and the round before it as the final round of each node.
+// An empty final round is a fatal local corruption, even above the genesis round, the cache round
+// can't be rewound below the stored round meta, and the next rounds would reference a stale
+// final round, so the store must be repaired or synced again from scratch.
 func LoadRoundGraph(store storage.Store) (*RoundGraph, error) {
 	graph := &RoundGraph{
 		CacheRound: make(map[crypto.Hash]*CacheRound),
@@ -84,23 +230,23 @@ func LoadRoundGraph(store storage.Store) (*RoundGraph, error) {
 
 		cache, err := loadHeadRoundForNode(store, id)
 		if err != nil {
+			logRoundInconsistentError(err)
 			return nil, err
 		}
-		graph.CacheRound[cache.NodeId] = cache
 
 		finalRoundNumber := cache.Number - 1
 		if cache.Number == 0 {
-			finalRoundNumber = cache.Number
-			graph.CacheRound[id] = &CacheRound{
-				NodeId: id,
-				Number: 1,
-				Start:  0,
-			}
+			finalRoundNumber = 0
 		}
 		final, err := loadFinalRoundForNode(store, id, finalRoundNumber)
 		if err != nil {
+			logRoundInconsistentError(err)
 			return nil, err
 		}
+		if cache.Number == 0 {
+			cache = genesisCacheRound(final)
+		}
+		graph.CacheRound[cache.NodeId] = cache
 		graph.FinalRound[final.NodeId] = final
 	}
 
@@ -109,6 +255,13 @@ func LoadRoundGraph(store storage.Store) (*RoundGraph, error) {
 	return graph, nil
 }
 
+func logRoundInconsistentError(err error) {
+	switch err.(type) {
+	case *RoundInconsistentError, *EmptyFinalRoundError:
+		logger.Println("LOCAL STORE INCONSISTENT", err)
+	}
+}
+
 func loadHeadRoundForNode(store storage.Store, nodeIdWithNetwork crypto.Hash) (*CacheRound, error) {
 	meta, err := store.SnapshotsReadRoundMeta(nodeIdWithNetwork)
 	if err != nil {
@@ -127,12 +280,29 @@ func loadHeadRoundForNode(store storage.Store, nodeIdWithNetwork crypto.Hash) (*
 	}
 	for _, s := range round.Snapshots {
 		if s.Timestamp < round.Start {
-			panic(round.NodeId.String())
+			return nil, &RoundInconsistentError{NodeId: round.NodeId, Number: round.Number, Timestamp: s.Timestamp}
 		}
-		if s.Timestamp > round.End {
-			round.End = s.Timestamp
+	}
+
+	// the stored round end is absent in the data written by old versions, then scan the snapshots
+	end, found, err := store.SnapshotsReadRoundEnd(nodeIdWithNetwork)
+	if err != nil {
+		return nil, err
+	}
+	if !found || config.VerifyRoundEnd {
+		for _, s := range round.Snapshots {
+			if s.Timestamp > round.End {
+				round.End = s.Timestamp
+			}
 		}
 	}
+	if found && config.VerifyRoundEnd && end != round.End {
+		return nil, fmt.Errorf("round end mismatch %s %d %d %d", round.NodeId, round.Number, end, round.End)
+	}
+	if found {
+		round.End = end
+	}
+	round.flushSnapshots(config.CacheRoundSnapshotsLimit)
 	return round, nil
 }
 
@@ -141,28 +311,23 @@ func loadFinalRoundForNode(store storage.Store, nodeIdWithNetwork crypto.Hash, n
 	if err != nil {
 		return nil, err
 	}
+	return finalRoundFromSnapshots(nodeIdWithNetwork, number, snapshots)
+}
 
-	start := snapshots[0].Timestamp
-	end := snapshots[len(snapshots)-1].Timestamp
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, number)
-	hashes := append(nodeIdWithNetwork[:], buf...)
-	for _, s := range snapshots {
-		h := crypto.NewHash(s.Payload())
-		hashes = append(hashes, h[:]...)
-		if s.Timestamp < start {
-			panic(*s)
-		}
-		if s.Timestamp > end {
-			panic(*s)
-		}
+func finalRoundFromSnapshots(nodeIdWithNetwork crypto.Hash, number uint64, snapshots []*common.Snapshot) (*FinalRound, error) {
+	if len(snapshots) == 0 {
+		return nil, &EmptyFinalRoundError{NodeId: nodeIdWithNetwork, Number: number}
 	}
+
+	// the store order is not trusted, the round is sorted the same as sealed by asFinal
+	snapshots = append([]*common.Snapshot{}, snapshots...)
+	sortRoundSnapshots(snapshots)
 	round := &FinalRound{
 		NodeId: nodeIdWithNetwork,
 		Number: number,
-		Start:  start,
-		End:    end,
-		Hash:   crypto.NewHash(hashes),
+		Start:  snapshots[0].Timestamp,
+		End:    snapshots[len(snapshots)-1].Timestamp,
+		Hash:   roundHash(nodeIdWithNetwork, number, snapshots),
 	}
 	return round, nil
 }
@@ -183,28 +348,160 @@ func (c *CacheRound) Copy() *CacheRound {
 	return &r
 }
 
+// TryAdvance makes the cache round final and starts the next round when the timestamp reaches
+// the round gap, or before that once the round has the limit snapshots, a later snapshot joins
+// the next round then. The final round is nil when the round doesn't advance. All snapshots must
+// be finalized, so the round is final with the same hash in all nodes, and the store is only
+// used when some snapshots have been flushed from the cache.
+func (c *CacheRound) TryAdvance(timestamp, gap uint64, limit int, verifyFinal func(*common.Snapshot) bool, store storage.Store) (*CacheRound, *FinalRound, error) {
+	cache := c.Copy()
+	count := len(cache.Snapshots) + cache.Flushed
+	full := limit > 0 && count >= limit && timestamp > cache.End
+	if timestamp < gap+cache.Start && !full {
+		return cache, nil, nil
+	}
+	if count == 0 {
+		cache.Start = timestamp
+		return cache, nil, nil
+	}
+	for _, s := range cache.Snapshots {
+		if !verifyFinal(s) {
+			return cache, nil, fmt.Errorf("round snapshot not finalized %s %d %s", c.NodeId.String(), c.Number, s.PayloadHash().String())
+		}
+	}
+	final, err := cache.asFinal(store)
+	if err != nil {
+		return cache, nil, err
+	}
+	next := &CacheRound{
+		NodeId: c.NodeId,
+		Number: c.Number + 1,
+		Start:  timestamp,
+		End:    timestamp,
+	}
+	return next, final, nil
+}
+
+// all cache snapshots are finalized and written to the store already,
+// so the earliest ones could be dropped from memory when there are too many
+func (c *CacheRound) flushSnapshots(limit int) {
+	if len(c.Snapshots) <= limit {
+		return
+	}
+	sortRoundSnapshots(c.Snapshots)
+	n := len(c.Snapshots) - limit
+	c.Snapshots = append([]*common.Snapshot{}, c.Snapshots[n:]...)
+	c.Flushed += n
+}
+
+type roundJSON struct {
+	NodeId    crypto.Hash        `json:"node"`
+	Number    uint64             `json:"round"`
+	Start     uint64             `json:"start"`
+	End       uint64             `json:"end"`
+	Hash      crypto.Hash        `json:"hash"`
+	Snapshots []*common.Snapshot `json:"snapshots,omitempty"`
+	Flushed   int                `json:"flushed,omitempty"`
+}
+
+// the hash is of the snapshots in memory, it's not the final hash when some have been flushed
+func (c *CacheRound) MarshalJSON() ([]byte, error) {
+	return json.Marshal(roundJSON{
+		NodeId:    c.NodeId,
+		Number:    c.Number,
+		Start:     c.Start,
+		End:       c.End,
+		Hash:      c.FinalHash(),
+		Snapshots: c.Snapshots,
+		Flushed:   c.Flushed,
+	})
+}
+
+func (f *FinalRound) MarshalJSON() ([]byte, error) {
+	return json.Marshal(roundJSON{
+		NodeId: f.NodeId,
+		Number: f.Number,
+		Start:  f.Start,
+		End:    f.End,
+		Hash:   f.Hash,
+	})
+}
+
+func (f *FinalRound) UnmarshalJSON(b []byte) error {
+	var r roundJSON
+	err := json.Unmarshal(b, &r)
+	if err != nil {
+		return err
+	}
+	f.NodeId, f.Number, f.Start, f.End, f.Hash = r.NodeId, r.Number, r.Start, r.End, r.Hash
+	return nil
+}
+
 func (f *FinalRound) Copy() *FinalRound {
 	r := *f
 	return &r
 }
 
-func (c *CacheRound) asFinal() *FinalRound {
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, c.Number)
-	hashes := append(c.NodeId[:], buf...)
-	sort.Slice(c.Snapshots, func(i, j int) bool {
-		return c.Snapshots[i].Timestamp <= c.Snapshots[j].Timestamp
+// all nodes must hash the round snapshots in the same order, so the snapshots with
+// the same timestamp are ordered by their payload hashes, returned in the sorted order
+func sortRoundSnapshots(snapshots []*common.Snapshot) []crypto.Hash {
+	hashes := make(map[*common.Snapshot]crypto.Hash)
+	for _, s := range snapshots {
+		hashes[s] = s.PayloadHash()
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		ha, hb := hashes[a], hashes[b]
+		return bytes.Compare(ha[:], hb[:]) < 0
 	})
-	for _, s := range c.Snapshots {
-		h := crypto.NewHash(s.Payload())
-		hashes = append(hashes, h[:]...)
+	sorted := make([]crypto.Hash, len(snapshots))
+	for i, s := range snapshots {
+		sorted[i] = hashes[s]
+	}
+	return sorted
+}
+
+// FinalHash computes the hash of the round as if it were final, the snapshots are sorted
+// in a copy so the cache snapshots order is never changed. Only the snapshots in memory are
+// hashed, asFinal reads the flushed ones from the store.
+func (c *CacheRound) FinalHash() crypto.Hash {
+	return roundHash(c.NodeId, c.Number, c.Snapshots)
+}
+
+func (c *CacheRound) asFinal(store storage.Store) (*FinalRound, error) {
+	hash := c.FinalHash()
+	if c.Flushed > 0 {
+		ss, err := store.SnapshotsReadSnapshotsForNodeRound(c.NodeId, c.Number)
+		if err != nil {
+			return nil, err
+		}
+		if len(ss) != len(c.Snapshots)+c.Flushed {
+			return nil, &RoundInconsistentError{NodeId: c.NodeId, Number: c.Number, Timestamp: c.End}
+		}
+		hash = roundHash(c.NodeId, c.Number, ss)
 	}
+
 	round := &FinalRound{
 		NodeId: c.NodeId,
 		Number: c.Number,
 		Start:  c.Start,
 		End:    c.End,
-		Hash:   crypto.NewHash(hashes),
+		Hash:   hash,
+	}
+	return round, nil
+}
+
+// the round hash is over the node id, the big endian round number and the payload
+// hashes of the round snapshots, never the transaction hashes
+func roundHash(nodeIdWithNetwork crypto.Hash, number uint64, snapshots []*common.Snapshot) crypto.Hash {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, number)
+	hashes := append(nodeIdWithNetwork[:], buf...)
+	for _, h := range sortRoundSnapshots(append([]*common.Snapshot{}, snapshots...)) {
+		hashes = append(hashes, h[:]...)
 	}
-	return round
+	return crypto.NewHash(hashes)
 }
@@ -0,0 +1,791 @@
+package kernel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+)
+
+type roundTestStore struct {
+	storage.Store
+	meta      [2]uint64
+	snapshots map[uint64][]*common.Snapshot
+}
+
+func (s *roundTestStore) SnapshotsReadRoundMeta(nodeIdWithNetwork crypto.Hash) ([2]uint64, error) {
+	return s.meta, nil
+}
+
+func (s *roundTestStore) SnapshotsReadRoundEnd(nodeIdWithNetwork crypto.Hash) (uint64, bool, error) {
+	return 0, false, nil
+}
+
+func (s *roundTestStore) SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error) {
+	return s.snapshots[round], nil
+}
+
+func (s *roundTestStore) SnapshotsReadNodesList() ([]crypto.Hash, error) {
+	return []crypto.Hash{crypto.NewHash([]byte("node"))}, nil
+}
+
+func TestRoundGraphSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	g := &RoundGraph{
+		Nodes:      []crypto.Hash{id},
+		CacheRound: make(map[crypto.Hash]*CacheRound),
+		FinalRound: make(map[crypto.Hash]*FinalRound),
+	}
+	g.CacheRound[id] = &CacheRound{NodeId: id, Number: 2, Start: 100, End: 200, Snapshots: []*common.Snapshot{{}, {}}}
+	g.FinalRound[id] = &FinalRound{NodeId: id, Number: 1, Start: 10, End: 20, Hash: crypto.NewHash([]byte("final"))}
+
+	state := g.Snapshot()
+	assert.Len(state.Nodes, 1)
+	cache := state.CacheRound[id.String()]
+	assert.Equal(uint64(2), cache.Number)
+	assert.Equal(uint64(100), cache.Start)
+	assert.Equal(2, cache.Snapshots)
+	final := state.FinalRound[id.String()]
+	assert.Equal(uint64(1), final.Number)
+	assert.Equal(g.FinalRound[id].Hash, final.Hash)
+
+	g.CacheRound[id].Number = 3
+	g.Nodes[0] = crypto.Hash{}
+	assert.Equal(uint64(2), state.CacheRound[id.String()].Number)
+	assert.Equal(id, state.Nodes[0])
+
+	data, err := json.Marshal(state)
+	assert.Nil(err)
+	assert.Contains(string(data), id.String())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			g.UpdateFinalCache()
+		}()
+		go func() {
+			defer wg.Done()
+			g.Snapshot()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRoundEmptyFinal(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	store := &roundTestStore{
+		meta: [2]uint64{3, 300},
+		snapshots: map[uint64][]*common.Snapshot{
+			0: {{NodeId: id, Timestamp: 10}},
+			1: {{NodeId: id, Timestamp: 100}, {NodeId: id, Timestamp: 150}},
+			3: {{NodeId: id, Timestamp: 300}},
+		},
+	}
+
+	final, err := loadFinalRoundForNode(store, id, 2)
+	assert.Nil(final)
+	efe, ok := err.(*EmptyFinalRoundError)
+	assert.True(ok)
+	assert.Equal(id, efe.NodeId)
+	assert.Equal(uint64(2), efe.Number)
+
+	// a gap below the cache round is never loaded, the graph would break the final round just
+	// before the cache round, which all the peers reference
+	graph, err := LoadRoundGraph(store)
+	assert.Nil(graph)
+	efe, ok = err.(*EmptyFinalRoundError)
+	assert.True(ok)
+	assert.Equal(uint64(2), efe.Number)
+
+	store.snapshots[2] = []*common.Snapshot{{NodeId: id, Timestamp: 200}, {NodeId: id, Timestamp: 250}}
+	graph, err = LoadRoundGraph(store)
+	assert.Nil(err)
+	assert.Equal(uint64(3), graph.CacheRound[id].Number)
+	assert.Equal(uint64(2), graph.FinalRound[id].Number)
+	assert.Equal(uint64(200), graph.FinalRound[id].Start)
+	assert.Equal(uint64(250), graph.FinalRound[id].End)
+
+	store.meta = [2]uint64{1, 100}
+	delete(store.snapshots, 0)
+	graph, err = LoadRoundGraph(store)
+	assert.Nil(graph)
+	efe, ok = err.(*EmptyFinalRoundError)
+	assert.True(ok)
+	assert.Equal(uint64(0), efe.Number)
+}
+
+func TestRoundInconsistent(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	store := &roundTestStore{
+		meta: [2]uint64{1, 100},
+		snapshots: map[uint64][]*common.Snapshot{
+			0: {{NodeId: id, Timestamp: 30}, {NodeId: id, Timestamp: 10}, {NodeId: id, Timestamp: 20}},
+			1: {{NodeId: id, Timestamp: 100}, {NodeId: id, Timestamp: 150}},
+		},
+	}
+
+	cache, err := loadHeadRoundForNode(store, id)
+	assert.Nil(err)
+	assert.Equal(uint64(150), cache.End)
+
+	final, err := loadFinalRoundForNode(store, id, 0)
+	assert.Nil(err)
+	assert.Equal(uint64(10), final.Start)
+	assert.Equal(uint64(30), final.End)
+
+	store.snapshots[1] = append(store.snapshots[1], &common.Snapshot{NodeId: id, Timestamp: 50})
+	cache, err = loadHeadRoundForNode(store, id)
+	assert.Nil(cache)
+	rie, ok := err.(*RoundInconsistentError)
+	assert.True(ok)
+	assert.Equal(id, rie.NodeId)
+	assert.Equal(uint64(1), rie.Number)
+	assert.Equal(uint64(50), rie.Timestamp)
+
+	graph, err := LoadRoundGraph(store)
+	assert.Nil(graph)
+	assert.IsType(&RoundInconsistentError{}, err)
+}
+
+func TestLoadHeadRoundEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStore()
+	id := crypto.NewHash([]byte("node"))
+	snapshot := func(round, timestamp uint64) *common.SnapshotWithTopologicalOrder {
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: id[:]})
+		tx.Extra = []byte(fmt.Sprint(timestamp))
+		return &common.SnapshotWithTopologicalOrder{
+			Snapshot: common.Snapshot{
+				NodeId:      id,
+				Transaction: &common.SignedTransaction{Transaction: *tx},
+				RoundNumber: round,
+				Timestamp:   timestamp,
+			},
+			TopologicalOrder: timestamp,
+		}
+	}
+	start := uint64(1000)
+	assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{snapshot(0, start)}))
+	next := start + config.SnapshotRoundGap
+	for _, ts := range []uint64{next + 30, next + 10, next + 50, next + 20} {
+		assert.Nil(store.SnapshotsWriteSnapshot(snapshot(1, ts)))
+	}
+
+	verify := config.VerifyRoundEnd
+	defer func() { config.VerifyRoundEnd = verify }()
+	config.VerifyRoundEnd = true
+	cache, err := loadHeadRoundForNode(store, id)
+	assert.Nil(err)
+	assert.Equal(uint64(1), cache.Number)
+	assert.Equal(next+10, cache.Start)
+	assert.Equal(next+50, cache.End)
+
+	var scanned uint64
+	for _, s := range cache.Snapshots {
+		if s.Timestamp > scanned {
+			scanned = s.Timestamp
+		}
+	}
+	assert.Equal(scanned, cache.End)
+
+	mismatch := &roundEndTestStore{Store: store, end: next + 40}
+	_, err = loadHeadRoundForNode(mismatch, id)
+	assert.NotNil(err)
+	config.VerifyRoundEnd = false
+	cache, err = loadHeadRoundForNode(mismatch, id)
+	assert.Nil(err)
+	assert.Equal(next+40, cache.End)
+}
+
+type roundEndTestStore struct {
+	storage.Store
+	end uint64
+}
+
+func (s *roundEndTestStore) SnapshotsReadRoundEnd(nodeIdWithNetwork crypto.Hash) (uint64, bool, error) {
+	return s.end, true, nil
+}
+
+func TestCacheRoundTryAdvance(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	start := uint64(time.Now().UnixNano())
+	cache := &CacheRound{NodeId: id, Number: 5, Start: start, End: start}
+	finalized := func(s *common.Snapshot) bool { return len(s.Signatures) > 0 }
+
+	next, final, err := cache.TryAdvance(start+config.SnapshotRoundGap-1, config.SnapshotRoundGap, 0, finalized, nil)
+	assert.Nil(err)
+	assert.Nil(final)
+	assert.Equal(uint64(5), next.Number)
+	assert.Equal(start, next.Start)
+
+	next, final, err = cache.TryAdvance(start+config.SnapshotRoundGap, config.SnapshotRoundGap, 0, finalized, nil)
+	assert.Nil(err)
+	assert.Nil(final)
+	assert.Equal(uint64(5), next.Number)
+	assert.Equal(start+config.SnapshotRoundGap, next.Start)
+	assert.Equal(start, cache.Start)
+
+	s := &common.Snapshot{NodeId: id, RoundNumber: 5, Timestamp: start, Transaction: &common.SignedTransaction{}}
+	cache.Snapshots = []*common.Snapshot{s}
+	next, final, err = cache.TryAdvance(start+config.SnapshotRoundGap, config.SnapshotRoundGap, 0, finalized, nil)
+	assert.NotNil(err)
+	assert.Nil(final)
+	assert.Equal(uint64(5), next.Number)
+
+	s.Signatures = []crypto.Signature{{}}
+	next, final, err = cache.TryAdvance(start+config.SnapshotRoundGap, config.SnapshotRoundGap, 0, finalized, nil)
+	assert.Nil(err)
+	assert.NotNil(final)
+	assert.Equal(uint64(6), next.Number)
+	assert.Equal(start+config.SnapshotRoundGap, next.Start)
+	assert.Equal(start+config.SnapshotRoundGap, next.End)
+	assert.Len(next.Snapshots, 0)
+	assert.Equal(uint64(5), final.Number)
+	assert.Equal(start, final.Start)
+	expected, err := cache.asFinal(nil)
+	assert.Nil(err)
+	assert.Equal(expected.Hash, final.Hash)
+	assert.Len(cache.Snapshots, 1)
+}
+
+func TestCacheRoundTryAdvanceLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	start := uint64(time.Now().UnixNano())
+	cache := &CacheRound{NodeId: id, Number: 5, Start: start, End: start + 2}
+	for i := 2; i >= 0; i-- {
+		s := &common.Snapshot{NodeId: id, RoundNumber: 5, Timestamp: start + uint64(i), Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(i)}
+		cache.Snapshots = append(cache.Snapshots, s)
+	}
+	finalized := func(s *common.Snapshot) bool { return true }
+
+	next, final, err := cache.TryAdvance(start+3, config.SnapshotRoundGap, 4, finalized, nil)
+	assert.Nil(err)
+	assert.Nil(final)
+	assert.Equal(uint64(5), next.Number)
+	next, final, err = cache.TryAdvance(start+2, config.SnapshotRoundGap, 3, finalized, nil)
+	assert.Nil(err)
+	assert.Nil(final)
+	assert.Equal(uint64(5), next.Number)
+
+	next, final, err = cache.TryAdvance(start+3, config.SnapshotRoundGap, 3, finalized, nil)
+	assert.Nil(err)
+	assert.NotNil(final)
+	assert.Equal(uint64(6), next.Number)
+	assert.Equal(start+3, next.Start)
+	assert.Equal(start+2, final.End)
+	assert.Equal(roundHash(id, 5, cache.Snapshots), final.Hash)
+
+	// the flushed snapshots count, and the final hash is the same from the store
+	store := &roundTestStore{snapshots: map[uint64][]*common.Snapshot{5: append([]*common.Snapshot{}, cache.Snapshots...)}}
+	cache.flushSnapshots(1)
+	_, flushed, err := cache.TryAdvance(start+3, config.SnapshotRoundGap, 3, finalized, store)
+	assert.Nil(err)
+	assert.Equal(final.Hash, flushed.Hash)
+	loaded, err := loadFinalRoundForNode(store, id, 5)
+	assert.Nil(err)
+	assert.Equal(final.Hash, loaded.Hash)
+
+	cache.Snapshots[0].Signatures = nil
+	_, _, err = cache.TryAdvance(start+3, config.SnapshotRoundGap, 3, func(s *common.Snapshot) bool { return len(s.Signatures) > 0 }, store)
+	assert.NotNil(err)
+}
+
+func TestCacheRoundFlushSnapshots(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	start := uint64(time.Now().UnixNano())
+	cache := &CacheRound{NodeId: id, Number: 5, Start: start}
+	for i := 9; i >= 0; i-- {
+		tx := &common.SignedTransaction{}
+		tx.Extra = []byte{byte(i)}
+		s := &common.Snapshot{NodeId: id, RoundNumber: 5, Timestamp: start + uint64(i), Transaction: tx}
+		cache.Snapshots = append(cache.Snapshots, s)
+	}
+	store := &roundTestStore{snapshots: map[uint64][]*common.Snapshot{
+		5: append([]*common.Snapshot{}, cache.Snapshots...),
+	}}
+	expected, err := cache.asFinal(nil)
+	assert.Nil(err)
+
+	cache.flushSnapshots(4)
+	assert.Len(cache.Snapshots, 4)
+	assert.Equal(6, cache.Flushed)
+	assert.Equal(start+6, cache.Snapshots[0].Timestamp)
+	cache.flushSnapshots(4)
+	assert.Equal(6, cache.Flushed)
+
+	finalized := func(s *common.Snapshot) bool { return true }
+	next, final, err := cache.TryAdvance(start+config.SnapshotRoundGap, config.SnapshotRoundGap, 0, finalized, store)
+	assert.Nil(err)
+	assert.Equal(uint64(6), next.Number)
+	assert.Equal(0, next.Flushed)
+	assert.Equal(expected.Hash, final.Hash)
+
+	store.snapshots[5] = store.snapshots[5][1:]
+	_, final, err = cache.TryAdvance(start+config.SnapshotRoundGap, config.SnapshotRoundGap, 0, finalized, store)
+	assert.IsType(&RoundInconsistentError{}, err)
+	assert.Nil(final)
+
+	// the snapshots of the same timestamp are flushed in the payload hash order, whatever the order in memory
+	var same []*common.Snapshot
+	for i := 0; i < 8; i++ {
+		tx := &common.SignedTransaction{}
+		tx.Extra = []byte{byte(i)}
+		same = append(same, &common.Snapshot{NodeId: id, RoundNumber: 5, Timestamp: start, Transaction: tx})
+	}
+	sorted := sortRoundSnapshots(append([]*common.Snapshot{}, same...))
+	for i := 0; i < 4; i++ {
+		rand.Shuffle(len(same), func(i, j int) { same[i], same[j] = same[j], same[i] })
+		cache := &CacheRound{NodeId: id, Number: 5, Start: start, Snapshots: append([]*common.Snapshot{}, same...)}
+		cache.flushSnapshots(3)
+		assert.Equal(sorted[5:], sortRoundSnapshots(cache.Snapshots))
+	}
+}
+
+func TestRoundGraphNodeRounds(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(3)
+	g := testRoundGraph(node)
+	id := node.IdForNetwork
+
+	cache, final, ok := g.NodeRounds(id)
+	assert.True(ok)
+	assert.Equal(uint64(1), cache.Number)
+	assert.Equal(crypto.NewHash(id[:]), final.Hash)
+	cache.Number, final.Number = 9, 9
+	assert.Equal(uint64(1), g.CacheRound[id].Number)
+	assert.Equal(uint64(0), g.FinalRound[id].Number)
+
+	desc := g.PrintNode(id)
+	assert.Equal(fmt.Sprintf("NODE# %s\nFINAL 0 0 %s\nCACHE 1 0", id, crypto.NewHash(id[:])), desc)
+	assert.Contains(g.Print(), desc)
+
+	missing := crypto.NewHash([]byte("missing"))
+	cache, final, ok = g.NodeRounds(missing)
+	assert.False(ok)
+	assert.Nil(cache)
+	assert.Nil(final)
+	assert.Equal(fmt.Sprintf("NODE# %s NOT FOUND", missing), g.PrintNode(missing))
+}
+
+func TestListNodeRounds(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(3)
+	node.Graph = testRoundGraph(node)
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	node.Graph.CacheRound[peer].Number = 5
+	node.Graph.FinalRound[peer].Number = 4
+	bootstrap := accounts[2].Hash().ForNetwork(node.networkId)
+	delete(node.Graph.FinalRound, bootstrap)
+
+	infos := node.ListNodeRounds()
+	assert.Len(infos, 3)
+	assert.Equal(NodeRoundInfo{NodeId: node.IdForNetwork, CacheNumber: 1, FinalHash: crypto.NewHash(node.IdForNetwork[:])}, infos[0])
+	assert.Equal(NodeRoundInfo{NodeId: peer, FinalNumber: 4, CacheNumber: 5, FinalHash: crypto.NewHash(peer[:])}, infos[1])
+	assert.Equal(NodeRoundInfo{NodeId: bootstrap, CacheNumber: 1}, infos[2])
+
+	node.Graph.CacheRound[peer].Number = 6
+	assert.Equal(uint64(5), infos[1].CacheNumber)
+}
+
+func TestCacheRoundFinalHashOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	snapshots := make([]*common.Snapshot, 0)
+	for i := 0; i < 6; i++ {
+		s := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: uint64(100 + i/3), Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(i)}
+		snapshots = append(snapshots, s)
+	}
+
+	var hash crypto.Hash
+	orders := [][]int{{0, 1, 2, 3, 4, 5}, {2, 1, 0, 5, 4, 3}, {4, 0, 3, 2, 5, 1}, {1, 2, 0, 3, 5, 4}}
+	for _, order := range orders {
+		cache := &CacheRound{NodeId: id, Number: 1, Start: 100, End: 101}
+		for _, i := range order {
+			cache.Snapshots = append(cache.Snapshots, snapshots[i])
+		}
+		final, err := cache.asFinal(nil)
+		assert.Nil(err)
+		if !hash.HasValue() {
+			hash = final.Hash
+		}
+		assert.Equal(hash, final.Hash)
+
+		store := &roundTestStore{snapshots: map[uint64][]*common.Snapshot{1: snapshots}}
+		final, err = loadFinalRoundForNode(store, id, 1)
+		assert.Nil(err)
+		assert.Equal(hash, final.Hash)
+	}
+}
+
+func TestCacheRoundFinalHashKeepsOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	cache := &CacheRound{NodeId: id, Number: 1, Start: 100, End: 105}
+	for i := 5; i >= 0; i-- {
+		s := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: uint64(100 + i), Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(i)}
+		cache.Snapshots = append(cache.Snapshots, s)
+	}
+	order := append([]*common.Snapshot{}, cache.Snapshots...)
+
+	hash := cache.FinalHash()
+	assert.Equal(order, cache.Snapshots)
+	final, err := cache.asFinal(nil)
+	assert.Nil(err)
+	assert.Equal(hash, final.Hash)
+	assert.Equal(order, cache.Snapshots)
+	for i, s := range cache.Snapshots {
+		assert.True(s == order[i])
+	}
+}
+
+func TestRoundHashBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	a := &common.Snapshot{NodeId: id, RoundNumber: 258, Timestamp: 101, Transaction: &common.SignedTransaction{}}
+	b := &common.Snapshot{NodeId: id, RoundNumber: 258, Timestamp: 100, Transaction: &common.SignedTransaction{}}
+	b.Transaction.Extra = []byte("b")
+	b.Signatures = []crypto.Signature{{1}}
+
+	ha, hb := a.PayloadHash(), b.PayloadHash()
+	msg := append(append([]byte{}, id[:]...), 0, 0, 0, 0, 0, 0, 1, 2)
+	msg = append(append(msg, hb[:]...), ha[:]...)
+	assert.Equal(crypto.NewHash(msg), roundHash(id, 258, []*common.Snapshot{a, b}))
+
+	// the round hash doesn't change with the snapshot signatures
+	b.Signatures = nil
+	assert.Equal(crypto.NewHash(msg), roundHash(id, 258, []*common.Snapshot{a, b}))
+}
+
+func TestRoundJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	cache := &CacheRound{NodeId: id, Number: 3, Start: 100, End: 102}
+	for i := 2; i >= 0; i-- {
+		s := &common.Snapshot{NodeId: id, RoundNumber: 3, Timestamp: uint64(100 + i), Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(i)}
+		cache.Snapshots = append(cache.Snapshots, s)
+	}
+	order := append([]*common.Snapshot{}, cache.Snapshots...)
+
+	data, err := json.Marshal(cache)
+	assert.Nil(err)
+	again, err := json.Marshal(cache)
+	assert.Nil(err)
+	assert.Equal(data, again)
+	assert.Equal(order, cache.Snapshots)
+	var c struct {
+		NodeId    string            `json:"node"`
+		Number    uint64            `json:"round"`
+		End       uint64            `json:"end"`
+		Hash      string            `json:"hash"`
+		Snapshots []json.RawMessage `json:"snapshots"`
+	}
+	assert.Nil(json.Unmarshal(data, &c))
+	assert.Equal(id.String(), c.NodeId)
+	assert.Equal(uint64(3), c.Number)
+	assert.Equal(uint64(102), c.End)
+	assert.Equal(cache.FinalHash().String(), c.Hash)
+	assert.Len(c.Snapshots, 3)
+
+	final, err := cache.asFinal(nil)
+	assert.Nil(err)
+	assert.Equal(final.Hash.String(), c.Hash)
+	data, err = json.Marshal(final)
+	assert.Nil(err)
+	assert.Contains(string(data), `"hash":"`+final.Hash.String()+`"`)
+	var decoded FinalRound
+	assert.Nil(json.Unmarshal(data, &decoded))
+	assert.Equal(*final, decoded)
+
+	var packed FinalRound
+	assert.Nil(msgpack.Unmarshal(common.MsgpackMarshalPanic(final), &packed))
+	assert.Equal(final.NodeId, packed.NodeId)
+	assert.Equal(final.Number, packed.Number)
+	assert.Equal(final.Start, packed.Start)
+	assert.False(packed.Hash.HasValue())
+	store := &roundTestStore{snapshots: map[uint64][]*common.Snapshot{3: {order[2], order[1], order[0]}}}
+	loaded, err := loadFinalRoundForNode(store, id, 3)
+	assert.Nil(err)
+	assert.Equal(decoded.Hash, loaded.Hash)
+}
+
+func TestLoadFinalRoundStoreOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	id := crypto.NewHash([]byte("node"))
+	cache := &CacheRound{NodeId: id, Number: 0, Start: 100}
+	for i := 0; i < 6; i++ {
+		s := &common.Snapshot{NodeId: id, Timestamp: uint64(100 + i/2), Transaction: &common.SignedTransaction{}}
+		s.Transaction.Extra = []byte{byte(i)}
+		cache.Snapshots = append(cache.Snapshots, s)
+		cache.End = s.Timestamp
+	}
+	sealed, err := cache.asFinal(nil)
+	assert.Nil(err)
+
+	next := &common.Snapshot{NodeId: id, RoundNumber: 1, Timestamp: 200, Transaction: &common.SignedTransaction{}}
+	for _, order := range [][]int{{0, 1, 2, 3, 4, 5}, {5, 4, 3, 2, 1, 0}, {3, 0, 5, 1, 4, 2}, {1, 0, 3, 2, 5, 4}} {
+		snapshots := make([]*common.Snapshot, 0)
+		for _, i := range order {
+			snapshots = append(snapshots, cache.Snapshots[i])
+		}
+		store := &roundTestStore{
+			meta:      [2]uint64{1, 200},
+			snapshots: map[uint64][]*common.Snapshot{0: snapshots, 1: {next}},
+		}
+		graph, err := LoadRoundGraph(store)
+		assert.Nil(err)
+		final := graph.FinalRound[id]
+		assert.Equal(sealed.Hash, final.Hash)
+		assert.Equal(sealed.Start, final.Start)
+		assert.Equal(sealed.End, final.End)
+		assert.Equal(cache.Snapshots[order[0]], snapshots[0])
+	}
+}
+
+// the rules of the rounds in the replayed graph, the peers have the final round 2 and some
+// snapshots in the cache round 3, and each peer round 2 is referenced by the next peer. The
+// final rounds are never pruned, so the rule 6 never applies, and the rule 4 is the order
+// of the self snapshots, see TestSignSnapshotConcurrentRounds.
+func TestRoundAcceptanceRules(t *testing.T) {
+	assert := assert.New(t)
+
+	trace, err := ioutil.ReadFile(replayTraceFile)
+	assert.Nil(err)
+	node, accounts, store := testReplayNode(assert)
+	snapshots, err := ReadSnapshotTrace(bytes.NewReader(trace))
+	assert.Nil(err)
+	assert.Nil(ReplaySnapshots(node, snapshots))
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	next := accounts[3].Hash().ForNetwork(node.networkId)
+	final, cache := *node.Graph.FinalRound[peer], *node.Graph.CacheRound[peer]
+	assert.Equal(uint64(2), final.Number)
+	assert.Equal(uint64(3), cache.Number)
+	assert.Len(cache.Snapshots, 4)
+	link, err := store.SnapshotsReadRoundLink(next, peer)
+	assert.Nil(err)
+	assert.Equal(uint64(2), link)
+	previous, err := store.SnapshotsReadSnapshotsForNodeRound(peer, 1)
+	assert.Nil(err)
+
+	genesis, err := store.SnapshotsReadSnapshotsForNodeRound(next, 0)
+	assert.Nil(err)
+	conflict := func(number, timestamp uint64, references [2]crypto.Hash) *common.Snapshot {
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.AddInput(genesis[0].TransactionHash(), 0)
+		tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+		tx.Extra = []byte(fmt.Sprint(number))
+		signed := &common.SignedTransaction{Transaction: *tx}
+		assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+		s := &common.Snapshot{NodeId: peer, Transaction: signed, RoundNumber: number, Timestamp: timestamp, References: references}
+		s.Sign(accounts[1].PrivateSpendKey)
+		return s
+	}
+	unchanged := func() {
+		assert.Equal(final, *node.Graph.FinalRound[peer])
+		assert.Len(node.Graph.CacheRound[peer].Snapshots, 4)
+		ss, err := store.SnapshotsReadSnapshotsForNodeRound(peer, 2)
+		assert.Nil(err)
+		assert.Len(ss, 4)
+		assert.Equal(final.Hash, roundHash(peer, 2, ss))
+		assert.Len(node.SnapshotsPool, 0)
+	}
+
+	// rule 1 and 3, an earlier conflict snapshot in the round 2 is never signed nor finalized
+	// once the round 3 has snapshots, and rule 5, the round 2 referenced is never changed
+	earlier := conflict(2, final.Start-1, [2]crypto.Hash{roundHash(peer, 1, previous), node.Graph.FinalRound[next].Hash})
+	r, err := node.verifySnapshot(earlier)
+	assert.True(r.Handled)
+	assert.Equal(&NextRoundAvailableError{NodeId: peer, Number: 2, Next: 3}, err)
+	assert.Nil(node.handleSnapshotInput(earlier))
+	unchanged()
+	earlier.Sign(accounts[2].PrivateSpendKey)
+	earlier.Sign(accounts[3].PrivateSpendKey)
+	assert.Nil(node.handleSnapshotInput(earlier))
+	unchanged()
+	o, err := store.SnapshotsReadSnapshotByTransactionHash(earlier.TransactionHash())
+	assert.Nil(err)
+	assert.Nil(o)
+
+	// the rule 1 is only for a next round with snapshots
+	empty := node.Graph.CacheRound[peer].Copy()
+	empty.Snapshots, empty.Flushed = nil, 4
+	node.Graph.CacheRound[peer] = empty
+	_, err = node.verifySnapshot(earlier)
+	assert.IsType(&NextRoundAvailableError{}, err)
+	empty.Flushed = 0
+	_, err = node.verifySnapshot(earlier)
+	assert.Nil(err)
+	node.Graph.CacheRound[peer] = &cache
+
+	// rule 2, a conflict snapshot in the cache round is accepted without pruning any snapshot
+	later := conflict(3, cache.End+uint64(time.Millisecond), [2]crypto.Hash{final.Hash, node.Graph.FinalRound[next].Hash})
+	assert.Nil(node.handleSnapshotInput(later))
+	assert.Len(node.SnapshotsPool[later.PayloadHash()], 2)
+	later.Sign(accounts[2].PrivateSpendKey)
+	later.Sign(accounts[3].PrivateSpendKey)
+	assert.Nil(node.handleSnapshotInput(later))
+	assert.Len(node.Graph.CacheRound[peer].Snapshots, 5)
+	assert.Equal(final, *node.Graph.FinalRound[peer])
+	o, err = store.SnapshotsReadSnapshotByTransactionHash(later.TransactionHash())
+	assert.Nil(err)
+	assert.NotNil(o)
+}
+
+func TestRoundLimitAdvance(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts, store := testReplayNode(assert)
+	node.roundLimit = 2
+	store.SnapshotsSetRoundLimit(2)
+	genesis, err := store.SnapshotsReadSnapshotsForNodeRound(node.IdForNetwork, 0)
+	assert.Nil(err)
+
+	feed := func(a common.Address, other crypto.Hash, output int, timestamp uint64) *common.Snapshot {
+		id := a.Hash().ForNetwork(node.networkId)
+		cache, final, err := node.Graph.CacheRound[id].TryAdvance(timestamp, node.roundGap, node.roundLimit, node.verifyFinalization, store)
+		assert.Nil(err)
+		if final == nil {
+			final = node.Graph.FinalRound[id]
+		}
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.AddInput(genesis[0].TransactionHash(), output)
+		tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+		signed := &common.SignedTransaction{Transaction: *tx}
+		assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+
+		s := &common.Snapshot{NodeId: id, Transaction: signed, RoundNumber: cache.Number, Timestamp: timestamp}
+		s.References = [2]crypto.Hash{final.Hash, node.Graph.FinalRound[other].Hash}
+		s.Sign(a.PrivateSpendKey)
+		assert.Nil(node.handleSnapshotInput(s))
+		for _, b := range accounts[1:] {
+			s.Sign(b.PrivateSpendKey)
+		}
+		assert.Nil(node.handleSnapshotInput(s))
+		return s
+	}
+
+	peer := accounts[1].Hash().ForNetwork(node.networkId)
+	other := accounts[2].Hash().ForNetwork(node.networkId)
+	start := replayGenesis + node.roundGap
+	for i := 0; i < 5; i++ {
+		s := feed(accounts[1], other, i, start+uint64(i+1)*uint64(time.Millisecond))
+		assert.Equal(uint64(i/2+1), s.RoundNumber)
+	}
+	final, cache := node.Graph.FinalRound[peer], node.Graph.CacheRound[peer]
+	assert.Equal(uint64(2), final.Number)
+	assert.Equal(uint64(3), cache.Number)
+	assert.Len(cache.Snapshots, 1)
+	assert.Equal(store.SnapshotsTopologySequence(), uint64(len(accounts)+5))
+
+	// the early final round is the same when loaded again, and referenced by other nodes
+	graph, err := LoadRoundGraph(store)
+	assert.Nil(err)
+	assert.Equal(*final, *graph.FinalRound[peer])
+	assert.Equal(cache.Number, graph.CacheRound[peer].Number)
+	s := feed(accounts[2], peer, 5, start+uint64(10*time.Millisecond))
+	assert.Equal(final.Hash, s.References[1])
+	o, err := store.SnapshotsReadSnapshotByTransactionHash(s.TransactionHash())
+	assert.Nil(err)
+	assert.NotNil(o)
+	link, err := store.SnapshotsReadRoundLink(other, peer)
+	assert.Nil(err)
+	assert.Equal(uint64(2), link)
+}
+
+func TestFinalCacheConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	g := testRoundGraph(node)
+
+	consistent := func(finals []FinalRound) bool {
+		if len(finals) != len(g.Nodes) {
+			return false
+		}
+		number := finals[0].Number
+		for _, f := range finals {
+			hash := crypto.NewHash([]byte(fmt.Sprint(f.NodeId, number)))
+			if f.Number != number || f.Start != number || f.End != number || f.Hash != hash {
+				return false
+			}
+		}
+		return true
+	}
+	advance := func(number uint64) {
+		g.Lock()
+		for id, f := range g.FinalRound {
+			f.Number, f.Start, f.End = number, number, number
+			f.Hash = crypto.NewHash([]byte(fmt.Sprint(id, number)))
+		}
+		g.Unlock()
+		g.UpdateFinalCache()
+	}
+	advance(0)
+
+	var wg sync.WaitGroup
+	var torn int64
+	var mutex sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last []FinalRound
+			for j := 0; j < 1000; j++ {
+				finals := g.FinalCache()
+				if !consistent(finals) || last != nil && !consistent(last) || last != nil && finals[0].Number < last[0].Number {
+					mutex.Lock()
+					torn++
+					mutex.Unlock()
+				}
+				last = finals
+			}
+		}()
+	}
+	for n := uint64(1); n <= 200; n++ {
+		advance(n)
+	}
+	wg.Wait()
+
+	assert.Equal(int64(0), torn)
+	finals := g.FinalCache()
+	assert.True(consistent(finals))
+	assert.Equal(uint64(200), finals[0].Number)
+}
@@ -0,0 +1,278 @@
+package kernel
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// a simulated network of in-process nodes, the messages are queued with the latency of
+// the receiver and delivered by the test in order, unless dropped or partitioned
+type testNetwork struct {
+	sync.Mutex
+	nodes     map[crypto.Hash]*Node
+	latency   map[crypto.Hash]uint64
+	drops     map[crypto.Hash]float64
+	partition map[crypto.Hash]int
+	rand      *rand.Rand
+	now       uint64
+	sequence  uint64
+	queue     []*testMessage
+	dropped   int
+}
+
+type testMessage struct {
+	to       crypto.Hash
+	at       uint64
+	sequence uint64
+	snapshot *common.Snapshot
+}
+
+type testPeer struct {
+	network *testNetwork
+	id      crypto.Hash
+}
+
+func newTestNetwork(seed int64) *testNetwork {
+	return &testNetwork{
+		nodes:     make(map[crypto.Hash]*Node),
+		latency:   make(map[crypto.Hash]uint64),
+		drops:     make(map[crypto.Hash]float64),
+		partition: make(map[crypto.Hash]int),
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (n *testNetwork) join(node *Node) {
+	n.nodes[node.IdForNetwork] = node
+	node.Sender = &testPeer{network: n, id: node.IdForNetwork}
+}
+
+// the nodes in different groups can't reach each other, all nodes are in the group 0 by default
+func (n *testNetwork) split(groups ...[]crypto.Hash) {
+	n.Lock()
+	defer n.Unlock()
+	n.partition = make(map[crypto.Hash]int)
+	for i, ids := range groups {
+		for _, id := range ids {
+			n.partition[id] = i
+		}
+	}
+}
+
+func (n *testNetwork) heal() {
+	n.split()
+}
+
+func (n *testNetwork) send(from, to crypto.Hash, s *common.Snapshot) {
+	n.Lock()
+	defer n.Unlock()
+	if from == to || n.nodes[to] == nil {
+		return
+	}
+	if n.partition[from] != n.partition[to] || n.rand.Float64() < n.drops[to] {
+		n.dropped++
+		return
+	}
+	c := *s
+	c.Signatures = append([]crypto.Signature{}, s.Signatures...)
+	c.Signers = nil
+	n.sequence++
+	n.queue = append(n.queue, &testMessage{to: to, at: n.now + n.latency[to], sequence: n.sequence, snapshot: &c})
+}
+
+// deliver all messages due until the time, including those sent during the delivery,
+// and returns the number of delivered messages
+func (n *testNetwork) deliver(until uint64) (int, error) {
+	var delivered int
+	for {
+		n.Lock()
+		sort.Slice(n.queue, func(i, j int) bool {
+			if n.queue[i].at == n.queue[j].at {
+				return n.queue[i].sequence < n.queue[j].sequence
+			}
+			return n.queue[i].at < n.queue[j].at
+		})
+		if len(n.queue) == 0 || n.queue[0].at > until {
+			n.now = until
+			n.Unlock()
+			return delivered, nil
+		}
+		m := n.queue[0]
+		n.queue = n.queue[1:]
+		if m.at > n.now {
+			n.now = m.at
+		}
+		n.Unlock()
+
+		delivered++
+		err := n.nodes[m.to].handleSnapshotInput(m.snapshot)
+		if err != nil {
+			return delivered, err
+		}
+	}
+}
+
+func (p *testPeer) SendSnapshotMessage(idForNetwork crypto.Hash, s *common.Snapshot) error {
+	p.network.send(p.id, idForNetwork, s)
+	return nil
+}
+
+func (p *testPeer) SendSnapshotMessageBatch(peerIds []crypto.Hash, s *common.Snapshot) map[crypto.Hash]error {
+	errs := make(map[crypto.Hash]error)
+	for _, id := range peerIds {
+		errs[id] = p.SendSnapshotMessage(id, s)
+	}
+	return errs
+}
+
+// the nodes of the same genesis, each one with its own memory store and all sharing the clock
+func testNetworkNodes(assert *assert.Assertions, network *testNetwork, clock Clock) ([]*Node, []common.Address, []storage.Store) {
+	nodes, stores := make([]*Node, 0), make([]storage.Store, 0)
+	var accounts []common.Address
+	for i := 0; i < 4; i++ {
+		node, all, store := testReplayNode(assert)
+		accounts = all
+		node.Account = accounts[i]
+		node.IdForNetwork = accounts[i].Hash().ForNetwork(node.networkId)
+		node.Clock = clock
+		network.join(node)
+		nodes, stores = append(nodes, node), append(stores, store)
+	}
+	for _, node := range nodes {
+		for _, peer := range nodes {
+			node.AddGossipPeer(peer.IdForNetwork)
+		}
+	}
+	return nodes, accounts, stores
+}
+
+// a transaction spending a genesis output of the first account, which all stores have
+func testNetworkTransaction(assert *assert.Assertions, store storage.Store, node *Node, accounts []common.Address, output int) *common.SignedTransaction {
+	genesis := accounts[output/replayOutputs].Hash().ForNetwork(node.networkId)
+	in, err := store.SnapshotsReadSnapshotsForNodeRound(genesis, 0)
+	assert.Nil(err)
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(in[0].Transaction.PayloadHash(), output%replayOutputs)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(10000))
+	signed := &common.SignedTransaction{Transaction: *tx}
+	assert.Nil(signed.SignInput(store, 0, accounts[:1]))
+	return signed
+}
+
+func TestNetworkPartitionHealing(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(1)
+	clock := &stepClock{now: replayGenesis + config.SnapshotRoundGap, step: uint64(time.Millisecond)}
+	nodes, accounts, stores := testNetworkNodes(assert, network, clock)
+	ids := make([]crypto.Hash, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.IdForNetwork
+	}
+	network.latency[ids[1]] = uint64(10 * time.Millisecond)
+	network.latency[ids[3]] = uint64(30 * time.Millisecond)
+	network.split(ids[:2], ids[2:])
+
+	propose := func(i, output int) *common.Snapshot {
+		s := &common.Snapshot{NodeId: ids[i], Transaction: testNetworkTransaction(assert, stores[i], nodes[i], accounts, output)}
+		assert.Nil(nodes[i].handleSnapshotInput(s))
+		assert.Len(s.Signatures, 1)
+		return s
+	}
+	finalized := func(s *common.Snapshot) int {
+		var count int
+		for _, store := range stores {
+			ss, err := store.SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+			assert.Nil(err)
+			if ss != nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	a, b := propose(0, 0), propose(2, 1)
+	delivered, err := network.deliver(network.now + uint64(time.Second))
+	assert.Nil(err)
+	assert.True(delivered > 0)
+	assert.True(network.dropped > 0)
+	assert.Equal(0, finalized(a))
+	assert.Equal(0, finalized(b))
+	assert.Len(nodes[0].SnapshotsPool[a.PayloadHash()], 2)
+	assert.Len(nodes[2].SnapshotsPool[b.PayloadHash()], 2)
+	for _, node := range nodes {
+		for _, id := range ids {
+			assert.Len(node.Graph.CacheRound[id].Snapshots, 0)
+		}
+	}
+
+	network.heal()
+	now := time.Now().Add(time.Duration(config.SnapshotSignatureTimeout + nodes[0].roundGap))
+	nodes[0].sendSignatureRequests(nodes[0].reconcileSignatures(now), now)
+	nodes[2].sendSignatureRequests(nodes[2].reconcileSignatures(now), now)
+	_, err = network.deliver(network.now + uint64(time.Second))
+	assert.Nil(err)
+	assert.Equal(len(nodes), finalized(a))
+	assert.Equal(len(nodes), finalized(b))
+
+	// the next snapshots are in the next round, which makes the round of the healed snapshots final
+	atomic.AddUint64(&clock.now, 2*nodes[0].roundGap)
+	c, d := propose(0, 2), propose(2, 3)
+	_, err = network.deliver(network.now + uint64(time.Second))
+	assert.Nil(err)
+	assert.Equal(len(nodes), finalized(c))
+	assert.Equal(len(nodes), finalized(d))
+
+	for _, id := range []crypto.Hash{ids[0], ids[2]} {
+		final := nodes[0].Graph.FinalRound[id]
+		assert.Equal(uint64(1), final.Number)
+		for _, node := range nodes[1:] {
+			assert.Equal(final.Number, node.Graph.FinalRound[id].Number)
+			assert.Equal(final.Hash, node.Graph.FinalRound[id].Hash)
+		}
+	}
+}
+
+func TestNetworkLatencyAndDrops(t *testing.T) {
+	assert := assert.New(t)
+
+	network := newTestNetwork(1)
+	clock := &stepClock{now: replayGenesis + config.SnapshotRoundGap, step: uint64(time.Millisecond)}
+	nodes, accounts, stores := testNetworkNodes(assert, network, clock)
+	ids := make([]crypto.Hash, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.IdForNetwork
+	}
+	network.latency[ids[3]] = uint64(time.Second)
+	network.drops[ids[2]] = 1
+
+	s := &common.Snapshot{NodeId: ids[0], Transaction: testNetworkTransaction(assert, stores[0], nodes[0], accounts, 0)}
+	assert.Nil(nodes[0].handleSnapshotInput(s))
+	assert.Equal(1, network.dropped)
+	assert.Len(network.queue, 2)
+
+	_, err := network.deliver(network.now + uint64(time.Second) - 1)
+	assert.Nil(err)
+	assert.Len(network.queue, 2)
+	for _, m := range network.queue {
+		assert.Equal(ids[3], m.to)
+	}
+	assert.Len(nodes[0].SnapshotsPool[s.PayloadHash()], 2)
+
+	_, err = network.deliver(network.now + 1)
+	assert.Nil(err)
+	assert.Len(network.queue, 0)
+	ss, err := stores[0].SnapshotsReadSnapshotByPayloadHash(s.PayloadHash())
+	assert.Nil(err)
+	assert.NotNil(ss)
+}
@@ -0,0 +1,237 @@
+package kernel
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/vmihailenco/msgpack"
+)
+
+const stateVersion = 1
+
+// the round state of a node is its final round and cache round, with all their snapshots, so
+// the final hash is recomputed and the cache round verified on import. The ledger state, e.g.
+// the UTXOs, is not included, the snapshots before the final rounds are synced from peers.
+type roundState struct {
+	Version uint8            `msgpack:"V"`
+	Nodes   []nodeRoundState `msgpack:"N"`
+}
+
+type nodeRoundState struct {
+	NodeId         crypto.Hash        `msgpack:"I"`
+	Final          uint64             `msgpack:"F"`
+	FinalStart     uint64             `msgpack:"FS"`
+	FinalEnd       uint64             `msgpack:"FE"`
+	FinalHash      crypto.Hash        `msgpack:"FH"`
+	FinalSnapshots []*common.Snapshot `msgpack:"FSS"`
+	Cache          uint64             `msgpack:"C"`
+	CacheStart     uint64             `msgpack:"CS"`
+	CacheEnd       uint64             `msgpack:"CE"`
+	CacheSnapshots []*common.Snapshot `msgpack:"CSS"`
+}
+
+// ExportState writes the round state of all nodes in the graph. An empty cache round is never
+// written to the store, so the final round is exported as the cache round then, the same rounds
+// loaded by LoadRoundGraph after a restart, which are the rounds persisted by ImportState.
+func (node *Node) ExportState(w io.Writer) error {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	state := &roundState{Version: stateVersion}
+	for _, id := range node.Graph.Nodes {
+		cache, final := node.Graph.CacheRound[id], node.Graph.FinalRound[id]
+		if cache == nil || final == nil {
+			return fmt.Errorf("round state missing %s", id)
+		}
+		var err error
+		number, start, end, caches := cache.Number, cache.Start, cache.End, cache.Snapshots
+		if cache.Flushed > 0 {
+			caches, err = node.store.SnapshotsReadSnapshotsForNodeRound(id, cache.Number)
+			if err != nil {
+				return err
+			}
+		}
+		if len(cache.Snapshots)+cache.Flushed == 0 && final.Number > 0 {
+			number, start, end = final.Number, final.Start, final.End
+			caches, err = node.store.SnapshotsReadSnapshotsForNodeRound(id, final.Number)
+			if err != nil {
+				return err
+			}
+			final, err = loadFinalRoundForNode(node.store, id, final.Number-1)
+			if err != nil {
+				return err
+			}
+		}
+		finals, err := node.store.SnapshotsReadSnapshotsForNodeRound(id, final.Number)
+		if err != nil {
+			return err
+		}
+		state.Nodes = append(state.Nodes, nodeRoundState{
+			NodeId:         id,
+			Final:          final.Number,
+			FinalStart:     final.Start,
+			FinalEnd:       final.End,
+			FinalHash:      final.Hash,
+			FinalSnapshots: finals,
+			Cache:          number,
+			CacheStart:     start,
+			CacheEnd:       end,
+			CacheSnapshots: caches,
+		})
+	}
+	_, err := w.Write(common.MsgpackMarshalPanic(state))
+	return err
+}
+
+// ImportState loads the round state exported by a trusted node into a fresh node, whose graph has
+// only the genesis rounds, e.g. a new node to catch up the recent rounds only. Nothing is trusted
+// blindly, each final hash is recomputed from the round snapshots, all snapshots must be finalized
+// by the consensus nodes, and the cache round snapshots must reference the final round. The rounds
+// are written to the store, and the graph is loaded from it again, the same as after a restart.
+func (node *Node) ImportState(r io.Reader) error {
+	var state roundState
+	err := msgpack.NewDecoder(r).Decode(&state)
+	if err != nil {
+		return err
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("invalid round state version %d", state.Version)
+	}
+	if len(state.Nodes) == 0 {
+		return fmt.Errorf("empty round state")
+	}
+
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+	if node.Graph == nil || !node.Graph.atGenesis() {
+		return fmt.Errorf("round graph not at genesis")
+	}
+
+	finals := make(map[crypto.Hash]*FinalRound)
+	var snapshots []*common.SnapshotWithTopologicalOrder
+	for _, ns := range state.Nodes {
+		if finals[ns.NodeId] != nil {
+			return fmt.Errorf("duplicated round state node %s", ns.NodeId)
+		}
+		final, err := ns.verifyFinal()
+		if err != nil {
+			return err
+		}
+		if local := node.Graph.FinalRound[ns.NodeId]; local != nil && local.Number == final.Number && local.Hash != final.Hash {
+			return fmt.Errorf("round state final hash mismatch %s %d %s %s", ns.NodeId, final.Number, local.Hash, final.Hash)
+		}
+		_, err = ns.verifyCache(final)
+		if err != nil {
+			return err
+		}
+		finals[ns.NodeId] = final
+
+		for _, round := range [][]*common.Snapshot{ns.FinalSnapshots, ns.CacheSnapshots} {
+			round = append([]*common.Snapshot{}, round...)
+			sortRoundSnapshots(round)
+			for _, s := range round {
+				// e.g. the genesis snapshots, which have no signatures
+				stored, err := node.store.SnapshotsReadSnapshotByTransactionHash(s.TransactionHash())
+				if err != nil {
+					return err
+				}
+				if stored != nil {
+					continue
+				}
+				if !node.verifyFinalization(s) {
+					return fmt.Errorf("round state snapshot not finalized %s %d %s", ns.NodeId, s.RoundNumber, s.PayloadHash())
+				}
+				snapshots = append(snapshots, &common.SnapshotWithTopologicalOrder{Snapshot: *s})
+			}
+		}
+	}
+
+	err = node.TopoCounter.assign(snapshots, func() error {
+		return node.store.SnapshotsImportState(snapshots)
+	})
+	if err != nil {
+		return err
+	}
+	graph, err := LoadRoundGraph(node.store)
+	if err != nil {
+		return err
+	}
+	for id, final := range finals {
+		if f := graph.FinalRound[id]; f == nil || f.Hash != final.Hash {
+			return fmt.Errorf("round state import inconsistent %s %d", id, final.Number)
+		}
+	}
+	node.Graph.replace(graph)
+	node.trackProgress()
+	return nil
+}
+
+// the rounds are replaced in the same graph with its lock held, so the readers
+// without the state lock never see a partial graph, nor hold a stale one
+func (g *RoundGraph) replace(o *RoundGraph) {
+	g.Lock()
+	g.Nodes, g.CacheRound, g.FinalRound = o.Nodes, o.CacheRound, o.FinalRound
+	g.Unlock()
+	g.UpdateFinalCache()
+}
+
+// the graph has only the genesis rounds, i.e. no snapshot after the genesis yet
+func (g *RoundGraph) atGenesis() bool {
+	g.RLock()
+	defer g.RUnlock()
+
+	for _, id := range g.Nodes {
+		cache, final := g.CacheRound[id], g.FinalRound[id]
+		if final.Number > 0 || len(cache.Snapshots)+cache.Flushed > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (ns *nodeRoundState) verifyFinal() (*FinalRound, error) {
+	for _, s := range ns.FinalSnapshots {
+		if s.NodeId != ns.NodeId || s.RoundNumber != ns.Final {
+			return nil, fmt.Errorf("round state final snapshot %s %s %d", ns.NodeId, s.NodeId, s.RoundNumber)
+		}
+	}
+	final, err := finalRoundFromSnapshots(ns.NodeId, ns.Final, ns.FinalSnapshots)
+	if err != nil {
+		return nil, err
+	}
+	if final.Hash != ns.FinalHash || final.Start != ns.FinalStart || final.End != ns.FinalEnd {
+		return nil, fmt.Errorf("round state final hash mismatch %s %d %s %s", ns.NodeId, ns.Final, ns.FinalHash, final.Hash)
+	}
+	return final, nil
+}
+
+// the cache round is only empty after the genesis, otherwise the final round is exported as it
+func (ns *nodeRoundState) verifyCache(final *FinalRound) (*CacheRound, error) {
+	cache := &CacheRound{
+		NodeId:    ns.NodeId,
+		Number:    ns.Cache,
+		Start:     ns.CacheStart,
+		End:       ns.CacheEnd,
+		Snapshots: ns.CacheSnapshots,
+	}
+	if cache.Number != final.Number+1 {
+		return nil, fmt.Errorf("round state cache number %s %d %d", ns.NodeId, cache.Number, final.Number)
+	}
+	if len(cache.Snapshots) == 0 && final.Number > 0 {
+		return nil, fmt.Errorf("round state cache empty %s %d", ns.NodeId, cache.Number)
+	}
+	for _, s := range cache.Snapshots {
+		if s.NodeId != ns.NodeId || s.RoundNumber != cache.Number {
+			return nil, fmt.Errorf("round state cache snapshot %s %s %d", ns.NodeId, s.NodeId, s.RoundNumber)
+		}
+		if s.Timestamp < cache.Start || s.Timestamp > cache.End {
+			return nil, &RoundInconsistentError{NodeId: ns.NodeId, Number: cache.Number, Timestamp: s.Timestamp}
+		}
+		if s.References[0] != final.Hash {
+			return nil, fmt.Errorf("round state cache reference %s %d %s", ns.NodeId, cache.Number, s.References[0])
+		}
+	}
+	return cache, nil
+}
@@ -0,0 +1,131 @@
+package kernel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestRoundStateExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	accounts := testGenesisAccounts()
+	node := testGenesisNode(assert, accounts, 0)
+	assert.Nil(node.LoadConsensusNodes())
+	genesis := node.Graph.FinalRound[node.Graph.Nodes[0]]
+	start := genesis.Start
+
+	// the nodes after the first one have some rounds, all signed by the consensus nodes
+	for i, id := range node.Graph.Nodes[1:4] {
+		final := node.Graph.FinalRound[id]
+		for number := uint64(1); number <= uint64(i+2); number++ {
+			var round []*common.Snapshot
+			for j := 0; j < 3; j++ {
+				tx := common.NewTransaction(common.XINAssetId)
+				tx.Inputs = append(tx.Inputs, &common.Input{Genesis: id[:]})
+				tx.Extra = []byte{byte(i), byte(number), byte(j)}
+				s := &common.Snapshot{NodeId: id, RoundNumber: number, Timestamp: start + number*node.roundGap + uint64(j)}
+				s.Transaction = &common.SignedTransaction{Transaction: *tx}
+				s.References = [2]crypto.Hash{final.Hash, genesis.Hash}
+				for _, a := range accounts {
+					s.Sign(a.PrivateSpendKey)
+				}
+				topo := &common.SnapshotWithTopologicalOrder{Snapshot: *s, TopologicalOrder: node.TopoCounter.Next()}
+				assert.Nil(node.store.SnapshotsWriteSnapshot(topo))
+				round = append(round, s)
+			}
+			final, _ = finalRoundFromSnapshots(id, number, round)
+		}
+	}
+	graph, err := LoadRoundGraph(node.store)
+	assert.Nil(err)
+	node.Graph = graph
+
+	// an empty cache round after the advance is not in the store
+	advanced := node.Graph.Nodes[3]
+	cache := node.Graph.CacheRound[advanced]
+	next, final, err := cache.TryAdvance(cache.Start+node.roundGap, node.roundGap, node.roundLimit, node.verifyFinalization, node.store)
+	assert.Nil(err)
+	assert.NotNil(final)
+	assert.Len(next.Snapshots, 0)
+	node.Graph.UpdateRound(next, final)
+	node.Graph.UpdateFinalCache()
+
+	var buf bytes.Buffer
+	assert.Nil(node.ExportState(&buf))
+	data := buf.Bytes()
+
+	imported := testGenesisNode(assert, accounts, 1)
+	assert.Nil(imported.LoadConsensusNodes())
+	current := imported.Graph
+	assert.Nil(imported.ImportState(bytes.NewReader(data)))
+	assert.True(current == imported.Graph)
+	restarted, err := LoadRoundGraph(node.store)
+	assert.Nil(err)
+	assert.Equal(restarted.Print(), imported.Graph.Print())
+	assert.ElementsMatch(restarted.FinalCache(), imported.Graph.FinalCache())
+	assert.Equal(final.Hash, imported.Graph.CacheRound[advanced].FinalHash())
+	assert.Len(imported.Graph.CacheRound[advanced].Snapshots, 3)
+	assert.Equal(uint64(3), imported.Graph.FinalRound[advanced].Number)
+
+	// the imported rounds are persisted, the same graph is loaded after a restart
+	graph, err = LoadRoundGraph(imported.store)
+	assert.Nil(err)
+	assert.Equal(imported.Graph.Print(), graph.Print())
+	// the 8 genesis snapshots, and the final and cache rounds of 3 nodes, the rounds before are synced later
+	assert.Equal(uint64(8+3*2*3), imported.store.SnapshotsTopologySequence())
+	assert.Equal(uint64(8+3*2*3), imported.TopoCounter.seq)
+	snapshots, err := imported.store.SnapshotsReadSnapshotsForNodeRound(advanced, 2)
+	assert.Nil(err)
+	assert.Len(snapshots, 0)
+	assert.NotNil(imported.ImportState(bytes.NewReader(data)))
+
+	tamper := func(f func(state *roundState)) []byte {
+		var state roundState
+		assert.Nil(msgpack.Unmarshal(data, &state))
+		f(&state)
+		return common.MsgpackMarshalPanic(&state)
+	}
+	rejected := func(data []byte) {
+		fresh := testGenesisNode(assert, accounts, 1)
+		assert.Nil(fresh.LoadConsensusNodes())
+		seq := fresh.TopoCounter.seq
+		assert.NotNil(fresh.ImportState(bytes.NewReader(data)))
+		assert.Equal(seq, fresh.TopoCounter.seq)
+		assert.True(fresh.Graph.atGenesis())
+		graph, err := LoadRoundGraph(fresh.store)
+		assert.Nil(err)
+		assert.True(graph.atGenesis())
+	}
+
+	// a snapshot without enough signatures is never imported
+	rejected(tamper(func(state *roundState) {
+		s := state.Nodes[2].CacheSnapshots[1]
+		s.Signatures = s.Signatures[:len(accounts)*2/3]
+	}))
+	// a tampered final round
+	rejected(tamper(func(state *roundState) {
+		state.Nodes[3].FinalSnapshots[1].Transaction.Extra = []byte("corrupted")
+	}))
+	// the cache round must reference the final round
+	rejected(tamper(func(state *roundState) {
+		state.Nodes[1].CacheSnapshots[0].References[0] = crypto.NewHash([]byte("fork"))
+	}))
+	// an empty cache round is only after the genesis
+	rejected(tamper(func(state *roundState) {
+		state.Nodes[2].CacheSnapshots = nil
+	}))
+	// the genesis of another network
+	rejected(tamper(func(state *roundState) {
+		ns := &state.Nodes[0]
+		ns.FinalSnapshots[0].Transaction.Extra = []byte("network")
+		final, err := finalRoundFromSnapshots(ns.NodeId, 0, ns.FinalSnapshots)
+		assert.Nil(err)
+		ns.FinalHash = final.Hash
+	}))
+	rejected([]byte("invalid"))
+}
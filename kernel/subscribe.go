@@ -0,0 +1,74 @@
+package kernel
+
+import (
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+)
+
+type snapshotSubscribers struct {
+	sync.RWMutex
+	sequence    uint64
+	subscribers map[uint64]*snapshotSubscriber
+}
+
+type snapshotSubscriber struct {
+	ch    chan *common.SnapshotWithTopologicalOrder
+	done  chan struct{}
+	close sync.Once
+}
+
+// SubscribeSnapshots returns a channel of the finalized snapshots in their topological order,
+// and the function to unsubscribe, which closes the channel and no snapshot is sent after it.
+// A subscriber buffer size snapshots behind blocks the node when config.SnapshotSubscriberBlocking,
+// otherwise the snapshots are dropped for it, and the gap is in the topological orders received.
+func (node *Node) SubscribeSnapshots(buffer int) (<-chan *common.SnapshotWithTopologicalOrder, func()) {
+	sub := &snapshotSubscriber{
+		ch:   make(chan *common.SnapshotWithTopologicalOrder, buffer),
+		done: make(chan struct{}),
+	}
+
+	subs := &node.subscribers
+	subs.Lock()
+	if subs.subscribers == nil {
+		subs.subscribers = make(map[uint64]*snapshotSubscriber)
+	}
+	subs.sequence++
+	id := subs.sequence
+	subs.subscribers[id] = sub
+	subs.Unlock()
+
+	return sub.ch, func() {
+		sub.close.Do(func() {
+			// a blocked send returns when done, so the lock is released for the removal
+			close(sub.done)
+			subs.Lock()
+			delete(subs.subscribers, id)
+			subs.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// all sends are under the lock, so a subscriber removed never gets any snapshot
+func (subs *snapshotSubscribers) send(node *Node, s *common.SnapshotWithTopologicalOrder) {
+	subs.RLock()
+	defer subs.RUnlock()
+
+	for _, sub := range subs.subscribers {
+		if config.SnapshotSubscriberBlocking {
+			select {
+			case sub.ch <- s:
+			case <-sub.done:
+			}
+			continue
+		}
+		select {
+		case sub.ch <- s:
+		case <-sub.done:
+		default:
+			node.Metrics.Inc(MetricSubscriberDrop, s.NodeId == node.IdForNetwork)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package kernel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeSnapshots(t *testing.T) {
+	assert := assert.New(t)
+
+	node, _ := testConsensusNode(7)
+	metrics := NewPrometheusMetrics()
+	node.Metrics = metrics
+
+	var wg sync.WaitGroup
+	fast := make([][]uint64, 3)
+	unsubscribes := make([]func(), len(fast))
+	for i := range fast {
+		ch, unsubscribe := node.SubscribeSnapshots(16)
+		unsubscribes[i] = unsubscribe
+		wg.Add(1)
+		go func(i int, ch <-chan *common.SnapshotWithTopologicalOrder) {
+			defer wg.Done()
+			for s := range ch {
+				fast[i] = append(fast[i], s.TopologicalOrder)
+			}
+		}(i, ch)
+	}
+	slow, unsubscribe := node.SubscribeSnapshots(2)
+	for i := uint64(0); i < 10; i++ {
+		node.notifyFinalized(testFinalizedSnapshot(i))
+	}
+	assert.Equal(uint64(8), metrics.Value(MetricSubscriberDrop, false))
+
+	// the slow one sees a gap in the topological orders
+	assert.Equal(uint64(0), (<-slow).TopologicalOrder)
+	assert.Equal(uint64(1), (<-slow).TopologicalOrder)
+	node.notifyFinalized(testFinalizedSnapshot(10))
+	assert.Equal(uint64(10), (<-slow).TopologicalOrder)
+
+	unsubscribe()
+	unsubscribe()
+	_, open := <-slow
+	assert.False(open)
+	node.notifyFinalized(testFinalizedSnapshot(11))
+	assert.Len(node.subscribers.subscribers, 3)
+
+	for _, unsubscribe := range unsubscribes {
+		unsubscribe()
+	}
+	wg.Wait()
+	assert.Len(node.subscribers.subscribers, 0)
+	for _, orders := range fast {
+		assert.Len(orders, 12)
+		for i, topo := range orders {
+			assert.Equal(uint64(i), topo)
+		}
+	}
+}
+
+func TestSubscribeSnapshotsUnsubscribeBlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	blocking := config.SnapshotSubscriberBlocking
+	defer func() { config.SnapshotSubscriberBlocking = blocking }()
+	config.SnapshotSubscriberBlocking = true
+
+	node, _ := testConsensusNode(7)
+	ch, unsubscribe := node.SubscribeSnapshots(1)
+	node.notifyFinalized(testFinalizedSnapshot(0))
+
+	done := make(chan struct{})
+	go func() {
+		node.notifyFinalized(testFinalizedSnapshot(1))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("notify not blocked by the full subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unsubscribe()
+	<-done
+	s, open := <-ch
+	assert.True(open)
+	assert.Equal(uint64(0), s.TopologicalOrder)
+	_, open = <-ch
+	assert.False(open)
+	assert.Len(node.subscribers.subscribers, 0)
+	node.notifyFinalized(testFinalizedSnapshot(2))
+}
@@ -3,6 +3,7 @@ package kernel
 import (
 	"sync"
 
+	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/mixin/storage"
 )
 
@@ -19,8 +20,82 @@ func (c *TopologicalSequence) Next() uint64 {
 	return next
 }
 
+// the orders are taken only when the write succeeds, and no other order is taken in the
+// write, so a failed or refused write, e.g. an invalid import or a snapshot write of an
+// order already taken, never leaves a gap in the orders
+func (c *TopologicalSequence) assign(snapshots []*common.SnapshotWithTopologicalOrder, write func() error) error {
+	c.Lock()
+	defer c.Unlock()
+	for i, s := range snapshots {
+		s.TopologicalOrder = c.seq + uint64(i)
+	}
+	err := write()
+	if err != nil {
+		return err
+	}
+	c.seq = c.seq + uint64(len(snapshots))
+	return nil
+}
+
 func getTopologyCounter(store storage.Store) *TopologicalSequence {
 	return &TopologicalSequence{
 		seq: store.SnapshotsTopologySequence(),
 	}
 }
+
+// ReindexTopology rebuilds the local topological order from all stored round snapshots,
+// ordered by timestamp and then payload hash. The snapshots are staged in the store round
+// by round, and the store switches to the new index only when it's all written. It should
+// only run when the node is not processing any snapshots, and returns the number of
+// snapshots with a changed order.
+func (node *Node) ReindexTopology() (int, error) {
+	nodes, err := node.store.SnapshotsReadNodesList()
+	if err != nil {
+		return 0, err
+	}
+
+	err = node.store.SnapshotsBeginTopologyReindex()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range nodes {
+		meta, err := node.store.SnapshotsReadRoundMeta(id)
+		if err != nil {
+			return 0, err
+		}
+		for round := uint64(0); round <= meta[0]; round++ {
+			ss, err := node.store.SnapshotsReadSnapshotsForNodeRound(id, round)
+			if err != nil {
+				return 0, err
+			}
+			err = node.store.SnapshotsStageTopologyReindex(ss)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	rewritten, err := node.store.SnapshotsFinishTopologyReindex()
+	if err != nil {
+		return 0, err
+	}
+	node.TopoCounter = getTopologyCounter(node.store)
+	return rewritten, nil
+}
+
+// a reindex interrupted by a crash leaves the old index in use, or the new one with some
+// snapshots meta orders not updated yet, so it's done again at startup before any new
+// snapshot takes a topological order
+func (node *Node) resumeTopologyReindex() error {
+	reindexing, err := node.store.SnapshotsTopologyReindexing()
+	if err != nil || !reindexing {
+		return err
+	}
+	node.Logger.Warn("TOPOLOGY REINDEX RESUME")
+	rewritten, err := node.ReindexTopology()
+	if err != nil {
+		return err
+	}
+	node.Logger.Info("TOPOLOGY REINDEX DONE", rewritten)
+	return nil
+}
@@ -0,0 +1,118 @@
+package kernel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopologicalSequenceAssign(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStore()
+	counter := &TopologicalSequence{seq: 5}
+	taken := &common.SnapshotWithTopologicalOrder{Snapshot: common.Snapshot{NodeId: crypto.NewHash([]byte("taken")), Transaction: &common.SignedTransaction{}}}
+	taken.Transaction.Extra = []byte("taken")
+	taken.TopologicalOrder = 5
+	assert.Nil(store.SnapshotsWriteSnapshot(taken))
+
+	// the refused write of an order already taken never advances the counter
+	s := &common.SnapshotWithTopologicalOrder{Snapshot: common.Snapshot{NodeId: crypto.NewHash([]byte("node")), Transaction: &common.SignedTransaction{}}}
+	err := counter.assign([]*common.SnapshotWithTopologicalOrder{s}, func() error {
+		return store.SnapshotsWriteSnapshot(s)
+	})
+	assert.NotNil(err)
+	assert.Equal(uint64(5), counter.seq)
+
+	counter.seq = 6
+	err = counter.assign([]*common.SnapshotWithTopologicalOrder{s}, func() error {
+		return store.SnapshotsWriteSnapshot(s)
+	})
+	assert.Nil(err)
+	assert.Equal(uint64(6), s.TopologicalOrder)
+	assert.Equal(uint64(7), counter.seq)
+}
+
+func TestReindexTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-kernel-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := storage.NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+
+	scrambled := []uint64{11, 3, 7, 0, 42, 9}
+	snapshots := make([]*common.SnapshotWithTopologicalOrder, 0)
+	for i, topo := range scrambled {
+		nodeId := crypto.NewHash([]byte(fmt.Sprintf("node%d", i%3)))
+		tx := common.NewTransaction(common.XINAssetId)
+		tx.Inputs = append(tx.Inputs, &common.Input{Genesis: nodeId[:]})
+		tx.Extra = []byte{byte(i)}
+		snapshots = append(snapshots, &common.SnapshotWithTopologicalOrder{
+			Snapshot: common.Snapshot{
+				NodeId:      nodeId,
+				Transaction: &common.SignedTransaction{Transaction: *tx},
+				Timestamp:   uint64(1000 + i/2),
+			},
+			TopologicalOrder: topo,
+		})
+	}
+	assert.Nil(store.SnapshotsLoadGenesis(snapshots))
+
+	node := &Node{store: store}
+	rewritten, err := node.ReindexTopology()
+	assert.Nil(err)
+	assert.Equal(6, rewritten)
+	assert.Equal(uint64(6), node.TopoCounter.Next())
+
+	topology, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+	assert.Nil(err)
+	assert.Len(topology, 6)
+	for i, s := range topology {
+		assert.Equal(uint64(i), s.TopologicalOrder)
+		o, err := store.SnapshotsReadSnapshotByTransactionHash(s.Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.Equal(uint64(i), o.TopologicalOrder)
+		if i == 0 {
+			continue
+		}
+		p := topology[i-1]
+		assert.True(p.Timestamp < s.Timestamp || p.Timestamp == s.Timestamp && bytes.Compare(p.Hash[:], s.Hash[:]) < 0)
+	}
+
+	rewritten, err = node.ReindexTopology()
+	assert.Nil(err)
+	assert.Equal(0, rewritten)
+
+	// an unfinished reindex is done again at startup, with the old index in use until done
+	assert.Nil(store.SnapshotsBeginTopologyReindex())
+	assert.Nil(store.SnapshotsStageTopologyReindex([]*common.Snapshot{&topology[0].Snapshot}))
+	reindexing, err := store.SnapshotsTopologyReindexing()
+	assert.Nil(err)
+	assert.True(reindexing)
+	unfinished, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+	assert.Nil(err)
+	assert.Len(unfinished, 6)
+	assert.Nil(node.resumeTopologyReindex())
+	reindexed, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+	assert.Nil(err)
+	assert.Len(reindexed, 6)
+	for i, s := range reindexed {
+		assert.Equal(uint64(i), s.TopologicalOrder)
+		assert.Equal(topology[i].PayloadHash(), s.PayloadHash())
+	}
+	reindexing, err = store.SnapshotsTopologyReindexing()
+	assert.Nil(err)
+	assert.False(reindexing)
+	assert.Nil(node.resumeTopologyReindex())
+}
@@ -0,0 +1,57 @@
+package kernel
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// the snapshot may reference a final round of a consensus node not synced yet,
+// it's kept until the node has any final round, at most a round cache limit per node
+func (node *Node) deferUnknownReference(nodeId crypto.Hash, s *common.Snapshot) {
+	deferred := node.unknownRefs[nodeId]
+	if len(deferred) >= config.CacheRoundSnapshotsLimit {
+		node.Logger.Warn("UNKNOWN REFERENCE DROPPED", nodeId, s.PayloadHash())
+		return
+	}
+	node.unknownRefs[nodeId] = append(deferred, s)
+}
+
+// the referenced final round may arrive later, the snapshot is handled again in a round gap,
+// at most the retries limit times before dropped
+func (node *Node) retryMissingReference(s *common.Snapshot, err error) {
+	hash := s.PayloadHash()
+	if node.refRetries == nil {
+		node.refRetries = make(map[crypto.Hash]int)
+	}
+	retries := node.refRetries[hash]
+	if retries >= config.SnapshotReferenceRetries {
+		delete(node.refRetries, hash)
+		node.Logger.Warn("MISSING REFERENCE DROPPED", err)
+		node.Metrics.Inc(MetricValidationFailure, s.NodeId == node.IdForNetwork)
+		return
+	}
+	node.refRetries[hash] = retries + 1
+	node.Logger.Warn("MISSING REFERENCE DEFERRED", retries+1, err)
+	time.AfterFunc(time.Duration(node.roundGap), func() {
+		node.queueSnapshot(s)
+	})
+}
+
+// feed the deferred snapshots back to the mempool once the referenced node rounds arrive,
+// they are sent in another goroutine because the mempool consumer is the caller
+func (node *Node) resumeUnknownReferences() {
+	for id, deferred := range node.unknownRefs {
+		if node.Graph.FinalRound[id] == nil {
+			continue
+		}
+		delete(node.unknownRefs, id)
+		go func(snapshots []*common.Snapshot) {
+			for _, s := range snapshots {
+				node.queueSnapshot(s)
+			}
+		}(deferred)
+	}
+}
@@ -0,0 +1,101 @@
+package kernel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+type unknownTestStore struct {
+	linkTestStore
+	rounds map[crypto.Hash][]*common.Snapshot
+}
+
+func (s *unknownTestStore) SnapshotsReadRoundMeta(nodeIdWithNetwork crypto.Hash) ([2]uint64, error) {
+	return [2]uint64{2, 0}, nil
+}
+
+func (s *unknownTestStore) SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error) {
+	if round != 1 {
+		return nil, nil
+	}
+	return s.rounds[nodeIdWithNetwork], nil
+}
+
+func TestVerifyReferencesUnknownNode(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	store := &unknownTestStore{linkTestStore: linkTestStore{links: make(map[crypto.Hash]uint64)}, rounds: make(map[crypto.Hash][]*common.Snapshot)}
+	node.store = store
+	self := *node.Graph.FinalRound[node.IdForNetwork]
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: 200}
+	s.References = [2]crypto.Hash{self.Hash, crypto.NewHash([]byte("unknown"))}
+
+	r, err := node.verifyReferences(self, s)
+	assert.NotNil(err)
+	assert.True(r.Handled)
+	_, ok := err.(*UnknownReferencedNodeError)
+	assert.False(ok)
+
+	// a forged reference is never deferred for an unsynced node
+	peer := accounts[2].Hash().ForNetwork(node.networkId)
+	final := node.Graph.FinalRound[peer]
+	delete(node.Graph.FinalRound, peer)
+	r, err = node.verifyReferences(self, s)
+	assert.True(r.Handled)
+	assert.IsType(&ReferenceMissingError{}, err)
+
+	round := &common.Snapshot{NodeId: peer, RoundNumber: 1, Transaction: &common.SignedTransaction{}, Timestamp: 100}
+	store.rounds[peer] = []*common.Snapshot{round}
+	s.References[1] = roundHash(peer, 1, store.rounds[peer])
+	r, err = node.verifyReferences(self, s)
+	assert.True(r.Handled)
+	unknown, ok := err.(*UnknownReferencedNodeError)
+	assert.True(ok)
+	assert.Equal(peer, unknown.NodeId)
+	assert.Equal(s.References[1], unknown.Reference)
+
+	node.ConsensusNodes[2].State = common.NodeStatePledging
+	_, err = node.verifyReferences(self, s)
+	_, ok = err.(*UnknownReferencedNodeError)
+	assert.False(ok)
+
+	node.ConsensusNodes[2].State = common.NodeStateAccepted
+	node.Graph.FinalRound[peer] = final
+	_, err = node.verifyReferences(self, s)
+	_, ok = err.(*UnknownReferencedNodeError)
+	assert.False(ok)
+}
+
+func TestResumeUnknownReferences(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	node.Graph = testRoundGraph(node)
+	node.mempoolChan = make(chan *common.Snapshot, 4)
+	node.unknownRefs = make(map[crypto.Hash][]*common.Snapshot)
+
+	peer := accounts[2].Hash().ForNetwork(node.networkId)
+	final := node.Graph.FinalRound[peer]
+	delete(node.Graph.FinalRound, peer)
+	s := &common.Snapshot{NodeId: node.IdForNetwork, Transaction: &common.SignedTransaction{}, Timestamp: 200}
+	node.deferUnknownReference(peer, s)
+
+	node.resumeUnknownReferences()
+	assert.Len(node.unknownRefs[peer], 1)
+
+	node.Graph.FinalRound[peer] = final
+	node.resumeUnknownReferences()
+	assert.Len(node.unknownRefs, 0)
+	select {
+	case r := <-node.mempoolChan:
+		assert.Equal(s, r)
+	case <-time.After(time.Second):
+		t.Fatal("deferred snapshot not resumed")
+	}
+}
@@ -0,0 +1,31 @@
+package kernel
+
+import (
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+)
+
+// ValidateTransaction runs the same transaction checks as a snapshot handling,
+// but the inputs are only checked against the existing locks and never locked,
+// nothing is written or sent, so it returns the same errors a submission will get
+func (node *Node) ValidateTransaction(tx *common.SignedTransaction) error {
+	err := tx.Validate(node.store)
+	if err != nil {
+		return err
+	}
+	s := &common.Snapshot{Transaction: tx}
+	return s.LockInputs(&dryRunLocker{store: node.store})
+}
+
+type dryRunLocker struct {
+	store storage.Store
+}
+
+func (l *dryRunLocker) SnapshotsLockUTXO(hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error) {
+	return nil, l.store.SnapshotsCheckUTXOLock(hash, index, tx)
+}
+
+func (l *dryRunLocker) SnapshotsLockDepositInput(deposit *common.DepositData, tx crypto.Hash) error {
+	return l.store.SnapshotsCheckDepositInput(deposit, tx)
+}
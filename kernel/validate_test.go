@@ -0,0 +1,117 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type validateTestStore struct {
+	storage.Store
+	seed     []byte
+	accounts []common.Address
+	locks    map[int]crypto.Hash
+	locked   int
+	rejected []*common.RejectedSnapshot
+}
+
+// the memory store serves all the store methods not overridden
+func newValidateTestStore(seed crypto.Hash, accounts []common.Address) *validateTestStore {
+	return &validateTestStore{
+		Store:    storage.NewMemoryStore(),
+		seed:     append(seed[:], seed[:]...),
+		accounts: accounts,
+		locks:    make(map[int]crypto.Hash),
+	}
+}
+
+func (s *validateTestStore) SnapshotsReadUTXO(hash crypto.Hash, index int) (*common.UTXO, error) {
+	mask := crypto.NewKeyFromSeed(s.seed)
+	utxo := &common.UTXO{
+		Input: common.Input{Hash: hash, Index: index},
+		Output: common.Output{
+			Type:   common.OutputTypeScript,
+			Amount: common.NewInteger(10000),
+			Script: common.Script{common.OperatorCmp, common.OperatorSum, 1},
+			Mask:   mask.Public(),
+		},
+		Asset: common.XINAssetId,
+	}
+	key := crypto.DeriveGhostPublicKey(&mask, &s.accounts[0].PublicViewKey, &s.accounts[0].PublicSpendKey, uint64(index))
+	utxo.Keys = append(utxo.Keys, *key)
+	return utxo, nil
+}
+
+func (s *validateTestStore) SnapshotsCheckUTXOLock(hash crypto.Hash, index int, tx crypto.Hash) error {
+	if lock, found := s.locks[index]; found && lock != tx {
+		return &utxoLockTestError{lock}
+	}
+	return nil
+}
+
+func (s *validateTestStore) SnapshotsLockUTXO(hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error) {
+	s.locked++
+	return nil, nil
+}
+
+func (s *validateTestStore) SnapshotsCheckGhost(key crypto.Key) (bool, error) {
+	return false, nil
+}
+
+func (s *validateTestStore) SnapshotsReadConsensusNodes() []common.Node {
+	return nil
+}
+
+func (s *validateTestStore) SnapshotsReadDomains() []common.Domain {
+	return nil
+}
+
+func (s *validateTestStore) SnapshotsWriteRejected(r *common.RejectedSnapshot) error {
+	s.rejected = append(s.rejected, r)
+	return nil
+}
+
+type utxoLockTestError struct {
+	lock crypto.Hash
+}
+
+func (e *utxoLockTestError) Error() string {
+	return "utxo locked for transaction " + e.lock.String()
+}
+
+func TestValidateTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	node, accounts := testConsensusNode(7)
+	seed := crypto.NewHash([]byte("mask"))
+	store := newValidateTestStore(seed, accounts)
+	node.store = store
+
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.AddInput(crypto.NewHash([]byte("genesis")), 0)
+	tx.AddInput(crypto.NewHash([]byte("genesis")), 1)
+	tx.AddScriptOutput(accounts[1:2], common.Script{common.OperatorCmp, common.OperatorSum, 1}, common.NewInteger(20000))
+	signed := &common.SignedTransaction{Transaction: *tx}
+	for i := range signed.Inputs {
+		assert.Nil(signed.SignInput(store, i, accounts[:1]))
+	}
+
+	assert.Nil(node.ValidateTransaction(signed))
+	assert.Nil(node.ValidateTransaction(signed))
+
+	other := crypto.NewHash([]byte("other"))
+	store.locks[1] = other
+	err := node.ValidateTransaction(signed)
+	assert.Equal(&utxoLockTestError{other}, err)
+	assert.Equal(0, store.locked)
+
+	store.locks[1] = signed.PayloadHash()
+	assert.Nil(node.ValidateTransaction(signed))
+
+	signed.Signatures[0][0] = crypto.Signature{}
+	assert.NotNil(node.ValidateTransaction(signed))
+	assert.Equal(0, store.locked)
+}
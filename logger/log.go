@@ -1,6 +1,19 @@
 package logger
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	DEBUG = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
 
 func Println(v ...interface{}) {
 	log.Println(v...)
@@ -9,3 +22,53 @@ func Println(v ...interface{}) {
 func Printf(format string, v ...interface{}) {
 	log.Printf(format, v...)
 }
+
+// Logger drops the messages below its level before formatting them, a nil Logger logs everything
+type Logger struct {
+	level int
+}
+
+func New(level int) *Logger {
+	return &Logger{level: level}
+}
+
+func ParseLevel(name string) (int, error) {
+	for i, n := range levelNames {
+		if strings.ToLower(name) == n {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %s", name)
+}
+
+func (l *Logger) Enabled(level int) bool {
+	return l == nil || level >= l.level
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.println(DEBUG, v...)
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.println(INFO, v...)
+}
+
+func (l *Logger) Warn(v ...interface{}) {
+	l.println(WARN, v...)
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.println(ERROR, v...)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	if l.Enabled(INFO) {
+		log.Printf(format, v...)
+	}
+}
+
+func (l *Logger) println(level int, v ...interface{}) {
+	if l.Enabled(level) {
+		log.Println(v...)
+	}
+}
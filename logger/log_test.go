@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingStringer struct {
+	count int
+}
+
+func (s *countingStringer) String() string {
+	s.count++
+	return "snapshot"
+}
+
+func TestLoggerLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	l := New(WARN)
+	assert.False(l.Enabled(DEBUG))
+	assert.False(l.Enabled(INFO))
+	assert.True(l.Enabled(WARN))
+	assert.True(l.Enabled(ERROR))
+
+	s := &countingStringer{}
+	l.Debug("VERIFY SNAPSHOT", s)
+	l.Info("INFO", s)
+	l.Infof("%s\n", s)
+	assert.Equal(0, s.count)
+	assert.Equal(0, buf.Len())
+
+	l.Warn("WARN", s)
+	l.Error("ERROR", s)
+	assert.Equal(2, s.count)
+	assert.Contains(buf.String(), "WARN snapshot")
+	assert.Contains(buf.String(), "ERROR snapshot")
+
+	var nl *Logger
+	assert.True(nl.Enabled(DEBUG))
+	nl.Debug("DEBUG", s)
+	assert.Equal(3, s.count)
+}
+
+func TestParseLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	level, err := ParseLevel("debug")
+	assert.Nil(err)
+	assert.Equal(DEBUG, level)
+	level, err = ParseLevel("WARN")
+	assert.Nil(err)
+	assert.Equal(WARN, level)
+	_, err = ParseLevel("verbose")
+	assert.NotNil(err)
+}
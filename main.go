@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/kernel"
+	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/mixin/rpc"
 	"github.com/MixinNetwork/mixin/storage"
 	"gopkg.in/urfave/cli.v1"
@@ -31,6 +33,20 @@ func main() {
 					Value: 7239,
 					Usage: "the peer port to listen",
 				},
+				cli.StringFlag{
+					Name:  "log,l",
+					Value: "info",
+					Usage: "the log level, debug, info, warn or error",
+				},
+				cli.StringFlag{
+					Name:  "durability",
+					Value: "async",
+					Usage: "the snapshots durability, sync, async or batched",
+				},
+				cli.StringFlag{
+					Name:  "trace",
+					Usage: "the file to record the inbound snapshots for replay",
+				},
 			},
 		},
 		{
@@ -152,7 +168,17 @@ func main() {
 }
 
 func kernelCmd(c *cli.Context) error {
-	store, err := storage.NewBadgerStore(c.String("dir"))
+	level, err := logger.ParseLevel(c.String("log"))
+	if err != nil {
+		return err
+	}
+
+	config.SnapshotTraceFile = c.String("trace")
+	durability, err := storage.ParseDurability(c.String("durability"))
+	if err != nil {
+		return err
+	}
+	store, err := storage.NewBadgerStoreWithDurability(c.String("dir"), durability)
 	if err != nil {
 		return err
 	}
@@ -165,5 +191,5 @@ func kernelCmd(c *cli.Context) error {
 		}
 	}()
 
-	return kernel.Loop(store, fmt.Sprintf(":%d", c.Int("port")), c.String("dir"))
+	return kernel.Loop(store, fmt.Sprintf(":%d", c.Int("port")), c.String("dir"), level)
 }
@@ -0,0 +1,213 @@
+package network
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+)
+
+// A snapshot is sent in full the first time, and the receiver advertises the payload hash back
+// with a have message after caching it. Later the same snapshot is sent as a delta, the payload
+// hash and only the signatures not sent yet, and the receiver rebuilds the full snapshot from its
+// cache. Both sides evict old hashes independently, a delta of an evicted hash is answered with a
+// miss message, the sender forgets the hash then and falls back to the full snapshot next time.
+
+var errInvalidDeltaMessage = errors.New("invalid snapshot delta message")
+
+// the payload hashes a neighbor holds, with the signatures it's known to have of each
+type snapshotHolds struct {
+	sync.Mutex
+	limit int
+	order *list.List
+	sigs  map[crypto.Hash]map[crypto.Signature]bool
+}
+
+func newSnapshotHolds(limit int) *snapshotHolds {
+	return &snapshotHolds{
+		limit: limit,
+		order: list.New(),
+		sigs:  make(map[crypto.Hash]map[crypto.Signature]bool),
+	}
+}
+
+func (h *snapshotHolds) add(hashes []crypto.Hash) {
+	h.Lock()
+	defer h.Unlock()
+	for _, hash := range hashes {
+		if h.sigs[hash] != nil {
+			continue
+		}
+		h.sigs[hash] = make(map[crypto.Signature]bool)
+		h.order.PushBack(hash)
+	}
+	for h.order.Len() > h.limit {
+		delete(h.sigs, h.order.Remove(h.order.Front()).(crypto.Hash))
+	}
+}
+
+// the order list is not updated, the evicted hash isn't in the map already
+func (h *snapshotHolds) remove(hashes []crypto.Hash) {
+	h.Lock()
+	defer h.Unlock()
+	for _, hash := range hashes {
+		delete(h.sigs, hash)
+	}
+}
+
+// the signatures in the delta are not known by the neighbor until the message is sent,
+// they are marked after that, and any failed send includes them again the next time
+func (h *snapshotHolds) message(s *common.Snapshot, full []byte) ([]byte, []crypto.Signature) {
+	if s.Aggregated != nil {
+		return full, nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	hash := s.PayloadHash()
+	known := h.sigs[hash]
+	if known == nil {
+		return full, nil
+	}
+	sigs := make([]crypto.Signature, 0)
+	for _, sig := range s.Signatures {
+		if !known[sig] {
+			sigs = append(sigs, sig)
+		}
+	}
+	return buildSnapshotDeltaMessage(hash, sigs), sigs
+}
+
+func (h *snapshotHolds) mark(hash crypto.Hash, sigs []crypto.Signature) {
+	h.Lock()
+	defer h.Unlock()
+	known := h.sigs[hash]
+	if known == nil {
+		return
+	}
+	for _, sig := range sigs {
+		known[sig] = true
+	}
+}
+
+// the snapshots received in full from each neighbor, merged with the later deltas of the
+// same neighbor only, so the junk signatures of one neighbor never reach the snapshots
+// rebuilt for the others, and the signatures merged are capped at the consensus nodes
+type snapshotCache struct {
+	sync.Mutex
+	limit     int
+	order     *list.List
+	snapshots map[snapshotCacheKey]*common.Snapshot
+}
+
+type snapshotCacheKey struct {
+	peer crypto.Hash
+	hash crypto.Hash
+}
+
+func newSnapshotCache(limit int) *snapshotCache {
+	return &snapshotCache{
+		limit:     limit,
+		order:     list.New(),
+		snapshots: make(map[snapshotCacheKey]*common.Snapshot),
+	}
+}
+
+func (c *snapshotCache) put(peer crypto.Hash, s *common.Snapshot, max int) crypto.Hash {
+	c.Lock()
+	defer c.Unlock()
+	key := snapshotCacheKey{peer: peer, hash: s.PayloadHash()}
+	if cached := c.snapshots[key]; cached != nil {
+		mergeSignatures(cached, s.Signatures, max)
+		return key.hash
+	}
+	cached := *s
+	cached.Signatures = nil
+	cached.Aggregated, cached.Signers = nil, nil
+	mergeSignatures(&cached, s.Signatures, max)
+	c.snapshots[key] = &cached
+	c.order.PushBack(key)
+	for c.order.Len() > c.limit {
+		delete(c.snapshots, c.order.Remove(c.order.Front()).(snapshotCacheKey))
+	}
+	return key.hash
+}
+
+// a copy of the snapshot cached for the neighbor with all signatures it ever sent, nil when not cached
+func (c *snapshotCache) apply(peer crypto.Hash, hash crypto.Hash, sigs []crypto.Signature, max int) *common.Snapshot {
+	c.Lock()
+	defer c.Unlock()
+	cached := c.snapshots[snapshotCacheKey{peer: peer, hash: hash}]
+	if cached == nil {
+		return nil
+	}
+	mergeSignatures(cached, sigs, max)
+	s := *cached
+	s.Signatures = append([]crypto.Signature{}, cached.Signatures...)
+	return &s
+}
+
+func mergeSignatures(s *common.Snapshot, sigs []crypto.Signature, max int) {
+	filter := make(map[crypto.Signature]bool)
+	for _, sig := range s.Signatures {
+		filter[sig] = true
+	}
+	for _, sig := range sigs {
+		if len(s.Signatures) >= max {
+			return
+		}
+		if !filter[sig] {
+			s.Signatures = append(s.Signatures, sig)
+			filter[sig] = true
+		}
+	}
+}
+
+func buildSnapshotDeltaMessage(hash crypto.Hash, sigs []crypto.Signature) []byte {
+	data := make([]byte, 0, 1+len(hash)+len(sigs)*len(crypto.Signature{}))
+	data = append(data, PeerMessageTypeSnapshotDelta)
+	data = append(data, hash[:]...)
+	for _, sig := range sigs {
+		data = append(data, sig[:]...)
+	}
+	return data
+}
+
+func buildSnapshotHashesMessage(typ uint8, hashes []crypto.Hash) []byte {
+	data := make([]byte, 0, 1+len(hashes)*len(crypto.Hash{}))
+	data = append(data, typ)
+	for _, hash := range hashes {
+		data = append(data, hash[:]...)
+	}
+	return data
+}
+
+func parseSnapshotDelta(msg *PeerMessage, data []byte) error {
+	var hash crypto.Hash
+	var sig crypto.Signature
+	if len(data) < len(hash) || (len(data)-len(hash))%len(sig) != 0 {
+		return errInvalidDeltaMessage
+	}
+	copy(hash[:], data)
+	msg.Hashes = []crypto.Hash{hash}
+	msg.Signatures = make([]crypto.Signature, 0)
+	for data = data[len(hash):]; len(data) > 0; data = data[len(sig):] {
+		copy(sig[:], data)
+		msg.Signatures = append(msg.Signatures, sig)
+	}
+	return nil
+}
+
+func parseSnapshotHashes(msg *PeerMessage, data []byte) error {
+	var hash crypto.Hash
+	if len(data) == 0 || len(data)%len(hash) != 0 {
+		return errInvalidDeltaMessage
+	}
+	msg.Hashes = make([]crypto.Hash, 0)
+	for ; len(data) > 0; data = data[len(hash):] {
+		copy(hash[:], data)
+		msg.Hashes = append(msg.Hashes, hash)
+	}
+	return nil
+}
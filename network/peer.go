@@ -3,6 +3,7 @@ package network
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/MixinNetwork/mixin/common"
@@ -18,6 +19,11 @@ const (
 	PeerMessageTypePong           = 2
 	PeerMessageTypeAuthentication = 3
 	PeerMessageTypeGraph          = 4
+	PeerMessageTypeSnapshotDelta  = 5
+	PeerMessageTypeSnapshotHave   = 6
+	PeerMessageTypeSnapshotMiss   = 7
+
+	SendBatchParallelism = 16
 )
 
 type PeerMessage struct {
@@ -25,6 +31,8 @@ type PeerMessage struct {
 	Snapshot   *common.Snapshot
 	FinalCache []SyncPoint
 	Data       []byte
+	Hashes     []crypto.Hash
+	Signatures []crypto.Signature
 }
 
 type SyncHandle interface {
@@ -35,6 +43,7 @@ type SyncHandle interface {
 	ReadSnapshotsSinceTopology(offset, count uint64) ([]*common.SnapshotWithTopologicalOrder, error)
 	ReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error)
 	ReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error)
+	ConsensusInfo() (total int, accepted int, threshold int)
 }
 
 type SyncPoint struct {
@@ -52,6 +61,8 @@ type Peer struct {
 	transport Transport
 	send      chan []byte
 	sync      chan []SyncPoint
+	holds     *snapshotHolds
+	snapshots *snapshotCache
 }
 
 func (me *Peer) AddNeighbor(idForNetwork crypto.Hash, addr string) {
@@ -73,16 +84,52 @@ func NewPeer(handle SyncHandle, idForNetwork crypto.Hash, addr string) *Peer {
 		send:         make(chan []byte, 8192),
 		sync:         make(chan []SyncPoint),
 		handle:       handle,
+		holds:        newSnapshotHolds(config.GossipSnapshotCacheSize),
+		snapshots:    newSnapshotCache(config.GossipSnapshotCacheSize),
 	}
 }
 
 func (me *Peer) SendSnapshotMessage(idForNetwork crypto.Hash, s *common.Snapshot) error {
+	return me.sendSnapshotData(idForNetwork, s, buildSnapshotMessage(s))
+}
+
+func (me *Peer) SendSnapshotMessageBatch(peerIds []crypto.Hash, s *common.Snapshot) map[crypto.Hash]error {
+	full := buildSnapshotMessage(s)
+	errs := make(map[crypto.Hash]error)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, SendBatchParallelism)
+	for _, id := range peerIds {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(id crypto.Hash) {
+			defer wg.Done()
+			err := me.sendSnapshotData(id, s, full)
+			<-limit
+
+			mutex.Lock()
+			errs[id] = err
+			mutex.Unlock()
+		}(id)
+	}
+	wg.Wait()
+	return errs
+}
+
+// the full message is sent unless the neighbor holds the snapshot already
+func (me *Peer) sendSnapshotData(idForNetwork crypto.Hash, s *common.Snapshot, full []byte) error {
 	if idForNetwork == me.IdForNetwork {
 		return nil
 	}
 	for _, p := range me.neighbors {
 		if p.IdForNetwork == idForNetwork {
-			return p.SendData(buildSnapshotMessage(s))
+			data, sigs := p.holds.message(s, full)
+			err := p.SendData(data)
+			if err == nil {
+				p.holds.mark(s.PayloadHash(), sigs)
+			}
+			return err
 		}
 	}
 	return nil
@@ -131,6 +178,16 @@ func parseNetworkMessage(data []byte) (*PeerMessage, error) {
 			return nil, err
 		}
 		msg.Snapshot = &ss
+	case PeerMessageTypeSnapshotDelta:
+		err := parseSnapshotDelta(msg, data[1:])
+		if err != nil {
+			return nil, err
+		}
+	case PeerMessageTypeSnapshotHave, PeerMessageTypeSnapshotMiss:
+		err := parseSnapshotHashes(msg, data[1:])
+		if err != nil {
+			return nil, err
+		}
 	case PeerMessageTypeGraph:
 		err := msgpack.Unmarshal(data[1:], &msg.FinalCache)
 		if err != nil {
@@ -203,10 +260,11 @@ func (me *Peer) openPeerStream(peer *Peer) error {
 			if err != nil {
 				return err
 			}
-			_, err = parseNetworkMessage(data)
+			msg, err := parseNetworkMessage(data)
 			if err != nil {
 				return err
 			}
+			peer.handleSnapshotHolds(msg)
 		}
 	}()
 
@@ -263,13 +321,47 @@ func (me *Peer) acceptNeighborConnection(client Client) error {
 				return err
 			}
 		case PeerMessageTypeSnapshot:
+			hash := me.snapshots.put(peer.IdForNetwork, msg.Snapshot, me.snapshotSignaturesLimit())
+			err = client.Send(buildSnapshotHashesMessage(PeerMessageTypeSnapshotHave, []crypto.Hash{hash}))
+			if err != nil {
+				return err
+			}
 			me.handle.FeedMempool(peer, msg.Snapshot)
+		case PeerMessageTypeSnapshotDelta:
+			s := me.snapshots.apply(peer.IdForNetwork, msg.Hashes[0], msg.Signatures, me.snapshotSignaturesLimit())
+			if s == nil {
+				err = client.Send(buildSnapshotHashesMessage(PeerMessageTypeSnapshotMiss, msg.Hashes))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			me.handle.FeedMempool(peer, s)
 		case PeerMessageTypeGraph:
 			peer.sync <- msg.FinalCache
 		}
 	}
 }
 
+// no snapshot has more valid signatures than the consensus nodes
+func (me *Peer) snapshotSignaturesLimit() int {
+	total, _, _ := me.handle.ConsensusInfo()
+	if total > config.SnapshotSignaturesLimit {
+		return config.SnapshotSignaturesLimit
+	}
+	return total
+}
+
+// the messages from a neighbor about the snapshots it holds, in reply to the sent ones
+func (p *Peer) handleSnapshotHolds(msg *PeerMessage) {
+	switch msg.Type {
+	case PeerMessageTypeSnapshotHave:
+		p.holds.add(msg.Hashes)
+	case PeerMessageTypeSnapshotMiss:
+		p.holds.remove(msg.Hashes)
+	}
+}
+
 func (me *Peer) authenticateNeighbor(client Client) (*Peer, error) {
 	var peer *Peer
 	auth := make(chan error)
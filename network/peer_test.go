@@ -0,0 +1,205 @@
+package network
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendSnapshotMessageBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	me := NewPeer(nil, crypto.NewHash([]byte("me")), "127.0.0.1:7000")
+	ids := []crypto.Hash{me.IdForNetwork}
+	for i := 0; i < 20; i++ {
+		p := NewPeer(nil, crypto.NewHash([]byte{byte(i)}), "")
+		me.neighbors[p.IdForNetwork] = p
+		ids = append(ids, p.IdForNetwork)
+	}
+	blocked := NewPeer(nil, crypto.NewHash([]byte("blocked")), "")
+	blocked.send = make(chan []byte)
+	me.neighbors[blocked.IdForNetwork] = blocked
+	ids = append(ids, blocked.IdForNetwork)
+
+	s := &common.Snapshot{NodeId: me.IdForNetwork, Transaction: &common.SignedTransaction{}}
+	errs := me.SendSnapshotMessageBatch(ids, s)
+	assert.Len(errs, len(ids))
+	for _, id := range ids {
+		if id == blocked.IdForNetwork {
+			assert.NotNil(errs[id])
+			continue
+		}
+		assert.Nil(errs[id])
+		if id == me.IdForNetwork {
+			continue
+		}
+		data := <-me.neighbors[id].send
+		assert.Equal(buildSnapshotMessage(s), data)
+	}
+}
+
+type deltaTestHandle struct {
+	SyncHandle
+	peer crypto.Hash
+	fed  chan *common.Snapshot
+}
+
+func (h *deltaTestHandle) Authenticate(msg []byte) (crypto.Hash, error) {
+	return h.peer, nil
+}
+
+func (h *deltaTestHandle) ConsensusInfo() (int, int, int) {
+	return 8, 8, 5
+}
+
+func (h *deltaTestHandle) FeedMempool(peer *Peer, s *common.Snapshot) error {
+	h.fed <- s
+	return nil
+}
+
+type deltaTestClient struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (c *deltaTestClient) Receive() ([]byte, error) {
+	data, ok := <-c.in
+	if !ok {
+		return nil, errors.New("closed")
+	}
+	return data, nil
+}
+
+func (c *deltaTestClient) Send(data []byte) error {
+	c.out <- data
+	return nil
+}
+
+func (c *deltaTestClient) Close() error {
+	return nil
+}
+
+func TestSnapshotDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	size := config.GossipSnapshotCacheSize
+	config.GossipSnapshotCacheSize = 2
+	defer func() { config.GossipSnapshotCacheSize = size }()
+
+	senderId, receiverId := crypto.NewHash([]byte("sender")), crypto.NewHash([]byte("receiver"))
+	sender, neighbor := NewPeer(nil, senderId, ""), NewPeer(nil, receiverId, "")
+	sender.neighbors[receiverId] = neighbor
+	handle := &deltaTestHandle{peer: senderId, fed: make(chan *common.Snapshot, 1)}
+	receiver := NewPeer(handle, receiverId, "")
+	receiver.neighbors[senderId] = NewPeer(nil, senderId, "")
+	client := &deltaTestClient{in: make(chan []byte), out: make(chan []byte, 1)}
+	defer close(client.in)
+	go receiver.acceptNeighborConnection(client)
+	client.in <- buildAuthenticationMessage([]byte("auth"))
+
+	// delivers the next sent message, and handles the reply if any
+	deliver := func(reply bool) ([]byte, *common.Snapshot) {
+		data := <-neighbor.send
+		client.in <- data
+		if !reply {
+			return data, <-handle.fed
+		}
+		msg, err := parseNetworkMessage(<-client.out)
+		assert.Nil(err)
+		neighbor.handleSnapshotHolds(msg)
+		if msg.Type == PeerMessageTypeSnapshotMiss {
+			return data, nil
+		}
+		return data, <-handle.fed
+	}
+
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.Extra = make([]byte, 1024)
+	s := &common.Snapshot{NodeId: senderId, Transaction: &common.SignedTransaction{Transaction: *tx}, Timestamp: 100}
+	s.Signatures = []crypto.Signature{{1}}
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	full, fed := deliver(true)
+	assert.Equal(buildSnapshotMessage(s), full)
+	assert.Equal(s.PayloadHash(), fed.PayloadHash())
+
+	s.Signatures = append(s.Signatures, crypto.Signature{2}, crypto.Signature{3})
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	delta, fed := deliver(false)
+	assert.Equal(uint8(PeerMessageTypeSnapshotDelta), delta[0])
+	assert.Len(delta, 1+32+3*64)
+	assert.Equal(s.PayloadHash(), fed.PayloadHash())
+	assert.Equal(s.Signatures, fed.Signatures)
+	assert.Equal(s.Transaction.Extra, fed.Transaction.Extra)
+
+	// only the new signatures, and the receiver keeps the previous ones
+	errs := sender.SendSnapshotMessageBatch([]crypto.Hash{receiverId}, &common.Snapshot{
+		NodeId: s.NodeId, Transaction: s.Transaction, Timestamp: s.Timestamp,
+		Signatures: []crypto.Signature{{2}, {4}},
+	})
+	assert.Nil(errs[receiverId])
+	delta, fed = deliver(false)
+	assert.Len(delta, 1+32+64)
+	assert.True(len(delta) < len(full))
+	assert.Equal([]crypto.Signature{{1}, {2}, {3}, {4}}, fed.Signatures)
+
+	// the signatures of a failed send are sent again with the next delta
+	send := neighbor.send
+	neighbor.send = make(chan []byte)
+	s.Signatures = append(s.Signatures, crypto.Signature{4}, crypto.Signature{5})
+	assert.NotNil(sender.SendSnapshotMessage(receiverId, s))
+	neighbor.send = send
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	delta, fed = deliver(false)
+	assert.Len(delta, 1+32+64)
+	assert.Equal([]crypto.Signature{{1}, {2}, {3}, {4}, {5}}, fed.Signatures)
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	delta, _ = deliver(false)
+	assert.Len(delta, 1+32)
+
+	// evicted by the receiver, missed and sent in full again
+	for i := 0; i < 2; i++ {
+		receiver.snapshots.put(senderId, &common.Snapshot{NodeId: senderId, Transaction: s.Transaction, Timestamp: uint64(i)}, 8)
+	}
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	delta, fed = deliver(true)
+	assert.Equal(uint8(PeerMessageTypeSnapshotDelta), delta[0])
+	assert.Nil(fed)
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	full, fed = deliver(true)
+	assert.Equal(buildSnapshotMessage(s), full)
+	assert.Equal(s.Signatures, fed.Signatures)
+
+	s.Aggregated = &common.AggregatedSignature{}
+	assert.Nil(sender.SendSnapshotMessage(receiverId, s))
+	assert.Equal(buildSnapshotMessage(s), <-neighbor.send)
+
+	_, err := parseNetworkMessage(append(buildSnapshotDeltaMessage(s.PayloadHash(), nil), 1))
+	assert.NotNil(err)
+	_, err = parseNetworkMessage([]byte{PeerMessageTypeSnapshotHave})
+	assert.NotNil(err)
+}
+
+func TestSnapshotCacheNeighbors(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := crypto.NewHash([]byte("a")), crypto.NewHash([]byte("b"))
+	tx := common.NewTransaction(common.XINAssetId)
+	s := &common.Snapshot{NodeId: a, Transaction: &common.SignedTransaction{Transaction: *tx}, Timestamp: 100}
+	s.Signatures = []crypto.Signature{{1}}
+	cache := newSnapshotCache(4)
+	hash := cache.put(a, s, 3)
+
+	// the delta of another neighbor never rebuilds the snapshot
+	assert.Nil(cache.apply(b, hash, []crypto.Signature{{2}}, 3))
+
+	// the junk signatures of a neighbor are capped, and never reach the others
+	r := cache.apply(a, hash, []crypto.Signature{{2}, {3}, {4}, {5}}, 3)
+	assert.Equal([]crypto.Signature{{1}, {2}, {3}}, r.Signatures)
+	cache.put(b, s, 3)
+	r = cache.apply(b, hash, []crypto.Signature{{6}}, 3)
+	assert.Equal([]crypto.Signature{{1}, {6}}, r.Signatures)
+}
@@ -31,7 +31,7 @@ func (me *Peer) compareRoundGraphAndGetTopologicalOffset(local, remote []SyncPoi
 		if len(ss) == 0 {
 			continue
 		}
-		s, err := me.handle.ReadSnapshotByTransactionHash(ss[len(ss)-1].Transaction.PayloadHash())
+		s, err := me.handle.ReadSnapshotByTransactionHash(ss[len(ss)-1].TransactionHash())
 		if err != nil {
 			return offset, err
 		}
@@ -52,7 +52,7 @@ func (me *Peer) syncToNeighborSince(p *Peer, offset uint64, filter map[crypto.Ha
 		return offset, err
 	}
 	for _, s := range snapshots {
-		hash := s.Transaction.PayloadHash()
+		hash := s.TransactionHash()
 		if filter[hash].Add(time.Duration(config.SnapshotRoundGap)).After(time.Now()) {
 			continue
 		}
@@ -39,6 +39,7 @@ func getInfo(store storage.Store) (map[string]interface{}, error) {
 		"network":   kernel.NetworkId(),
 		"node":      kernel.NodeIdForNetwork(),
 		"consensus": kernel.ConsensusNodes(),
+		"committee": kernel.ConsensusInfo(),
 		"cache":     cacheGraph,
 		"final":     finalGraph,
 		"topology":  kernel.TopologicalOrder(),
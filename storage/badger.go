@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
 	"github.com/dgraph-io/badger"
 )
 
@@ -8,10 +12,21 @@ type BadgerStore struct {
 	snapshotsDB *badger.DB
 	queueDB     *badger.DB
 	stateDB     *badger.DB
+	roundLinks  *roundLinksCache
+	roundGap    uint64
+	roundLimit  int
+	committer   *snapshotsCommitter
 }
 
 func NewBadgerStore(dir string) (*BadgerStore, error) {
-	snapshotsDB, err := openDB(dir+"/snapshots", false)
+	return NewBadgerStoreWithDurability(dir, DurabilityAsync)
+}
+
+func NewBadgerStoreWithDurability(dir string, durability Durability) (*BadgerStore, error) {
+	if durability > DurabilityBatched {
+		return nil, fmt.Errorf("invalid durability %d", durability)
+	}
+	snapshotsDB, err := openDB(dir+"/snapshots", durability != DurabilityAsync)
 	if err != nil {
 		return nil, err
 	}
@@ -23,11 +38,18 @@ func NewBadgerStore(dir string) (*BadgerStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &BadgerStore{
+	store := &BadgerStore{
 		snapshotsDB: snapshotsDB,
 		queueDB:     queueDB,
 		stateDB:     stateDB,
-	}, nil
+		roundLinks:  &roundLinksCache{links: make(map[[2]crypto.Hash]uint64)},
+		roundGap:    config.SnapshotRoundGap,
+		roundLimit:  config.SnapshotRoundLimit,
+	}
+	if durability == DurabilityBatched {
+		store.committer = newSnapshotsCommitter(config.StorageBatchWrites)
+	}
+	return store, nil
 }
 
 func (store *BadgerStore) Close() error {
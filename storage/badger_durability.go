@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/dgraph-io/badger"
+)
+
+// Durability selects when the snapshot writes reach the disk, a write is always applied before
+// SnapshotsWriteSnapshot returns, so it's visible to the following reads in any mode.
+//
+// The snapshots database is rebuilt from its value log on open, and the writes of a snapshot
+// are in one transaction, so a lost value log tail only drops the latest snapshots as a whole,
+// the graph loaded from the store is still consistent and the node resyncs the lost snapshots
+// from its peers. A consensus node may have signed some of the lost snapshots already, so the
+// async mode is only for test networks or nodes which can resync before signing.
+type Durability int
+
+const (
+	// the value log is fsynced by each write, no written snapshot is ever lost
+	DurabilitySync Durability = iota
+	// the writes are left in the os page cache, a process crash loses nothing, but a power
+	// loss or an os crash may lose any snapshots written since the os flushed the cache
+	DurabilityAsync
+	// the value log is fsynced by each commit as sync, but the concurrent snapshot writes, at
+	// most config.StorageBatchWrites, are committed together, no written snapshot is ever lost
+	DurabilityBatched
+)
+
+var durabilityNames = []string{"sync", "async", "batched"}
+
+func ParseDurability(name string) (Durability, error) {
+	for i, n := range durabilityNames {
+		if strings.ToLower(name) == n {
+			return Durability(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid durability %s", name)
+}
+
+func (d Durability) String() string {
+	if int(d) < len(durabilityNames) {
+		return durabilityNames[d]
+	}
+	return fmt.Sprintf("durability(%d)", int(d))
+}
+
+// the batched writes are committed by one writer, the first writer commits its snapshot at once,
+// and all the writes queued while it commits are committed together in its next transaction, so
+// the concurrent writers share one fsync, and each write still returns only after committed
+type snapshotsCommitter struct {
+	sync.Mutex
+	limit   int
+	queue   []*snapshotWrite
+	running bool
+}
+
+type snapshotWrite struct {
+	snapshot *common.SnapshotWithTopologicalOrder
+	done     chan error
+}
+
+func newSnapshotsCommitter(limit int) *snapshotsCommitter {
+	return &snapshotsCommitter{limit: limit}
+}
+
+func (s *BadgerStore) commitSnapshot(snapshot *common.SnapshotWithTopologicalOrder) error {
+	c := s.committer
+	w := &snapshotWrite{snapshot: snapshot, done: make(chan error, 1)}
+	c.Lock()
+	c.queue = append(c.queue, w)
+	if c.running {
+		c.Unlock()
+		return <-w.done
+	}
+	c.running = true
+	c.Unlock()
+
+	for {
+		batch := c.next()
+		if len(batch) == 0 {
+			break
+		}
+		s.commitSnapshots(batch)
+	}
+	return <-w.done
+}
+
+// the queued writes of a batch, the round checks of a snapshot iterate the stored snapshots of
+// its node, which never include the pending writes of the transaction, so a batch has at most
+// one snapshot of each node, and the running flag is reset when the queue is empty
+func (c *snapshotsCommitter) next() []*snapshotWrite {
+	c.Lock()
+	defer c.Unlock()
+	batch := make([]*snapshotWrite, 0)
+	nodes := make(map[crypto.Hash]bool)
+	for _, w := range c.queue {
+		if len(batch) == c.limit || nodes[w.snapshot.NodeId] {
+			break
+		}
+		nodes[w.snapshot.NodeId] = true
+		batch = append(batch, w)
+	}
+	c.queue = c.queue[len(batch):]
+	if len(batch) == 0 {
+		c.running = false
+	}
+	return batch
+}
+
+// a failed batch is committed again one snapshot by one, so each write gets its own error
+func (s *BadgerStore) commitSnapshots(batch []*snapshotWrite) {
+	err := s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		for _, w := range batch {
+			err := writeSnapshot(txn, w.snapshot, s.roundGap, s.roundLimit, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && len(batch) > 1 {
+		for _, w := range batch {
+			s.commitSnapshots([]*snapshotWrite{w})
+		}
+		return
+	}
+	for _, w := range batch {
+		if err == nil {
+			s.updateRoundLinks(w.snapshot)
+		}
+		w.done <- err
+	}
+}
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/dgraph-io/badger"
+)
+
+const snapshotsPrefixEquivocation = "EQUIVOCATION" // conflict snapshots signed by the same node in the same round
+
+func (s *BadgerStore) SnapshotsWriteEquivocation(a, b *common.Snapshot) error {
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		key := equivocationKey(a, b)
+		val := common.MsgpackMarshalPanic([]*common.Snapshot{a, b})
+		return txn.Set(key, val)
+	})
+}
+
+func equivocationKey(a, b *common.Snapshot) []byte {
+	ah, bh := a.PayloadHash(), b.PayloadHash()
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, a.RoundNumber)
+	binary.BigEndian.PutUint64(buf[8:], a.Timestamp)
+	key := append([]byte(snapshotsPrefixEquivocation), a.NodeId[:]...)
+	key = append(key, buf...)
+	proof := crypto.NewHash(append(ah[:], bh[:]...))
+	return append(key, proof[:]...)
+}
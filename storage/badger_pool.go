@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/dgraph-io/badger"
+	"github.com/vmihailenco/msgpack"
+)
+
+const snapshotsPrefixPool = "POOL" // in progress snapshot signatures, irreverlant to the consensus rule
+
+func (s *BadgerStore) SnapshotsPoolWrite(hash crypto.Hash, sigs []crypto.Signature) error {
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Set(poolKey(hash), common.MsgpackMarshalPanic(sigs))
+	})
+}
+
+func (s *BadgerStore) SnapshotsPoolDelete(hash crypto.Hash) error {
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(poolKey(hash))
+	})
+}
+
+func (s *BadgerStore) SnapshotsPoolRead() (map[crypto.Hash][]crypto.Signature, error) {
+	pool := make(map[crypto.Hash][]crypto.Signature)
+
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := []byte(snapshotsPrefixPool)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return pool, err
+		}
+		var sigs []crypto.Signature
+		err = msgpack.Unmarshal(v, &sigs)
+		if err != nil {
+			return pool, err
+		}
+		var hash crypto.Hash
+		copy(hash[:], item.Key()[len(prefix):])
+		pool[hash] = sigs
+	}
+	return pool, nil
+}
+
+func poolKey(hash crypto.Hash) []byte {
+	return append([]byte(snapshotsPrefixPool), hash[:]...)
+}
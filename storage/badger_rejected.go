@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/dgraph-io/badger"
+	"github.com/vmihailenco/msgpack"
+)
+
+const snapshotsPrefixRejected = "REJECTED" // a ring of the recently dropped snapshots for forensics, irrelevant to the consensus rule
+
+// the records are keyed by an increasing sequence, and the ones out of the
+// limit are deleted in the same transaction, so at most limit records remain
+func (s *BadgerStore) SnapshotsWriteRejected(r *common.RejectedSnapshot) error {
+	limit := uint64(config.SnapshotRejectedLimit)
+	if limit == 0 {
+		return nil
+	}
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		sequence := rejectedSequence(txn)
+		err := txn.Set(rejectedKey(sequence), common.MsgpackMarshalPanic(r))
+		if err != nil || sequence < limit {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(snapshotsPrefixRejected)
+		keys := make([][]byte, 0)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if rejectedOrder(key)+limit > sequence {
+				break
+			}
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			err := txn.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the newest records first
+func (s *BadgerStore) SnapshotsReadRejected(limit int) ([]*common.RejectedSnapshot, error) {
+	records := make([]*common.RejectedSnapshot, 0)
+
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := []byte(snapshotsPrefixRejected)
+	for it.Seek(rejectedKey(^uint64(0))); it.ValidForPrefix(prefix) && len(records) < limit; it.Next() {
+		v, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return records, err
+		}
+		var r common.RejectedSnapshot
+		err = msgpack.Unmarshal(v, &r)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, &r)
+	}
+	return records, nil
+}
+
+func rejectedSequence(txn *badger.Txn) uint64 {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Seek(rejectedKey(^uint64(0)))
+	if it.ValidForPrefix([]byte(snapshotsPrefixRejected)) {
+		return rejectedOrder(it.Item().Key()) + 1
+	}
+	return 0
+}
+
+func rejectedKey(sequence uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, sequence)
+	return append([]byte(snapshotsPrefixRejected), buf...)
+}
+
+func rejectedOrder(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(snapshotsPrefixRejected):])
+}
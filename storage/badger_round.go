@@ -2,12 +2,39 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
 
+	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/crypto"
 	"github.com/dgraph-io/badger"
 )
 
+// the round meta is the round number and start, with the round end appended by new versions,
+// a meta of any other length is partially written or of an unknown version
+var ErrCorruptRoundMeta = errors.New("corrupt round meta")
+
+type RoundMetaError struct {
+	NodeId crypto.Hash
+	Length int
+}
+
+func (e *RoundMetaError) Error() string {
+	return fmt.Sprintf("%s %s %d", ErrCorruptRoundMeta, e.NodeId.String(), e.Length)
+}
+
+func (e *RoundMetaError) Unwrap() error {
+	return ErrCorruptRoundMeta
+}
+
+func checkRoundMeta(nodeIdWithNetwork crypto.Hash, val []byte) error {
+	if len(val) == 16 || len(val) == 24 {
+		return nil
+	}
+	return &RoundMetaError{NodeId: nodeIdWithNetwork, Length: len(val)}
+}
+
 func (s *BadgerStore) SnapshotsReadNodesList() ([]crypto.Hash, error) {
 	var nodes []crypto.Hash
 
@@ -42,7 +69,85 @@ func (s *BadgerStore) SnapshotsReadRoundMeta(nodeIdWithNetwork crypto.Hash) ([2]
 	return readRoundMeta(txn, nodeIdWithNetwork)
 }
 
+func (s *BadgerStore) SnapshotsReadRoundEnd(nodeIdWithNetwork crypto.Hash) (uint64, bool, error) {
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	return readRoundEnd(txn, nodeIdWithNetwork)
+}
+
+// SnapshotsStartRound starts the next round of the node without any snapshot, e.g. after the head
+// round sealed by force, so the same rounds are loaded again after a restart. The start is moved
+// to the first snapshot of the round when it comes after the round gap, the same as an empty
+// cache round advanced in the kernel.
+func (s *BadgerStore) SnapshotsStartRound(nodeIdWithNetwork crypto.Hash, number, start uint64) error {
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		meta, err := readRoundMeta(txn, nodeIdWithNetwork)
+		if err != nil {
+			return err
+		}
+		if meta[0]+1 != number || !roundFull(txn, nodeIdWithNetwork, meta[0], 1) {
+			return fmt.Errorf("invalid round start %s %d %d", nodeIdWithNetwork, meta[0], number)
+		}
+		return writeRoundMeta(txn, nodeIdWithNetwork, number, start, start)
+	})
+}
+
+// round links never decrease, so the cache keeps the largest link ever seen. A missed link is
+// read from the store with the cache locked, and the written links are updated with the same lock
+// after the commit, so a link read before a commit is always replaced by the committed one
+type roundLinksCache struct {
+	sync.RWMutex
+	links map[[2]crypto.Hash]uint64
+}
+
+func (c *roundLinksCache) get(from, to crypto.Hash) (uint64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	link, found := c.links[[2]crypto.Hash{from, to}]
+	return link, found
+}
+
+func (c *roundLinksCache) update(from, to crypto.Hash, link uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.set(from, to, link)
+}
+
+func (c *roundLinksCache) set(from, to crypto.Hash, link uint64) {
+	key := [2]crypto.Hash{from, to}
+	if old, found := c.links[key]; !found || link > old {
+		c.links[key] = link
+	}
+}
+
+func (c *roundLinksCache) load(from, to crypto.Hash, read func() (uint64, error)) (uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if link, found := c.links[[2]crypto.Hash{from, to}]; found {
+		return link, nil
+	}
+	link, err := read()
+	if err != nil {
+		return 0, err
+	}
+	c.set(from, to, link)
+	return link, nil
+}
+
 func (s *BadgerStore) SnapshotsReadRoundLink(from, to crypto.Hash) (uint64, error) {
+	if !config.StorageRoundLinksCache {
+		return s.readRoundLink(from, to)
+	}
+	if link, found := s.roundLinks.get(from, to); found {
+		return link, nil
+	}
+	return s.roundLinks.load(from, to, func() (uint64, error) {
+		return s.readRoundLink(from, to)
+	})
+}
+
+func (s *BadgerStore) readRoundLink(from, to crypto.Hash) (uint64, error) {
 	txn := s.snapshotsDB.NewTransaction(false)
 	defer txn.Discard()
 
@@ -63,13 +168,50 @@ func readRoundMeta(txn *badger.Txn, nodeIdWithNetwork crypto.Hash) ([2]uint64, e
 	if err != nil {
 		return meta, err
 	}
+	err = checkRoundMeta(nodeIdWithNetwork, ival)
+	if err != nil {
+		return meta, err
+	}
 	number := binary.BigEndian.Uint64(ival[:8])
-	start := binary.BigEndian.Uint64(ival[8:])
+	start := binary.BigEndian.Uint64(ival[8:16])
 	meta[0], meta[1] = number, start
 	return meta, nil
 }
 
-func writeRoundMeta(txn *badger.Txn, nodeIdWithNetwork crypto.Hash, number, start uint64) error {
+// the round end is appended to the round meta, it's absent in the meta written by old versions
+func readRoundEnd(txn *badger.Txn, nodeIdWithNetwork crypto.Hash) (uint64, bool, error) {
+	item, err := txn.Get(nodeRoundMetaKey(nodeIdWithNetwork))
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	ival, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, false, err
+	}
+	err = checkRoundMeta(nodeIdWithNetwork, ival)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(ival) < 24 {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint64(ival[16:]), true, nil
+}
+
+func writeRoundMeta(txn *badger.Txn, nodeIdWithNetwork crypto.Hash, number, start, end uint64) error {
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint64(buf, number)
+	binary.BigEndian.PutUint64(buf[8:], start)
+	binary.BigEndian.PutUint64(buf[16:], end)
+	key := nodeRoundMetaKey(nodeIdWithNetwork)
+	return txn.Set(key, buf)
+}
+
+// keep the meta without the round end, which is unknown until the next round
+func writeLegacyRoundMeta(txn *badger.Txn, nodeIdWithNetwork crypto.Hash, number, start uint64) error {
 	buf := make([]byte, 16)
 	binary.BigEndian.PutUint64(buf, number)
 	binary.BigEndian.PutUint64(buf[8:], start)
@@ -102,6 +244,9 @@ func writeRoundLink(txn *badger.Txn, from, to crypto.Hash, link uint64) error {
 	if old > link {
 		return fmt.Errorf("invalid round link %d=>%d", old, link)
 	}
+	if old == link {
+		return nil
+	}
 
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, link)
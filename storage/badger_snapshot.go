@@ -8,7 +8,6 @@ import (
 	"sort"
 
 	"github.com/MixinNetwork/mixin/common"
-	"github.com/MixinNetwork/mixin/config"
 	"github.com/MixinNetwork/mixin/crypto"
 	"github.com/dgraph-io/badger"
 	"github.com/vmihailenco/msgpack"
@@ -22,6 +21,7 @@ const (
 	snapshotsPrefixDeposit   = "DEPOSIT"   // unspent outputs, will be deleted once consumed
 	snapshotsPrefixNodeRound = "NODEROUND" // node specific info, e.g. round number, round hash
 	snapshotsPrefixNodeLink  = "NODELINK"  // latest node round links
+	snapshotsPrefixPayload   = "PAYLOAD"   // snapshot payload hash to transaction hash
 )
 
 func (s *BadgerStore) SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error) {
@@ -60,10 +60,104 @@ func (s *BadgerStore) SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (
 	return readSnapshotByTransactionHash(txn, hash)
 }
 
-func (s *BadgerStore) SnapshotsWriteSnapshot(snapshot *common.SnapshotWithTopologicalOrder) error {
+func (s *BadgerStore) SnapshotsReadSnapshotByPayloadHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get(payloadKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var txHash crypto.Hash
+	copy(txHash[:], val)
+	return readSnapshotByTransactionHash(txn, txHash)
+}
+
+// only the signatures of a finalized snapshot are replaced, in both the graph and the topology,
+// nothing else of the snapshot is changed, so its payload hash and the round hash are the same
+func (s *BadgerStore) SnapshotsUpdateSignatures(hash crypto.Hash, sigs []crypto.Signature) error {
 	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
-		return writeSnapshot(txn, snapshot, false)
+		item, err := txn.Get(snapshotKey(hash))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("snapshot not found %s", hash.String())
+		} else if err != nil {
+			return err
+		}
+		meta, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		key := meta[:len(graphKey(crypto.Hash{}, 0, crypto.Hash{}))]
+		topo := binary.BigEndian.Uint64(meta[len(key):])
+		prefix, err := readTopologySpace(txn)
+		if err != nil {
+			return err
+		}
+		for _, key := range [][]byte{key, topologyKey(prefix, topo)} {
+			err = updateSnapshotSignatures(txn, key, sigs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func updateSnapshotSignatures(txn *badger.Txn, key []byte, sigs []crypto.Signature) error {
+	item, err := txn.Get(key)
+	if err != nil {
+		return err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	var snap common.SnapshotWithTopologicalOrder
+	err = msgpack.Unmarshal(val, &snap)
+	if err != nil {
+		return err
+	}
+	snap.Signatures = sigs
+	return txn.Set(key, common.MsgpackMarshalPanic(snap))
+}
+
+// the round gap of the network, only used to check the snapshot rounds before writing
+func (s *BadgerStore) SnapshotsSetRoundGap(gap uint64) {
+	s.roundGap = gap
+}
+
+// the snapshots limit of a round of the network, a full round is followed before the round gap
+func (s *BadgerStore) SnapshotsSetRoundLimit(limit int) {
+	s.roundLimit = limit
+}
+
+// the round links are written in the same transaction with the snapshot, and the links cache
+// is only updated after the commit, so a snapshot and its links are never seen one without the other,
+// the cache is updated with its lock, which is held by a missed link read as well
+func (s *BadgerStore) SnapshotsWriteSnapshot(snapshot *common.SnapshotWithTopologicalOrder) error {
+	if s.committer != nil {
+		return s.commitSnapshot(snapshot)
+	}
+	err := s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return writeSnapshot(txn, snapshot, s.roundGap, s.roundLimit, false)
 	})
+	if err != nil {
+		return err
+	}
+	s.updateRoundLinks(snapshot)
+	return nil
+}
+
+func (s *BadgerStore) updateRoundLinks(snapshot *common.SnapshotWithTopologicalOrder) {
+	for to, link := range snapshot.RoundLinks {
+		s.roundLinks.update(snapshot.NodeId, to, link)
+	}
 }
 
 func (s *BadgerStore) SnapshotsReadUTXO(hash crypto.Hash, index int) (*common.UTXO, error) {
@@ -115,57 +209,93 @@ func (s *BadgerStore) SnapshotsCheckDepositInput(deposit *common.DepositData, tx
 
 func (s *BadgerStore) SnapshotsLockDepositInput(deposit *common.DepositData, tx crypto.Hash) error {
 	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
-		key := depositKey(deposit)
-		ival, err := readDepositInput(txn, deposit)
-		save := func() error {
-			return txn.Set(key, tx[:])
-		}
-		if err == badger.ErrKeyNotFound {
-			return save()
-		}
-		if err != nil {
-			return err
-		}
-		if bytes.Compare(ival, tx[:]) != 0 {
-			return fmt.Errorf("deposit locked for transaction %s", hex.EncodeToString(ival))
-		}
-		return save()
+		return lockDepositInput(txn, deposit, tx)
 	})
 }
 
+func lockDepositInput(txn *badger.Txn, deposit *common.DepositData, tx crypto.Hash) error {
+	key := depositKey(deposit)
+	ival, err := readDepositInput(txn, deposit)
+	save := func() error {
+		return txn.Set(key, tx[:])
+	}
+	if err == badger.ErrKeyNotFound {
+		return save()
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(ival, tx[:]) != 0 {
+		return fmt.Errorf("deposit locked for transaction %s", hex.EncodeToString(ival))
+	}
+	return save()
+}
+
 func (s *BadgerStore) SnapshotsLockUTXO(hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error) {
 	var utxo *common.UTXO
 	err := s.snapshotsDB.Update(func(txn *badger.Txn) error {
-		key := utxoKey(hash, index)
-		item, err := txn.Get([]byte(key))
-		if err == badger.ErrKeyNotFound {
-			return nil
-		}
-		if err != nil {
-			return err
-		}
-		ival, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-
-		var out common.UTXOWithLock
-		err = msgpack.Unmarshal(ival, &out)
-		if err != nil {
-			return err
-		}
-
-		if out.LockHash.HasValue() && out.LockHash != tx {
-			return fmt.Errorf("utxo locked for transaction %s", out.LockHash)
-		}
-		out.LockHash = tx
-		err = txn.Set([]byte(key), common.MsgpackMarshalPanic(out))
-		utxo = &out.UTXO
+		var err error
+		utxo, err = lockUTXO(txn, hash, index, tx)
 		return err
 	})
 	return utxo, err
 }
 
+func lockUTXO(txn *badger.Txn, hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error) {
+	key := utxoKey(hash, index)
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ival, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var out common.UTXOWithLock
+	err = msgpack.Unmarshal(ival, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	if out.LockHash.HasValue() && out.LockHash != tx {
+		return nil, fmt.Errorf("utxo locked for transaction %s", out.LockHash)
+	}
+	out.LockHash = tx
+	err = txn.Set([]byte(key), common.MsgpackMarshalPanic(out))
+	return &out.UTXO, err
+}
+
+func (s *BadgerStore) SnapshotsCheckUTXOLock(hash crypto.Hash, index int, tx crypto.Hash) error {
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get([]byte(utxoKey(hash, index)))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ival, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	var out common.UTXOWithLock
+	err = msgpack.Unmarshal(ival, &out)
+	if err != nil {
+		return err
+	}
+	if out.LockHash.HasValue() && out.LockHash != tx {
+		return fmt.Errorf("utxo locked for transaction %s", out.LockHash)
+	}
+	return nil
+}
+
 func (s *BadgerStore) SnapshotsCheckGhost(key crypto.Key) (bool, error) {
 	txn := s.snapshotsDB.NewTransaction(false)
 	defer txn.Discard()
@@ -190,12 +320,12 @@ func (s *BadgerStore) SnapshotsLoadGenesis(snapshots []*common.SnapshotWithTopol
 		for _, snap := range snapshots {
 			if !filter[snap.NodeId] {
 				filter[snap.NodeId] = true
-				err := writeRoundMeta(txn, snap.NodeId, snap.RoundNumber, snap.Timestamp)
+				err := writeRoundMeta(txn, snap.NodeId, snap.RoundNumber, snap.Timestamp, snap.Timestamp)
 				if err != nil {
 					return err
 				}
 			}
-			err := writeSnapshot(txn, snap, true)
+			err := writeSnapshot(txn, snap, s.roundGap, s.roundLimit, true)
 			if err != nil {
 				return err
 			}
@@ -205,6 +335,64 @@ func (s *BadgerStore) SnapshotsLoadGenesis(snapshots []*common.SnapshotWithTopol
 	})
 }
 
+// SnapshotsImportState writes the round snapshots imported from a trusted node in one transaction,
+// the snapshots of a node in their round order. The round meta of a node jumps to its first imported
+// round. The inputs are locked to the imported transactions once all outputs are written, whatever
+// the snapshots order, so an imported output spent already is never spent again, and the inputs of
+// the outputs before the import are skipped, the ledger before the imported rounds is not local.
+func (s *BadgerStore) SnapshotsImportState(snapshots []*common.SnapshotWithTopologicalOrder) error {
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		filter := make(map[crypto.Hash]bool)
+		for _, snap := range snapshots {
+			if !filter[snap.NodeId] {
+				filter[snap.NodeId] = true
+				meta, err := readRoundMeta(txn, snap.NodeId)
+				if err != nil {
+					return err
+				}
+				if meta[1] > 0 && snap.RoundNumber < meta[0] {
+					return fmt.Errorf("import round %s %d before %d", snap.NodeId, snap.RoundNumber, meta[0])
+				}
+				if meta[1] == 0 || snap.RoundNumber > meta[0]+1 {
+					err = writeRoundMeta(txn, snap.NodeId, snap.RoundNumber, snap.Timestamp, snap.Timestamp)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			err := writeSnapshot(txn, snap, s.roundGap, s.roundLimit, true)
+			if err != nil {
+				return err
+			}
+		}
+		for _, snap := range snapshots {
+			err := lockImportedInputs(txn, snap)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func lockImportedInputs(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrder) error {
+	txHash := snapshot.TransactionHash()
+	for _, in := range snapshot.Transaction.Inputs {
+		var err error
+		switch {
+		case len(in.Genesis) > 0:
+		case in.Deposit != nil:
+			err = lockDepositInput(txn, in.Deposit, txHash)
+		default:
+			_, err = lockUTXO(txn, in.Hash, in.Index, txHash)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func checkGenesisLoad(txn *badger.Txn) bool {
 	it := txn.NewIterator(badger.DefaultIteratorOptions)
 	defer it.Close()
@@ -239,7 +427,7 @@ func readSnapshotByTransactionHash(txn *badger.Txn, hash crypto.Hash) (*common.S
 	}
 	var s common.SnapshotWithTopologicalOrder
 	err = msgpack.Unmarshal(val, &s)
-	s.Transaction.Hash = s.Transaction.PayloadHash()
+	s.Transaction.Hash = s.TransactionHash()
 	s.TopologicalOrder = topo
 	s.Hash = s.PayloadHash()
 	return &s, err
@@ -249,8 +437,10 @@ func pruneSnapshot(txn *badger.Txn, tx crypto.Hash) error {
 	return nil
 }
 
-func writeSnapshot(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrder, genesis bool) error {
-	txHash := snapshot.Transaction.PayloadHash()
+// the genesis and imported snapshots are trusted, their node pledges are not in the local ledger, and the
+// imported inputs are locked after all the imported outputs written
+func writeSnapshot(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrder, gap uint64, limit int, trusted bool) error {
+	txHash := snapshot.TransactionHash()
 	// FIXME what if same transaction but different snapshot hash
 	_, err := txn.Get(snapshotKey(txHash))
 	if err == nil {
@@ -269,22 +459,39 @@ func writeSnapshot(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrde
 	if snapshot.RoundNumber < roundNumber || snapshot.RoundNumber > roundNumber+1 {
 		panic(fmt.Errorf("snapshot round error %d %d %d %d", roundNumber, roundStart, snapshot.RoundNumber, snapshot.Timestamp))
 	}
-	if snapshot.RoundNumber == roundNumber && snapshot.Timestamp >= config.SnapshotRoundGap+roundStart {
+	// the round started without any snapshot, e.g. sealed by force, moves its start to the first one after the round gap
+	moved := snapshot.RoundNumber == roundNumber && snapshot.Timestamp >= gap+roundStart
+	if moved && roundFull(txn, snapshot.NodeId, roundNumber, 1) {
 		panic(fmt.Errorf("snapshot old round timestamp error %d %d %d %d", roundNumber, roundStart, snapshot.RoundNumber, snapshot.Timestamp))
 	}
-	if snapshot.RoundNumber == roundNumber+1 && snapshot.Timestamp < config.SnapshotRoundGap+roundStart {
+	if snapshot.RoundNumber == roundNumber+1 && snapshot.Timestamp < gap+roundStart && !roundFull(txn, snapshot.NodeId, roundNumber, limit) {
 		panic(fmt.Errorf("snapshot new round timestamp error %d %d %d %d", roundNumber, roundStart, snapshot.RoundNumber, snapshot.Timestamp))
 	}
 
 	// FIXME should ensure round meta and snapshot consistence, how to move out here?
-	if snapshot.RoundNumber == roundNumber+1 || snapshot.Timestamp < roundStart {
-		err = writeRoundMeta(txn, snapshot.NodeId, snapshot.RoundNumber, snapshot.Timestamp)
-		if err != nil {
-			return err
+	// the round end is only kept when it's known, i.e. not written by old versions
+	roundEnd, found, err := readRoundEnd(txn, snapshot.NodeId)
+	if err != nil {
+		return err
+	}
+	if snapshot.RoundNumber == roundNumber+1 || moved {
+		err = writeRoundMeta(txn, snapshot.NodeId, snapshot.RoundNumber, snapshot.Timestamp, snapshot.Timestamp)
+	} else if found {
+		if snapshot.Timestamp < roundStart {
+			roundStart = snapshot.Timestamp
+		}
+		if snapshot.Timestamp > roundEnd {
+			roundEnd = snapshot.Timestamp
 		}
+		err = writeRoundMeta(txn, snapshot.NodeId, roundNumber, roundStart, roundEnd)
+	} else if snapshot.Timestamp < roundStart {
+		err = writeLegacyRoundMeta(txn, snapshot.NodeId, snapshot.RoundNumber, snapshot.Timestamp)
+	}
+	if err != nil {
+		return err
 	}
 
-	// FIXME should ensure round links and snapshot consistence, how to move out here?
+	// the links never decrease, so the written ones are the snapshot links after the commit
 	for to, link := range snapshot.RoundLinks {
 		err = writeRoundLink(txn, snapshot.NodeId, to, link)
 		if err != nil {
@@ -294,7 +501,7 @@ func writeSnapshot(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrde
 
 	// FIXME assert kind checks, not needed at all
 	for _, in := range snapshot.Transaction.Inputs {
-		if len(in.Genesis) > 0 {
+		if len(in.Genesis) > 0 || trusted {
 			continue
 		}
 
@@ -355,21 +562,21 @@ func writeSnapshot(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrde
 		case common.OutputTypeNodePledge:
 			var publicSpend crypto.Key
 			copy(publicSpend[:], snapshot.Transaction.Extra)
-			err = writeNodePledge(txn, publicSpend, snapshot.Transaction.PayloadHash())
+			err = writeNodePledge(txn, publicSpend, snapshot.TransactionHash())
 			if err != nil {
 				return err
 			}
 		case common.OutputTypeNodeAccept:
 			var publicSpend crypto.Key
 			copy(publicSpend[:], snapshot.Transaction.Extra)
-			err = writeNodeAccept(txn, publicSpend, snapshot.Transaction.PayloadHash(), genesis)
+			err = writeNodeAccept(txn, publicSpend, snapshot.TransactionHash(), trusted)
 			if err != nil {
 				return err
 			}
 		case common.OutputTypeDomainAccept:
 			var publicSpend crypto.Key
 			copy(publicSpend[:], snapshot.Transaction.Extra)
-			err = writeDomainAccept(txn, publicSpend, snapshot.Transaction.PayloadHash())
+			err = writeDomainAccept(txn, publicSpend, snapshot.TransactionHash())
 			if err != nil {
 				return err
 			}
@@ -400,17 +607,29 @@ func writeSnapshot(txn *badger.Txn, snapshot *common.SnapshotWithTopologicalOrde
 	for _, ref := range snapshot.References {
 		meta = append(meta, ref[:]...)
 	}
-	err = txn.Set(snapshotKey(snapshot.Transaction.PayloadHash()), meta)
+	err = txn.Set(snapshotKey(snapshot.TransactionHash()), meta)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(payloadKey(snapshot.PayloadHash()), txHash[:])
+	if err != nil {
+		return err
+	}
+	prefix, err := readTopologySpace(txn)
 	if err != nil {
 		return err
 	}
-	return writeSnapshotTopology(txn, snapshot)
+	return writeSnapshotTopology(txn, prefix, snapshot.TopologicalOrder, val)
 }
 
 func snapshotKey(transactionHash crypto.Hash) []byte {
 	return append([]byte(snapshotsPrefixSnapshot), transactionHash[:]...)
 }
 
+func payloadKey(snapshotHash crypto.Hash) []byte {
+	return append([]byte(snapshotsPrefixPayload), snapshotHash[:]...)
+}
+
 func graphKey(nodeIdWithNetwork crypto.Hash, round uint64, txHash crypto.Hash) []byte {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, round)
@@ -434,3 +653,22 @@ func depositKey(deposit *common.DepositData) []byte {
 func ghostKey(k crypto.Key) []byte {
 	return append([]byte(snapshotsPrefixGhost), k[:]...)
 }
+
+// a round with the limit snapshots is full, the limit 0 is never reached
+func roundFull(txn *badger.Txn, nodeIdWithNetwork crypto.Hash, round uint64, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	key := graphKey(nodeIdWithNetwork, round, crypto.Hash{})
+	prefix := key[:len(key)-len(crypto.Hash{})]
+	var count int
+	for it.Seek(key); it.ValidForPrefix(prefix) && count < limit; it.Next() {
+		count++
+	}
+	return count >= limit
+}
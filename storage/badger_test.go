@@ -1,10 +1,17 @@
 package storage
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/dgraph-io/badger"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,3 +43,569 @@ func TestBadger(t *testing.T) {
 	err = store.Close()
 	assert.Nil(err)
 }
+
+func TestBadgerPool(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+
+	h1, h2 := crypto.NewHash([]byte("h1")), crypto.NewHash([]byte("h2"))
+	err = store.SnapshotsPoolWrite(h1, []crypto.Signature{{1}, {2}})
+	assert.Nil(err)
+	err = store.SnapshotsPoolWrite(h2, []crypto.Signature{{3}})
+	assert.Nil(err)
+	err = store.SnapshotsPoolWrite(h1, []crypto.Signature{{1}, {2}, {4}})
+	assert.Nil(err)
+	assert.Nil(store.Close())
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	pool, err := store.SnapshotsPoolRead()
+	assert.Nil(err)
+	assert.Len(pool, 2)
+	assert.Equal([]crypto.Signature{{1}, {2}, {4}}, pool[h1])
+	assert.Equal([]crypto.Signature{{3}}, pool[h2])
+
+	err = store.SnapshotsPoolDelete(h1)
+	assert.Nil(err)
+	pool, err = store.SnapshotsPoolRead()
+	assert.Nil(err)
+	assert.Len(pool, 1)
+	assert.Nil(store.Close())
+}
+
+func TestBadgerTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	nodeId := crypto.NewHash([]byte("node"))
+	err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+		testTopologySnapshot(nodeId, 0, 1000),
+		testTopologySnapshot(nodeId, 1, 1001),
+	})
+	assert.Nil(err)
+	assert.Equal(uint64(2), store.SnapshotsTopologySequence())
+	err = store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 2, 1002))
+	assert.Nil(err)
+	assert.Nil(store.Close())
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	seq := store.SnapshotsTopologySequence()
+	assert.Equal(uint64(3), seq)
+	err = store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 2, 1003))
+	assert.NotNil(err)
+	err = store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, seq, 1003))
+	assert.Nil(err)
+
+	snapshots, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+	assert.Nil(err)
+	assert.Len(snapshots, 4)
+	for i, s := range snapshots {
+		assert.Equal(uint64(i), s.TopologicalOrder)
+	}
+	assert.Nil(store.Close())
+}
+
+func TestBadgerPayloadHash(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+
+	nodeId := crypto.NewHash([]byte("node"))
+	snapshot := testTopologySnapshot(nodeId, 0, 1000)
+	snapshot.Signatures = []crypto.Signature{{1}, {2}}
+	err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{snapshot})
+	assert.Nil(err)
+
+	s, err := store.SnapshotsReadSnapshotByPayloadHash(snapshot.PayloadHash())
+	assert.Nil(err)
+	assert.NotNil(s)
+	assert.Equal(snapshot.PayloadHash(), s.Hash)
+	assert.Equal(snapshot.Transaction.PayloadHash(), s.Transaction.Hash)
+	assert.Equal(snapshot.Signatures, s.Signatures)
+
+	s, err = store.SnapshotsReadSnapshotByPayloadHash(snapshot.Transaction.PayloadHash())
+	assert.Nil(err)
+	assert.Nil(s)
+}
+
+func testTopologySnapshot(nodeId crypto.Hash, topo, timestamp uint64) *common.SnapshotWithTopologicalOrder {
+	tx := common.NewTransaction(common.XINAssetId)
+	tx.Inputs = append(tx.Inputs, &common.Input{Genesis: nodeId[:]})
+	tx.Extra = []byte{byte(timestamp)}
+	return &common.SnapshotWithTopologicalOrder{
+		Snapshot: common.Snapshot{
+			NodeId:      nodeId,
+			Transaction: &common.SignedTransaction{Transaction: *tx},
+			Timestamp:   timestamp,
+		},
+		TopologicalOrder: topo,
+	}
+}
+
+func TestBadgerRoundLink(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+
+	from, to := crypto.NewHash([]byte("from")), crypto.NewHash([]byte("to"))
+	err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+		testTopologySnapshot(from, 0, 1000),
+		testTopologySnapshot(to, 1, 1000),
+	})
+	assert.Nil(err)
+
+	link, err := store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(0), link)
+
+	s := testTopologySnapshot(from, 2, 1001)
+	s.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 3}
+	err = store.SnapshotsWriteSnapshot(s)
+	assert.Nil(err)
+	link, err = store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(3), link)
+
+	s = testTopologySnapshot(from, 3, 1002)
+	s.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 2}
+	err = store.SnapshotsWriteSnapshot(s)
+	assert.NotNil(err)
+	link, err = store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(3), link)
+}
+
+// a link read before a concurrent write commits is cached only until the write updates the cache
+func TestBadgerRoundLinkConcurrentWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+
+	from, to := crypto.NewHash([]byte("from")), crypto.NewHash([]byte("to"))
+	err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+		testTopologySnapshot(from, 0, 1000),
+		testTopologySnapshot(to, 1, 1000),
+	})
+	assert.Nil(err)
+
+	written := make(chan error, 1)
+	link, err := store.roundLinks.load(from, to, func() (uint64, error) {
+		link, err := store.readRoundLink(from, to)
+		if err != nil {
+			return 0, err
+		}
+		s := testTopologySnapshot(from, 2, 1001)
+		s.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 3}
+		go func() { written <- store.SnapshotsWriteSnapshot(s) }()
+		for {
+			committed, err := store.readRoundLink(from, to)
+			if err != nil || committed == 3 {
+				return link, err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	assert.Nil(err)
+	assert.Equal(uint64(0), link)
+	assert.Nil(<-written)
+
+	link, err = store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(3), link)
+}
+
+func TestBadgerTopologyReindexCrash(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	nodeId := crypto.NewHash([]byte("node"))
+	snapshots := []*common.SnapshotWithTopologicalOrder{
+		testTopologySnapshot(nodeId, 7, 1000),
+		testTopologySnapshot(nodeId, 8, 1001),
+		testTopologySnapshot(nodeId, 9, 1002),
+	}
+	assert.Nil(store.SnapshotsLoadGenesis(snapshots))
+	assert.Equal(uint64(10), store.SnapshotsTopologySequence())
+	stage := func(store *BadgerStore) {
+		assert.Nil(store.SnapshotsBeginTopologyReindex())
+		for _, s := range snapshots {
+			assert.Nil(store.SnapshotsStageTopologyReindex([]*common.Snapshot{&s.Snapshot}))
+		}
+	}
+	check := func(store *BadgerStore, base uint64) {
+		topology, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+		assert.Nil(err)
+		assert.Len(topology, 3)
+		for i, s := range topology {
+			assert.Equal(base+uint64(i), s.TopologicalOrder)
+			assert.Equal(snapshots[i].PayloadHash(), s.PayloadHash())
+		}
+		assert.Equal(base+3, store.SnapshotsTopologySequence())
+	}
+
+	// the process crashes after a part of the new index written, the old one is still in use
+	stage(store)
+	_, err = store.writeTopology([]byte(snapshotsPrefixTopologyAlt))
+	assert.Nil(err)
+	assert.Nil(store.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(topologyKey([]byte(snapshotsPrefixTopologyAlt), 2))
+	}))
+	assert.Nil(store.Close())
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	reindexing, err := store.SnapshotsTopologyReindexing()
+	assert.Nil(err)
+	assert.True(reindexing)
+	check(store, 7)
+	s, err := store.SnapshotsReadSnapshotByTransactionHash(snapshots[0].TransactionHash())
+	assert.Nil(err)
+	assert.Equal(uint64(7), s.TopologicalOrder)
+
+	// the process crashes after the switch, before the snapshots meta orders updated
+	stage(store)
+	_, err = store.writeTopology([]byte(snapshotsPrefixTopologyAlt))
+	assert.Nil(err)
+	assert.Nil(store.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(snapshotsTopologySpace), []byte(snapshotsPrefixTopologyAlt))
+	}))
+	assert.Nil(store.Close())
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+	reindexing, err = store.SnapshotsTopologyReindexing()
+	assert.Nil(err)
+	assert.True(reindexing)
+	check(store, 0)
+
+	stage(store)
+	rewritten, err := store.SnapshotsFinishTopologyReindex()
+	assert.Nil(err)
+	assert.Equal(3, rewritten)
+	reindexing, err = store.SnapshotsTopologyReindexing()
+	assert.Nil(err)
+	assert.False(reindexing)
+	check(store, 0)
+	for i, snap := range snapshots {
+		s, err := store.SnapshotsReadSnapshotByTransactionHash(snap.TransactionHash())
+		assert.Nil(err)
+		assert.Equal(uint64(i), s.TopologicalOrder)
+	}
+	for _, prefix := range []string{snapshotsPrefixTopologyAlt, snapshotsPrefixTopologySort} {
+		keys, _, err := store.readPrefixItems([]byte(prefix), []byte(prefix), 100, false)
+		assert.Nil(err)
+		assert.Len(keys, 0)
+	}
+}
+
+func TestBadgerRoundLinkCrash(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+
+	from, to := crypto.NewHash([]byte("from")), crypto.NewHash([]byte("to"))
+	err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+		testTopologySnapshot(from, 0, 1000),
+		testTopologySnapshot(to, 1, 1000),
+	})
+	assert.Nil(err)
+	s := testTopologySnapshot(from, 2, 1001)
+	s.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 3}
+	assert.Nil(store.SnapshotsWriteSnapshot(s))
+
+	// the process crashes after the snapshot written but before the transaction committed
+	crashed := testTopologySnapshot(from, 3, 1002)
+	crashed.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 5}
+	err = store.snapshotsDB.Update(func(txn *badger.Txn) error {
+		err := writeSnapshot(txn, crashed, store.roundGap, store.roundLimit, false)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("crash")
+	})
+	assert.NotNil(err)
+	link, err := store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(3), link)
+	assert.Nil(store.Close())
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	link, err = store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(3), link)
+	r, err := store.SnapshotsReadSnapshotByTransactionHash(crashed.Transaction.PayloadHash())
+	assert.Nil(err)
+	assert.Nil(r)
+	r, err = store.SnapshotsReadSnapshotByTransactionHash(s.Transaction.PayloadHash())
+	assert.Nil(err)
+	assert.NotNil(r)
+
+	crashed.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 5}
+	assert.Nil(store.SnapshotsWriteSnapshot(crashed))
+	link, err = store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(5), link)
+	link, err = store.SnapshotsReadRoundLink(from, from)
+	assert.Nil(err)
+	assert.Equal(uint64(0), link)
+
+	// the process crashes after the transaction committed but before the links cache updated
+	committed := testTopologySnapshot(from, 4, 1003)
+	committed.RoundLinks = map[crypto.Hash]uint64{to: 7}
+	err = store.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return writeSnapshot(txn, committed, store.roundGap, store.roundLimit, false)
+	})
+	assert.Nil(err)
+	assert.Nil(store.Close())
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+	link, err = store.SnapshotsReadRoundLink(from, to)
+	assert.Nil(err)
+	assert.Equal(uint64(7), link)
+	r, err = store.SnapshotsReadSnapshotByTransactionHash(committed.Transaction.PayloadHash())
+	assert.Nil(err)
+	assert.NotNil(r)
+}
+
+func TestBadgerLegacyRoundMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+
+	nodeId := crypto.NewHash([]byte("node"))
+	err = store.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return writeLegacyRoundMeta(txn, nodeId, 0, 1000)
+	})
+	assert.Nil(err)
+	_, found, err := store.SnapshotsReadRoundEnd(nodeId)
+	assert.Nil(err)
+	assert.False(found)
+
+	err = store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 0, 1001))
+	assert.Nil(err)
+	_, found, err = store.SnapshotsReadRoundEnd(nodeId)
+	assert.Nil(err)
+	assert.False(found)
+	meta, err := store.SnapshotsReadRoundMeta(nodeId)
+	assert.Nil(err)
+	assert.Equal([2]uint64{0, 1000}, meta)
+
+	err = store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 1, 999))
+	assert.Nil(err)
+	meta, err = store.SnapshotsReadRoundMeta(nodeId)
+	assert.Nil(err)
+	assert.Equal([2]uint64{0, 999}, meta)
+
+	s := testTopologySnapshot(nodeId, 2, 1000+config.SnapshotRoundGap)
+	s.RoundNumber = 1
+	err = store.SnapshotsWriteSnapshot(s)
+	assert.Nil(err)
+	end, found, err := store.SnapshotsReadRoundEnd(nodeId)
+	assert.Nil(err)
+	assert.True(found)
+	assert.Equal(s.Timestamp, end)
+}
+
+func TestBadgerCorruptRoundMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	store, err := NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+
+	nodeId := crypto.NewHash([]byte("node"))
+	for _, n := range []int{0, 7, 15, 20, 32} {
+		err = store.snapshotsDB.Update(func(txn *badger.Txn) error {
+			return txn.Set(nodeRoundMetaKey(nodeId), make([]byte, n))
+		})
+		assert.Nil(err)
+
+		_, err = store.SnapshotsReadRoundMeta(nodeId)
+		assert.IsType(&RoundMetaError{}, err)
+		assert.Equal(nodeId, err.(*RoundMetaError).NodeId)
+		assert.Equal(n, err.(*RoundMetaError).Length)
+		assert.Equal(ErrCorruptRoundMeta, err.(*RoundMetaError).Unwrap())
+		assert.Contains(err.Error(), nodeId.String())
+		_, _, err = store.SnapshotsReadRoundEnd(nodeId)
+		assert.IsType(&RoundMetaError{}, err)
+		err = store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 0, 1000))
+		assert.IsType(&RoundMetaError{}, err)
+	}
+
+	err = store.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return writeRoundMeta(txn, nodeId, 1, 1000, 1001)
+	})
+	assert.Nil(err)
+	meta, err := store.SnapshotsReadRoundMeta(nodeId)
+	assert.Nil(err)
+	assert.Equal([2]uint64{1, 1000}, meta)
+}
+
+func testDurabilitySnapshot(nodeId, other crypto.Hash, topo, timestamp uint64) *common.SnapshotWithTopologicalOrder {
+	s := testTopologySnapshot(nodeId, topo, timestamp)
+	s.Transaction.Extra = make([]byte, 8)
+	binary.BigEndian.PutUint64(s.Transaction.Extra, timestamp)
+	s.RoundLinks = map[crypto.Hash]uint64{other: topo}
+	return s
+}
+
+func TestBadgerDurabilityBatched(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "mixin-badger-test")
+	assert.Nil(err)
+	defer os.RemoveAll(root)
+
+	d, err := ParseDurability("Batched")
+	assert.Nil(err)
+	assert.Equal(DurabilityBatched, d)
+	assert.Equal("batched", d.String())
+	_, err = ParseDurability("fast")
+	assert.NotNil(err)
+	_, err = NewBadgerStoreWithDurability(root, Durability(3))
+	assert.NotNil(err)
+
+	limit := config.StorageBatchWrites
+	config.StorageBatchWrites = 4
+	defer func() { config.StorageBatchWrites = limit }()
+	store, err := NewBadgerStoreWithDurability(root, DurabilityBatched)
+	assert.Nil(err)
+	nodeId, other := crypto.NewHash([]byte("node")), crypto.NewHash([]byte("other"))
+	err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{testTopologySnapshot(nodeId, 0, 1000)})
+	assert.Nil(err)
+	for i := uint64(1); i < 11; i++ {
+		err = store.SnapshotsWriteSnapshot(testDurabilitySnapshot(nodeId, other, i, 1000+i))
+		assert.Nil(err)
+		s, err := store.SnapshotsReadSnapshotByTransactionHash(testDurabilitySnapshot(nodeId, other, i, 1000+i).Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.NotNil(s)
+	}
+	assert.False(store.committer.running)
+	assert.Len(store.committer.queue, 0)
+	assert.Nil(store.Close())
+
+	// the same node snapshots are never in one batch, and each batch is limited
+	committer := newSnapshotsCommitter(2)
+	committer.queue = []*snapshotWrite{
+		{snapshot: testDurabilitySnapshot(nodeId, other, 11, 1011)},
+		{snapshot: testDurabilitySnapshot(other, nodeId, 12, 1012)},
+		{snapshot: testDurabilitySnapshot(crypto.NewHash([]byte("third")), nodeId, 13, 1013)},
+		{snapshot: testDurabilitySnapshot(nodeId, other, 14, 1014)},
+	}
+	assert.Len(committer.next(), 2)
+	assert.Len(committer.next(), 2)
+	assert.Len(committer.next(), 0)
+	assert.False(committer.running)
+	committer.queue = []*snapshotWrite{
+		{snapshot: testDurabilitySnapshot(nodeId, other, 11, 1011)},
+		{snapshot: testDurabilitySnapshot(nodeId, other, 12, 1012)},
+	}
+	assert.Len(committer.next(), 1)
+	assert.Len(committer.next(), 1)
+
+	store, err = NewBadgerStore(root)
+	assert.Nil(err)
+	defer store.Close()
+	assert.Equal(uint64(11), store.SnapshotsTopologySequence())
+	snapshots, err := store.SnapshotsReadSnapshotsForNodeRound(nodeId, 0)
+	assert.Nil(err)
+	assert.Len(snapshots, 11)
+	meta, err := store.SnapshotsReadRoundMeta(nodeId)
+	assert.Nil(err)
+	assert.Equal([2]uint64{0, 1000}, meta)
+	end, found, err := store.SnapshotsReadRoundEnd(nodeId)
+	assert.Nil(err)
+	assert.True(found)
+	assert.Equal(uint64(1010), end)
+	link, err := store.SnapshotsReadRoundLink(nodeId, other)
+	assert.Nil(err)
+	assert.Equal(uint64(10), link)
+}
+
+func BenchmarkBadgerDurability(b *testing.B) {
+	for _, d := range []Durability{DurabilitySync, DurabilityAsync, DurabilityBatched} {
+		b.Run(d.String(), func(b *testing.B) {
+			root, err := ioutil.TempDir("", "mixin-badger-test")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			store, err := NewBadgerStoreWithDurability(root, d)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+
+			nodeId, other := crypto.NewHash([]byte("node")), crypto.NewHash([]byte("other"))
+			err = store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{testTopologySnapshot(nodeId, 0, 1000)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			snapshots := make([]*common.SnapshotWithTopologicalOrder, b.N)
+			for i := range snapshots {
+				snapshots[i] = testDurabilitySnapshot(nodeId, other, uint64(i+1), uint64(1001+i))
+			}
+			b.ResetTimer()
+			for _, s := range snapshots {
+				err := store.SnapshotsWriteSnapshot(s)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
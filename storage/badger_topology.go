@@ -2,13 +2,22 @@ package storage
 
 import (
 	"encoding/binary"
+	"fmt"
 
 	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
 	"github.com/dgraph-io/badger"
 	"github.com/vmihailenco/msgpack"
 )
 
-const snapshotsPrefixTopology = "TOPOLOGY" // local topological sorted snapshots, irreverlant to the consensus rule
+const (
+	snapshotsPrefixTopology     = "TOPOLOGY"        // local topological sorted snapshots, irreverlant to the consensus rule
+	snapshotsPrefixTopologyAlt  = "ALTTOPOLOGY"     // the other keyspace of the topology, a reindex is written there and switched to
+	snapshotsPrefixTopologySort = "REINDEXSORT"     // the snapshots staged for a topology reindex, sorted by timestamp and payload hash
+	snapshotsTopologySpace      = "ACTIVETOPOLOGY"  // the keyspace of the topology in use, the default one if not set
+	snapshotsTopologyMarker     = "REINDEXTOPOLOGY" // an unfinished topology reindex
+	topologyReindexBatch        = 1000
+)
 
 func (s *BadgerStore) SnapshotsReadSnapshotsSinceTopology(topologyOffset, count uint64) ([]*common.SnapshotWithTopologicalOrder, error) {
 	snapshots := make([]*common.SnapshotWithTopologicalOrder, 0)
@@ -16,11 +25,16 @@ func (s *BadgerStore) SnapshotsReadSnapshotsSinceTopology(topologyOffset, count
 	txn := s.snapshotsDB.NewTransaction(false)
 	defer txn.Discard()
 
+	prefix, err := readTopologySpace(txn)
+	if err != nil {
+		return snapshots, err
+	}
+
 	it := txn.NewIterator(badger.DefaultIteratorOptions)
 	defer it.Close()
 
-	it.Seek(topologyKey(topologyOffset))
-	for ; it.ValidForPrefix([]byte(snapshotsPrefixTopology)) && uint64(len(snapshots)) < count; it.Next() {
+	it.Seek(topologyKey(prefix, topologyOffset))
+	for ; it.ValidForPrefix(prefix) && uint64(len(snapshots)) < count; it.Next() {
 		item := it.Item()
 		v, err := item.ValueCopy(nil)
 		if err != nil {
@@ -31,7 +45,7 @@ func (s *BadgerStore) SnapshotsReadSnapshotsSinceTopology(topologyOffset, count
 		if err != nil {
 			return snapshots, err
 		}
-		s.Transaction.Hash = s.Transaction.PayloadHash()
+		s.Transaction.Hash = s.TransactionHash()
 		s.TopologicalOrder = topologyOrder(item.Key())
 		s.Hash = s.PayloadHash()
 		snapshots = append(snapshots, &s)
@@ -40,12 +54,25 @@ func (s *BadgerStore) SnapshotsReadSnapshotsSinceTopology(topologyOffset, count
 	return snapshots, nil
 }
 
+// only finalized snapshots are written, so they are all returned strictly after the topological order
+func (s *BadgerStore) SnapshotsReadSnapshotsAfterTopology(topo uint64, limit int) ([]*common.SnapshotWithTopologicalOrder, error) {
+	if topo == ^uint64(0) || limit <= 0 {
+		return make([]*common.SnapshotWithTopologicalOrder, 0), nil
+	}
+	return s.SnapshotsReadSnapshotsSinceTopology(topo+1, uint64(limit))
+}
+
 func (s *BadgerStore) SnapshotsTopologySequence() uint64 {
 	var sequence uint64
 
 	txn := s.snapshotsDB.NewTransaction(false)
 	defer txn.Discard()
 
+	prefix, err := readTopologySpace(txn)
+	if err != nil {
+		panic(err)
+	}
+
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchValues = false
 	opts.Reverse = true
@@ -53,27 +80,291 @@ func (s *BadgerStore) SnapshotsTopologySequence() uint64 {
 	it := txn.NewIterator(opts)
 	defer it.Close()
 
-	it.Seek(topologyKey(^uint64(0)))
-	if it.ValidForPrefix([]byte(snapshotsPrefixTopology)) {
+	it.Seek(topologyKey(prefix, ^uint64(0)))
+	if it.ValidForPrefix(prefix) {
 		item := it.Item()
 		sequence = topologyOrder(item.Key()) + 1
 	}
 	return sequence
 }
 
-func writeSnapshotTopology(txn *badger.Txn, s *common.SnapshotWithTopologicalOrder) error {
-	key := topologyKey(s.TopologicalOrder)
-	val := common.MsgpackMarshalPanic(s)
+func (s *BadgerStore) SnapshotsTopologyReindexing() (bool, error) {
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	_, err := txn.Get([]byte(snapshotsTopologyMarker))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// a topology reindex never changes the index in use until switched to the new one, the snapshots
+// are staged in a sorted keyspace, then written to the other topology keyspace in their order,
+// which is switched to in a single transaction. The reindex is marked from the beginning until
+// all done, and done again after a crash, so the staged snapshots and the other keyspace left
+// by an interrupted reindex are dropped at first.
+func (s *BadgerStore) SnapshotsBeginTopologyReindex() error {
+	err := s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(snapshotsTopologyMarker), []byte{1})
+	})
+	if err != nil {
+		return err
+	}
+	prefix, err := s.readTopologySpace()
+	if err != nil {
+		return err
+	}
+	err = s.dropPrefix([]byte(snapshotsPrefixTopologySort))
+	if err != nil {
+		return err
+	}
+	return s.dropPrefix(otherTopologySpace(prefix))
+}
+
+// the snapshots are staged in batches, e.g. a round each time, so never all in memory
+func (s *BadgerStore) SnapshotsStageTopologyReindex(snapshots []*common.Snapshot) error {
+	return s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		for _, snap := range snapshots {
+			txHash := snap.TransactionHash()
+			err := txn.Set(topologySortKey(snap), txHash[:])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the staged snapshots take the topological orders from 0 in the other keyspace, which is then
+// switched to, and the snapshots meta orders are updated after the switch. It returns the number
+// of snapshots with a changed order.
+func (s *BadgerStore) SnapshotsFinishTopologyReindex() (int, error) {
+	prefix, err := s.readTopologySpace()
+	if err != nil {
+		return 0, err
+	}
+	next := otherTopologySpace(prefix)
+	rewritten, err := s.writeTopology(next)
+	if err != nil {
+		return 0, err
+	}
+	err = s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(snapshotsTopologySpace), next)
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = s.writeTopologyMeta()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range [][]byte{prefix, []byte(snapshotsPrefixTopologySort)} {
+		err = s.dropPrefix(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = s.snapshotsDB.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(snapshotsTopologyMarker))
+	})
+	return rewritten, err
+}
+
+func (s *BadgerStore) readTopologySpace() ([]byte, error) {
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	return readTopologySpace(txn)
+}
+
+func readTopologySpace(txn *badger.Txn) ([]byte, error) {
+	item, err := txn.Get([]byte(snapshotsTopologySpace))
+	if err == badger.ErrKeyNotFound {
+		return []byte(snapshotsPrefixTopology), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func otherTopologySpace(prefix []byte) []byte {
+	if string(prefix) == snapshotsPrefixTopologyAlt {
+		return []byte(snapshotsPrefixTopology)
+	}
+	return []byte(snapshotsPrefixTopologyAlt)
+}
+
+func (s *BadgerStore) dropPrefix(prefix []byte) error {
+	for {
+		keys, _, err := s.readPrefixItems(prefix, prefix, topologyReindexBatch, false)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		err = s.snapshotsDB.Update(func(txn *badger.Txn) error {
+			for _, k := range keys {
+				err := txn.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// the staged snapshots in order, each batch calls the function with the order of its first one
+func (s *BadgerStore) walkTopologySort(fn func(txn *badger.Txn, order uint64, hashes [][]byte) error) error {
+	prefix := []byte(snapshotsPrefixTopologySort)
+	seek, order := prefix, uint64(0)
+	for {
+		keys, hashes, err := s.readPrefixItems(prefix, seek, topologyReindexBatch, true)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		err = s.snapshotsDB.Update(func(txn *badger.Txn) error {
+			return fn(txn, order, hashes)
+		})
+		if err != nil {
+			return err
+		}
+		order += uint64(len(keys))
+		seek = append(keys[len(keys)-1], 0)
+	}
+}
+
+// the graph values are the same snapshots of the topology values, the order is not encoded
+func (s *BadgerStore) writeTopology(prefix []byte) (int, error) {
+	var rewritten int
+	err := s.walkTopologySort(func(txn *badger.Txn, order uint64, hashes [][]byte) error {
+		var changed int
+		for i, h := range hashes {
+			key, topo, err := readSnapshotMeta(txn, h)
+			if err != nil {
+				return err
+			}
+			if topo != order+uint64(i) {
+				changed++
+			}
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = writeSnapshotTopology(txn, prefix, order+uint64(i), val)
+			if err != nil {
+				return err
+			}
+		}
+		rewritten += changed
+		return nil
+	})
+	return rewritten, err
+}
+
+func (s *BadgerStore) writeTopologyMeta() error {
+	return s.walkTopologySort(func(txn *badger.Txn, order uint64, hashes [][]byte) error {
+		for i, h := range hashes {
+			err := writeSnapshotMetaTopology(txn, h, order+uint64(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BadgerStore) readPrefixItems(prefix, seek []byte, limit int, values bool) ([][]byte, [][]byte, error) {
+	txn := s.snapshotsDB.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = values
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	keys, vals := make([][]byte, 0), make([][]byte, 0)
+	for it.Seek(seek); it.ValidForPrefix(prefix) && len(keys) < limit; it.Next() {
+		item := it.Item()
+		keys = append(keys, item.KeyCopy(nil))
+		if !values {
+			continue
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return keys, vals, err
+		}
+		vals = append(vals, v)
+	}
+	return keys, vals, nil
+}
+
+func readSnapshotMeta(txn *badger.Txn, txHash []byte) ([]byte, uint64, error) {
+	item, err := txn.Get(append([]byte(snapshotsPrefixSnapshot), txHash...))
+	if err != nil {
+		return nil, 0, err
+	}
+	meta, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := meta[:len(graphKey(crypto.Hash{}, 0, crypto.Hash{}))]
+	return key, binary.BigEndian.Uint64(meta[len(key):]), nil
+}
+
+func writeSnapshotMetaTopology(txn *badger.Txn, txHash []byte, order uint64) error {
+	key := append([]byte(snapshotsPrefixSnapshot), txHash...)
+	item, err := txn.Get(key)
+	if err != nil {
+		return err
+	}
+	meta, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	offset := len(graphKey(crypto.Hash{}, 0, crypto.Hash{}))
+	binary.BigEndian.PutUint64(meta[offset:], order)
+	return txn.Set(key, meta)
+}
+
+func writeSnapshotTopology(txn *badger.Txn, prefix []byte, order uint64, val []byte) error {
+	key := topologyKey(prefix, order)
+	_, err := txn.Get(key)
+	if err == nil {
+		return fmt.Errorf("topological order %d already taken", order)
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
 	return txn.Set(key, val)
 }
 
-func topologyKey(order uint64) []byte {
+func topologySortKey(s *common.Snapshot) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, s.Timestamp)
+	key := append([]byte(snapshotsPrefixTopologySort), buf...)
+	hash := s.PayloadHash()
+	return append(key, hash[:]...)
+}
+
+func topologyKey(prefix []byte, order uint64) []byte {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, order)
-	return append([]byte(snapshotsPrefixTopology), buf...)
+	return append(append([]byte{}, prefix...), buf...)
 }
 
 func topologyOrder(key []byte) uint64 {
-	order := key[len(snapshotsPrefixTopology):]
+	order := key[len(key)-8:]
 	return binary.BigEndian.Uint64(order)
 }
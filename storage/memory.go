@@ -0,0 +1,868 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/vmihailenco/msgpack"
+)
+
+// MemoryStore keeps everything in Go maps with the same semantics as the badger store,
+// values are msgpack encoded so the callers never share memory with the store,
+// it's not persistent and mainly used by tests
+type MemoryStore struct {
+	sync.RWMutex
+	roundGap   uint64
+	roundLimit int
+
+	state map[string][]byte
+	queue map[uint64][]byte
+
+	rounds        map[crypto.Hash][2]uint64
+	ends          map[crypto.Hash]uint64
+	links         map[[2]crypto.Hash]uint64
+	graph         map[crypto.Hash]map[uint64]map[crypto.Hash][]byte
+	snapshots     map[crypto.Hash]*memorySnapshotMeta
+	payloads      map[crypto.Hash]crypto.Hash
+	topology      map[uint64][]byte
+	utxos         map[string][]byte
+	deposits      map[crypto.Hash]crypto.Hash
+	ghosts        map[crypto.Key]bool
+	nodes         map[string]map[crypto.Key]crypto.Hash
+	domains       map[crypto.Key]crypto.Hash
+	pool          map[crypto.Hash][]byte
+	equivocations map[string][]byte
+	rejected      [][]byte
+	reindex       map[crypto.Hash]*common.Snapshot
+}
+
+type memorySnapshotMeta struct {
+	nodeId crypto.Hash
+	round  uint64
+	topo   uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		roundGap:      config.SnapshotRoundGap,
+		roundLimit:    config.SnapshotRoundLimit,
+		state:         make(map[string][]byte),
+		queue:         make(map[uint64][]byte),
+		rounds:        make(map[crypto.Hash][2]uint64),
+		ends:          make(map[crypto.Hash]uint64),
+		links:         make(map[[2]crypto.Hash]uint64),
+		graph:         make(map[crypto.Hash]map[uint64]map[crypto.Hash][]byte),
+		snapshots:     make(map[crypto.Hash]*memorySnapshotMeta),
+		payloads:      make(map[crypto.Hash]crypto.Hash),
+		topology:      make(map[uint64][]byte),
+		utxos:         make(map[string][]byte),
+		deposits:      make(map[crypto.Hash]crypto.Hash),
+		ghosts:        make(map[crypto.Key]bool),
+		nodes:         make(map[string]map[crypto.Key]crypto.Hash),
+		domains:       make(map[crypto.Key]crypto.Hash),
+		pool:          make(map[crypto.Hash][]byte),
+		equivocations: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) StateGet(key string, val interface{}) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ival, found := s.state[key]
+	if !found {
+		return false, nil
+	}
+	return true, msgpack.Unmarshal(ival, val)
+}
+
+func (s *MemoryStore) StateSet(key string, val interface{}) error {
+	ival, err := msgpack.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.state[key] = ival
+	return nil
+}
+
+func (s *MemoryStore) QueueAdd(tx *common.SignedTransaction) error {
+	ival, err := msgpack.Marshal(tx)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.queue[uint64(time.Now().UnixNano())] = ival
+	return nil
+}
+
+// the hook is called without the store lock, and nothing is removed from the queue if any hook fails
+func (s *MemoryStore) QueuePoll(offset uint64, hook func(k uint64, v []byte) error) error {
+	s.RLock()
+	keys := make([]uint64, 0)
+	for k := range s.queue {
+		if k >= offset {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = s.queue[k]
+	}
+	s.RUnlock()
+
+	for i, k := range keys {
+		err := hook(k, values[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, k := range keys {
+		delete(s.queue, k)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsSetRoundGap(gap uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.roundGap = gap
+}
+
+func (s *MemoryStore) SnapshotsSetRoundLimit(limit int) {
+	s.Lock()
+	defer s.Unlock()
+	s.roundLimit = limit
+}
+
+func (s *MemoryStore) SnapshotsLoadGenesis(snapshots []*common.SnapshotWithTopologicalOrder) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.snapshotsEmpty() {
+		return nil
+	}
+
+	filter := make(map[crypto.Hash]bool)
+	for _, snap := range snapshots {
+		if !filter[snap.NodeId] {
+			filter[snap.NodeId] = true
+			s.rounds[snap.NodeId] = [2]uint64{snap.RoundNumber, snap.Timestamp}
+			s.ends[snap.NodeId] = snap.Timestamp
+		}
+		err := s.writeSnapshot(snap, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsImportState(snapshots []*common.SnapshotWithTopologicalOrder) error {
+	s.Lock()
+	defer s.Unlock()
+
+	filter := make(map[crypto.Hash]bool)
+	for _, snap := range snapshots {
+		if !filter[snap.NodeId] {
+			filter[snap.NodeId] = true
+			meta, found := s.rounds[snap.NodeId]
+			if found && snap.RoundNumber < meta[0] {
+				return fmt.Errorf("import round %s %d before %d", snap.NodeId, snap.RoundNumber, meta[0])
+			}
+			if !found || snap.RoundNumber > meta[0]+1 {
+				s.rounds[snap.NodeId] = [2]uint64{snap.RoundNumber, snap.Timestamp}
+				s.ends[snap.NodeId] = snap.Timestamp
+			}
+		}
+		err := s.writeSnapshot(snap, true)
+		if err != nil {
+			return err
+		}
+	}
+	for _, snap := range snapshots {
+		err := s.lockImportedInputs(snap)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) lockImportedInputs(snapshot *common.SnapshotWithTopologicalOrder) error {
+	txHash := snapshot.TransactionHash()
+	for _, in := range snapshot.Transaction.Inputs {
+		var err error
+		switch {
+		case len(in.Genesis) > 0:
+		case in.Deposit != nil:
+			err = s.lockDepositInput(in.Deposit, txHash)
+		default:
+			_, err = s.lockUTXO(in.Hash, in.Index, txHash)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the badger store loads genesis only when the whole snapshots database is empty
+func (s *MemoryStore) snapshotsEmpty() bool {
+	return len(s.rounds) == 0 && len(s.links) == 0 && len(s.snapshots) == 0 &&
+		len(s.topology) == 0 && len(s.utxos) == 0 && len(s.deposits) == 0 &&
+		len(s.pool) == 0 && len(s.equivocations) == 0 && len(s.rejected) == 0
+}
+
+func (s *MemoryStore) SnapshotsWriteSnapshot(snapshot *common.SnapshotWithTopologicalOrder) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.writeSnapshot(snapshot, false)
+}
+
+// all the checks go before any write, so a failed snapshot leaves nothing behind like a badger transaction
+func (s *MemoryStore) writeSnapshot(snapshot *common.SnapshotWithTopologicalOrder, trusted bool) error {
+	txHash := snapshot.TransactionHash()
+	if s.snapshots[txHash] != nil {
+		return nil
+	}
+
+	roundMeta := s.rounds[snapshot.NodeId]
+	roundNumber, roundStart := roundMeta[0], roundMeta[1]
+	if snapshot.RoundNumber < roundNumber || snapshot.RoundNumber > roundNumber+1 {
+		panic(fmt.Errorf("snapshot round error %d %d %d %d", roundNumber, roundStart, snapshot.RoundNumber, snapshot.Timestamp))
+	}
+	moved := snapshot.RoundNumber == roundNumber && snapshot.Timestamp >= s.roundGap+roundStart
+	if moved && len(s.graph[snapshot.NodeId][roundNumber]) > 0 {
+		panic(fmt.Errorf("snapshot old round timestamp error %d %d %d %d", roundNumber, roundStart, snapshot.RoundNumber, snapshot.Timestamp))
+	}
+	full := s.roundLimit > 0 && len(s.graph[snapshot.NodeId][roundNumber]) >= s.roundLimit
+	if snapshot.RoundNumber == roundNumber+1 && snapshot.Timestamp < s.roundGap+roundStart && !full {
+		panic(fmt.Errorf("snapshot new round timestamp error %d %d %d %d", roundNumber, roundStart, snapshot.RoundNumber, snapshot.Timestamp))
+	}
+
+	for to, link := range snapshot.RoundLinks {
+		old := s.links[[2]crypto.Hash{snapshot.NodeId, to}]
+		if old > link {
+			return fmt.Errorf("invalid round link %d=>%d", old, link)
+		}
+	}
+
+	for _, in := range snapshot.Transaction.Inputs {
+		if len(in.Genesis) > 0 || trusted {
+			continue
+		}
+		if in.Deposit != nil {
+			lock, found := s.deposits[depositHash(in.Deposit)]
+			if !found {
+				panic(fmt.Errorf("deposit check error %s", in.Deposit.TransactionHash))
+			}
+			if lock != txHash {
+				panic(fmt.Errorf("deposit locked for transaction %s", hex.EncodeToString(lock[:])))
+			}
+			continue
+		}
+		out, err := s.readUTXOWithLock(in.Hash, in.Index)
+		if err != nil || out == nil {
+			panic(fmt.Errorf("UTXO check error %v", err))
+		}
+		if out.LockHash != txHash {
+			panic(fmt.Errorf("utxo locked for transaction %s", out.LockHash))
+		}
+	}
+
+	utxos := snapshot.UnspentOutputs()
+	for _, utxo := range utxos {
+		for _, k := range utxo.Keys {
+			if s.ghosts[k] {
+				panic("ErrorValidateFailed")
+			}
+		}
+		var publicSpend crypto.Key
+		copy(publicSpend[:], snapshot.Transaction.Extra)
+		switch utxo.Type {
+		case common.OutputTypeNodePledge:
+			if _, found := s.nodes[snapshotsPrefixNodeAccept][publicSpend]; found {
+				return fmt.Errorf("node already accepted %s", publicSpend.String())
+			}
+			if node, found := s.firstNodeInState(snapshotsPrefixNodePledge); found {
+				return fmt.Errorf("node %s is pledging", node.String())
+			}
+			if node, found := s.firstNodeInState(snapshotsPrefixNodeDepart); found {
+				return fmt.Errorf("node %s is departing", node.String())
+			}
+		case common.OutputTypeNodeAccept:
+			_, found := s.nodes[snapshotsPrefixNodePledge][publicSpend]
+			if !found && !trusted {
+				return fmt.Errorf("node not pledging yet %s", publicSpend.String())
+			}
+		}
+	}
+
+	if _, found := s.graph[snapshot.NodeId][snapshot.RoundNumber][txHash]; found {
+		panic("ErrorValidateFailed")
+	}
+	if _, found := s.topology[snapshot.TopologicalOrder]; found {
+		return fmt.Errorf("topological order %d already taken", snapshot.TopologicalOrder)
+	}
+
+	if snapshot.RoundNumber == roundNumber+1 || moved {
+		s.rounds[snapshot.NodeId] = [2]uint64{snapshot.RoundNumber, snapshot.Timestamp}
+		s.ends[snapshot.NodeId] = snapshot.Timestamp
+	} else {
+		if snapshot.Timestamp < roundStart {
+			s.rounds[snapshot.NodeId] = [2]uint64{snapshot.RoundNumber, snapshot.Timestamp}
+		}
+		if snapshot.Timestamp > s.ends[snapshot.NodeId] {
+			s.ends[snapshot.NodeId] = snapshot.Timestamp
+		}
+	}
+	for to, link := range snapshot.RoundLinks {
+		s.links[[2]crypto.Hash{snapshot.NodeId, to}] = link
+	}
+
+	for _, utxo := range utxos {
+		for _, k := range utxo.Keys {
+			s.ghosts[k] = true
+		}
+		s.utxos[string(utxoKey(utxo.Hash, utxo.Index))] = common.MsgpackMarshalPanic(utxo)
+
+		var publicSpend crypto.Key
+		copy(publicSpend[:], snapshot.Transaction.Extra)
+		switch utxo.Type {
+		case common.OutputTypeNodePledge:
+			s.writeNodeState(snapshotsPrefixNodePledge, publicSpend, txHash)
+		case common.OutputTypeNodeAccept:
+			s.writeNodeState(snapshotsPrefixNodeAccept, publicSpend, txHash)
+		case common.OutputTypeDomainAccept:
+			s.domains[publicSpend] = txHash
+		}
+	}
+
+	rounds := s.graph[snapshot.NodeId]
+	if rounds == nil {
+		rounds = make(map[uint64]map[crypto.Hash][]byte)
+		s.graph[snapshot.NodeId] = rounds
+	}
+	if rounds[snapshot.RoundNumber] == nil {
+		rounds[snapshot.RoundNumber] = make(map[crypto.Hash][]byte)
+	}
+	val := common.MsgpackMarshalPanic(snapshot)
+	rounds[snapshot.RoundNumber][txHash] = val
+
+	s.snapshots[txHash] = &memorySnapshotMeta{
+		nodeId: snapshot.NodeId,
+		round:  snapshot.RoundNumber,
+		topo:   snapshot.TopologicalOrder,
+	}
+	s.payloads[snapshot.PayloadHash()] = txHash
+	s.topology[snapshot.TopologicalOrder] = val
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	snapshots := make([]*common.Snapshot, 0)
+	items := s.graph[nodeIdWithNetwork][round]
+	hashes := make([]crypto.Hash, 0, len(items))
+	for h := range items {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+	for _, h := range hashes {
+		var snap common.Snapshot
+		err := msgpack.Unmarshal(items[h], &snap)
+		if err != nil {
+			return snapshots, err
+		}
+		snapshots = append(snapshots, &snap)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Timestamp < snapshots[j].Timestamp })
+	return snapshots, nil
+}
+
+func (s *MemoryStore) SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.readSnapshotByTransactionHash(hash)
+}
+
+func (s *MemoryStore) SnapshotsReadSnapshotByPayloadHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	txHash, found := s.payloads[hash]
+	if !found {
+		return nil, nil
+	}
+	return s.readSnapshotByTransactionHash(txHash)
+}
+
+func (s *MemoryStore) SnapshotsUpdateSignatures(hash crypto.Hash, sigs []crypto.Signature) error {
+	s.Lock()
+	defer s.Unlock()
+
+	meta := s.snapshots[hash]
+	if meta == nil {
+		return fmt.Errorf("snapshot not found %s", hash.String())
+	}
+	round := s.graph[meta.nodeId][meta.round]
+	val, err := replaceSignatures(round[hash], sigs)
+	if err != nil {
+		return err
+	}
+	topo, err := replaceSignatures(s.topology[meta.topo], sigs)
+	if err != nil {
+		return err
+	}
+	round[hash], s.topology[meta.topo] = val, topo
+	return nil
+}
+
+func replaceSignatures(val []byte, sigs []crypto.Signature) ([]byte, error) {
+	var snap common.SnapshotWithTopologicalOrder
+	err := msgpack.Unmarshal(val, &snap)
+	if err != nil {
+		return nil, err
+	}
+	snap.Signatures = sigs
+	return common.MsgpackMarshalPanic(snap), nil
+}
+
+func (s *MemoryStore) readSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error) {
+	meta := s.snapshots[hash]
+	if meta == nil {
+		return nil, nil
+	}
+	val, found := s.graph[meta.nodeId][meta.round][hash]
+	if !found {
+		panic(hash.String())
+	}
+	var snap common.SnapshotWithTopologicalOrder
+	err := msgpack.Unmarshal(val, &snap)
+	snap.Transaction.Hash = snap.TransactionHash()
+	snap.TopologicalOrder = meta.topo
+	snap.Hash = snap.PayloadHash()
+	return &snap, err
+}
+
+func (s *MemoryStore) SnapshotsReadNodesList() ([]crypto.Hash, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var nodes []crypto.Hash
+	for id := range s.rounds {
+		nodes = append(nodes, id)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return bytes.Compare(nodes[i][:], nodes[j][:]) < 0 })
+	return nodes, nil
+}
+
+func (s *MemoryStore) SnapshotsStartRound(nodeIdWithNetwork crypto.Hash, number, start uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	meta := s.rounds[nodeIdWithNetwork]
+	if meta[0]+1 != number || len(s.graph[nodeIdWithNetwork][meta[0]]) == 0 {
+		return fmt.Errorf("invalid round start %s %d %d", nodeIdWithNetwork, meta[0], number)
+	}
+	s.rounds[nodeIdWithNetwork] = [2]uint64{number, start}
+	s.ends[nodeIdWithNetwork] = start
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsReadRoundMeta(nodeIdWithNetwork crypto.Hash) ([2]uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.rounds[nodeIdWithNetwork], nil
+}
+
+func (s *MemoryStore) SnapshotsReadRoundEnd(nodeIdWithNetwork crypto.Hash) (uint64, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	end, found := s.ends[nodeIdWithNetwork]
+	return end, found, nil
+}
+
+func (s *MemoryStore) SnapshotsReadRoundLink(from, to crypto.Hash) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.links[[2]crypto.Hash{from, to}], nil
+}
+
+func (s *MemoryStore) SnapshotsTopologySequence() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	var sequence uint64
+	for order := range s.topology {
+		if order+1 > sequence {
+			sequence = order + 1
+		}
+	}
+	return sequence
+}
+
+func (s *MemoryStore) SnapshotsReadSnapshotsSinceTopology(topologyOffset, count uint64) ([]*common.SnapshotWithTopologicalOrder, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	orders := make([]uint64, 0)
+	for order := range s.topology {
+		if order >= topologyOffset {
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i] < orders[j] })
+
+	snapshots := make([]*common.SnapshotWithTopologicalOrder, 0)
+	for _, order := range orders {
+		if uint64(len(snapshots)) >= count {
+			break
+		}
+		var snap common.SnapshotWithTopologicalOrder
+		err := msgpack.Unmarshal(s.topology[order], &snap)
+		if err != nil {
+			return snapshots, err
+		}
+		snap.Transaction.Hash = snap.TransactionHash()
+		snap.TopologicalOrder = order
+		snap.Hash = snap.PayloadHash()
+		snapshots = append(snapshots, &snap)
+	}
+	return snapshots, nil
+}
+
+func (s *MemoryStore) SnapshotsReadSnapshotsAfterTopology(topo uint64, limit int) ([]*common.SnapshotWithTopologicalOrder, error) {
+	if topo == ^uint64(0) || limit <= 0 {
+		return make([]*common.SnapshotWithTopologicalOrder, 0), nil
+	}
+	return s.SnapshotsReadSnapshotsSinceTopology(topo+1, uint64(limit))
+}
+
+func (s *MemoryStore) SnapshotsBeginTopologyReindex() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.reindex = make(map[crypto.Hash]*common.Snapshot)
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsStageTopologyReindex(snapshots []*common.Snapshot) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.reindex == nil {
+		return fmt.Errorf("topology reindex not begun")
+	}
+	for _, snap := range snapshots {
+		s.reindex[snap.TransactionHash()] = snap
+	}
+	return nil
+}
+
+// the memory topology is replaced at once with the lock held, ordered by timestamp and payload hash
+func (s *MemoryStore) SnapshotsFinishTopologyReindex() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.reindex == nil {
+		return 0, fmt.Errorf("topology reindex not begun")
+	}
+	hashes := make([]crypto.Hash, 0, len(s.reindex))
+	payloads := make(map[crypto.Hash]crypto.Hash)
+	for h, snap := range s.reindex {
+		hashes = append(hashes, h)
+		payloads[h] = snap.PayloadHash()
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := s.reindex[hashes[i]], s.reindex[hashes[j]]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		pa, pb := payloads[hashes[i]], payloads[hashes[j]]
+		return bytes.Compare(pa[:], pb[:]) < 0
+	})
+
+	topology := make(map[uint64][]byte)
+	for i, h := range hashes {
+		meta := s.snapshots[h]
+		if meta == nil {
+			return 0, fmt.Errorf("snapshot not found %s", h)
+		}
+		topology[uint64(i)] = s.graph[meta.nodeId][meta.round][h]
+	}
+	var rewritten int
+	for i, h := range hashes {
+		meta := s.snapshots[h]
+		if meta.topo != uint64(i) {
+			rewritten++
+		}
+		meta.topo = uint64(i)
+	}
+	s.topology = topology
+	s.reindex = nil
+	return rewritten, nil
+}
+
+func (s *MemoryStore) SnapshotsTopologyReindexing() (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.reindex != nil, nil
+}
+
+func (s *MemoryStore) SnapshotsReadUTXO(hash crypto.Hash, index int) (*common.UTXO, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ival, found := s.utxos[string(utxoKey(hash, index))]
+	if !found {
+		return nil, nil
+	}
+	var out common.UTXO
+	err := msgpack.Unmarshal(ival, &out)
+	return &out, err
+}
+
+func (s *MemoryStore) readUTXOWithLock(hash crypto.Hash, index int) (*common.UTXOWithLock, error) {
+	ival, found := s.utxos[string(utxoKey(hash, index))]
+	if !found {
+		return nil, nil
+	}
+	var out common.UTXOWithLock
+	err := msgpack.Unmarshal(ival, &out)
+	return &out, err
+}
+
+func (s *MemoryStore) SnapshotsLockUTXO(hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lockUTXO(hash, index, tx)
+}
+
+func (s *MemoryStore) lockUTXO(hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error) {
+	out, err := s.readUTXOWithLock(hash, index)
+	if err != nil || out == nil {
+		return nil, err
+	}
+	if out.LockHash.HasValue() && out.LockHash != tx {
+		return nil, fmt.Errorf("utxo locked for transaction %s", out.LockHash)
+	}
+	out.LockHash = tx
+	s.utxos[string(utxoKey(hash, index))] = common.MsgpackMarshalPanic(out)
+	return &out.UTXO, nil
+}
+
+func (s *MemoryStore) SnapshotsCheckUTXOLock(hash crypto.Hash, index int, tx crypto.Hash) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	out, err := s.readUTXOWithLock(hash, index)
+	if err != nil || out == nil {
+		return err
+	}
+	if out.LockHash.HasValue() && out.LockHash != tx {
+		return fmt.Errorf("utxo locked for transaction %s", out.LockHash)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsCheckDepositInput(deposit *common.DepositData, tx crypto.Hash) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	lock, found := s.deposits[depositHash(deposit)]
+	if !found || lock == tx {
+		return nil
+	}
+	return fmt.Errorf("invalid lock %s %s", hex.EncodeToString(lock[:]), hex.EncodeToString(tx[:]))
+}
+
+func (s *MemoryStore) SnapshotsLockDepositInput(deposit *common.DepositData, tx crypto.Hash) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lockDepositInput(deposit, tx)
+}
+
+func (s *MemoryStore) lockDepositInput(deposit *common.DepositData, tx crypto.Hash) error {
+	key := depositHash(deposit)
+	lock, found := s.deposits[key]
+	if found && lock != tx {
+		return fmt.Errorf("deposit locked for transaction %s", hex.EncodeToString(lock[:]))
+	}
+	s.deposits[key] = tx
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsCheckGhost(key crypto.Key) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.ghosts[key], nil
+}
+
+func (s *MemoryStore) SnapshotsReadConsensusNodes() []common.Node {
+	s.RLock()
+	defer s.RUnlock()
+
+	nodes := make([]common.Node, 0)
+	for _, n := range s.readNodesInState(snapshotsPrefixNodeAccept) {
+		nodes = append(nodes, common.Node{Account: n, State: common.NodeStateAccepted})
+	}
+	for _, n := range s.readNodesInState(snapshotsPrefixNodePledge) {
+		nodes = append(nodes, common.Node{Account: n, State: common.NodeStatePledging})
+	}
+	for _, n := range s.readNodesInState(snapshotsPrefixNodeDepart) {
+		nodes = append(nodes, common.Node{Account: n, State: common.NodeStateDeparting})
+	}
+	return nodes
+}
+
+func (s *MemoryStore) readNodesInState(nodeState string) []common.Address {
+	nodes := make([]common.Address, 0)
+	for _, k := range sortedKeys(s.nodes[nodeState]) {
+		nodes = append(nodes, nodeAccountForState(append([]byte(nodeState), k[:]...), nodeState))
+	}
+	return nodes
+}
+
+func (s *MemoryStore) firstNodeInState(nodeState string) (crypto.Key, bool) {
+	keys := sortedKeys(s.nodes[nodeState])
+	if len(keys) == 0 {
+		return crypto.Key{}, false
+	}
+	return keys[0], true
+}
+
+func (s *MemoryStore) writeNodeState(nodeState string, publicSpend crypto.Key, tx crypto.Hash) {
+	if s.nodes[nodeState] == nil {
+		s.nodes[nodeState] = make(map[crypto.Key]crypto.Hash)
+	}
+	s.nodes[nodeState][publicSpend] = tx
+}
+
+func (s *MemoryStore) SnapshotsReadDomains() []common.Domain {
+	s.RLock()
+	defer s.RUnlock()
+
+	domains := make([]common.Domain, 0)
+	for _, k := range sortedKeys(s.domains) {
+		key := append([]byte(snapshotsPrefixDomainAccept), k[:]...)
+		domains = append(domains, common.Domain{Account: domainAccountForState(key, snapshotsPrefixDomainAccept)})
+	}
+	return domains
+}
+
+func (s *MemoryStore) SnapshotsPoolWrite(hash crypto.Hash, sigs []crypto.Signature) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pool[hash] = common.MsgpackMarshalPanic(sigs)
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsPoolDelete(hash crypto.Hash) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.pool, hash)
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsPoolRead() (map[crypto.Hash][]crypto.Signature, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	pool := make(map[crypto.Hash][]crypto.Signature)
+	for hash, val := range s.pool {
+		var sigs []crypto.Signature
+		err := msgpack.Unmarshal(val, &sigs)
+		if err != nil {
+			return pool, err
+		}
+		pool[hash] = sigs
+	}
+	return pool, nil
+}
+
+func (s *MemoryStore) SnapshotsWriteEquivocation(a, b *common.Snapshot) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.equivocations[string(equivocationKey(a, b))] = common.MsgpackMarshalPanic([]*common.Snapshot{a, b})
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsWriteRejected(r *common.RejectedSnapshot) error {
+	s.Lock()
+	defer s.Unlock()
+
+	limit := config.SnapshotRejectedLimit
+	if limit <= 0 {
+		return nil
+	}
+	s.rejected = append(s.rejected, common.MsgpackMarshalPanic(r))
+	if len(s.rejected) > limit {
+		s.rejected = append([][]byte{}, s.rejected[len(s.rejected)-limit:]...)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SnapshotsReadRejected(limit int) ([]*common.RejectedSnapshot, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	records := make([]*common.RejectedSnapshot, 0)
+	for i := len(s.rejected) - 1; i >= 0 && len(records) < limit; i-- {
+		var r common.RejectedSnapshot
+		err := msgpack.Unmarshal(s.rejected[i], &r)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, &r)
+	}
+	return records, nil
+}
+
+func depositHash(deposit *common.DepositData) crypto.Hash {
+	return crypto.NewHash(common.MsgpackMarshalPanic(deposit))
+}
+
+func sortedKeys(m map[crypto.Key]crypto.Hash) []crypto.Key {
+	keys := make([]crypto.Key, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	return keys
+}
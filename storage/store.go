@@ -12,21 +12,40 @@ type Store interface {
 	StateSet(key string, val interface{}) error
 
 	SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder) error
+	SnapshotsImportState([]*common.SnapshotWithTopologicalOrder) error
 	SnapshotsTopologySequence() uint64
+	SnapshotsSetRoundGap(gap uint64)
+	SnapshotsSetRoundLimit(limit int)
+	SnapshotsBeginTopologyReindex() error
+	SnapshotsStageTopologyReindex(snapshots []*common.Snapshot) error
+	SnapshotsFinishTopologyReindex() (int, error)
+	SnapshotsTopologyReindexing() (bool, error)
 	SnapshotsReadUTXO(hash crypto.Hash, index int) (*common.UTXO, error)
 	SnapshotsLockUTXO(hash crypto.Hash, index int, tx crypto.Hash) (*common.UTXO, error)
+	SnapshotsCheckUTXOLock(hash crypto.Hash, index int, tx crypto.Hash) error
 	SnapshotsCheckDepositInput(deposit *common.DepositData, tx crypto.Hash) error
 	SnapshotsLockDepositInput(deposit *common.DepositData, tx crypto.Hash) error
 	SnapshotsCheckGhost(key crypto.Key) (bool, error)
 	SnapshotsReadSnapshotsSinceTopology(offset, count uint64) ([]*common.SnapshotWithTopologicalOrder, error)
+	SnapshotsReadSnapshotsAfterTopology(topo uint64, limit int) ([]*common.SnapshotWithTopologicalOrder, error)
 	SnapshotsReadSnapshotsForNodeRound(nodeIdWithNetwork crypto.Hash, round uint64) ([]*common.Snapshot, error)
 	SnapshotsReadNodesList() ([]crypto.Hash, error)
 	SnapshotsReadRoundMeta(nodeIdWithNetwork crypto.Hash) ([2]uint64, error)
+	SnapshotsReadRoundEnd(nodeIdWithNetwork crypto.Hash) (uint64, bool, error)
+	SnapshotsStartRound(nodeIdWithNetwork crypto.Hash, number, start uint64) error
 	SnapshotsReadRoundLink(from, to crypto.Hash) (uint64, error)
 	SnapshotsWriteSnapshot(*common.SnapshotWithTopologicalOrder) error
 	SnapshotsReadSnapshotByTransactionHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error)
+	SnapshotsReadSnapshotByPayloadHash(hash crypto.Hash) (*common.SnapshotWithTopologicalOrder, error)
+	SnapshotsUpdateSignatures(hash crypto.Hash, sigs []crypto.Signature) error
 	SnapshotsReadConsensusNodes() []common.Node
 	SnapshotsReadDomains() []common.Domain
+	SnapshotsPoolWrite(hash crypto.Hash, sigs []crypto.Signature) error
+	SnapshotsPoolDelete(hash crypto.Hash) error
+	SnapshotsPoolRead() (map[crypto.Hash][]crypto.Signature, error)
+	SnapshotsWriteEquivocation(a, b *common.Snapshot) error
+	SnapshotsWriteRejected(r *common.RejectedSnapshot) error
+	SnapshotsReadRejected(limit int) ([]*common.RejectedSnapshot, error)
 
 	QueueAdd(tx *common.SignedTransaction) error
 	QueuePoll(uint64, func(k uint64, v []byte) error) error
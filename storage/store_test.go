@@ -0,0 +1,567 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/config"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBadgerStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) (Store, func()) {
+		root, err := ioutil.TempDir("", "mixin-badger-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := NewBadgerStore(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store, func() {
+			store.Close()
+			os.RemoveAll(root)
+		}
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) (Store, func()) {
+		return NewMemoryStore(), func() {}
+	})
+}
+
+// testStoreConformance checks the behaviors the kernel relies on, every Store implementation should pass it
+func testStoreConformance(t *testing.T, newStore func(t *testing.T) (Store, func())) {
+	run := func(name string, f func(*assert.Assertions, Store)) {
+		t.Run(name, func(t *testing.T) {
+			store, cleanup := newStore(t)
+			defer cleanup()
+			f(assert.New(t), store)
+		})
+	}
+
+	run("state", func(assert *assert.Assertions, store Store) {
+		var val int
+		found, err := store.StateGet("state-key", &val)
+		assert.Nil(err)
+		assert.False(found)
+		assert.Nil(store.StateSet("state-key", 1))
+		found, err = store.StateGet("state-key", &val)
+		assert.Nil(err)
+		assert.True(found)
+		assert.Equal(1, val)
+	})
+
+	run("pool", func(assert *assert.Assertions, store Store) {
+		h1, h2 := crypto.NewHash([]byte("h1")), crypto.NewHash([]byte("h2"))
+		assert.Nil(store.SnapshotsPoolWrite(h1, []crypto.Signature{{1}, {2}}))
+		assert.Nil(store.SnapshotsPoolWrite(h2, []crypto.Signature{{3}}))
+		assert.Nil(store.SnapshotsPoolWrite(h1, []crypto.Signature{{1}, {2}, {4}}))
+		pool, err := store.SnapshotsPoolRead()
+		assert.Nil(err)
+		assert.Len(pool, 2)
+		assert.Equal([]crypto.Signature{{1}, {2}, {4}}, pool[h1])
+		assert.Equal([]crypto.Signature{{3}}, pool[h2])
+		assert.Nil(store.SnapshotsPoolDelete(h1))
+		pool, err = store.SnapshotsPoolRead()
+		assert.Nil(err)
+		assert.Len(pool, 1)
+	})
+
+	run("queue", func(assert *assert.Assertions, store Store) {
+		tx := common.NewTransaction(common.XINAssetId)
+		assert.Nil(store.QueueAdd(&common.SignedTransaction{Transaction: *tx}))
+		var polled int
+		err := store.QueuePoll(0, func(k uint64, v []byte) error {
+			polled++
+			return nil
+		})
+		assert.Nil(err)
+		assert.Equal(1, polled)
+		err = store.QueuePoll(0, func(k uint64, v []byte) error {
+			polled++
+			return nil
+		})
+		assert.Nil(err)
+		assert.Equal(1, polled)
+	})
+
+	run("genesis", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(nodeId, 0, 1000),
+		}))
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(nodeId, 1, 1001),
+		}))
+		assert.Equal(uint64(1), store.SnapshotsTopologySequence())
+		meta, err := store.SnapshotsReadRoundMeta(nodeId)
+		assert.Nil(err)
+		assert.Equal([2]uint64{0, 1000}, meta)
+	})
+
+	run("topology", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		assert.Equal(uint64(0), store.SnapshotsTopologySequence())
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(nodeId, 0, 1000),
+			testTopologySnapshot(nodeId, 1, 1001),
+		}))
+		assert.Equal(uint64(2), store.SnapshotsTopologySequence())
+		assert.Nil(store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 2, 1002)))
+		assert.NotNil(store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 2, 1003)))
+		assert.Equal(uint64(3), store.SnapshotsTopologySequence())
+
+		snapshots, err := store.SnapshotsReadSnapshotsSinceTopology(1, 100)
+		assert.Nil(err)
+		assert.Len(snapshots, 2)
+		for i, s := range snapshots {
+			assert.Equal(uint64(i+1), s.TopologicalOrder)
+			assert.Equal(s.PayloadHash(), s.Hash)
+		}
+		snapshots, err = store.SnapshotsReadSnapshotsSinceTopology(0, 1)
+		assert.Nil(err)
+		assert.Len(snapshots, 1)
+		snapshots, err = store.SnapshotsReadSnapshotsAfterTopology(0, 1)
+		assert.Nil(err)
+		assert.Len(snapshots, 1)
+		assert.Equal(uint64(1), snapshots[0].TopologicalOrder)
+		snapshots, err = store.SnapshotsReadSnapshotsAfterTopology(2, 10)
+		assert.Nil(err)
+		assert.Len(snapshots, 0)
+		snapshots, err = store.SnapshotsReadSnapshotsAfterTopology(^uint64(0), 10)
+		assert.Nil(err)
+		assert.Len(snapshots, 0)
+
+		early := testTopologySnapshot(crypto.NewHash([]byte("other")), 3, 999)
+		assert.Nil(store.SnapshotsWriteSnapshot(early))
+		reindexing, err := store.SnapshotsTopologyReindexing()
+		assert.Nil(err)
+		assert.False(reindexing)
+		assert.Nil(store.SnapshotsBeginTopologyReindex())
+		reindexing, err = store.SnapshotsTopologyReindexing()
+		assert.Nil(err)
+		assert.True(reindexing)
+		snapshots, err = store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+		assert.Nil(err)
+		assert.Len(snapshots, 4)
+		for _, s := range snapshots {
+			assert.Nil(store.SnapshotsStageTopologyReindex([]*common.Snapshot{&s.Snapshot}))
+		}
+		rewritten, err := store.SnapshotsFinishTopologyReindex()
+		assert.Nil(err)
+		assert.Equal(4, rewritten)
+		reindexing, err = store.SnapshotsTopologyReindexing()
+		assert.Nil(err)
+		assert.False(reindexing)
+		assert.Equal(uint64(4), store.SnapshotsTopologySequence())
+		s, err := store.SnapshotsReadSnapshotByTransactionHash(early.Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.Equal(uint64(0), s.TopologicalOrder)
+		reindexed, err := store.SnapshotsReadSnapshotsSinceTopology(0, 100)
+		assert.Nil(err)
+		assert.Len(reindexed, 4)
+		assert.Equal(early.PayloadHash(), reindexed[0].Hash)
+		for i, s := range reindexed {
+			assert.Equal(uint64(i), s.TopologicalOrder)
+			assert.Equal(snapshots[(i+3)%4].Hash, s.Hash)
+		}
+		assert.Nil(store.SnapshotsWriteSnapshot(testTopologySnapshot(nodeId, 4, 1003)))
+		assert.Equal(uint64(5), store.SnapshotsTopologySequence())
+	})
+
+	run("snapshot", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		snapshot := testTopologySnapshot(nodeId, 0, 1000)
+		snapshot.Signatures = []crypto.Signature{{1}, {2}}
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{snapshot}))
+
+		s, err := store.SnapshotsReadSnapshotByPayloadHash(snapshot.PayloadHash())
+		assert.Nil(err)
+		assert.NotNil(s)
+		assert.Equal(snapshot.PayloadHash(), s.Hash)
+		assert.Equal(snapshot.Transaction.PayloadHash(), s.Transaction.Hash)
+		assert.Equal(snapshot.Signatures, s.Signatures)
+		s.Signatures[0] = crypto.Signature{3}
+		s, err = store.SnapshotsReadSnapshotByTransactionHash(snapshot.Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.Equal(snapshot.Signatures, s.Signatures)
+
+		s, err = store.SnapshotsReadSnapshotByPayloadHash(snapshot.Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.Nil(s)
+		s, err = store.SnapshotsReadSnapshotByTransactionHash(snapshot.PayloadHash())
+		assert.Nil(err)
+		assert.Nil(s)
+	})
+
+	run("signatures", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		snapshot := testTopologySnapshot(nodeId, 0, 1000)
+		snapshot.Signatures = []crypto.Signature{{1}}
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{snapshot}))
+
+		sigs := []crypto.Signature{{1}, {2}}
+		assert.Nil(store.SnapshotsUpdateSignatures(snapshot.TransactionHash(), sigs))
+		s, err := store.SnapshotsReadSnapshotByTransactionHash(snapshot.TransactionHash())
+		assert.Nil(err)
+		assert.Equal(sigs, s.Signatures)
+		assert.Equal(snapshot.PayloadHash(), s.Hash)
+		assert.Equal(uint64(0), s.TopologicalOrder)
+		snapshots, err := store.SnapshotsReadSnapshotsForNodeRound(nodeId, 0)
+		assert.Nil(err)
+		assert.Len(snapshots, 1)
+		assert.Equal(sigs, snapshots[0].Signatures)
+		topology, err := store.SnapshotsReadSnapshotsSinceTopology(0, 1)
+		assert.Nil(err)
+		assert.Len(topology, 1)
+		assert.Equal(sigs, topology[0].Signatures)
+
+		assert.NotNil(store.SnapshotsUpdateSignatures(snapshot.PayloadHash(), sigs))
+	})
+
+	run("rounds", func(assert *assert.Assertions, store Store) {
+		a, b := crypto.NewHash([]byte("a")), crypto.NewHash([]byte("b"))
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(a, 0, 1000),
+			testTopologySnapshot(b, 1, 1000),
+		}))
+		assert.Nil(store.SnapshotsWriteSnapshot(testTopologySnapshot(a, 2, 1002)))
+		assert.Nil(store.SnapshotsWriteSnapshot(testTopologySnapshot(a, 3, 1001)))
+
+		nodes, err := store.SnapshotsReadNodesList()
+		assert.Nil(err)
+		assert.Len(nodes, 2)
+		assert.Contains(nodes, a)
+		assert.Contains(nodes, b)
+
+		snapshots, err := store.SnapshotsReadSnapshotsForNodeRound(a, 0)
+		assert.Nil(err)
+		assert.Len(snapshots, 3)
+		end, found, err := store.SnapshotsReadRoundEnd(a)
+		assert.Nil(err)
+		assert.True(found)
+		assert.Equal(uint64(1002), end)
+		assert.Equal(uint64(1000), snapshots[0].Timestamp)
+		assert.Equal(uint64(1001), snapshots[1].Timestamp)
+		assert.Equal(uint64(1002), snapshots[2].Timestamp)
+		snapshots, err = store.SnapshotsReadSnapshotsForNodeRound(a, 1)
+		assert.Nil(err)
+		assert.Len(snapshots, 0)
+
+		s := testTopologySnapshot(a, 4, 1000+config.SnapshotRoundGap)
+		s.RoundNumber = 1
+		s.Transaction.Extra = []byte("round")
+		assert.Nil(store.SnapshotsWriteSnapshot(s))
+		meta, err := store.SnapshotsReadRoundMeta(a)
+		assert.Nil(err)
+		assert.Equal([2]uint64{1, s.Timestamp}, meta)
+		meta, err = store.SnapshotsReadRoundMeta(b)
+		assert.Nil(err)
+		assert.Equal([2]uint64{0, 1000}, meta)
+
+		end, found, err = store.SnapshotsReadRoundEnd(a)
+		assert.Nil(err)
+		assert.True(found)
+		assert.Equal(s.Timestamp, end)
+		end, found, err = store.SnapshotsReadRoundEnd(b)
+		assert.Nil(err)
+		assert.True(found)
+		assert.Equal(uint64(1000), end)
+		_, found, err = store.SnapshotsReadRoundEnd(crypto.NewHash([]byte("c")))
+		assert.Nil(err)
+		assert.False(found)
+
+		// a round started without snapshots, its start moved to the first one after the round gap
+		assert.NotNil(store.SnapshotsStartRound(a, 3, s.Timestamp+1))
+		assert.Nil(store.SnapshotsStartRound(a, 2, s.Timestamp+1))
+		assert.NotNil(store.SnapshotsStartRound(a, 3, s.Timestamp+1))
+		meta, err = store.SnapshotsReadRoundMeta(a)
+		assert.Nil(err)
+		assert.Equal([2]uint64{2, s.Timestamp + 1}, meta)
+		end, found, err = store.SnapshotsReadRoundEnd(a)
+		assert.Nil(err)
+		assert.True(found)
+		assert.Equal(s.Timestamp+1, end)
+		moved := testTopologySnapshot(a, 5, s.Timestamp+1+config.SnapshotRoundGap)
+		moved.RoundNumber = 2
+		moved.Transaction.Extra = []byte("moved")
+		assert.Nil(store.SnapshotsWriteSnapshot(moved))
+		meta, err = store.SnapshotsReadRoundMeta(a)
+		assert.Nil(err)
+		assert.Equal([2]uint64{2, moved.Timestamp}, meta)
+	})
+
+	run("import", func(assert *assert.Assertions, store Store) {
+		a, b := crypto.NewHash([]byte("a")), crypto.NewHash([]byte("b"))
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{testTopologySnapshot(a, 0, 1000)}))
+		gap := config.SnapshotRoundGap
+		snapshot := func(id crypto.Hash, topo, round, timestamp uint64) *common.SnapshotWithTopologicalOrder {
+			s := testTopologySnapshot(id, topo, timestamp)
+			s.RoundNumber = round
+			s.Transaction.Extra = []byte{byte(topo)}
+			return s
+		}
+		// the input is not in the local ledger
+		spent := snapshot(a, 2, 5, 1000+5*gap+1)
+		spent.Transaction.Inputs = []*common.Input{{Hash: crypto.NewHash([]byte("unknown"))}}
+		assert.Nil(store.SnapshotsImportState([]*common.SnapshotWithTopologicalOrder{
+			snapshot(a, 1, 5, 1000+5*gap),
+			spent,
+			snapshot(a, 3, 6, 1000+6*gap),
+			snapshot(b, 4, 3, 1000+3*gap),
+		}))
+		assert.Equal(uint64(5), store.SnapshotsTopologySequence())
+		meta, err := store.SnapshotsReadRoundMeta(a)
+		assert.Nil(err)
+		assert.Equal([2]uint64{6, 1000 + 6*gap}, meta)
+		meta, err = store.SnapshotsReadRoundMeta(b)
+		assert.Nil(err)
+		assert.Equal([2]uint64{3, 1000 + 3*gap}, meta)
+		snapshots, err := store.SnapshotsReadSnapshotsForNodeRound(a, 5)
+		assert.Nil(err)
+		assert.Len(snapshots, 2)
+		snapshots, err = store.SnapshotsReadSnapshotsForNodeRound(a, 6)
+		assert.Nil(err)
+		assert.Len(snapshots, 1)
+		nodes, err := store.SnapshotsReadNodesList()
+		assert.Nil(err)
+		assert.Len(nodes, 2)
+
+		// never imported before the stored rounds
+		assert.NotNil(store.SnapshotsImportState([]*common.SnapshotWithTopologicalOrder{snapshot(a, 5, 2, 1000+2*gap)}))
+		meta, err = store.SnapshotsReadRoundMeta(a)
+		assert.Nil(err)
+		assert.Equal([2]uint64{6, 1000 + 6*gap}, meta)
+	})
+
+	run("import spent", func(assert *assert.Assertions, store Store) {
+		a, b := crypto.NewHash([]byte("a")), crypto.NewHash([]byte("b"))
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(a, 0, 1000),
+			testTopologySnapshot(b, 1, 1000),
+		}))
+		gap := config.SnapshotRoundGap
+
+		created := testTopologySnapshot(a, 2, 1000+3*gap)
+		created.RoundNumber = 3
+		created.Transaction.Outputs = append(created.Transaction.Outputs, &common.Output{
+			Type:   common.OutputTypeScript,
+			Amount: common.NewInteger(1),
+			Keys:   []crypto.Key{crypto.NewKeyFromSeed(make([]byte, 64)).Public()},
+		})
+		output := created.Transaction.PayloadHash()
+		deposit := &common.DepositData{
+			Chain:           crypto.NewHash([]byte("chain")),
+			AssetKey:        "asset",
+			TransactionHash: "transaction",
+			Amount:          common.NewInteger(1),
+		}
+		// the spending snapshot is imported before the output, the rounds of another node
+		spent := testTopologySnapshot(b, 3, 1000+2*gap)
+		spent.RoundNumber = 2
+		spent.Transaction.Inputs = []*common.Input{{Hash: output, Index: 0}, {Deposit: deposit}, {Hash: crypto.NewHash([]byte("before")), Index: 0}}
+		assert.Nil(store.SnapshotsImportState([]*common.SnapshotWithTopologicalOrder{spent, created}))
+
+		third := crypto.NewHash([]byte("third"))
+		_, err := store.SnapshotsLockUTXO(output, 0, third)
+		assert.NotNil(err)
+		assert.NotNil(store.SnapshotsCheckUTXOLock(output, 0, third))
+		assert.Nil(store.SnapshotsCheckUTXOLock(output, 0, spent.Transaction.PayloadHash()))
+		assert.NotNil(store.SnapshotsLockDepositInput(deposit, third))
+		assert.Nil(store.SnapshotsCheckDepositInput(deposit, spent.Transaction.PayloadHash()))
+	})
+
+	run("limit", func(assert *assert.Assertions, store Store) {
+		a := crypto.NewHash([]byte("a"))
+		store.SnapshotsSetRoundLimit(3)
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(a, 0, 1000),
+		}))
+		assert.Nil(store.SnapshotsWriteSnapshot(testTopologySnapshot(a, 1, 1001)))
+		next := testTopologySnapshot(a, 3, 1003)
+		next.RoundNumber = 1
+		assert.Panics(func() { store.SnapshotsWriteSnapshot(next) })
+
+		// the full round is followed before the round gap
+		assert.Nil(store.SnapshotsWriteSnapshot(testTopologySnapshot(a, 2, 1002)))
+		assert.Nil(store.SnapshotsWriteSnapshot(next))
+		meta, err := store.SnapshotsReadRoundMeta(a)
+		assert.Nil(err)
+		assert.Equal([2]uint64{1, 1003}, meta)
+		snapshots, err := store.SnapshotsReadSnapshotsForNodeRound(a, 0)
+		assert.Nil(err)
+		assert.Len(snapshots, 3)
+		snapshots, err = store.SnapshotsReadSnapshotsForNodeRound(a, 1)
+		assert.Nil(err)
+		assert.Len(snapshots, 1)
+	})
+
+	run("links", func(assert *assert.Assertions, store Store) {
+		from, to := crypto.NewHash([]byte("from")), crypto.NewHash([]byte("to"))
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{
+			testTopologySnapshot(from, 0, 1000),
+			testTopologySnapshot(to, 1, 1000),
+		}))
+		link, err := store.SnapshotsReadRoundLink(from, to)
+		assert.Nil(err)
+		assert.Equal(uint64(0), link)
+
+		s := testTopologySnapshot(from, 2, 1001)
+		s.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 3}
+		assert.Nil(store.SnapshotsWriteSnapshot(s))
+		link, err = store.SnapshotsReadRoundLink(from, to)
+		assert.Nil(err)
+		assert.Equal(uint64(3), link)
+		link, err = store.SnapshotsReadRoundLink(to, from)
+		assert.Nil(err)
+		assert.Equal(uint64(0), link)
+
+		s = testTopologySnapshot(from, 3, 1002)
+		s.RoundLinks = map[crypto.Hash]uint64{from: 0, to: 2}
+		assert.NotNil(store.SnapshotsWriteSnapshot(s))
+		link, err = store.SnapshotsReadRoundLink(from, to)
+		assert.Nil(err)
+		assert.Equal(uint64(3), link)
+		r, err := store.SnapshotsReadSnapshotByTransactionHash(s.Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.Nil(r)
+		assert.Equal(uint64(3), store.SnapshotsTopologySequence())
+	})
+
+	run("utxo", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		ghost := crypto.NewKeyFromSeed(make([]byte, 64)).Public()
+		s := testTopologySnapshot(nodeId, 0, 1000)
+		s.Transaction.Outputs = append(s.Transaction.Outputs, &common.Output{
+			Type:   common.OutputTypeScript,
+			Amount: common.NewInteger(1),
+			Keys:   []crypto.Key{ghost},
+		})
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{s}))
+
+		found, err := store.SnapshotsCheckGhost(ghost)
+		assert.Nil(err)
+		assert.True(found)
+		found, err = store.SnapshotsCheckGhost(crypto.Key{})
+		assert.Nil(err)
+		assert.False(found)
+
+		hash := s.Transaction.PayloadHash()
+		utxo, err := store.SnapshotsReadUTXO(hash, 0)
+		assert.Nil(err)
+		assert.NotNil(utxo)
+		assert.Equal([]crypto.Key{ghost}, utxo.Keys)
+		utxo, err = store.SnapshotsReadUTXO(hash, 1)
+		assert.Nil(err)
+		assert.Nil(utxo)
+
+		tx1, tx2 := crypto.NewHash([]byte("tx1")), crypto.NewHash([]byte("tx2"))
+		assert.Nil(store.SnapshotsCheckUTXOLock(hash, 0, tx2))
+		utxo, err = store.SnapshotsLockUTXO(hash, 0, tx1)
+		assert.Nil(err)
+		assert.NotNil(utxo)
+		utxo, err = store.SnapshotsLockUTXO(hash, 0, tx1)
+		assert.Nil(err)
+		assert.NotNil(utxo)
+		assert.Nil(store.SnapshotsCheckUTXOLock(hash, 0, tx1))
+		assert.NotNil(store.SnapshotsCheckUTXOLock(hash, 0, tx2))
+		_, err = store.SnapshotsLockUTXO(hash, 0, tx2)
+		assert.NotNil(err)
+		utxo, err = store.SnapshotsLockUTXO(hash, 1, tx2)
+		assert.Nil(err)
+		assert.Nil(utxo)
+	})
+
+	run("deposit", func(assert *assert.Assertions, store Store) {
+		deposit := &common.DepositData{
+			Chain:           crypto.NewHash([]byte("chain")),
+			AssetKey:        "asset",
+			TransactionHash: "transaction",
+			Amount:          common.NewInteger(1),
+		}
+		tx1, tx2 := crypto.NewHash([]byte("tx1")), crypto.NewHash([]byte("tx2"))
+		assert.Nil(store.SnapshotsCheckDepositInput(deposit, tx1))
+		assert.Nil(store.SnapshotsLockDepositInput(deposit, tx1))
+		assert.Nil(store.SnapshotsLockDepositInput(deposit, tx1))
+		assert.Nil(store.SnapshotsCheckDepositInput(deposit, tx1))
+		assert.NotNil(store.SnapshotsCheckDepositInput(deposit, tx2))
+		assert.NotNil(store.SnapshotsLockDepositInput(deposit, tx2))
+	})
+
+	run("nodes", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		spend := crypto.NewKeyFromSeed(make([]byte, 64)).Public()
+		s := testTopologySnapshot(nodeId, 0, 1000)
+		s.Transaction.Extra = spend[:]
+		s.Transaction.Outputs = append(s.Transaction.Outputs, &common.Output{
+			Type:   common.OutputTypeNodeAccept,
+			Amount: common.NewInteger(10000),
+		})
+		assert.Nil(store.SnapshotsLoadGenesis([]*common.SnapshotWithTopologicalOrder{s}))
+		assert.Len(store.SnapshotsReadDomains(), 0)
+		nodes := store.SnapshotsReadConsensusNodes()
+		assert.Len(nodes, 1)
+		assert.Equal(spend, nodes[0].Account.PublicSpendKey)
+		assert.Equal(common.NodeStateAccepted, nodes[0].State)
+
+		s = testTopologySnapshot(nodeId, 1, 1001)
+		s.Transaction.Extra = spend[:]
+		s.Transaction.Outputs = append(s.Transaction.Outputs, &common.Output{
+			Type:   common.OutputTypeNodePledge,
+			Amount: common.NewInteger(10000),
+		})
+		assert.NotNil(store.SnapshotsWriteSnapshot(s))
+		r, err := store.SnapshotsReadSnapshotByTransactionHash(s.Transaction.PayloadHash())
+		assert.Nil(err)
+		assert.Nil(r)
+		assert.Len(store.SnapshotsReadConsensusNodes(), 1)
+	})
+
+	run("equivocation", func(assert *assert.Assertions, store Store) {
+		nodeId := crypto.NewHash([]byte("node"))
+		a, b := testTopologySnapshot(nodeId, 0, 1000), testTopologySnapshot(nodeId, 1, 1000)
+		assert.Nil(store.SnapshotsWriteEquivocation(&a.Snapshot, &b.Snapshot))
+	})
+
+	run("rejected", func(assert *assert.Assertions, store Store) {
+		limit := config.SnapshotRejectedLimit
+		config.SnapshotRejectedLimit = 3
+		defer func() { config.SnapshotRejectedLimit = limit }()
+
+		nodeId, source := crypto.NewHash([]byte("node")), crypto.NewHash([]byte("source"))
+		records, err := store.SnapshotsReadRejected(10)
+		assert.Nil(err)
+		assert.Len(records, 0)
+		for i := 0; i < 5; i++ {
+			s := testTopologySnapshot(nodeId, uint64(i), 1000+uint64(i))
+			r := &common.RejectedSnapshot{Snapshot: &s.Snapshot, Reason: "LIMITS", Error: "invalid", Source: source, Timestamp: uint64(i)}
+			assert.Nil(store.SnapshotsWriteRejected(r))
+		}
+		records, err = store.SnapshotsReadRejected(10)
+		assert.Nil(err)
+		assert.Len(records, 3)
+		for i, r := range records {
+			assert.Equal(uint64(4-i), r.Timestamp)
+			assert.Equal(uint64(4-i), r.Snapshot.Timestamp-1000)
+			assert.Equal("LIMITS", r.Reason)
+			assert.Equal("invalid", r.Error)
+			assert.Equal(source, r.Source)
+			assert.Equal(nodeId, r.Snapshot.NodeId)
+		}
+		records, err = store.SnapshotsReadRejected(2)
+		assert.Nil(err)
+		assert.Len(records, 2)
+		assert.Equal(uint64(4), records[0].Timestamp)
+
+		config.SnapshotRejectedLimit = 0
+		assert.Nil(store.SnapshotsWriteRejected(&common.RejectedSnapshot{Reason: "SEEN", Timestamp: 5}))
+		records, err = store.SnapshotsReadRejected(10)
+		assert.Nil(err)
+		assert.Len(records, 3)
+	})
+}